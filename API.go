@@ -1,12 +1,43 @@
 package trade
 
-import "github.com/nntaoli-project/GoEx"
+import (
+	"context"
+	"github.com/nntaoli-project/GoEx"
+)
 
 type SpotTradeManagerAPI interface {
-	CancelPendingOrders(orderType goex.TradeSide)
-	CancelAllPendingOrders()
-	StripOrders(orderId string) *goex.Order
-	GetAccount(waitFrozen bool) *Account
-	Buy(amount float64) *goex.Order
-	Sell(amount float64) *goex.Order
+	CancelPendingOrders(orderType goex.TradeSide) error
+	CancelPendingOrdersCtx(ctx context.Context, orderType goex.TradeSide) error
+	CancelAllPendingOrders() error
+	CancelAllPendingOrdersCtx(ctx context.Context) error
+	StripOrders(orderId string) (*goex.Order, error)
+	StripOrdersCtx(ctx context.Context, orderId string) (*goex.Order, error)
+	GetAccount(waitFrozen bool) (*Account, error)
+	GetAccountCtx(ctx context.Context, waitFrozen bool) (*Account, error)
+	Buy(amount float64) (*ExecutionReport, error)
+	BuyCtx(ctx context.Context, amount float64) (*ExecutionReport, error)
+	Sell(amount float64) (*ExecutionReport, error)
+	SellCtx(ctx context.Context, amount float64) (*ExecutionReport, error)
 }
+
+var _ SpotTradeManagerAPI = (*SpotTradeManager)(nil)
+
+type FutureTradeManagerAPI interface {
+	OpenLong(price, opAmount float64) (*SummaryPosition, error)
+	OpenLongCtx(ctx context.Context, price, opAmount float64) (*SummaryPosition, error)
+	OpenShort(price, opAmount float64) (*SummaryPosition, error)
+	OpenShortCtx(ctx context.Context, price, opAmount float64) (*SummaryPosition, error)
+	CloseLong(price, opAmount float64) (*ExecutionReport, error)
+	CloseLongCtx(ctx context.Context, price, opAmount float64) (*ExecutionReport, error)
+	CloseShort(price, opAmount float64) (*ExecutionReport, error)
+	CloseShortCtx(ctx context.Context, price, opAmount float64) (*ExecutionReport, error)
+	GetAccount() (*Account, error)
+	GetAccountCtx(ctx context.Context) (*Account, error)
+	GetPosition(direction int) (*Position, error)
+	GetPositionCtx(ctx context.Context, direction int) (*Position, error)
+	Profit(price, opAmount float64) (float64, error)
+	CancelAll() error
+	CancelAllCtx(ctx context.Context) error
+}
+
+var _ FutureTradeManagerAPI = (*FutureTradeManager)(nil)
@@ -0,0 +1,306 @@
+package trade
+
+import (
+	"context"
+	"fmt"
+	"github.com/beaquant/utils"
+	"github.com/nntaoli-project/GoEx"
+	"github.com/sirupsen/logrus"
+	"math"
+	"sync"
+	"time"
+)
+
+// ArbPolicy says what an ArbExecutor does when its legs fill unequally.
+type ArbPolicy int
+
+const (
+	ARB_UNWIND = iota //在多成交的一腿反向平掉余量
+	ARB_HEDGE         //在少成交的一腿补单, 补不上再平掉
+	ARB_LEAVE         //不处理, 只报告
+)
+
+func (policy ArbPolicy) String() string {
+	switch policy {
+	case ARB_UNWIND:
+		return "ARB_UNWIND"
+	case ARB_HEDGE:
+		return "ARB_HEDGE"
+	case ARB_LEAVE:
+		return "ARB_LEAVE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+type ArbConfig struct {
+	Policy       ArbPolicy     //两腿不平衡时的处理方式
+	MaxHedges    int           //ARB_HEDGE最多补单次数, 0为1次
+	Tolerance    float64       //两腿成交量差不超过此值视为平衡, 一般不小于最小交易数量
+	Timeout      time.Duration //每腿(及每次补单/平仓)的执行时限, 0为不限
+	PollInterval time.Duration //执行中比较两腿成交量的间隔, 0为1秒
+	Grace        time.Duration //执行中成交量差超过Tolerance最多持续的时间, 超过就停下两腿, 0为5秒
+}
+
+func (cfg *ArbConfig) Validate() error {
+	switch {
+	case cfg.Policy.String() == "UNKNOWN":
+		return fmt.Errorf("%w: arb policy %d", ErrInvalidConfig, cfg.Policy)
+	case cfg.MaxHedges < 0 || cfg.Tolerance < 0 || cfg.Timeout < 0 || cfg.PollInterval < 0 || cfg.Grace < 0:
+		return fmt.Errorf("%w: negative arb setting", ErrInvalidConfig)
+	}
+	return nil
+}
+
+func (cfg *ArbConfig) pollInterval() time.Duration {
+	if cfg.PollInterval == 0 {
+		return time.Second
+	}
+	return cfg.PollInterval
+}
+
+func (cfg *ArbConfig) grace() time.Duration {
+	if cfg.Grace == 0 {
+		return 5 * time.Second
+	}
+	return cfg.Grace
+}
+
+// ArbReport is how one Execute went. Buy and Sell merge every order of their
+// leg, hedges included, each with the fees of its own exchange; Unwind is the
+// reverse trade on the leg that filled more, nil when there was none.
+type ArbReport struct {
+	Requested float64          `json:"requested"`
+	Buy       *ExecutionReport `json:"buy"`
+	Sell      *ExecutionReport `json:"sell"`
+	Unwind    *ExecutionReport `json:"unwind,omitempty"`
+	Hedges    int              `json:"hedges"`   //补单次数
+	Residual  float64          `json:"residual"` //买腿净买入 - 卖腿净卖出, 正数为多余的多头
+	Spread    float64          `json:"spread"`   //卖腿均价 - 买腿均价, 扣除手续费(基础币手续费按成交均价折算)
+}
+
+// ArbExecutor buys on one manager and sells the same amount on another at
+// the same time, typically the same pair on two exchanges. While the legs
+// run, the fills of their own orders are followed; when one leg fails, or
+// the legs stay further apart than the tolerance for longer than the grace
+// period, both are stopped, and whatever they filled unequally is hedged or
+// unwound as the policy says. Only the managers of this package, wrapped or
+// not, report their fills while running; a leg on any other manager counts
+// as unfilled until it returns.
+type ArbExecutor struct {
+	buy    SpotTradeManagerAPI
+	sell   SpotTradeManagerAPI
+	cfg    ArbConfig
+	logger *logrus.Logger
+}
+
+func NewArbExecutor(buy, sell SpotTradeManagerAPI, cfg ArbConfig, logger *logrus.Logger) (*ArbExecutor, error) {
+	if buy == nil || sell == nil {
+		return nil, fmt.Errorf("%w: nil arb leg", ErrInvalidConfig)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = logrus.New()
+	}
+	return &ArbExecutor{buy: buy, sell: sell, cfg: cfg, logger: logger}, nil
+}
+
+type arbLeg struct {
+	mgr    SpotTradeManagerAPI
+	side   goex.TradeSide
+	mu     sync.Mutex
+	traded float64 //执行中订单的成交量合计
+	reps   []*ExecutionReport
+	err    error
+}
+
+func (leg *arbLeg) fill(delta float64) {
+	leg.mu.Lock()
+	leg.traded += delta
+	leg.mu.Unlock()
+}
+
+// progress is how much the leg's orders have filled so far.
+func (leg *arbLeg) progress() float64 {
+	leg.mu.Lock()
+	defer leg.mu.Unlock()
+	return leg.traded
+}
+
+func (leg *arbLeg) filled() float64 {
+	var filled = 0.0
+	for _, rep := range leg.reps {
+		if rep != nil {
+			filled += rep.Filled
+		}
+	}
+	return filled
+}
+
+// run trades amount on the leg, bounded by the configured timeout.
+func (arb *ArbExecutor) run(ctx context.Context, mgr SpotTradeManagerAPI, side goex.TradeSide, amount float64) (*ExecutionReport, error) {
+	if arb.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, arb.cfg.Timeout)
+		defer cancel()
+	}
+	trade, err := sliceFunc(mgr, side)
+	if err != nil {
+		return nil, err
+	}
+	return trade(ctx, amount)
+}
+
+// watch compares the progress of the legs until done is closed, calling
+// fail with ErrLegImbalance once it has differed by more than the tolerance
+// for longer than the grace period.
+func (arb *ArbExecutor) watch(ctx context.Context, legs []*arbLeg, done <-chan struct{}, fail func(err error)) {
+	var ticker = time.NewTicker(arb.cfg.pollInterval())
+	defer ticker.Stop()
+	var since time.Time //成交量差开始超过Tolerance的时间
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var bought, sold = legs[0].progress(), legs[1].progress()
+		if math.Abs(bought-sold) <= arb.cfg.Tolerance {
+			since = time.Time{}
+			continue
+		}
+		if since.IsZero() {
+			since = time.Now()
+		}
+		if time.Since(since) >= arb.cfg.grace() {
+			fail(fmt.Errorf("%w: bought %s, sold %s for %s, legs stopped", ErrLegImbalance,
+				utils.Float64RoundString(bought, 8), utils.Float64RoundString(sold, 8), time.Since(since).Round(time.Millisecond)))
+			return
+		}
+	}
+}
+
+// netPrice is the VWAP of rep with its fees per unit filled added for a buy
+// and taken off for a sell, fees in the base currency converted at the
+// VWAP. Fees in any other currency are left out.
+func netPrice(rep *ExecutionReport) float64 {
+	var fee = 0.0
+	switch rep.FeeCurrency {
+	case rep.Pair.CurrencyB:
+		fee = rep.Fees
+	case rep.Pair.CurrencyA:
+		fee = rep.Fees * rep.VWAP
+	}
+	if rep.IsBuy() {
+		return rep.VWAP + fee/rep.Filled
+	}
+	return rep.VWAP - fee/rep.Filled
+}
+
+// Execute buys amount on the buy manager while selling it on the sell
+// manager. It returns ErrLegImbalance when the legs still differ by more
+// than the tolerance at the end, and otherwise the error that stopped the
+// legs first: a failed leg, or ErrLegImbalance when the watch stopped them.
+func (arb *ArbExecutor) Execute(ctx context.Context, amount float64) (*ArbReport, error) {
+	var started = time.Now()
+	var legs = []*arbLeg{{mgr: arb.buy, side: goex.BUY}, {mgr: arb.sell, side: goex.SELL}}
+	var legCtx, stop = context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error //先停下两腿的错误, 另一腿随后的取消不算
+	var fail = func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		stop() //不再继续扩大敞口
+	}
+	for _, leg := range legs {
+		wg.Add(1)
+		go func(leg *arbLeg) {
+			defer wg.Done()
+			rep, err := arb.run(withProgress(legCtx, leg.fill), leg.mgr, leg.side, amount)
+			leg.reps = append(leg.reps, rep)
+			if err != nil {
+				leg.err = err
+				fail(err)
+			}
+		}(leg)
+	}
+	var done = make(chan struct{})
+	var watched = make(chan struct{})
+	go func() {
+		defer close(watched)
+		arb.watch(legCtx, legs, done, fail)
+	}()
+	wg.Wait()
+	close(done)
+	<-watched
+	stop()
+	var buy, sell = legs[0], legs[1]
+	if firstErr != nil {
+		arb.logger.Warningf("[ ARB ] legs stopped: %v (buy %v, sell %v)", firstErr, buy.err, sell.err)
+	}
+
+	var rep = &ArbReport{Requested: amount}
+	var residual = buy.filled() - sell.filled()
+	if arb.cfg.Policy == ARB_HEDGE {
+		var hedges = arb.cfg.MaxHedges
+		if hedges == 0 {
+			hedges = 1
+		}
+		for math.Abs(residual) > arb.cfg.Tolerance && rep.Hedges < hedges && ctx.Err() == nil {
+			rep.Hedges++
+			var lagging = sell
+			if residual < 0 {
+				lagging = buy
+			}
+			arb.logger.Infof("[ ARB ] hedge %d: %s %s", rep.Hedges, lagging.side.String(), utils.Float64RoundString(math.Abs(residual), 8))
+			hedge, err := arb.run(ctx, lagging.mgr, lagging.side, math.Abs(residual))
+			lagging.reps = append(lagging.reps, hedge)
+			residual = buy.filled() - sell.filled()
+			if err != nil {
+				arb.logger.Warningf("[ ARB ] hedge failed: %v", err)
+				break
+			}
+		}
+	}
+	if arb.cfg.Policy != ARB_LEAVE && math.Abs(residual) > arb.cfg.Tolerance && ctx.Err() == nil {
+		// 多买了就在买腿卖回, 多卖了就在卖腿买回
+		var leading, side = buy.mgr, goex.TradeSide(goex.SELL)
+		if residual < 0 {
+			leading, side = sell.mgr, goex.BUY
+		}
+		arb.logger.Warningf("[ ARB ] unwind: %s %s", side.String(), utils.Float64RoundString(math.Abs(residual), 8))
+		unwind, err := arb.run(ctx, leading, side, math.Abs(residual))
+		if err != nil {
+			arb.logger.Errorf("[ ARB ] unwind failed: %v", err)
+		}
+		if unwind != nil {
+			rep.Unwind = unwind
+			if side == goex.SELL {
+				residual -= unwind.Filled
+			} else {
+				residual += unwind.Filled
+			}
+		}
+	}
+
+	rep.Buy = mergeReports(goex.BUY, amount, started, 1, buy.reps)
+	rep.Sell = mergeReports(goex.SELL, amount, started, 1, sell.reps)
+	rep.Residual = utils.Float64Round(residual, 8)
+	if rep.Buy.Filled > 0 && rep.Sell.Filled > 0 {
+		rep.Spread = utils.Float64Round(netPrice(rep.Sell)-netPrice(rep.Buy), 8)
+	}
+	arb.logger.Infof("[ ARB ] bought %s, sold %s, spread %s, residual %s", utils.Float64RoundString(rep.Buy.Filled, 8),
+		utils.Float64RoundString(rep.Sell.Filled, 8), utils.Float64RoundString(rep.Spread, 8), utils.Float64RoundString(rep.Residual, 8))
+	if math.Abs(rep.Residual) > arb.cfg.Tolerance {
+		return rep, fmt.Errorf("%w: residual %s after %s", ErrLegImbalance, utils.Float64RoundString(rep.Residual, 8), arb.cfg.Policy)
+	}
+	return rep, firstErr
+}
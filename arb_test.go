@@ -0,0 +1,157 @@
+package trade
+
+import (
+	"context"
+	"errors"
+	"github.com/beaquant/utils"
+	"github.com/goex-top/goex_trade/mockex"
+	"github.com/nntaoli-project/GoEx"
+	"testing"
+	"time"
+)
+
+// shortSeller sells at most cap on its first request.
+type shortSeller struct {
+	SpotTradeManagerAPI
+	cap   float64
+	calls int
+}
+
+func (c *shortSeller) SellCtx(ctx context.Context, amount float64) (*ExecutionReport, error) {
+	c.calls++
+	if c.calls == 1 && amount > c.cap {
+		amount = c.cap
+	}
+	return c.SpotTradeManagerAPI.SellCtx(ctx, amount)
+}
+
+// newArbLegs buys at 101 on one exchange and sells at 104 on another.
+func newArbLegs() (buy, sell SpotTradeManagerAPI, exBuy, exSell *mockex.Exchange) {
+	exA, a := newMockSpot(OPMODE_TAKE)
+	exB, b := newMockSpot(OPMODE_TAKE)
+	exB.Market(spotPair).SetTicker(104, 106)
+	return a, b, exA, exB
+}
+
+func TestArbExecutor_Execute(t *testing.T) {
+	buy, sell, exA, exB := newArbLegs()
+	arb, err := NewArbExecutor(buy, sell, ArbConfig{Tolerance: 0.01}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := arb.Execute(context.Background(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Buy.Filled != 3 || rep.Sell.Filled != 3 || rep.Residual != 0 || rep.Spread != 3 || rep.Unwind != nil {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	if a, _ := exA.Balance(goex.BTC); a != 13 {
+		t.Fatalf("buy leg holds %v BTC", a)
+	}
+	if b, _ := exB.Balance(goex.BTC); b != 7 {
+		t.Fatalf("sell leg holds %v BTC", b)
+	}
+}
+
+func TestArbExecutor_Hedge(t *testing.T) {
+	buy, sell, _, exB := newArbLegs()
+	var capped = &shortSeller{SpotTradeManagerAPI: sell, cap: 1}
+	arb, _ := NewArbExecutor(buy, capped, ArbConfig{Policy: ARB_HEDGE, Tolerance: 0.01}, nil)
+	rep, err := arb.Execute(context.Background(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Hedges != 1 || rep.Sell.Filled != 3 || rep.Residual != 0 || rep.Unwind != nil {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	if b, _ := exB.Balance(goex.BTC); b != 7 {
+		t.Fatalf("sell leg holds %v BTC", b)
+	}
+}
+
+func TestArbExecutor_Unwind(t *testing.T) {
+	buy, sell, exA, _ := newArbLegs()
+	arb, _ := NewArbExecutor(buy, &shortSeller{SpotTradeManagerAPI: sell, cap: 1}, ArbConfig{Policy: ARB_UNWIND, Tolerance: 0.01}, nil)
+	rep, err := arb.Execute(context.Background(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Unwind == nil || rep.Unwind.Filled != 2 || rep.Residual != 0 {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	if a, _ := exA.Balance(goex.BTC); a != 11 {
+		t.Fatalf("buy leg holds %v BTC after unwinding", a)
+	}
+
+	buy, sell, _, _ = newArbLegs()
+	arb, _ = NewArbExecutor(buy, &shortSeller{SpotTradeManagerAPI: sell, cap: 1}, ArbConfig{Policy: ARB_LEAVE, Tolerance: 0.01}, nil)
+	if rep, err = arb.Execute(context.Background(), 3); !errors.Is(err, ErrLegImbalance) || rep.Residual != 2 {
+		t.Fatalf("want ErrLegImbalance with 2 left, got %+v, %v", rep, err)
+	}
+}
+
+func TestArbExecutor_LegFails(t *testing.T) {
+	if _, err := NewArbExecutor(nil, nil, ArbConfig{}, nil); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("want ErrInvalidConfig, got %v", err)
+	}
+	buy, sell, exA, exB := newArbLegs()
+	exB.SetBalance(goex.BTC, 1)
+	arb, _ := NewArbExecutor(buy, sell, ArbConfig{Tolerance: 0.01}, nil)
+	rep, err := arb.Execute(context.Background(), 3)
+	if !errors.Is(err, ErrInsufficientBalance) || rep.Residual != 0 || rep.Sell.Filled != 1 {
+		t.Fatalf("want the sell leg's error with the legs evened out, got %+v, %v", rep, err)
+	}
+	var a, _ = exA.Balance(goex.BTC)
+	var b, _ = exB.Balance(goex.BTC)
+	if a+b != 11 {
+		t.Fatalf("net position left: %v + %v BTC", a, b)
+	}
+}
+
+func TestArbExecutor_Watch(t *testing.T) {
+	exA, buy := newMockSpot(OPMODE_TAKE)
+	exB, sell := newMockSpot(OPMODE_MAKE) //挂在卖一之上, 永不成交
+	exB.Market(spotPair).SetTicker(104, 106)
+	arb, _ := NewArbExecutor(buy, sell, ArbConfig{Policy: ARB_UNWIND, Tolerance: 0.01, PollInterval: 2 * time.Millisecond, Grace: 20 * time.Millisecond}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rep, err := arb.Execute(ctx, 3)
+	if !errors.Is(err, ErrLegImbalance) || ctx.Err() != nil {
+		t.Fatalf("want the legs stopped by the watch, got %v", err)
+	}
+	if rep.Sell.Filled != 0 || rep.Unwind == nil || rep.Unwind.Filled != 3 || rep.Residual != 0 {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	if open := exB.OpenOrders(); len(open) != 0 {
+		t.Fatalf("sell leg left open %v", open)
+	}
+	if a, _ := exA.Balance(goex.BTC); a != 10 {
+		t.Fatalf("buy leg holds %v BTC after unwinding", a)
+	}
+}
+
+func TestArbExecutor_Spread(t *testing.T) {
+	_, buy := newMockSpot(OPMODE_TAKE)
+	exB, sell := newMockSpot(OPMODE_TAKE)
+	exB.Market(spotPair).SetTicker(104, 106)
+	buy.fees = NewFeeTable(FeeSchedule{Taker: 0.01}) //买腿手续费收BTC, 卖腿没有FeeModel
+	arb, _ := NewArbExecutor(buy, sell, ArbConfig{Tolerance: 0.01}, nil)
+	rep, err := arb.Execute(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 0.01 BTC of fees on the buy leg cost 1.01 USDT at its VWAP
+	if rep.Buy.FeeCurrency != goex.BTC || rep.Spread != 1.99 {
+		t.Fatalf("want the net spread across fee currencies, got %+v", rep)
+	}
+
+	buy.fees = NewFeeTable(FeeSchedule{Taker: 0.01, Asset: FEE_QUOTE})
+	sell.fees = buy.fees
+	if rep, err = arb.Execute(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Sell.FeeCurrency != goex.USDT || rep.Spread >= 3 || rep.Spread != utils.Float64Round(rep.Sell.NetVWAP-rep.Buy.NetVWAP, 8) {
+		t.Fatalf("want the net spread in one fee currency, got %+v", rep)
+	}
+}
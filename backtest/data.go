@@ -0,0 +1,233 @@
+package backtest
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/nntaoli-project/GoEx"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Format int
+
+const (
+	CSV Format = iota
+	JSON
+)
+
+// Event is one step of recorded market history: a kline or a tick.
+type Event struct {
+	Time  time.Time
+	Bid   float64 // 0 for klines, derived from Last and Config.Spread
+	Ask   float64
+	Last  float64
+	Vol   float64
+	Kline *goex.Kline // nil for ticks
+}
+
+// stamp is a timestamp given either as a JSON number or a JSON string.
+type stamp string
+
+func (s *stamp) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err == nil {
+		*s = stamp(str)
+		return nil
+	}
+	*s = stamp(b)
+	return nil
+}
+
+type klineRecord struct {
+	Timestamp stamp   `json:"timestamp"`
+	Open      float64 `json:"open"`
+	High      float64 `json:"high"`
+	Low       float64 `json:"low"`
+	Close     float64 `json:"close"`
+	Volume    float64 `json:"volume"`
+}
+
+type tickRecord struct {
+	Timestamp stamp   `json:"timestamp"`
+	Bid       float64 `json:"bid"`
+	Ask       float64 `json:"ask"`
+	Last      float64 `json:"last"`
+	Volume    float64 `json:"volume"`
+}
+
+// LoadKlines reads klines of pair. CSV rows are
+// timestamp,open,high,low,close[,volume]; JSON is an array of objects with
+// the same keys. Timestamps may be unix seconds, unix milliseconds or
+// RFC 3339. A CSV header row is skipped.
+func LoadKlines(r io.Reader, format Format, pair goex.CurrencyPair) ([]Event, error) {
+	var records []klineRecord
+	switch format {
+	case CSV:
+		rows, err := readCSV(r, 5)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			var rec = klineRecord{Timestamp: stamp(row[0])}
+			var fields = []*float64{&rec.Open, &rec.High, &rec.Low, &rec.Close, &rec.Volume}
+			if err = parseFloats(row[1:], fields); err != nil {
+				return nil, err
+			}
+			records = append(records, rec)
+		}
+	case JSON:
+		if err := json.NewDecoder(r).Decode(&records); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("backtest: unknown format %d", format)
+	}
+	var events = make([]Event, 0, len(records))
+	for _, rec := range records {
+		at, err := parseTime(string(rec.Timestamp))
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, Event{
+			Time: at,
+			Last: rec.Close,
+			Vol:  rec.Volume,
+			Kline: &goex.Kline{
+				Pair:      pair,
+				Timestamp: at.Unix(),
+				Open:      rec.Open,
+				High:      rec.High,
+				Low:       rec.Low,
+				Close:     rec.Close,
+				Vol:       rec.Volume,
+			},
+		})
+	}
+	return events, nil
+}
+
+// LoadTicks reads ticks. CSV rows are timestamp,bid,ask[,last[,volume]];
+// JSON is an array of objects with the same keys. A missing last price is
+// taken as the mid.
+func LoadTicks(r io.Reader, format Format) ([]Event, error) {
+	var records []tickRecord
+	switch format {
+	case CSV:
+		rows, err := readCSV(r, 3)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			var rec = tickRecord{Timestamp: stamp(row[0])}
+			var fields = []*float64{&rec.Bid, &rec.Ask, &rec.Last, &rec.Volume}
+			if err = parseFloats(row[1:], fields); err != nil {
+				return nil, err
+			}
+			records = append(records, rec)
+		}
+	case JSON:
+		if err := json.NewDecoder(r).Decode(&records); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("backtest: unknown format %d", format)
+	}
+	var events = make([]Event, 0, len(records))
+	for _, rec := range records {
+		at, err := parseTime(string(rec.Timestamp))
+		if err != nil {
+			return nil, err
+		}
+		if rec.Last == 0 {
+			rec.Last = (rec.Bid + rec.Ask) / 2
+		}
+		events = append(events, Event{Time: at, Bid: rec.Bid, Ask: rec.Ask, Last: rec.Last, Vol: rec.Volume})
+	}
+	return events, nil
+}
+
+// LoadKlinesFile is LoadKlines on a file, picking the format from its
+// extension.
+func LoadKlinesFile(path string, pair goex.CurrencyPair) ([]Event, error) {
+	f, format, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadKlines(f, format, pair)
+}
+
+// LoadTicksFile is LoadTicks on a file, picking the format from its
+// extension.
+func LoadTicksFile(path string) ([]Event, error) {
+	f, format, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadTicks(f, format)
+}
+
+func open(path string) (*os.File, Format, error) {
+	var format Format
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		format = CSV
+	case ".json":
+		format = JSON
+	default:
+		return nil, 0, fmt.Errorf("backtest: unknown file type %s", path)
+	}
+	f, err := os.Open(path)
+	return f, format, err
+}
+
+func readCSV(r io.Reader, minFields int) ([][]string, error) {
+	var reader = csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > 0 && len(rows[0]) > 1 {
+		if _, err := strconv.ParseFloat(rows[0][1], 64); err != nil {
+			rows = rows[1:] // header
+		}
+	}
+	for i, row := range rows {
+		if len(row) < minFields {
+			return nil, fmt.Errorf("backtest: row %d has %d fields, want at least %d", i+1, len(row), minFields)
+		}
+	}
+	return rows, nil
+}
+
+func parseFloats(values []string, fields []*float64) error {
+	for i := 0; i < len(values) && i < len(fields); i++ {
+		if values[i] == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(values[i], 64)
+		if err != nil {
+			return err
+		}
+		*fields[i] = v
+	}
+	return nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		if n > 1e12 {
+			return time.Unix(0, int64(n)*int64(time.Millisecond)).UTC(), nil
+		}
+		return time.Unix(int64(n), 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
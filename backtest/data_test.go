@@ -0,0 +1,39 @@
+package backtest
+
+import (
+	"github.com/nntaoli-project/GoEx"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadKlinesCSV(t *testing.T) {
+	var data = "timestamp,open,high,low,close,volume\n" +
+		"1559383200,100,102,99,101,12\n" +
+		"1559383260000,101,103,100,102,\n"
+	events, err := LoadKlines(strings.NewReader(data), CSV, goex.BTC_USDT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("want 2 events, got %d", len(events))
+	}
+	if k := events[0].Kline; k.Close != 101 || k.Vol != 12 || events[0].Last != 101 {
+		t.Fatalf("unexpected kline %+v", k)
+	}
+	if !events[1].Time.Equal(time.Unix(1559383260, 0)) {
+		t.Fatalf("unexpected time %v", events[1].Time)
+	}
+}
+
+func TestLoadTicksJSON(t *testing.T) {
+	var data = `[{"timestamp":"2019-06-01T10:00:00Z","bid":99,"ask":101},
+		{"timestamp":1559383201,"bid":100,"ask":102,"last":101.5,"volume":3}]`
+	events, err := LoadTicks(strings.NewReader(data), JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Last != 100 || events[1].Last != 101.5 || events[1].Kline != nil {
+		t.Fatalf("unexpected events %+v", events)
+	}
+}
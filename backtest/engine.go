@@ -0,0 +1,148 @@
+// Package backtest replays recorded klines or ticks through a simulated
+// exchange, so that the trade managers run their normal code paths against
+// history.
+package backtest
+
+import (
+	"errors"
+	"github.com/goex-top/goex_trade/mockex"
+	"github.com/nntaoli-project/GoEx"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	Pair           goex.CurrencyPair
+	ContractType   string                    //合约类型, 现货留空
+	Balances       map[goex.Currency]float64 //现货初始资金
+	Margin         float64                   //合约初始保证金, 以 Pair.CurrencyB 计
+	ContractValue  float64                   //合约面值, 默认 1
+	MakerFee       float64                   //挂单手续费率
+	TakerFee       float64                   //吃单手续费率
+	Slippage       float64                   //吃单滑点比例
+	Spread         float64                   //由K线收盘价推算买卖价时的价差比例
+	PeriodsPerYear float64                   //计算夏普比率的年化周期数, 0 表示按事件间隔推算
+}
+
+// EquityPoint is the account value after an event was processed.
+type EquityPoint struct {
+	Time   time.Time
+	Equity float64
+}
+
+type Result struct {
+	Equity []EquityPoint
+	Trades []Trade
+	Stats  Stats
+}
+
+// Engine owns the simulated exchange. Build trade managers on Spot or Future
+// and drive them from the callback passed to Run.
+type Engine struct {
+	cfg Config
+	ex  *mockex.Exchange
+
+	mu  sync.Mutex
+	now time.Time
+}
+
+func New(cfg Config) *Engine {
+	if cfg.ContractValue == 0 {
+		cfg.ContractValue = 1
+	}
+	var engine = &Engine{cfg: cfg, ex: mockex.New("backtest")}
+	engine.ex.SetClock(engine.clock)
+	engine.ex.SetFee(cfg.MakerFee, cfg.TakerFee)
+	engine.ex.SetSlippage(cfg.Slippage)
+	engine.ex.SetContractValue(cfg.ContractValue)
+	for currency, amount := range cfg.Balances {
+		engine.ex.SetBalance(currency, amount)
+	}
+	if cfg.ContractType != "" {
+		engine.ex.SetMargin(cfg.Pair.CurrencyB, cfg.Margin)
+	}
+	return engine
+}
+
+// Exchange gives access to the simulated exchange for further scripting.
+func (engine *Engine) Exchange() *mockex.Exchange {
+	return engine.ex
+}
+
+func (engine *Engine) Spot() goex.API {
+	return engine.ex.Spot()
+}
+
+func (engine *Engine) Future() goex.FutureRestAPI {
+	return engine.ex.Future()
+}
+
+// Now is the simulated time: the time of the event being processed.
+func (engine *Engine) Now() time.Time {
+	return engine.clock()
+}
+
+func (engine *Engine) clock() time.Time {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	return engine.now
+}
+
+// Run moves the simulated market through events in order and calls onEvent
+// after each move. An error from onEvent stops the run; the result up to
+// that event is still returned.
+func (engine *Engine) Run(events []Event, onEvent func(ev *Event) error) (*Result, error) {
+	if len(events) == 0 {
+		return nil, errors.New("backtest: no events")
+	}
+	var market = engine.ex.Market(engine.cfg.Pair)
+	if engine.cfg.ContractType != "" {
+		market = engine.ex.FutureMarket(engine.cfg.Pair, engine.cfg.ContractType)
+	}
+	var result = new(Result)
+	var initial = engine.initialEquity(events[0])
+	var err error
+	for i := range events {
+		var ev = &events[i]
+		engine.mu.Lock()
+		engine.now = ev.Time
+		engine.mu.Unlock()
+		if ev.Kline != nil {
+			market.AddKlines(*ev.Kline)
+		}
+		var bid, ask = ev.Bid, ev.Ask
+		if bid == 0 && ask == 0 {
+			bid = ev.Last * (1 - engine.cfg.Spread/2)
+			ask = ev.Last * (1 + engine.cfg.Spread/2)
+		}
+		market.SetTicker(bid, ask)
+		market.SetLast(ev.Last)
+		if onEvent != nil {
+			err = onEvent(ev)
+		}
+		result.Equity = append(result.Equity, EquityPoint{Time: ev.Time, Equity: engine.equity(ev.Last)})
+		if err != nil {
+			break
+		}
+	}
+	result.Trades = roundTrips(engine.ex.Fills(), engine.cfg.ContractValue)
+	result.Stats = summarize(initial, result.Equity, result.Trades, engine.cfg.PeriodsPerYear)
+	return result, err
+}
+
+func (engine *Engine) initialEquity(first Event) float64 {
+	if engine.cfg.ContractType != "" {
+		return engine.cfg.Margin
+	}
+	return engine.cfg.Balances[engine.cfg.Pair.CurrencyB] + engine.cfg.Balances[engine.cfg.Pair.CurrencyA]*first.Last
+}
+
+// equity values the account in the quote currency at price.
+func (engine *Engine) equity(price float64) float64 {
+	if engine.cfg.ContractType != "" {
+		return engine.ex.Rights(engine.cfg.Pair.CurrencyB)
+	}
+	var base, baseFrozen = engine.ex.Balance(engine.cfg.Pair.CurrencyA)
+	var quote, quoteFrozen = engine.ex.Balance(engine.cfg.Pair.CurrencyB)
+	return quote + quoteFrozen + (base+baseFrozen)*price
+}
@@ -0,0 +1,109 @@
+package backtest
+
+import (
+	"errors"
+	"github.com/goex-top/goex_trade"
+	"github.com/nntaoli-project/GoEx"
+	"math"
+	"testing"
+	"time"
+)
+
+func klines(closes ...float64) []Event {
+	var t0 = time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	var events = make([]Event, len(closes))
+	for i, c := range closes {
+		var at = t0.Add(time.Duration(i) * time.Hour)
+		events[i] = Event{Time: at, Last: c, Kline: &goex.Kline{Timestamp: at.Unix(), Open: c, High: c, Low: c, Close: c}}
+	}
+	return events
+}
+
+func TestEngineSpot(t *testing.T) {
+	var engine = New(Config{
+		Pair:     goex.BTC_USDT,
+		Balances: map[goex.Currency]float64{goex.USDT: 1000},
+		TakerFee: 0.001,
+	})
+	var mgr = trade.NewSportManager(engine.Spot(), goex.BTC_USDT, trade.OPMODE_TAKE, 1, 0, 10, 0.01, 1, 10, nil, 2, 4, false)
+	var events = klines(100, 90, 110, 120)
+	result, err := engine.Run(events, func(ev *Event) error {
+		var err error
+		switch ev.Last {
+		case 100:
+			_, err = mgr.Buy(5)
+		case 120:
+			_, err = mgr.Sell(4.995)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Equity) != 4 || len(result.Trades) != 2 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	var stats = result.Stats
+	// 5 BTC for 500 USDT, 0.005 BTC fee; 4.995 BTC sold for 599.4 less 0.5994 fee
+	var final = 500 + 599.4 - 0.5994
+	if math.Abs(stats.FinalEquity-final) > 1e-6 || math.Abs(stats.Return-(final/1000-1)) > 1e-9 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.Trades != 1 || stats.WinRate != 1 {
+		t.Fatalf("unexpected win rate %+v", stats)
+	}
+	// equity after buying at 100 and marking at 90: 500 + 4.995*90
+	var trough = 500 + 4.995*90
+	if math.Abs(stats.MaxDrawdown-(1000-trough)/1000) > 1e-9 {
+		t.Fatalf("unexpected drawdown %f", stats.MaxDrawdown)
+	}
+	if stats.Sharpe == 0 {
+		t.Fatal("sharpe not computed")
+	}
+}
+
+func TestEngineFuture(t *testing.T) {
+	var engine = New(Config{
+		Pair:         goex.BTC_USD,
+		ContractType: goex.QUARTER_CONTRACT,
+		Margin:       1000,
+		Slippage:     0.01,
+	})
+	var events = klines(100, 100, 90)
+	var mgr *trade.FutureTradeManager
+	result, err := engine.Run(events, func(ev *Event) error {
+		if mgr == nil {
+			mgr = trade.NewFutureTradeManager(engine.Future(), goex.BTC_USD, goex.QUARTER_CONTRACT, trade.OPMODE_TAKE, 2, 0.1, 0.1, 0.1, 1, nil, 2, 0)
+			_, err := mgr.OpenShort(ev.Last, 10)
+			return err
+		}
+		if ev.Last == 90 {
+			_, err := mgr.CloseShort(ev.Last, 10)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// short 10 at 99 (1% slippage), cover 10 at 90.9
+	if math.Abs(result.Stats.FinalEquity-1081) > 1e-6 || result.Stats.WinRate != 1 {
+		t.Fatalf("unexpected stats %+v", result.Stats)
+	}
+}
+
+func TestEngineFutureOutage(t *testing.T) {
+	var engine = New(Config{
+		Pair:         goex.BTC_USD,
+		ContractType: goex.QUARTER_CONTRACT,
+		Margin:       1000,
+	})
+	engine.Exchange().Fail("GetFutureUserinfo", 1000, errors.New("maintenance"))
+	result, err := engine.Run(klines(100, 90), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Equity) != 2 || result.Equity[1].Equity != 1000 {
+		t.Fatalf("unexpected equity %+v", result.Equity)
+	}
+}
@@ -0,0 +1,153 @@
+package backtest
+
+import (
+	"github.com/goex-top/goex_trade/mockex"
+	"github.com/nntaoli-project/GoEx"
+	"math"
+	"time"
+)
+
+// Trade is one fill of the run. Fills that close earlier fills, matched
+// first in first out, carry the realised PnL net of the fees of both sides.
+type Trade struct {
+	Time    time.Time
+	OrderID string
+	Buy     bool
+	Price   float64
+	Amount  float64
+	Fee     float64 // in the quote currency
+	Closing bool
+	PnL     float64
+}
+
+type Stats struct {
+	InitialEquity float64
+	FinalEquity   float64
+	Return        float64 //收益率
+	MaxDrawdown   float64 //最大回撤比例
+	Sharpe        float64 //年化夏普比率
+	WinRate       float64 //平仓盈利次数占比
+	Trades        int     //平仓次数
+	Fees          float64 //手续费, 以计价货币计
+}
+
+type lot struct {
+	amount float64
+	price  float64
+	fee    float64 // per unit
+}
+
+func roundTrips(fills []mockex.Fill, contractValue float64) []Trade {
+	var trades = make([]Trade, 0, len(fills))
+	var longs, shorts []lot
+	for _, f := range fills {
+		var t = Trade{Time: f.Time, OrderID: f.OrderID, Buy: f.Buy, Price: f.Price, Amount: f.Amount, Fee: f.Fee}
+		var value = contractValue
+		if f.ContractType == "" {
+			value = 1
+			if f.Buy {
+				t.Fee = f.Fee * f.Price // spot buys pay the fee in the base currency
+			}
+		}
+		var feePerUnit = t.Fee / f.Amount
+		switch {
+		case f.ContractType == "" && f.Buy, f.OpenType == goex.OPEN_BUY:
+			longs = append(longs, lot{f.Amount, f.Price, feePerUnit})
+		case f.OpenType == goex.OPEN_SELL:
+			shorts = append(shorts, lot{f.Amount, f.Price, feePerUnit})
+		case f.ContractType == "" && !f.Buy, f.OpenType == goex.CLOSE_BUY:
+			t.Closing, t.PnL, longs = closeLots(longs, f.Amount, f.Price, feePerUnit, value, 1)
+		case f.OpenType == goex.CLOSE_SELL:
+			t.Closing, t.PnL, shorts = closeLots(shorts, f.Amount, f.Price, feePerUnit, value, -1)
+		}
+		trades = append(trades, t)
+	}
+	return trades
+}
+
+// closeLots takes amount off lots at price. sign is 1 for longs and -1 for
+// shorts. Amounts without a matching lot do not count towards the PnL.
+func closeLots(lots []lot, amount, price, feePerUnit, value, sign float64) (bool, float64, []lot) {
+	var matched = false
+	var pnl = 0.0
+	for amount > 1e-12 && len(lots) > 0 {
+		var q = math.Min(amount, lots[0].amount)
+		pnl += sign*(price-lots[0].price)*q*value - (lots[0].fee+feePerUnit)*q
+		matched = true
+		amount -= q
+		lots[0].amount -= q
+		if lots[0].amount <= 1e-12 {
+			lots = lots[1:]
+		}
+	}
+	return matched, pnl, lots
+}
+
+func summarize(initial float64, equity []EquityPoint, trades []Trade, periodsPerYear float64) Stats {
+	var stats = Stats{InitialEquity: initial, FinalEquity: initial}
+	if len(equity) > 0 {
+		stats.FinalEquity = equity[len(equity)-1].Equity
+	}
+	if initial != 0 {
+		stats.Return = stats.FinalEquity/initial - 1
+	}
+	var peak = initial
+	for _, p := range equity {
+		peak = math.Max(peak, p.Equity)
+		if peak > 0 {
+			stats.MaxDrawdown = math.Max(stats.MaxDrawdown, (peak-p.Equity)/peak)
+		}
+	}
+	var wins = 0
+	for _, t := range trades {
+		stats.Fees += t.Fee
+		if !t.Closing {
+			continue
+		}
+		stats.Trades++
+		if t.PnL > 0 {
+			wins++
+		}
+	}
+	if stats.Trades > 0 {
+		stats.WinRate = float64(wins) / float64(stats.Trades)
+	}
+	stats.Sharpe = sharpe(initial, equity, periodsPerYear)
+	return stats
+}
+
+func sharpe(initial float64, equity []EquityPoint, periodsPerYear float64) float64 {
+	if len(equity) < 2 {
+		return 0
+	}
+	var returns = make([]float64, 0, len(equity))
+	var prev = initial
+	for _, p := range equity {
+		if prev != 0 {
+			returns = append(returns, p.Equity/prev-1)
+		}
+		prev = p.Equity
+	}
+	var mean = 0.0
+	for _, r := range returns {
+		mean += r
+	}
+	mean /= float64(len(returns))
+	var variance = 0.0
+	for _, r := range returns {
+		variance += (r - mean) * (r - mean)
+	}
+	if len(returns) < 2 || variance == 0 {
+		return 0
+	}
+	var std = math.Sqrt(variance / float64(len(returns)-1))
+	if periodsPerYear == 0 {
+		var span = equity[len(equity)-1].Time.Sub(equity[0].Time)
+		if span <= 0 {
+			return 0
+		}
+		var step = span / time.Duration(len(equity)-1)
+		periodsPerYear = float64(365*24*time.Hour) / float64(step)
+	}
+	return mean / std * math.Sqrt(periodsPerYear)
+}
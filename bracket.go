@@ -0,0 +1,131 @@
+package trade
+
+import (
+	"context"
+	"fmt"
+	"github.com/beaquant/utils"
+	"github.com/nntaoli-project/GoEx"
+)
+
+// Bracket is the pair of exits attached to a futures entry. A zero price
+// leaves that exit out, but at least one must be set.
+type Bracket struct {
+	TakeProfit float64 //止盈价
+	StopLoss   float64 //止损价
+}
+
+// BracketPosition is an entry together with the conditional orders that will
+// close it.
+type BracketPosition struct {
+	*SummaryPosition
+	TakeProfitID string //止盈单ID, 未设置或未成交时为空
+	StopLossID   string //止损单ID, 未设置或未成交时为空
+}
+
+// validate checks that the exits lie on the right sides of price (0 skips
+// that check) for an entry in direction.
+func (bracket Bracket) validate(direction int, price float64) error {
+	var tp, sl = bracket.TakeProfit, bracket.StopLoss
+	switch {
+	case tp < 0 || sl < 0:
+		return fmt.Errorf("%w: negative bracket price", ErrInvalidConfig)
+	case tp == 0 && sl == 0:
+		return fmt.Errorf("%w: bracket needs a take-profit or a stop-loss", ErrInvalidConfig)
+	}
+	var long = direction == goex.OPEN_BUY
+	if price > 0 {
+		if tp > 0 && (long && tp <= price || !long && tp >= price) {
+			return fmt.Errorf("%w: take-profit %v on the wrong side of %v", ErrInvalidConfig, tp, price)
+		}
+		if sl > 0 && (long && sl >= price || !long && sl <= price) {
+			return fmt.Errorf("%w: stop-loss %v on the wrong side of %v", ErrInvalidConfig, sl, price)
+		}
+	} else if tp > 0 && sl > 0 && (long && sl >= tp || !long && sl <= tp) {
+		return fmt.Errorf("%w: stop-loss %v and take-profit %v crossed", ErrInvalidConfig, sl, tp)
+	}
+	return nil
+}
+
+// OpenLongBracket is OpenLong followed by a take-profit and a stop-loss on
+// exits, linked one-cancels-other and sized to what was actually opened, so
+// a partial entry gets partial exits and an unfilled one none. exits must
+// close through this manager, see NewFutureCloser.
+//
+// If the exits cannot be registered the new position is closed again, so no
+// entry is ever left without them; the error is returned with the entry.
+func (future *FutureTradeManager) OpenLongBracket(exits *ConditionalManager, price, opAmount float64, bracket Bracket) (*BracketPosition, error) {
+	return future.openBracket(context.Background(), exits, goex.OPEN_BUY, price, opAmount, bracket)
+}
+
+// OpenLongBracketCtx is OpenLongBracket with the entry, and the closing
+// again when the exits cannot be registered, bounded by ctx. An entry that
+// ctx cuts short still gets exits for what it opened and is returned with
+// the error.
+func (future *FutureTradeManager) OpenLongBracketCtx(ctx context.Context, exits *ConditionalManager, price, opAmount float64, bracket Bracket) (*BracketPosition, error) {
+	return future.openBracket(ctx, exits, goex.OPEN_BUY, price, opAmount, bracket)
+}
+
+// OpenShortBracket is OpenLongBracket for a short.
+func (future *FutureTradeManager) OpenShortBracket(exits *ConditionalManager, price, opAmount float64, bracket Bracket) (*BracketPosition, error) {
+	return future.openBracket(context.Background(), exits, goex.OPEN_SELL, price, opAmount, bracket)
+}
+
+// OpenShortBracketCtx is OpenLongBracketCtx for a short.
+func (future *FutureTradeManager) OpenShortBracketCtx(ctx context.Context, exits *ConditionalManager, price, opAmount float64, bracket Bracket) (*BracketPosition, error) {
+	return future.openBracket(ctx, exits, goex.OPEN_SELL, price, opAmount, bracket)
+}
+
+// openBracket registers exits for whatever open filled, also when open
+// stopped early with an error, which is then returned with the entry.
+func (future *FutureTradeManager) openBracket(ctx context.Context, exits *ConditionalManager, direction int, price, opAmount float64, bracket Bracket) (*BracketPosition, error) {
+	if exits == nil {
+		return nil, fmt.Errorf("%w: nil conditional manager", ErrInvalidConfig)
+	}
+	if err := bracket.validate(direction, price); err != nil {
+		return nil, err
+	}
+	pos, openErr := future.open(ctx, direction, price, opAmount)
+	if pos == nil {
+		return nil, openErr
+	}
+	var bp = &BracketPosition{SummaryPosition: pos}
+	if pos.Amount <= 0 {
+		future.logger.Warningf("[ BRACKET ] nothing opened of %s, no exits", utils.Float64RoundString(opAmount, 8))
+		return bp, openErr
+	}
+	if openErr != nil {
+		future.logger.Warningf("[ BRACKET ] entry stopped at %s: %v, adding exits for it", utils.Float64RoundString(pos.Amount, 8), openErr)
+	}
+	var side = goex.TradeSide(goex.SELL)
+	if direction == goex.OPEN_SELL {
+		side = goex.BUY
+	}
+	var orders []ConditionalOrder
+	if bracket.TakeProfit > 0 {
+		orders = append(orders, ConditionalOrder{Kind: TRIGGER_TAKE_PROFIT, Side: side, Amount: pos.Amount, TriggerPrice: bracket.TakeProfit})
+	}
+	if bracket.StopLoss > 0 {
+		orders = append(orders, ConditionalOrder{Kind: TRIGGER_STOP_LOSS, Side: side, Amount: pos.Amount, TriggerPrice: bracket.StopLoss})
+	}
+	ids, err := exits.OCO(orders...)
+	if err != nil {
+		future.logger.Errorf("[ BRACKET ] exits not registered: %v, closing %s again", err, utils.Float64RoundString(pos.Amount, 8))
+		var cover = goex.CLOSE_BUY
+		if direction == goex.OPEN_SELL {
+			cover = goex.CLOSE_SELL
+		}
+		if _, cerr := future.cover(ctx, cover, pos.Amount, price); cerr != nil {
+			future.logger.Errorf("[ BRACKET ] unwinding failed: %v", cerr)
+		}
+		return bp, err
+	}
+	if bracket.TakeProfit > 0 {
+		bp.TakeProfitID, ids = ids[0], ids[1:]
+	}
+	if bracket.StopLoss > 0 {
+		bp.StopLossID = ids[0]
+	}
+	future.logger.Infof("[ BRACKET ] opened %s @ %s, take-profit %s, stop-loss %s", utils.Float64RoundString(pos.Amount, 8),
+		utils.Float64RoundString(pos.Price, 8), utils.Float64RoundString(bracket.TakeProfit, 8), utils.Float64RoundString(bracket.StopLoss, 8))
+	return bp, openErr
+}
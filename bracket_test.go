@@ -0,0 +1,103 @@
+package trade
+
+import (
+	"context"
+	"errors"
+	"github.com/nntaoli-project/GoEx"
+	"testing"
+)
+
+type failingStore struct{}
+
+func (failingStore) Load() ([]*ConditionalOrder, error) { return nil, nil }
+
+func (failingStore) Save(orders []*ConditionalOrder) error { return errors.New("disk full") }
+
+// newBracketFuture offers only 3 contracts within the slide of a 100 entry.
+func newBracketFuture(store ConditionalStore) (*FutureTradeManager, *ConditionalManager) {
+	ex, mgr := newMockFuture()
+	ex.FutureMarket(futurePair, goex.QUARTER_CONTRACT).SetDepth(
+		goex.DepthRecords{{Price: 99.5, Amount: 10}},
+		goex.DepthRecords{{Price: 100.5, Amount: 3}, {Price: 200, Amount: 100}},
+	)
+	cm, _ := NewConditionalManager(NewFutureFeed(ex.Future(), futurePair, goex.QUARTER_CONTRACT), NewFutureCloser(mgr), store, 1, nil)
+	return mgr, cm
+}
+
+func TestFutureTradeManager_OpenLongBracket(t *testing.T) {
+	mgr, cm := newBracketFuture(nil)
+	bp, err := mgr.OpenLongBracket(cm, 100, 5, Bracket{TakeProfit: 110, StopLoss: 95})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bp.Amount != 3 || bp.TakeProfitID == "" || bp.StopLossID == "" {
+		t.Fatalf("unexpected bracket %+v", bp)
+	}
+	tp, _ := cm.Get(bp.TakeProfitID)
+	sl, _ := cm.Get(bp.StopLossID)
+	if tp.Amount != 3 || sl.Amount != 3 || tp.Side != goex.SELL || tp.Group == "" || tp.Group != sl.Group {
+		t.Fatalf("exits not sized to the fill %+v %+v", tp, sl)
+	}
+	if err = cm.Update(context.Background(), lastTicker(94)); err != nil {
+		t.Fatal(err)
+	}
+	if pos, _ := mgr.GetPosition(goex.OPEN_BUY); pos != nil && pos.Amount != 0 {
+		t.Fatalf("stop did not close the long %+v", pos)
+	}
+	if tp, _ = cm.Get(bp.TakeProfitID); tp.Status != CONDITIONAL_CANCELLED {
+		t.Fatalf("take-profit still %s", tp.Status)
+	}
+}
+
+func TestFutureTradeManager_BracketInvalid(t *testing.T) {
+	mgr, cm := newBracketFuture(nil)
+	for _, bracket := range []Bracket{{}, {TakeProfit: 90}, {StopLoss: 101}} {
+		if _, err := mgr.OpenLongBracket(cm, 100, 1, bracket); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%+v: want ErrInvalidConfig, got %v", bracket, err)
+		}
+	}
+	if _, err := mgr.OpenShortBracket(cm, 100, 1, Bracket{TakeProfit: 105}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("short take-profit above entry: want ErrInvalidConfig, got %v", err)
+	}
+	if pos, _ := mgr.GetPosition(goex.OPEN_BUY); pos != nil && pos.Amount != 0 {
+		t.Fatalf("invalid bracket opened %+v", pos)
+	}
+}
+
+func TestFutureTradeManager_BracketUnwinds(t *testing.T) {
+	mgr, cm := newBracketFuture(failingStore{})
+	bp, err := mgr.OpenLongBracket(cm, 100, 2, Bracket{StopLoss: 95})
+	if err == nil || bp == nil || bp.Amount != 2 {
+		t.Fatalf("want the store error with the entry, got %+v, %v", bp, err)
+	}
+	if pos, _ := mgr.GetPosition(goex.OPEN_BUY); pos != nil && pos.Amount != 0 {
+		t.Fatalf("entry left without exits %+v", pos)
+	}
+	if len(cm.Orders()) != 0 {
+		t.Fatalf("exits half registered %+v", cm.Orders())
+	}
+}
+
+// cancelOnPlace cancels the caller's ctx as soon as an order is placed.
+type cancelOnPlace struct {
+	goex.FutureRestAPI
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnPlace) PlaceFutureOrder(pair goex.CurrencyPair, contractType, price, amount string, openType, matchPrice, leverRate int) (string, error) {
+	defer c.cancel()
+	return c.FutureRestAPI.PlaceFutureOrder(pair, contractType, price, amount, openType, matchPrice, leverRate)
+}
+
+func TestFutureTradeManager_BracketEntryStopped(t *testing.T) {
+	mgr, cm := newBracketFuture(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	mgr.exchange = &cancelOnPlace{FutureRestAPI: mgr.exchange, cancel: cancel}
+	bp, err := mgr.OpenLongBracketCtx(ctx, cm, 100, 5, Bracket{StopLoss: 95})
+	if !errors.Is(err, context.Canceled) || bp == nil || bp.Amount != 3 {
+		t.Fatalf("want ctx's error with the entry, got %+v, %v", bp, err)
+	}
+	if sl, err := cm.Get(bp.StopLossID); err != nil || sl.Amount != 3 {
+		t.Fatalf("entry left without its stop %+v, %v", sl, err)
+	}
+}
@@ -0,0 +1,517 @@
+package trade
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/beaquant/utils"
+	"github.com/nntaoli-project/GoEx"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TriggerKind is what makes a ConditionalOrder fire.
+type TriggerKind int
+
+const (
+	TRIGGER_STOP_LOSS     = iota //价格不利穿过触发价
+	TRIGGER_TAKE_PROFIT          //价格有利穿过触发价
+	TRIGGER_TRAILING_STOP        //价格从最有利处回撤超过跟踪距离
+)
+
+func (kind TriggerKind) String() string {
+	switch kind {
+	case TRIGGER_STOP_LOSS:
+		return "TRIGGER_STOP_LOSS"
+	case TRIGGER_TAKE_PROFIT:
+		return "TRIGGER_TAKE_PROFIT"
+	case TRIGGER_TRAILING_STOP:
+		return "TRIGGER_TRAILING_STOP"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// ConditionalStatus is where a ConditionalOrder is in its life.
+type ConditionalStatus int
+
+const (
+	CONDITIONAL_ACTIVE    = iota //等待触发
+	CONDITIONAL_TRIGGERED        //已触发, 正在下单
+	CONDITIONAL_FILLED           //已触发并执行完成
+	CONDITIONAL_FAILED           //已触发但执行出错或被中断
+	CONDITIONAL_CANCELLED        //被撤销或被OCO同组订单取消
+)
+
+func (status ConditionalStatus) String() string {
+	switch status {
+	case CONDITIONAL_ACTIVE:
+		return "CONDITIONAL_ACTIVE"
+	case CONDITIONAL_TRIGGERED:
+		return "CONDITIONAL_TRIGGERED"
+	case CONDITIONAL_FILLED:
+		return "CONDITIONAL_FILLED"
+	case CONDITIONAL_FAILED:
+		return "CONDITIONAL_FAILED"
+	case CONDITIONAL_CANCELLED:
+		return "CONDITIONAL_CANCELLED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// ConditionalOrder closes Amount when its trigger fires. Side goex.SELL
+// protects a long (spot: sells, futures: CloseLong) and fires on falling
+// prices for stops and rising prices for take-profits; goex.BUY protects a
+// short the other way round.
+type ConditionalOrder struct {
+	ID           string            `json:"id"`
+	Kind         TriggerKind       `json:"kind"`
+	Side         goex.TradeSide    `json:"side"`                   //goex.SELL平多|goex.BUY平空
+	Amount       float64           `json:"amount"`                 //触发后下单数量
+	TriggerPrice float64           `json:"trigger_price"`          //止损/止盈触发价
+	Trail        float64           `json:"trail,omitempty"`        //跟踪止损回撤距离
+	TrailRatio   float64           `json:"trail_ratio,omitempty"`  //跟踪止损回撤比例, 与Trail二选一
+	Extreme      float64           `json:"extreme,omitempty"`      //跟踪止损见过的最有利价格
+	Group        string            `json:"group,omitempty"`        //OCO组, 同组一个触发其余撤销
+	Status       ConditionalStatus `json:"status"`                 //状态
+	CreatedAt    time.Time         `json:"created_at"`             //创建时间
+	TriggeredAt  time.Time         `json:"triggered_at,omitempty"` //触发时间
+	TriggeredBy  float64           `json:"triggered_by,omitempty"` //触发时的价格
+	Report       *ExecutionReport  `json:"report,omitempty"`       //执行报告
+	Error        string            `json:"error,omitempty"`        //执行错误或撤销原因
+}
+
+func (order *ConditionalOrder) Validate() error {
+	switch {
+	case order.Kind.String() == "UNKNOWN":
+		return fmt.Errorf("%w: trigger kind %d", ErrInvalidConfig, order.Kind)
+	case order.Side != goex.BUY && order.Side != goex.SELL:
+		return fmt.Errorf("%w: %d", ErrUnknownSide, order.Side)
+	case order.Amount <= 0:
+		return fmt.Errorf("%w: conditional amount %v must be positive", ErrInvalidConfig, order.Amount)
+	case order.Kind != TRIGGER_TRAILING_STOP && order.TriggerPrice <= 0:
+		return fmt.Errorf("%w: %s needs a positive trigger price", ErrInvalidConfig, order.Kind)
+	case order.Kind == TRIGGER_TRAILING_STOP && (order.Trail > 0) == (order.TrailRatio > 0):
+		return fmt.Errorf("%w: trailing stop needs one of trail or trailRatio", ErrInvalidConfig)
+	case order.Trail < 0 || order.TrailRatio < 0 || order.TrailRatio >= 1:
+		return fmt.Errorf("%w: trail %v, trailRatio %v", ErrInvalidConfig, order.Trail, order.TrailRatio)
+	}
+	return nil
+}
+
+// StopPrice is the price at which the order fires: TriggerPrice, or for a
+// trailing stop the trail below (above) the best price seen so far. It is 0
+// for a trailing stop that has not seen a price yet.
+func (order *ConditionalOrder) StopPrice() float64 {
+	if order.Kind != TRIGGER_TRAILING_STOP {
+		return order.TriggerPrice
+	}
+	if order.Extreme == 0 {
+		return 0
+	}
+	var trail = order.Trail
+	if order.TrailRatio > 0 {
+		trail = order.Extreme * order.TrailRatio
+	}
+	if order.Side == goex.SELL {
+		return order.Extreme - trail
+	}
+	return order.Extreme + trail
+}
+
+// observe moves the extreme of a trailing stop to price when it is better,
+// and reports whether it did.
+func (order *ConditionalOrder) observe(price float64) bool {
+	if order.Kind != TRIGGER_TRAILING_STOP {
+		return false
+	}
+	if order.Extreme == 0 || order.Side == goex.SELL && price > order.Extreme || order.Side == goex.BUY && price < order.Extreme {
+		order.Extreme = price
+		return true
+	}
+	return false
+}
+
+// fires tells whether price sets the order off.
+func (order *ConditionalOrder) fires(price float64) bool {
+	var stop = order.StopPrice()
+	if stop == 0 {
+		return false
+	}
+	var falling = order.Side == goex.SELL
+	if order.Kind == TRIGGER_TAKE_PROFIT {
+		falling = !falling
+	}
+	if falling {
+		return price <= stop
+	}
+	return price >= stop
+}
+
+// ConditionalExecutor places the closing order of a triggered
+// ConditionalOrder.
+type ConditionalExecutor interface {
+	Close(ctx context.Context, side goex.TradeSide, amount, price float64) (*ExecutionReport, error)
+}
+
+type spotCloser struct {
+	mgr SpotTradeManagerAPI
+}
+
+// NewSpotCloser closes with SellCtx (goex.SELL) or BuyCtx (goex.BUY).
+func NewSpotCloser(mgr SpotTradeManagerAPI) ConditionalExecutor {
+	return &spotCloser{mgr: mgr}
+}
+
+func (c *spotCloser) Close(ctx context.Context, side goex.TradeSide, amount, price float64) (*ExecutionReport, error) {
+	var trade, err = sliceFunc(c.mgr, side)
+	if err != nil {
+		return nil, err
+	}
+	return trade(ctx, amount)
+}
+
+type futureCloser struct {
+	mgr FutureTradeManagerAPI
+}
+
+// NewFutureCloser closes with CloseLongCtx (goex.SELL) or CloseShortCtx
+// (goex.BUY), priced off the trigger price.
+func NewFutureCloser(mgr FutureTradeManagerAPI) ConditionalExecutor {
+	return &futureCloser{mgr: mgr}
+}
+
+func (c *futureCloser) Close(ctx context.Context, side goex.TradeSide, amount, price float64) (*ExecutionReport, error) {
+	switch side {
+	case goex.SELL:
+		return c.mgr.CloseLongCtx(ctx, price, amount)
+	case goex.BUY:
+		return c.mgr.CloseShortCtx(ctx, price, amount)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownSide, side)
+	}
+}
+
+// ConditionalStore keeps conditional orders across restarts.
+type ConditionalStore interface {
+	Load() ([]*ConditionalOrder, error)
+	Save(orders []*ConditionalOrder) error
+}
+
+type conditionalFile struct {
+	path string
+}
+
+// NewConditionalFile stores conditional orders as JSON in path. A missing
+// file loads as no orders; saves go through a temporary file so a crash
+// never leaves a half-written one.
+func NewConditionalFile(path string) ConditionalStore {
+	return &conditionalFile{path: path}
+}
+
+func (f *conditionalFile) Load() ([]*ConditionalOrder, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var orders []*ConditionalOrder
+	if err = json.Unmarshal(data, &orders); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.path, err)
+	}
+	return orders, nil
+}
+
+func (f *conditionalFile) Save(orders []*ConditionalOrder) error {
+	data, err := json.MarshalIndent(orders, "", "  ")
+	if err != nil {
+		return err
+	}
+	var tmp = f.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// ConditionalManager watches the ticker of a feed and closes positions
+// through an executor when stop-loss, take-profit or trailing-stop orders
+// fire. Orders sharing a Group are one-cancels-other. With a store every
+// change is saved, and orders are reloaded by NewConditionalManager.
+//
+// An order is marked CONDITIONAL_TRIGGERED and saved before its close is
+// placed, so a restart never closes twice; orders found still triggered on
+// load were interrupted and are marked CONDITIONAL_FAILED for the caller to
+// check.
+type ConditionalManager struct {
+	feed        Feed
+	executor    ConditionalExecutor
+	store       ConditionalStore
+	pollDelayMs time.Duration
+	logger      *logrus.Logger
+
+	mu     sync.Mutex
+	orders []*ConditionalOrder
+	seq    int
+}
+
+func NewConditionalManager(
+	feed Feed,
+	executor ConditionalExecutor,
+	store ConditionalStore,
+	pollDelayMs int,
+	logger *logrus.Logger,
+) (*ConditionalManager, error) {
+	if feed == nil || executor == nil {
+		return nil, fmt.Errorf("%w: nil feed or executor", ErrInvalidConfig)
+	}
+	if pollDelayMs <= 0 {
+		return nil, fmt.Errorf("%w: poll delay %dms", ErrInvalidConfig, pollDelayMs)
+	}
+	if logger == nil {
+		logger = logrus.New()
+	}
+	var cm = &ConditionalManager{
+		feed:        feed,
+		executor:    executor,
+		store:       store,
+		pollDelayMs: time.Duration(pollDelayMs) * time.Millisecond,
+		logger:      logger,
+	}
+	if store == nil {
+		return cm, nil
+	}
+	orders, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	var interrupted = false
+	for _, order := range orders {
+		if order.Status == CONDITIONAL_TRIGGERED {
+			order.Status = CONDITIONAL_FAILED
+			order.Error = "interrupted before the close was confirmed"
+			interrupted = true
+			logger.Warningf("[ COND ] %s was interrupted while closing %s, check the position", order.ID, utils.Float64RoundString(order.Amount, 8))
+		}
+		if n, err := strconv.Atoi(order.ID); err == nil && n > cm.seq {
+			cm.seq = n
+		}
+	}
+	cm.orders = orders
+	if interrupted {
+		if err = store.Save(orders); err != nil {
+			return nil, err
+		}
+	}
+	return cm, nil
+}
+
+// Add validates order and starts watching it. An empty ID is filled in.
+func (cm *ConditionalManager) Add(order ConditionalOrder) (string, error) {
+	if err := order.Validate(); err != nil {
+		return "", err
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	var n = len(cm.orders)
+	cm.add(&order)
+	if err := cm.save(); err != nil {
+		cm.orders = cm.orders[:n]
+		return "", err
+	}
+	return order.ID, nil
+}
+
+// OCO adds orders as one group: the first to fire cancels the rest. Either
+// all of them are added or, when saving fails, none.
+func (cm *ConditionalManager) OCO(orders ...ConditionalOrder) ([]string, error) {
+	for i := range orders {
+		if err := orders[i].Validate(); err != nil {
+			return nil, err
+		}
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	var n = len(cm.orders)
+	var ids = make([]string, 0, len(orders))
+	var group = ""
+	for i := range orders {
+		var order = orders[i]
+		cm.add(&order)
+		if group == "" {
+			group = "oco-" + order.ID
+		}
+		order.Group = group
+		ids = append(ids, order.ID)
+	}
+	if err := cm.save(); err != nil {
+		cm.orders = cm.orders[:n]
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (cm *ConditionalManager) add(order *ConditionalOrder) {
+	cm.seq++
+	if order.ID == "" {
+		order.ID = strconv.Itoa(cm.seq)
+	}
+	order.Status = CONDITIONAL_ACTIVE
+	order.CreatedAt = time.Now()
+	order.TriggeredAt = time.Time{}
+	order.Report = nil
+	order.Error = ""
+	cm.orders = append(cm.orders, order)
+}
+
+// Cancel stops watching an active order.
+func (cm *ConditionalManager) Cancel(id string) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, order := range cm.orders {
+		if order.ID != id {
+			continue
+		}
+		if order.Status != CONDITIONAL_ACTIVE {
+			return fmt.Errorf("%w: %s is %s", ErrConditionalNotFound, id, order.Status)
+		}
+		order.Status = CONDITIONAL_CANCELLED
+		order.Error = "cancelled"
+		return cm.save()
+	}
+	return fmt.Errorf("%w: %s", ErrConditionalNotFound, id)
+}
+
+// Orders returns a copy of every order, including finished ones.
+func (cm *ConditionalManager) Orders() []ConditionalOrder {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	var orders = make([]ConditionalOrder, 0, len(cm.orders))
+	for _, order := range cm.orders {
+		orders = append(orders, *order)
+	}
+	return orders
+}
+
+// Get returns a copy of one order.
+func (cm *ConditionalManager) Get(id string) (ConditionalOrder, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, order := range cm.orders {
+		if order.ID == id {
+			return *order, nil
+		}
+	}
+	return ConditionalOrder{}, fmt.Errorf("%w: %s", ErrConditionalNotFound, id)
+}
+
+func (cm *ConditionalManager) save() error {
+	if cm.store == nil {
+		return nil
+	}
+	return cm.store.Save(cm.orders)
+}
+
+// Run polls the feed until ctx is done.
+func (cm *ConditionalManager) Run(ctx context.Context) error {
+	for {
+		ticker, err := cm.feed.GetTicker()
+		if err == nil {
+			err = cm.Update(ctx, ticker)
+		}
+		if err != nil && ctx.Err() == nil {
+			cm.logger.Errorln("conditional orders:", err)
+		}
+		if err = sleepCtx(ctx, cm.pollDelayMs); err != nil {
+			return err
+		}
+	}
+}
+
+// tickerPrice is the last price, or the mid when the exchange has none.
+func tickerPrice(ticker *goex.Ticker) float64 {
+	if ticker.Last > 0 {
+		return ticker.Last
+	}
+	return (ticker.Buy + ticker.Sell) / 2
+}
+
+// Update checks every active order against ticker and closes those that
+// fire, one after the other. It returns the first close or save error.
+func (cm *ConditionalManager) Update(ctx context.Context, ticker *goex.Ticker) error {
+	var price = tickerPrice(ticker)
+	if price <= 0 {
+		return nil
+	}
+	cm.mu.Lock()
+	var fired []*ConditionalOrder
+	var moved = false
+	for _, order := range cm.orders {
+		if order.Status != CONDITIONAL_ACTIVE {
+			continue
+		}
+		if order.observe(price) {
+			moved = true
+		}
+		if !order.fires(price) {
+			continue
+		}
+		order.Status = CONDITIONAL_TRIGGERED
+		order.TriggeredAt = time.Now()
+		order.TriggeredBy = price
+		fired = append(fired, order)
+		cm.logger.Infof("[ COND ] %s %s %s fired @ %s, stop %s", order.ID, order.Kind, order.Side.String(),
+			utils.Float64RoundString(price, 8), utils.Float64RoundString(order.StopPrice(), 8))
+		if order.Group == "" {
+			continue
+		}
+		for _, other := range cm.orders {
+			if other != order && other.Group == order.Group && other.Status == CONDITIONAL_ACTIVE {
+				other.Status = CONDITIONAL_CANCELLED
+				other.Error = "oco: " + order.ID + " fired"
+			}
+		}
+	}
+	var firstErr error
+	if len(fired) > 0 || moved {
+		firstErr = cm.save()
+	}
+	cm.mu.Unlock()
+	if firstErr != nil && len(fired) > 0 {
+		// 触发状态没能保存, 宁可不下单也不能重启后重复平仓
+		cm.mu.Lock()
+		for _, order := range fired {
+			order.Status = CONDITIONAL_FAILED
+			order.Error = "save: " + firstErr.Error()
+		}
+		cm.mu.Unlock()
+		return firstErr
+	}
+	for _, order := range fired {
+		rep, err := cm.executor.Close(ctx, order.Side, order.Amount, price)
+		cm.mu.Lock()
+		order.Report = rep
+		order.Status = CONDITIONAL_FILLED
+		if err != nil {
+			order.Status = CONDITIONAL_FAILED
+			order.Error = err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if rep != nil && order.Amount-rep.Filled > 1e-8 {
+			cm.logger.Warningf("[ COND ] %s closed %s of %s", order.ID, utils.Float64RoundString(rep.Filled, 8), utils.Float64RoundString(order.Amount, 8))
+		}
+		if err = cm.save(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		cm.mu.Unlock()
+	}
+	return firstErr
+}
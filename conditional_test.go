@@ -0,0 +1,204 @@
+package trade
+
+import (
+	"context"
+	"errors"
+	"github.com/nntaoli-project/GoEx"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type recordingCloser struct {
+	sides   []goex.TradeSide
+	amounts []float64
+	err     error
+}
+
+func (c *recordingCloser) Close(ctx context.Context, side goex.TradeSide, amount, price float64) (*ExecutionReport, error) {
+	c.sides = append(c.sides, side)
+	c.amounts = append(c.amounts, amount)
+	return &ExecutionReport{Side: side, Requested: amount, Filled: amount, VWAP: price}, c.err
+}
+
+func lastTicker(price float64) *goex.Ticker {
+	return &goex.Ticker{Last: price}
+}
+
+func TestConditionalOrder_Fires(t *testing.T) {
+	for _, tc := range []struct {
+		order ConditionalOrder
+		price float64
+		want  bool
+	}{
+		{ConditionalOrder{Kind: TRIGGER_STOP_LOSS, Side: goex.SELL, TriggerPrice: 95}, 95, true},
+		{ConditionalOrder{Kind: TRIGGER_STOP_LOSS, Side: goex.SELL, TriggerPrice: 95}, 96, false},
+		{ConditionalOrder{Kind: TRIGGER_STOP_LOSS, Side: goex.BUY, TriggerPrice: 105}, 106, true},
+		{ConditionalOrder{Kind: TRIGGER_TAKE_PROFIT, Side: goex.SELL, TriggerPrice: 110}, 111, true},
+		{ConditionalOrder{Kind: TRIGGER_TAKE_PROFIT, Side: goex.BUY, TriggerPrice: 90}, 91, false},
+		{ConditionalOrder{Kind: TRIGGER_TRAILING_STOP, Side: goex.SELL, Trail: 2, Extreme: 105}, 103, true},
+		{ConditionalOrder{Kind: TRIGGER_TRAILING_STOP, Side: goex.BUY, TrailRatio: 0.1, Extreme: 100}, 109, false},
+		{ConditionalOrder{Kind: TRIGGER_TRAILING_STOP, Side: goex.SELL, Trail: 2}, 1, false},
+	} {
+		if got := tc.order.fires(tc.price); got != tc.want {
+			t.Errorf("%s %s @ %v: fires = %v, want %v", tc.order.Kind, tc.order.Side.String(), tc.price, got, tc.want)
+		}
+	}
+	var bad = ConditionalOrder{Kind: TRIGGER_TRAILING_STOP, Side: goex.SELL, Amount: 1, Trail: 2, TrailRatio: 0.1}
+	if err := bad.Validate(); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("want ErrInvalidConfig for both trails, got %v", err)
+	}
+}
+
+func TestConditionalManager_StopLoss(t *testing.T) {
+	ex, mgr := newMockSpot(OPMODE_TAKE)
+	cm, err := NewConditionalManager(NewSpotFeed(ex.Spot(), spotPair), NewSpotCloser(mgr), nil, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := cm.Add(ConditionalOrder{Kind: TRIGGER_STOP_LOSS, Side: goex.SELL, Amount: 1, TriggerPrice: 95})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cm.Update(context.Background(), lastTicker(98)); err != nil {
+		t.Fatal(err)
+	}
+	if btc, _ := ex.Balance(goex.BTC); btc != 10 {
+		t.Fatalf("stop fired early, %v BTC left", btc)
+	}
+	if err = cm.Update(context.Background(), lastTicker(94)); err != nil {
+		t.Fatal(err)
+	}
+	order, _ := cm.Get(id)
+	if order.Status != CONDITIONAL_FILLED || order.TriggeredBy != 94 || order.Report == nil || order.Report.Filled != 1 {
+		t.Fatalf("unexpected order %+v", order)
+	}
+	if btc, _ := ex.Balance(goex.BTC); btc != 9 {
+		t.Fatalf("want 9 BTC, got %v", btc)
+	}
+	if err = cm.Cancel(id); !errors.Is(err, ErrConditionalNotFound) {
+		t.Fatalf("want ErrConditionalNotFound cancelling a filled order, got %v", err)
+	}
+}
+
+func TestConditionalManager_OCO(t *testing.T) {
+	var closer = new(recordingCloser)
+	if _, err := NewConditionalManager(NewSpotFeed(nil, spotPair), closer, nil, 0, nil); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("want ErrInvalidConfig for a zero poll delay, got %v", err)
+	}
+	cm, err := NewConditionalManager(NewSpotFeed(nil, spotPair), closer, nil, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := cm.OCO(
+		ConditionalOrder{Kind: TRIGGER_STOP_LOSS, Side: goex.SELL, Amount: 1, TriggerPrice: 95},
+		ConditionalOrder{Kind: TRIGGER_TAKE_PROFIT, Side: goex.SELL, Amount: 1, TriggerPrice: 110},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.Update(context.Background(), lastTicker(111))
+	cm.Update(context.Background(), lastTicker(90))
+	if len(closer.sides) != 1 || closer.sides[0] != goex.SELL {
+		t.Fatalf("want exactly one close, got %v", closer.sides)
+	}
+	stop, _ := cm.Get(ids[0])
+	profit, _ := cm.Get(ids[1])
+	if stop.Status != CONDITIONAL_CANCELLED || profit.Status != CONDITIONAL_FILLED || stop.Group != profit.Group {
+		t.Fatalf("unexpected orders %+v %+v", stop, profit)
+	}
+}
+
+func TestConditionalManager_Trailing(t *testing.T) {
+	var closer = new(recordingCloser)
+	cm, _ := NewConditionalManager(NewSpotFeed(nil, spotPair), closer, nil, 1, nil)
+	id, _ := cm.Add(ConditionalOrder{Kind: TRIGGER_TRAILING_STOP, Side: goex.BUY, Amount: 2, Trail: 2})
+	for _, price := range []float64{100, 96, 97.5, 97.9} {
+		cm.Update(context.Background(), lastTicker(price))
+	}
+	if order, _ := cm.Get(id); order.Extreme != 96 || order.StopPrice() != 98 || len(closer.sides) != 0 {
+		t.Fatalf("unexpected trailing state %+v", order)
+	}
+	cm.Update(context.Background(), lastTicker(98))
+	if len(closer.sides) != 1 || closer.sides[0] != goex.BUY || closer.amounts[0] != 2 {
+		t.Fatalf("want the short closed, got %v %v", closer.sides, closer.amounts)
+	}
+}
+
+func TestConditionalManager_Persistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conditional")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var store = NewConditionalFile(filepath.Join(dir, "orders.json"))
+	var closer = new(recordingCloser)
+	cm, err := NewConditionalManager(NewSpotFeed(nil, spotPair), closer, store, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailing, _ := cm.Add(ConditionalOrder{Kind: TRIGGER_TRAILING_STOP, Side: goex.SELL, Amount: 1, TrailRatio: 0.05})
+	stop, _ := cm.Add(ConditionalOrder{Kind: TRIGGER_STOP_LOSS, Side: goex.SELL, Amount: 1, TriggerPrice: 50})
+	cm.Update(context.Background(), lastTicker(120))
+
+	// A restart keeps the high-water mark and carries on numbering.
+	cm, err = NewConditionalManager(NewSpotFeed(nil, spotPair), closer, store, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order, _ := cm.Get(trailing); order.Extreme != 120 || order.Status != CONDITIONAL_ACTIVE {
+		t.Fatalf("trailing stop not restored %+v", order)
+	}
+	if id, _ := cm.Add(ConditionalOrder{Kind: TRIGGER_TAKE_PROFIT, Side: goex.SELL, Amount: 1, TriggerPrice: 200}); id == trailing || id == stop {
+		t.Fatalf("id %s reused", id)
+	}
+	cm.Update(context.Background(), lastTicker(114))
+	if order, _ := cm.Get(trailing); order.Status != CONDITIONAL_FILLED || len(closer.sides) != 1 {
+		t.Fatalf("trailing stop did not fire after restart %+v", order)
+	}
+
+	// An order caught between trigger and fill is not closed again.
+	orders, _ := store.Load()
+	orders[1].Status = CONDITIONAL_TRIGGERED
+	store.Save(orders)
+	cm, err = NewConditionalManager(NewSpotFeed(nil, spotPair), closer, store, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.Update(context.Background(), lastTicker(10))
+	if order, _ := cm.Get(stop); order.Status != CONDITIONAL_FAILED || len(closer.sides) != 1 {
+		t.Fatalf("interrupted order handled wrong %+v, closes %d", order, len(closer.sides))
+	}
+}
+
+func TestFutureCloser_Ctx(t *testing.T) {
+	ex, _ := newMockFuture()
+	var cfg = DefaultFutureConfig()
+	cfg.RetryDelay = time.Minute
+	mgr, err := NewFutureTradeManagerWithConfig(ex.Future(), futurePair, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mgr.OpenLong(101, 2); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for len(ex.OpenOrders()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	rep, err := NewFutureCloser(mgr).Close(ctx, goex.SELL, 2, 120) //卖价高于买一, 挂着不成交
+	if !errors.Is(err, context.Canceled) || rep == nil || rep.Filled != 0 {
+		t.Fatalf("want the close stopped unfilled, got %+v, %v", rep, err)
+	}
+	if open := ex.OpenOrders(); len(open) != 0 {
+		t.Fatalf("orders left open %v", open)
+	}
+	if pos, _ := mgr.GetPosition(goex.OPEN_BUY); pos == nil || pos.Amount != 2 {
+		t.Fatalf("position touched %+v", pos)
+	}
+}
@@ -0,0 +1,425 @@
+package trade
+
+import (
+	"context"
+	"fmt"
+	"github.com/beaquant/utils"
+	"github.com/nntaoli-project/GoEx"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+const maxDot = 10 //价格/数量小数精度上限
+
+type SpotConfig struct {
+	OpMode      OpMode           //下单方式:吃单|挂单|挂单等待|冰山|只做maker|IOC|FOK
+	MaxSpace    float64          //挂单失效距离
+	SlidePrice  float64          //下单滑动价
+	MaxAmount   float64          //开仓最大单次下单量
+	MinStocks   float64          //最小交易数量
+	RetryDelay  time.Duration    //失败重试
+	WaitMake    time.Duration    //挂单等待时间(OPMODE_MAKE_WAIT)
+	Logger      *logrus.Logger   //logger
+	PriceDot    int              //价格小数精度
+	AmountDot   int              //数量小数精度
+	WaitFrozen  bool             //下单前等待冻结资金解冻
+	FillMode    FillMode         //成交统计方式
+	Instruments InstrumentSource //交易规则(最小价格/数量变动), 为空时按小数精度推算
+	Fees        FeeModel         //手续费模型, 为空时使用交易所返回的手续费
+	Iceberg     Iceberg          //冰山单参数(OPMODE_ICEBERG)
+	PriceMode   PriceMode        //挂单定价方式
+	MaxSlippage float64          //吃单最多吃到开始时对手方最优价的该比例之外, 0为不限
+	DepthSize   int              //深度档数, 0为默认20档
+	Journal     Journal          //订单日志, 构建时据此恢复崩溃前的订单
+}
+
+type FutureConfig struct {
+	ContractType                    string           //合约类型
+	OpMode                          OpMode           //下单方式:吃单|挂单|冰山
+	SlidePrice                      float64          //下单滑动价
+	SlideGrowthRate                 float64          //下单滑动价增长率
+	OpenPositionSlideGrowthRateMax  float64          //开仓滑动价最大增长率
+	CoverPositionSlideGrowthRateMax float64          //平仓滑动价最大增长率
+	RetryDelay                      time.Duration    //失败重试
+	Logger                          *logrus.Logger   //logger
+	PriceDot                        int              //价格小数精度
+	AmountDot                       int              //数量小数精度
+	MarginLevel                     int              //杆杠大小
+	Instruments                     InstrumentSource //交易规则(最小价格/数量变动), 为空时按小数精度推算
+	Fees                            FeeModel         //手续费模型, 为空时使用交易所返回的手续费
+	Iceberg                         Iceberg          //冰山单参数(OPMODE_ICEBERG)
+	Journal                         Journal          //订单日志, 构建时据此恢复崩溃前的订单
+}
+
+// DefaultSpotConfig is a taker setup with a 500ms retry delay, two price
+// decimals and four amount decimals.
+func DefaultSpotConfig() SpotConfig {
+	return SpotConfig{
+		OpMode:     OPMODE_TAKE,
+		MaxAmount:  1,
+		MinStocks:  0.0001,
+		RetryDelay: 500 * time.Millisecond,
+		WaitMake:   5 * time.Second,
+		PriceDot:   2,
+		AmountDot:  4,
+	}
+}
+
+// DefaultFutureConfig is a taker setup on the quarterly contract with a
+// 500ms retry delay, two price decimals and whole contracts.
+func DefaultFutureConfig() FutureConfig {
+	return FutureConfig{
+		ContractType:                    goex.QUARTER_CONTRACT,
+		OpMode:                          OPMODE_TAKE,
+		SlideGrowthRate:                 0.01,
+		OpenPositionSlideGrowthRateMax:  0.05,
+		CoverPositionSlideGrowthRateMax: 0.05,
+		RetryDelay:                      500 * time.Millisecond,
+		PriceDot:                        2,
+		AmountDot:                       0,
+	}
+}
+
+// Option tweaks a SpotConfig or FutureConfig. Options that only make sense
+// for one kind of manager are ignored by the other.
+type Option interface {
+	applySpot(cfg *SpotConfig)
+	applyFuture(cfg *FutureConfig)
+}
+
+type option struct {
+	spot   func(cfg *SpotConfig)
+	future func(cfg *FutureConfig)
+}
+
+func (o option) applySpot(cfg *SpotConfig) {
+	if o.spot != nil {
+		o.spot(cfg)
+	}
+}
+
+func (o option) applyFuture(cfg *FutureConfig) {
+	if o.future != nil {
+		o.future(cfg)
+	}
+}
+
+func WithOpMode(opMode OpMode) Option {
+	return option{
+		spot:   func(cfg *SpotConfig) { cfg.OpMode = opMode },
+		future: func(cfg *FutureConfig) { cfg.OpMode = opMode },
+	}
+}
+
+func WithSlidePrice(slidePrice float64) Option {
+	return option{
+		spot:   func(cfg *SpotConfig) { cfg.SlidePrice = slidePrice },
+		future: func(cfg *FutureConfig) { cfg.SlidePrice = slidePrice },
+	}
+}
+
+// WithMaxSpace only applies to spot managers.
+func WithMaxSpace(maxSpace float64) Option {
+	return option{spot: func(cfg *SpotConfig) { cfg.MaxSpace = maxSpace }}
+}
+
+// WithAmountLimits sets the largest single order and the smallest tradable
+// amount. It only applies to spot managers.
+func WithAmountLimits(maxAmount, minStocks float64) Option {
+	return option{spot: func(cfg *SpotConfig) {
+		cfg.MaxAmount = maxAmount
+		cfg.MinStocks = minStocks
+	}}
+}
+
+func WithRetryDelay(delay time.Duration) Option {
+	return option{
+		spot:   func(cfg *SpotConfig) { cfg.RetryDelay = delay },
+		future: func(cfg *FutureConfig) { cfg.RetryDelay = delay },
+	}
+}
+
+func WithPrecision(priceDot, amountDot int) Option {
+	return option{
+		spot: func(cfg *SpotConfig) {
+			cfg.PriceDot = priceDot
+			cfg.AmountDot = amountDot
+		},
+		future: func(cfg *FutureConfig) {
+			cfg.PriceDot = priceDot
+			cfg.AmountDot = amountDot
+		},
+	}
+}
+
+func WithLogger(logger *logrus.Logger) Option {
+	return option{
+		spot:   func(cfg *SpotConfig) { cfg.Logger = logger },
+		future: func(cfg *FutureConfig) { cfg.Logger = logger },
+	}
+}
+
+// WithSlideGrowth sets how fast the slide price grows between retries and
+// where opening and closing give up. It only applies to futures managers.
+func WithSlideGrowth(rate, openMax, coverMax float64) Option {
+	return option{future: func(cfg *FutureConfig) {
+		cfg.SlideGrowthRate = rate
+		cfg.OpenPositionSlideGrowthRateMax = openMax
+		cfg.CoverPositionSlideGrowthRateMax = coverMax
+	}}
+}
+
+// WithMarginLevel only applies to futures managers.
+func WithMarginLevel(marginLevel int) Option {
+	return option{future: func(cfg *FutureConfig) { cfg.MarginLevel = marginLevel }}
+}
+
+// WithFillMode only applies to spot managers.
+func WithFillMode(mode FillMode) Option {
+	return option{spot: func(cfg *SpotConfig) { cfg.FillMode = mode }}
+}
+
+// WithInstruments makes the manager round prices to tick multiples and
+// amounts to lot multiples of the instrument returned by source, instead of
+// the configured decimals. Wrap slow sources in an InstrumentCache.
+func WithInstruments(source InstrumentSource) Option {
+	return option{
+		spot:   func(cfg *SpotConfig) { cfg.Instruments = source },
+		future: func(cfg *FutureConfig) { cfg.Instruments = source },
+	}
+}
+
+// WithFees makes the manager work out fees from model, so reports carry net
+// prices and futures Profit is net of commission.
+func WithFees(model FeeModel) Option {
+	return option{
+		spot:   func(cfg *SpotConfig) { cfg.Fees = model },
+		future: func(cfg *FutureConfig) { cfg.Fees = model },
+	}
+}
+
+// WithIceberg switches the manager to OPMODE_ICEBERG with the given slice
+// settings.
+func WithIceberg(ice Iceberg) Option {
+	return option{
+		spot: func(cfg *SpotConfig) {
+			cfg.OpMode = OPMODE_ICEBERG
+			cfg.Iceberg = ice
+		},
+		future: func(cfg *FutureConfig) {
+			cfg.OpMode = OPMODE_ICEBERG
+			cfg.Iceberg = ice
+		},
+	}
+}
+
+// WithDepthPricing makes the manager read the order book: resting orders are
+// placed as mode says, and taking orders are limited to the levels within
+// maxSlippage (a fraction of the best price when the request started, 0 for
+// no limit), waiting for the book to refill when none are left. It only
+// applies to spot managers.
+func WithDepthPricing(mode PriceMode, maxSlippage float64) Option {
+	return option{spot: func(cfg *SpotConfig) {
+		cfg.PriceMode = mode
+		cfg.MaxSlippage = maxSlippage
+	}}
+}
+
+// WithJournal records every request, order, fill and cancel of the manager
+// in journal. The config constructors then start by reconciling what the
+// journal says was still open with the exchange, see Recover. A request
+// stops placing orders, and returns the error, once the journal fails.
+func WithJournal(journal Journal) Option {
+	return option{
+		spot:   func(cfg *SpotConfig) { cfg.Journal = journal },
+		future: func(cfg *FutureConfig) { cfg.Journal = journal },
+	}
+}
+
+func (cfg *SpotConfig) Validate() error {
+	if err := validOpMode(cfg.OpMode, cfg.Iceberg); err != nil {
+		return err
+	}
+	switch {
+	case cfg.SlidePrice < 0:
+		return fmt.Errorf("%w: negative slidePrice %f", ErrInvalidConfig, cfg.SlidePrice)
+	case cfg.MaxSpace < 0:
+		return fmt.Errorf("%w: negative maxSpace %f", ErrInvalidConfig, cfg.MaxSpace)
+	case cfg.MaxAmount <= 0:
+		return fmt.Errorf("%w: maxAmount %f must be positive", ErrInvalidConfig, cfg.MaxAmount)
+	case cfg.MinStocks < 0 || cfg.MinStocks > cfg.MaxAmount:
+		return fmt.Errorf("%w: minStocks %f outside [0, maxAmount]", ErrInvalidConfig, cfg.MinStocks)
+	case cfg.RetryDelay < time.Millisecond:
+		return fmt.Errorf("%w: retryDelay %v below 1ms", ErrInvalidConfig, cfg.RetryDelay)
+	case cfg.WaitMake < 0:
+		return fmt.Errorf("%w: negative waitMake %v", ErrInvalidConfig, cfg.WaitMake)
+	case cfg.FillMode.String() == "UNKNOWN":
+		return fmt.Errorf("%w: fillMode %d", ErrInvalidConfig, cfg.FillMode)
+	case cfg.PriceMode.String() == "UNKNOWN":
+		return fmt.Errorf("%w: priceMode %d", ErrInvalidConfig, cfg.PriceMode)
+	case cfg.MaxSlippage < 0 || cfg.DepthSize < 0:
+		return fmt.Errorf("%w: negative maxSlippage or depthSize", ErrInvalidConfig)
+	}
+	return validDots(cfg.PriceDot, cfg.AmountDot)
+}
+
+func (cfg *FutureConfig) Validate() error {
+	if err := validOpMode(cfg.OpMode, cfg.Iceberg); err != nil {
+		return err
+	}
+	switch {
+	case cfg.OpMode == OPMODE_POST_ONLY || immediate(cfg.OpMode):
+		return fmt.Errorf("%w: %s only applies to spot managers", ErrInvalidConfig, cfg.OpMode)
+	case cfg.SlidePrice < 0:
+		return fmt.Errorf("%w: negative slidePrice %f", ErrInvalidConfig, cfg.SlidePrice)
+	case cfg.SlideGrowthRate < 0 || cfg.OpenPositionSlideGrowthRateMax < 0 || cfg.CoverPositionSlideGrowthRateMax < 0:
+		return fmt.Errorf("%w: negative slide growth", ErrInvalidConfig)
+	case cfg.RetryDelay < time.Millisecond:
+		return fmt.Errorf("%w: retryDelay %v below 1ms", ErrInvalidConfig, cfg.RetryDelay)
+	case cfg.MarginLevel < 0:
+		return fmt.Errorf("%w: negative marginLevel %d", ErrInvalidConfig, cfg.MarginLevel)
+	}
+	return validDots(cfg.PriceDot, cfg.AmountDot)
+}
+
+func validOpMode(opMode OpMode, ice Iceberg) error {
+	if opMode.String() == "UNKNOWN" {
+		return fmt.Errorf("%w: opMode %d", ErrInvalidConfig, opMode)
+	}
+	if err := ice.Validate(); err != nil {
+		return err
+	}
+	if opMode == OPMODE_ICEBERG && ice.Visible <= 0 {
+		return fmt.Errorf("%w: OPMODE_ICEBERG needs a positive visible amount", ErrInvalidConfig)
+	}
+	return nil
+}
+
+func validDots(priceDot, amountDot int) error {
+	if priceDot < 0 || priceDot > maxDot {
+		return fmt.Errorf("%w: priceDot %d outside [0, %d]", ErrInvalidConfig, priceDot, maxDot)
+	}
+	if amountDot < 0 || amountDot > maxDot {
+		return fmt.Errorf("%w: amountDot %d outside [0, %d]", ErrInvalidConfig, amountDot, maxDot)
+	}
+	return nil
+}
+
+// NewSpotTradeManagerWithConfig applies opts on top of cfg, validates the
+// result and builds the manager. With a journal, orders a previous run left
+// open are cancelled and the interrupted requests closed out before the
+// manager is returned; see Recovered for what was found.
+func NewSpotTradeManagerWithConfig(exchange goex.API, pair goex.CurrencyPair, cfg SpotConfig, opts ...Option) (*SpotTradeManager, error) {
+	if exchange == nil {
+		return nil, fmt.Errorf("%w: nil exchange", ErrInvalidConfig)
+	}
+	for _, opt := range opts {
+		opt.applySpot(&cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	var mgr = newSpotTradeManager(exchange, pair, cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), recoverTimeout)
+	defer cancel()
+	if _, err := mgr.Recover(ctx); err != nil {
+		return nil, fmt.Errorf("recover journal: %w", err)
+	}
+	return mgr, nil
+}
+
+// NewFutureTradeManagerWithConfig applies opts on top of cfg, validates the
+// result and builds the manager, recovering from the journal as
+// NewSpotTradeManagerWithConfig does.
+func NewFutureTradeManagerWithConfig(exchange goex.FutureRestAPI, pair goex.CurrencyPair, cfg FutureConfig, opts ...Option) (*FutureTradeManager, error) {
+	if exchange == nil {
+		return nil, fmt.Errorf("%w: nil exchange", ErrInvalidConfig)
+	}
+	for _, opt := range opts {
+		opt.applyFuture(&cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	mgr, err := newFutureTradeManager(exchange, pair, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("get initial account: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), recoverTimeout)
+	defer cancel()
+	if _, err := mgr.Recover(ctx); err != nil {
+		return nil, fmt.Errorf("recover journal: %w", err)
+	}
+	return mgr, nil
+}
+
+func newSpotTradeManager(exchange goex.API, pair goex.CurrencyPair, cfg SpotConfig) *SpotTradeManager {
+	if cfg.Logger == nil {
+		cfg.Logger = logrus.New()
+	}
+	utils.SetDelay(int(cfg.RetryDelay / time.Millisecond))
+	return &SpotTradeManager{
+		exchange:     exchange,
+		pair:         pair,
+		opMode:       cfg.OpMode,
+		maxAmount:    cfg.MaxAmount,
+		maxSpace:     cfg.MaxSpace,
+		slidePrice:   cfg.SlidePrice,
+		minStocks:    cfg.MinStocks,
+		retryDelayMs: cfg.RetryDelay,
+		waitMakeMs:   int(cfg.WaitMake / time.Millisecond),
+		logger:       cfg.Logger,
+		priceDot:     cfg.PriceDot,
+		amountDot:    cfg.AmountDot,
+		waitFrozen:   cfg.WaitFrozen,
+		instruments:  cfg.Instruments,
+		fillMode:     cfg.FillMode,
+		fees:         cfg.Fees,
+		iceberg:      cfg.Iceberg,
+		priceMode:    cfg.PriceMode,
+		maxSlippage:  cfg.MaxSlippage,
+		depthLevels:  cfg.DepthSize,
+		journal:      cfg.Journal,
+	}
+}
+
+func newFutureTradeManager(exchange goex.FutureRestAPI, pair goex.CurrencyPair, cfg FutureConfig) (*FutureTradeManager, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = logrus.New()
+	}
+	utils.SetDelay(int(cfg.RetryDelay / time.Millisecond))
+	mgr := &FutureTradeManager{
+		exchange:                        exchange,
+		pair:                            pair,
+		contractType:                    cfg.ContractType,
+		initAccount:                     nil,
+		opMode:                          cfg.OpMode,
+		slidePrice:                      cfg.SlidePrice,
+		slideGrowthRate:                 cfg.SlideGrowthRate,
+		openPositionSlideGrowthRateMax:  cfg.OpenPositionSlideGrowthRateMax,
+		coverPositionSlideGrowthRateMax: cfg.CoverPositionSlideGrowthRateMax,
+		retryDelayMs:                    cfg.RetryDelay,
+		logger:                          cfg.Logger,
+		priceDot:                        cfg.PriceDot,
+		amountDot:                       cfg.AmountDot,
+		marginLevel:                     cfg.MarginLevel,
+		instruments:                     cfg.Instruments,
+		fees:                            cfg.Fees,
+		iceberg:                         cfg.Iceberg,
+		journal:                         cfg.Journal,
+	}
+	var timeout = time.Duration(accountRetries) * cfg.RetryDelay
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var err error
+	mgr.initAccount, err = mgr.GetAccountCtx(ctx)
+	return mgr, err
+}
+
+// accountRetries bounds, in retry delays (at least a second in all), how
+// long the constructors retry the initial account read, so one transient
+// error does not leave a manager without it.
+const accountRetries = 10
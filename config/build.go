@@ -0,0 +1,215 @@
+package config
+
+import (
+	"fmt"
+	"github.com/goex-top/goex_trade"
+	"github.com/nntaoli-project/GoEx"
+	"github.com/nntaoli-project/GoEx/builder"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Credentials are the secrets read from the environment for one exchange.
+type Credentials struct {
+	APIKey    string
+	SecretKey string
+}
+
+// Factory turns an exchange entry into goex clients. DefaultFactory uses the
+// goex builder; tests can substitute their own.
+type Factory interface {
+	Spot(ex Exchange, creds Credentials) (goex.API, error)
+	Future(ex Exchange, creds Credentials) (goex.FutureRestAPI, error)
+}
+
+type builderFactory struct{}
+
+var DefaultFactory Factory = builderFactory{}
+
+func (builderFactory) Spot(ex Exchange, creds Credentials) (goex.API, error) {
+	client, err := httpClient(ex)
+	if err != nil {
+		return nil, err
+	}
+	var api = builder.NewCustomAPIBuilder(client).APIKey(creds.APIKey).APISecretkey(creds.SecretKey).Build(ex.Exchange)
+	if api == nil {
+		return nil, fmt.Errorf("config: goex has no spot API for %s", ex.Exchange)
+	}
+	return api, nil
+}
+
+func (builderFactory) Future(ex Exchange, creds Credentials) (goex.FutureRestAPI, error) {
+	client, err := httpClient(ex)
+	if err != nil {
+		return nil, err
+	}
+	var api = builder.NewCustomAPIBuilder(client).APIKey(creds.APIKey).APISecretkey(creds.SecretKey).FutureBuild(ex.Exchange)
+	if api == nil {
+		return nil, fmt.Errorf("config: goex has no futures API for %s", ex.Exchange)
+	}
+	return api, nil
+}
+
+func httpClient(ex Exchange) (*http.Client, error) {
+	var timeout = time.Duration(ex.Timeout)
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	var transport = &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout: timeout,
+		}).Dial,
+	}
+	if ex.Proxy != "" {
+		proxy, err := url.Parse(ex.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("config: exchange %s proxy: %v", ex.Name, err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// Credentials reads the secrets of ex from the environment. A variable that
+// is named but unset is an error; an exchange naming none gets empty
+// credentials, enough for market data.
+func (ex Exchange) Credentials() (Credentials, error) {
+	var creds Credentials
+	var err error
+	if creds.APIKey, err = env(ex.APIKeyEnv); err != nil {
+		return creds, err
+	}
+	creds.SecretKey, err = env(ex.SecretKeyEnv)
+	return creds, err
+}
+
+func env(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	v, ok := os.LookupEnv(name)
+	if !ok || v == "" {
+		return "", fmt.Errorf("config: environment variable %s is not set", name)
+	}
+	return v, nil
+}
+
+type SpotBot struct {
+	Name     string
+	Exchange goex.API
+	Pair     goex.CurrencyPair
+	Manager  *trade.SpotTradeManager
+	Risk     Risk
+	Gate     *trade.RiskGate           //Risk有限制时的风控, 否则为nil
+	Trader   trade.SpotTradeManagerAPI //下单入口: 有风控时为经Gate检查的Manager, 否则即Manager
+}
+
+type FutureBot struct {
+	Name     string
+	Exchange goex.FutureRestAPI
+	Pair     goex.CurrencyPair
+	Manager  *trade.FutureTradeManager
+	Risk     Risk
+	Gate     *trade.RiskGate             //Risk有限制时的风控, 否则为nil
+	Trader   trade.FutureTradeManagerAPI //下单入口: 有风控时为经Gate检查的Manager, 否则即Manager
+}
+
+type Bots struct {
+	Spot    []*SpotBot
+	Futures []*FutureBot
+}
+
+// Build creates every manager of cfg with DefaultFactory.
+func (cfg *Config) Build(logger *logrus.Logger) (*Bots, error) {
+	return cfg.BuildWith(DefaultFactory, logger)
+}
+
+// BuildWith creates every manager of cfg, sharing one client per exchange
+// entry and, when set, one journal. Bots with risk limits get a RiskGate of
+// their own, and their Trader goes through it.
+func (cfg *Config) BuildWith(factory Factory, logger *logrus.Logger) (*Bots, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	var exchanges = make(map[string]Exchange, len(cfg.Exchanges))
+	for _, ex := range cfg.Exchanges {
+		exchanges[ex.Name] = ex
+	}
+	var spots = make(map[string]goex.API)
+	var futures = make(map[string]goex.FutureRestAPI)
+	var bots = new(Bots)
+	var opts = []trade.Option{trade.WithLogger(logger)}
+	if cfg.Journal != "" {
+		opts = append(opts, trade.WithJournal(trade.NewJournalFile(cfg.Journal)))
+	}
+
+	for _, s := range cfg.Spot {
+		api, ok := spots[s.Exchange]
+		if !ok {
+			var ex = exchanges[s.Exchange]
+			creds, err := ex.Credentials()
+			if err != nil {
+				return nil, err
+			}
+			if api, err = factory.Spot(ex, creds); err != nil {
+				return nil, err
+			}
+			spots[s.Exchange] = api
+		}
+		var pair = goex.NewCurrencyPair2(s.Pair)
+		mgr, err := trade.NewSpotTradeManagerWithConfig(api, pair, s.config(), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("config: spot %s %s: %w", s.Exchange, s.Pair, err)
+		}
+		var name = s.Name
+		if name == "" {
+			name = s.Exchange + ":" + s.Pair
+		}
+		var bot = &SpotBot{Name: name, Exchange: api, Pair: pair, Manager: mgr, Risk: s.Risk, Trader: mgr}
+		if s.Risk != (Risk{}) {
+			if bot.Gate, err = trade.NewRiskGate(s.Risk.limits(), logger); err != nil {
+				return nil, fmt.Errorf("config: spot %s %s risk: %w", s.Exchange, s.Pair, err)
+			}
+			bot.Trader = trade.NewRiskSpot(mgr, pair, trade.NewSpotFeed(api, pair), bot.Gate)
+		}
+		bots.Spot = append(bots.Spot, bot)
+	}
+
+	for _, f := range cfg.Futures {
+		api, ok := futures[f.Exchange]
+		if !ok {
+			var ex = exchanges[f.Exchange]
+			creds, err := ex.Credentials()
+			if err != nil {
+				return nil, err
+			}
+			if api, err = factory.Future(ex, creds); err != nil {
+				return nil, err
+			}
+			futures[f.Exchange] = api
+		}
+		var pair = goex.NewCurrencyPair2(f.Pair)
+		mgr, err := trade.NewFutureTradeManagerWithConfig(api, pair, f.config(), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("config: future %s %s: %w", f.Exchange, f.Pair, err)
+		}
+		var contractType = f.config().ContractType
+		var name = f.Name
+		if name == "" {
+			name = f.Exchange + ":" + f.Pair + ":" + contractType
+		}
+		var bot = &FutureBot{Name: name, Exchange: api, Pair: pair, Manager: mgr, Risk: f.Risk, Trader: mgr}
+		if f.Risk != (Risk{}) {
+			if bot.Gate, err = trade.NewRiskGate(f.Risk.limits(), logger); err != nil {
+				return nil, fmt.Errorf("config: future %s %s risk: %w", f.Exchange, f.Pair, err)
+			}
+			bot.Trader = trade.NewRiskFuture(mgr, pair, f.ContractValue, trade.NewFutureFeed(api, pair, contractType), bot.Gate)
+		}
+		bots.Futures = append(bots.Futures, bot)
+	}
+	return bots, nil
+}
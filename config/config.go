@@ -0,0 +1,260 @@
+// Package config loads trade manager setups from YAML, JSON or TOML files.
+//
+// API keys never live in the file: each exchange names the environment
+// variables holding its credentials, which are read when the managers are
+// built.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/goex-top/goex_trade"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Format int
+
+const (
+	YAML Format = iota
+	JSON
+	TOML
+)
+
+type Config struct {
+	Exchanges []Exchange `json:"exchanges" yaml:"exchanges" toml:"exchanges"`
+	Spot      []Spot     `json:"spot" yaml:"spot" toml:"spot"`
+	Futures   []Future   `json:"futures" yaml:"futures" toml:"futures"`
+	Journal   string     `json:"journal" yaml:"journal" toml:"journal"` //订单日志文件, 所有管理器共用, 为空不记录
+}
+
+// Exchange describes how to reach one exchange account.
+type Exchange struct {
+	Name         string   `json:"name" yaml:"name" toml:"name"`                               //引用名
+	Exchange     string   `json:"exchange" yaml:"exchange" toml:"exchange"`                   //goex 交易所名, 如 binance.com
+	APIKeyEnv    string   `json:"api_key_env" yaml:"api_key_env" toml:"api_key_env"`          //存放 API key 的环境变量
+	SecretKeyEnv string   `json:"secret_key_env" yaml:"secret_key_env" toml:"secret_key_env"` //存放 secret 的环境变量
+	Proxy        string   `json:"proxy" yaml:"proxy" toml:"proxy"`                            //如 socks5://127.0.0.1:1080
+	Timeout      Duration `json:"timeout" yaml:"timeout" toml:"timeout"`
+}
+
+// Risk holds per-bot risk limits, see trade.RiskLimits. Zero disables a
+// limit; a bot with any limit set trades through its own trade.RiskGate.
+type Risk struct {
+	MaxNotional        float64 `json:"max_order_notional" yaml:"max_order_notional" toml:"max_order_notional"`
+	MaxPosition        float64 `json:"max_position" yaml:"max_position" toml:"max_position"`
+	MaxDailyLoss       float64 `json:"max_daily_loss" yaml:"max_daily_loss" toml:"max_daily_loss"`
+	MaxOrdersPerMinute int     `json:"max_orders_per_minute" yaml:"max_orders_per_minute" toml:"max_orders_per_minute"`
+	PriceCollar        float64 `json:"price_collar" yaml:"price_collar" toml:"price_collar"`
+}
+
+// Iceberg holds the slice settings of op_mode iceberg.
+type Iceberg struct {
+	Visible       float64  `json:"visible" yaml:"visible" toml:"visible"`
+	Variance      float64  `json:"variance" yaml:"variance" toml:"variance"`
+	RefreshDelay  Duration `json:"refresh_delay" yaml:"refresh_delay" toml:"refresh_delay"`
+	RefreshJitter Duration `json:"refresh_jitter" yaml:"refresh_jitter" toml:"refresh_jitter"`
+}
+
+func (r Risk) limits() trade.RiskLimits {
+	return trade.RiskLimits{
+		MaxNotional:        r.MaxNotional,
+		MaxPosition:        r.MaxPosition,
+		MaxDailyLoss:       r.MaxDailyLoss,
+		MaxOrdersPerMinute: r.MaxOrdersPerMinute,
+		PriceCollar:        r.PriceCollar,
+	}
+}
+
+func (ice Iceberg) config() trade.Iceberg {
+	return trade.Iceberg{
+		Visible:       ice.Visible,
+		Variance:      ice.Variance,
+		RefreshDelay:  time.Duration(ice.RefreshDelay),
+		RefreshJitter: time.Duration(ice.RefreshJitter),
+	}
+}
+
+// Spot describes one SpotTradeManager. Fields left out keep the value of
+// trade.DefaultSpotConfig, except precisions, slide and max space, which
+// default to 0.
+type Spot struct {
+	Name            string   `json:"name" yaml:"name" toml:"name"`
+	Exchange        string   `json:"exchange" yaml:"exchange" toml:"exchange"`
+	Pair            string   `json:"pair" yaml:"pair" toml:"pair"`
+	OpMode          OpMode   `json:"op_mode" yaml:"op_mode" toml:"op_mode"`
+	MaxSpace        float64  `json:"max_space" yaml:"max_space" toml:"max_space"`
+	SlidePrice      float64  `json:"slide_price" yaml:"slide_price" toml:"slide_price"`
+	MaxAmount       float64  `json:"max_amount" yaml:"max_amount" toml:"max_amount"`
+	MinStocks       float64  `json:"min_stocks" yaml:"min_stocks" toml:"min_stocks"`
+	RetryDelay      Duration `json:"retry_delay" yaml:"retry_delay" toml:"retry_delay"`
+	WaitMake        Duration `json:"wait_make" yaml:"wait_make" toml:"wait_make"`
+	PriceDot        int      `json:"price_dot" yaml:"price_dot" toml:"price_dot"`
+	AmountDot       int      `json:"amount_dot" yaml:"amount_dot" toml:"amount_dot"`
+	WaitFrozen      bool     `json:"wait_frozen" yaml:"wait_frozen" toml:"wait_frozen"`
+	FillFromBalance bool     `json:"fill_from_balance" yaml:"fill_from_balance" toml:"fill_from_balance"`
+	Iceberg         Iceberg  `json:"iceberg" yaml:"iceberg" toml:"iceberg"`
+	Risk            Risk     `json:"risk" yaml:"risk" toml:"risk"`
+}
+
+// Future describes one FutureTradeManager. Fields left out keep the value of
+// trade.DefaultFutureConfig, except precisions, slide and margin level,
+// which default to 0.
+type Future struct {
+	Name                            string   `json:"name" yaml:"name" toml:"name"`
+	Exchange                        string   `json:"exchange" yaml:"exchange" toml:"exchange"`
+	Pair                            string   `json:"pair" yaml:"pair" toml:"pair"`
+	ContractType                    string   `json:"contract_type" yaml:"contract_type" toml:"contract_type"`
+	OpMode                          OpMode   `json:"op_mode" yaml:"op_mode" toml:"op_mode"`
+	SlidePrice                      float64  `json:"slide_price" yaml:"slide_price" toml:"slide_price"`
+	SlideGrowthRate                 float64  `json:"slide_growth_rate" yaml:"slide_growth_rate" toml:"slide_growth_rate"`
+	OpenPositionSlideGrowthRateMax  float64  `json:"open_slide_growth_rate_max" yaml:"open_slide_growth_rate_max" toml:"open_slide_growth_rate_max"`
+	CoverPositionSlideGrowthRateMax float64  `json:"cover_slide_growth_rate_max" yaml:"cover_slide_growth_rate_max" toml:"cover_slide_growth_rate_max"`
+	RetryDelay                      Duration `json:"retry_delay" yaml:"retry_delay" toml:"retry_delay"`
+	PriceDot                        int      `json:"price_dot" yaml:"price_dot" toml:"price_dot"`
+	AmountDot                       int      `json:"amount_dot" yaml:"amount_dot" toml:"amount_dot"`
+	MarginLevel                     int      `json:"margin_level" yaml:"margin_level" toml:"margin_level"`
+	Iceberg                         Iceberg  `json:"iceberg" yaml:"iceberg" toml:"iceberg"`
+	Risk                            Risk     `json:"risk" yaml:"risk" toml:"risk"`
+	ContractValue                   float64  `json:"contract_value" yaml:"contract_value" toml:"contract_value"` //每张合约价值, 风控算名义价值用, 默认1
+}
+
+// Load reads the file at path, picking the format from its extension.
+func Load(path string) (*Config, error) {
+	var format Format
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = YAML
+	case ".json":
+		format = JSON
+	case ".toml":
+		format = TOML
+	default:
+		return nil, fmt.Errorf("config: unknown file type %s", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data, format)
+}
+
+func Parse(data []byte, format Format) (*Config, error) {
+	var cfg = new(Config)
+	var err error
+	switch format {
+	case YAML:
+		err = yaml.UnmarshalStrict(data, cfg)
+	case JSON:
+		var dec = json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	case TOML:
+		_, err = toml.Decode(string(data), cfg)
+	default:
+		err = fmt.Errorf("unknown format %d", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate checks that every manager refers to a declared exchange and a
+// well formed pair. Manager parameters are checked when building.
+func (cfg *Config) Validate() error {
+	var names = make(map[string]bool, len(cfg.Exchanges))
+	for _, ex := range cfg.Exchanges {
+		if ex.Name == "" || ex.Exchange == "" {
+			return fmt.Errorf("config: exchange needs both name and exchange: %+v", ex)
+		}
+		if names[ex.Name] {
+			return fmt.Errorf("config: duplicate exchange %s", ex.Name)
+		}
+		names[ex.Name] = true
+	}
+	for _, s := range cfg.Spot {
+		if err := checkRef(names, s.Exchange, s.Pair); err != nil {
+			return err
+		}
+	}
+	for _, f := range cfg.Futures {
+		if err := checkRef(names, f.Exchange, f.Pair); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkRef(names map[string]bool, exchange, pair string) error {
+	if !names[exchange] {
+		return fmt.Errorf("config: unknown exchange %q", exchange)
+	}
+	var parts = strings.Split(pair, "_")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("config: bad pair %q, want e.g. BTC_USDT", pair)
+	}
+	return nil
+}
+
+func (s *Spot) config() trade.SpotConfig {
+	var cfg = trade.DefaultSpotConfig()
+	if s.OpMode != 0 {
+		cfg.OpMode = trade.OpMode(s.OpMode)
+	}
+	cfg.MaxSpace = s.MaxSpace
+	cfg.SlidePrice = s.SlidePrice
+	if s.MaxAmount != 0 {
+		cfg.MaxAmount = s.MaxAmount
+	}
+	if s.MinStocks != 0 {
+		cfg.MinStocks = s.MinStocks
+	}
+	if s.RetryDelay != 0 {
+		cfg.RetryDelay = time.Duration(s.RetryDelay)
+	}
+	if s.WaitMake != 0 {
+		cfg.WaitMake = time.Duration(s.WaitMake)
+	}
+	cfg.PriceDot = s.PriceDot
+	cfg.AmountDot = s.AmountDot
+	cfg.WaitFrozen = s.WaitFrozen
+	if s.FillFromBalance {
+		cfg.FillMode = trade.FILLMODE_BALANCE
+	}
+	cfg.Iceberg = s.Iceberg.config()
+	return cfg
+}
+
+func (f *Future) config() trade.FutureConfig {
+	var cfg = trade.DefaultFutureConfig()
+	if f.ContractType != "" {
+		cfg.ContractType = f.ContractType
+	}
+	if f.OpMode != 0 {
+		cfg.OpMode = trade.OpMode(f.OpMode)
+	}
+	cfg.SlidePrice = f.SlidePrice
+	if f.SlideGrowthRate != 0 {
+		cfg.SlideGrowthRate = f.SlideGrowthRate
+	}
+	if f.OpenPositionSlideGrowthRateMax != 0 {
+		cfg.OpenPositionSlideGrowthRateMax = f.OpenPositionSlideGrowthRateMax
+	}
+	if f.CoverPositionSlideGrowthRateMax != 0 {
+		cfg.CoverPositionSlideGrowthRateMax = f.CoverPositionSlideGrowthRateMax
+	}
+	if f.RetryDelay != 0 {
+		cfg.RetryDelay = time.Duration(f.RetryDelay)
+	}
+	cfg.PriceDot = f.PriceDot
+	cfg.AmountDot = f.AmountDot
+	cfg.MarginLevel = f.MarginLevel
+	cfg.Iceberg = f.Iceberg.config()
+	return cfg
+}
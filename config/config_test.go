@@ -0,0 +1,178 @@
+package config
+
+import (
+	"errors"
+	"github.com/goex-top/goex_trade"
+	"github.com/goex-top/goex_trade/mockex"
+	"github.com/nntaoli-project/GoEx"
+	"strings"
+	"testing"
+	"time"
+)
+
+const yamlConfig = `
+exchanges:
+  - name: main
+    exchange: binance.com
+    api_key_env: TEST_TRADE_KEY
+    secret_key_env: TEST_TRADE_SECRET
+    proxy: socks5://127.0.0.1:1080
+spot:
+  - exchange: main
+    pair: BTC_USDT
+    op_mode: make
+    slide_price: 0.5
+    max_amount: 2
+    retry_delay: 200ms
+    price_dot: 2
+    amount_dot: 4
+    risk:
+      max_order_notional: 10000
+      max_orders_per_minute: 30
+futures:
+  - name: quarterly
+    exchange: main
+    pair: BTC_USD
+    contract_type: quarter
+    margin_level: 20
+    op_mode: iceberg
+    iceberg:
+      visible: 2
+      refresh_delay: 1s
+`
+
+const jsonConfig = `{
+  "exchanges": [{"name": "main", "exchange": "binance.com", "api_key_env": "TEST_TRADE_KEY", "secret_key_env": "TEST_TRADE_SECRET", "proxy": "socks5://127.0.0.1:1080"}],
+  "spot": [{"exchange": "main", "pair": "BTC_USDT", "op_mode": "OPMODE_MAKE", "slide_price": 0.5, "max_amount": 2, "retry_delay": "200ms",
+    "price_dot": 2, "amount_dot": 4, "risk": {"max_order_notional": 10000, "max_orders_per_minute": 30}}],
+  "futures": [{"name": "quarterly", "exchange": "main", "pair": "BTC_USD", "contract_type": "quarter", "margin_level": 20,
+    "op_mode": "iceberg", "iceberg": {"visible": 2, "refresh_delay": "1s"}}]
+}`
+
+const tomlConfig = `
+[[exchanges]]
+name = "main"
+exchange = "binance.com"
+api_key_env = "TEST_TRADE_KEY"
+secret_key_env = "TEST_TRADE_SECRET"
+proxy = "socks5://127.0.0.1:1080"
+
+[[spot]]
+exchange = "main"
+pair = "BTC_USDT"
+op_mode = "make"
+slide_price = 0.5
+max_amount = 2.0
+retry_delay = "200ms"
+price_dot = 2
+amount_dot = 4
+[spot.risk]
+max_order_notional = 10000.0
+max_orders_per_minute = 30
+
+[[futures]]
+name = "quarterly"
+exchange = "main"
+pair = "BTC_USD"
+contract_type = "quarter"
+margin_level = 20
+op_mode = "iceberg"
+[futures.iceberg]
+visible = 2.0
+refresh_delay = "1s"
+`
+
+type mockFactory struct {
+	ex    *mockex.Exchange
+	creds []Credentials
+}
+
+func (f *mockFactory) Spot(ex Exchange, creds Credentials) (goex.API, error) {
+	f.creds = append(f.creds, creds)
+	return f.ex.Spot(), nil
+}
+
+func (f *mockFactory) Future(ex Exchange, creds Credentials) (goex.FutureRestAPI, error) {
+	f.creds = append(f.creds, creds)
+	return f.ex.Future(), nil
+}
+
+func TestParse(t *testing.T) {
+	for format, data := range map[Format]string{YAML: yamlConfig, JSON: jsonConfig, TOML: tomlConfig} {
+		cfg, err := Parse([]byte(data), format)
+		if err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if len(cfg.Exchanges) != 1 || cfg.Exchanges[0].Proxy != "socks5://127.0.0.1:1080" {
+			t.Fatalf("format %d: unexpected exchanges %+v", format, cfg.Exchanges)
+		}
+		var s = cfg.Spot[0]
+		if s.OpMode != OpMode(trade.OPMODE_MAKE) || time.Duration(s.RetryDelay) != 200*time.Millisecond || s.Risk.MaxOrdersPerMinute != 30 {
+			t.Fatalf("format %d: unexpected spot %+v", format, s)
+		}
+		if f := cfg.Futures[0].config(); f.MarginLevel != 20 || f.ContractType != "quarter" ||
+			f.OpMode != trade.OPMODE_ICEBERG || f.Iceberg.Visible != 2 || f.Iceberg.RefreshDelay != time.Second {
+			t.Fatalf("format %d: unexpected future %+v", format, f)
+		}
+	}
+}
+
+func TestParseRejectsBadConfig(t *testing.T) {
+	var cases = []string{
+		"spot:\n  - exchange: nowhere\n    pair: BTC_USDT\n",
+		"exchanges:\n  - name: a\n    exchange: binance.com\nspot:\n  - exchange: a\n    pair: BTCUSDT\n",
+		"exchanges:\n  - name: a\n    exchange: binance.com\nspot:\n  - exchange: a\n    pair: BTC_USDT\n    op_mode: sometimes\n",
+		"exchanges:\n  - name: a\n    exchange: binance.com\n    api_key: inline-secret\n",
+	}
+	for _, data := range cases {
+		if _, err := Parse([]byte(data), YAML); err == nil {
+			t.Errorf("no error for %q", data)
+		}
+	}
+}
+
+func TestBuildWith(t *testing.T) {
+	cfg, err := Parse([]byte(yamlConfig), YAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var factory = &mockFactory{ex: mockex.New("mock")}
+	if _, err = cfg.BuildWith(factory, nil); err == nil || !strings.Contains(err.Error(), "TEST_TRADE_KEY") {
+		t.Fatalf("want missing env error, got %v", err)
+	}
+
+	t.Setenv("TEST_TRADE_KEY", "key")
+	t.Setenv("TEST_TRADE_SECRET", "secret")
+	bots, err := cfg.BuildWith(factory, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bots.Spot) != 1 || len(bots.Futures) != 1 {
+		t.Fatalf("unexpected bots %+v", bots)
+	}
+	if bots.Spot[0].Name != "main:BTC_USDT" || bots.Futures[0].Name != "quarterly" || bots.Spot[0].Risk.MaxNotional != 10000 {
+		t.Fatalf("unexpected bots %+v %+v", bots.Spot[0], bots.Futures[0])
+	}
+	if len(factory.creds) != 2 || factory.creds[0] != (Credentials{APIKey: "key", SecretKey: "secret"}) {
+		t.Fatalf("unexpected credentials %+v", factory.creds)
+	}
+	if bots.Spot[0].Gate == nil || bots.Futures[0].Gate != nil || bots.Futures[0].Trader != bots.Futures[0].Manager {
+		t.Fatalf("want a gate on the spot bot only, got %+v %+v", bots.Spot[0], bots.Futures[0])
+	}
+	factory.ex.Market(goex.BTC_USDT).SetTicker(99, 101)
+	var riskErr *trade.RiskError
+	if _, err = bots.Spot[0].Trader.Buy(200); !errors.As(err, &riskErr) || riskErr.Rule != trade.RISK_NOTIONAL {
+		t.Fatalf("want the configured notional limit enforced, got %v", err)
+	}
+
+	cfg.Spot[0].Risk.MaxPosition = -1
+	if _, err = cfg.BuildWith(factory, nil); !errors.Is(err, trade.ErrInvalidConfig) {
+		t.Fatalf("want ErrInvalidConfig for a negative limit, got %v", err)
+	}
+	cfg.Spot[0].Risk.MaxPosition = 0
+
+	cfg.Spot[0].SlidePrice = -1
+	if _, err = cfg.BuildWith(factory, nil); err == nil {
+		t.Fatal("invalid slide accepted")
+	}
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"github.com/goex-top/goex_trade"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written as a string such as "500ms".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// OpMode is a trade.OpMode written as "take", "make", "make_wait",
+// "iceberg", "post_only", "ioc" or "fok" (the OPMODE_ prefix and case are
+// optional).
+type OpMode trade.OpMode
+
+var opModes = map[string]trade.OpMode{
+	"TAKE":      trade.OPMODE_TAKE,
+	"MAKE":      trade.OPMODE_MAKE,
+	"MAKE_WAIT": trade.OPMODE_MAKE_WAIT,
+	"ICEBERG":   trade.OPMODE_ICEBERG,
+	"POST_ONLY": trade.OPMODE_POST_ONLY,
+	"IOC":       trade.OPMODE_IOC,
+	"FOK":       trade.OPMODE_FOK,
+}
+
+func (op *OpMode) UnmarshalText(text []byte) error {
+	var name = strings.TrimPrefix(strings.ToUpper(string(text)), "OPMODE_")
+	v, ok := opModes[name]
+	if !ok {
+		return fmt.Errorf("unknown op_mode %q", text)
+	}
+	*op = OpMode(v)
+	return nil
+}
+
+func (op *OpMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return op.UnmarshalText([]byte(s))
+}
+
+func (op OpMode) MarshalText() ([]byte, error) {
+	return []byte(strings.ToLower(strings.TrimPrefix(trade.OpMode(op).String(), "OPMODE_"))), nil
+}
@@ -0,0 +1,70 @@
+package trade
+
+import (
+	"errors"
+	"github.com/goex-top/goex_trade/mockex"
+	"github.com/nntaoli-project/GoEx"
+	"github.com/sirupsen/logrus"
+	"testing"
+	"time"
+)
+
+func TestNewSpotTradeManagerWithConfig(t *testing.T) {
+	var logger = logrus.New()
+	mgr, err := NewSpotTradeManagerWithConfig(mockex.New("mock").Spot(), spotPair, DefaultSpotConfig(),
+		WithOpMode(OPMODE_MAKE),
+		WithSlidePrice(0.1),
+		WithMaxSpace(2),
+		WithRetryDelay(10*time.Millisecond),
+		WithPrecision(3, 5),
+		WithLogger(logger),
+		WithMarginLevel(20), // futures only, ignored
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mgr.opMode != OPMODE_MAKE || mgr.slidePrice != 0.1 || mgr.maxSpace != 2 || mgr.retryDelayMs != 10*time.Millisecond ||
+		mgr.priceDot != 3 || mgr.amountDot != 5 || mgr.logger != logger {
+		t.Fatalf("options not applied: %+v", mgr)
+	}
+}
+
+func TestNewFutureTradeManagerWithConfig(t *testing.T) {
+	var ex = mockex.New("mock")
+	ex.SetMargin(goex.USD, 10)
+	mgr, err := NewFutureTradeManagerWithConfig(ex.Future(), futurePair, DefaultFutureConfig(),
+		WithMarginLevel(20),
+		WithSlideGrowth(0.02, 0.1, 0.2),
+		WithMaxSpace(2), // spot only, ignored
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mgr.marginLevel != 20 || mgr.slideGrowthRate != 0.02 || mgr.coverPositionSlideGrowthRateMax != 0.2 || mgr.initAccount.Balance != 10 {
+		t.Fatalf("options not applied: %+v", mgr)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	var spot = mockex.New("mock").Spot()
+	var cases = []Option{
+		WithSlidePrice(-1),
+		WithRetryDelay(0),
+		WithPrecision(2, 11),
+		WithPrecision(-1, 2),
+		WithOpMode(0),
+		WithAmountLimits(1, 2),
+		WithMaxSpace(-0.5),
+	}
+	for _, opt := range cases {
+		if _, err := NewSpotTradeManagerWithConfig(spot, spotPair, DefaultSpotConfig(), opt); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("want ErrInvalidConfig, got %v", err)
+		}
+	}
+	if _, err := NewFutureTradeManagerWithConfig(nil, futurePair, DefaultFutureConfig()); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("want ErrInvalidConfig for nil exchange, got %v", err)
+	}
+	if _, err := NewFutureTradeManagerWithConfig(mockex.New("mock").Future(), futurePair, DefaultFutureConfig(), WithSlideGrowth(-0.1, 0, 0)); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("want ErrInvalidConfig for negative growth, got %v", err)
+	}
+}
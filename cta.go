@@ -1,5 +1,445 @@
 package trade
 
-func NewCTA() {
+import (
+	"context"
+	"fmt"
+	"github.com/beaquant/utils"
+	"github.com/nntaoli-project/GoEx"
+	"github.com/sirupsen/logrus"
+	"math"
+	"sync"
+	"time"
+)
 
+// Bar is one OHLCV candle.
+type Bar struct {
+	Pair  goex.CurrencyPair
+	Time  time.Time //开盘时间
+	Open  float64
+	High  float64
+	Low   float64
+	Close float64
+	Vol   float64
+}
+
+// Strategy receives market data from a CTA and steers it with SetTarget.
+type Strategy interface {
+	OnTick(cta *CTA, ticker *goex.Ticker)
+	OnBar(cta *CTA, bar *Bar)
+}
+
+// Feed is where a CTA gets its market data from.
+type Feed interface {
+	GetTicker() (*goex.Ticker, error)
+	GetKlineRecords(period, size int) ([]goex.Kline, error)
+}
+
+// Positioner moves a position towards the target set by a strategy. Positive
+// amounts are long, negative amounts short.
+type Positioner interface {
+	Position() (float64, error)
+	Target(ctx context.Context, target, price float64) error
+}
+
+type spotFeed struct {
+	exchange goex.API
+	pair     goex.CurrencyPair
+}
+
+func NewSpotFeed(exchange goex.API, pair goex.CurrencyPair) Feed {
+	return &spotFeed{exchange: exchange, pair: pair}
+}
+
+func (feed *spotFeed) GetTicker() (*goex.Ticker, error) {
+	return feed.exchange.GetTicker(feed.pair)
+}
+
+func (feed *spotFeed) GetKlineRecords(period, size int) ([]goex.Kline, error) {
+	return feed.exchange.GetKlineRecords(feed.pair, period, size, 0)
+}
+
+type futureFeed struct {
+	exchange     goex.FutureRestAPI
+	pair         goex.CurrencyPair
+	contractType string
+}
+
+func NewFutureFeed(exchange goex.FutureRestAPI, pair goex.CurrencyPair, contractType string) Feed {
+	return &futureFeed{exchange: exchange, pair: pair, contractType: contractType}
+}
+
+func (feed *futureFeed) GetTicker() (*goex.Ticker, error) {
+	return feed.exchange.GetFutureTicker(feed.pair, feed.contractType)
+}
+
+func (feed *futureFeed) GetKlineRecords(period, size int) ([]goex.Kline, error) {
+	records, err := feed.exchange.GetKlineRecords(feed.contractType, feed.pair, period, size, 0)
+	if err != nil {
+		return nil, err
+	}
+	var klines = make([]goex.Kline, 0, len(records))
+	for _, r := range records {
+		if r.Kline != nil {
+			klines = append(klines, *r.Kline)
+		}
+	}
+	return klines, nil
+}
+
+// spotPositioner keeps track of what it bought and sold itself, so coins
+// already held in the account are never sold by a strategy.
+type spotPositioner struct {
+	mgr      SpotTradeManagerAPI
+	position float64
+}
+
+func NewSpotPositioner(mgr SpotTradeManagerAPI) Positioner {
+	return &spotPositioner{mgr: mgr}
+}
+
+func (p *spotPositioner) Position() (float64, error) {
+	return p.position, nil
+}
+
+func (p *spotPositioner) Target(ctx context.Context, target, price float64) error {
+	if target < 0 {
+		return fmt.Errorf("%w: spot target %f", ErrShortUnsupported, target)
+	}
+	var rep *ExecutionReport
+	var err error
+	if diff := target - p.position; diff > 0 {
+		rep, err = p.mgr.BuyCtx(ctx, diff)
+		if rep != nil {
+			p.position += rep.Filled
+		}
+	} else if diff < 0 {
+		rep, err = p.mgr.SellCtx(ctx, -diff)
+		if rep != nil {
+			p.position -= rep.Filled
+		}
+	}
+	return err
+}
+
+type futurePositioner struct {
+	mgr FutureTradeManagerAPI
+}
+
+func NewFuturePositioner(mgr FutureTradeManagerAPI) Positioner {
+	return &futurePositioner{mgr: mgr}
+}
+
+func (p *futurePositioner) sides(ctx context.Context) (long, short float64, err error) {
+	pos, err := p.mgr.GetPositionCtx(ctx, goex.OPEN_BUY)
+	if err != nil {
+		return 0, 0, err
+	}
+	if pos != nil {
+		long = pos.Amount
+	}
+	if pos, err = p.mgr.GetPositionCtx(ctx, goex.OPEN_SELL); err != nil {
+		return 0, 0, err
+	}
+	if pos != nil {
+		short = pos.Amount
+	}
+	return long, short, nil
+}
+
+func (p *futurePositioner) Position() (float64, error) {
+	long, short, err := p.sides(context.Background())
+	return long - short, err
+}
+
+// Target closes the opposite side first and then opens or closes the side
+// the target lies on. It fails without opening anything when the opposite
+// side is not flat after its close, which may fill only in part.
+func (p *futurePositioner) Target(ctx context.Context, target, price float64) error {
+	long, short, err := p.sides(ctx)
+	if err != nil {
+		return err
+	}
+	if target >= 0 {
+		if short > 0 {
+			if _, err = p.mgr.CloseShortCtx(ctx, price, short); err != nil {
+				return err
+			}
+			if long, short, err = p.sides(ctx); err != nil {
+				return err
+			}
+			if short > 0 {
+				return fmt.Errorf("short %s still open after closing it", utils.Float64RoundString(short, 8))
+			}
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if target > long {
+			_, err = p.mgr.OpenLongCtx(ctx, price, target-long)
+		} else if target < long {
+			_, err = p.mgr.CloseLongCtx(ctx, price, long-target)
+		}
+	} else {
+		if long > 0 {
+			if _, err = p.mgr.CloseLongCtx(ctx, price, long); err != nil {
+				return err
+			}
+			if long, short, err = p.sides(ctx); err != nil {
+				return err
+			}
+			if long > 0 {
+				return fmt.Errorf("long %s still open after closing it", utils.Float64RoundString(long, 8))
+			}
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if -target > short {
+			_, err = p.mgr.OpenShortCtx(ctx, price, -target-short)
+		} else if -target < short {
+			_, err = p.mgr.CloseShortCtx(ctx, price, short+target)
+		}
+	}
+	return err
+}
+
+// BarAggregator builds bars of a fixed period out of ticker snapshots.
+type BarAggregator struct {
+	period  time.Duration
+	current *Bar
+	lastVol float64
+}
+
+func NewBarAggregator(period time.Duration) *BarAggregator {
+	return &BarAggregator{period: period}
+}
+
+// Update folds ticker, observed at, into the open bar. When at falls into a
+// later period the open bar is returned as closed and a new one is started.
+// Volume is taken from the growth of the ticker's rolling volume.
+func (agg *BarAggregator) Update(ticker *goex.Ticker, at time.Time) *Bar {
+	var price = ticker.Last
+	var vol = 0.0
+	if agg.lastVol > 0 && ticker.Vol > agg.lastVol {
+		vol = ticker.Vol - agg.lastVol
+	}
+	agg.lastVol = ticker.Vol
+	var start = at.Truncate(agg.period)
+	if agg.current != nil && start.Equal(agg.current.Time) {
+		agg.current.High = math.Max(agg.current.High, price)
+		agg.current.Low = math.Min(agg.current.Low, price)
+		agg.current.Close = price
+		agg.current.Vol += vol
+		return nil
+	}
+	var closed = agg.current
+	agg.current = &Bar{Pair: ticker.Pair, Time: start, Open: price, High: price, Low: price, Close: price, Vol: vol}
+	return closed
+}
+
+// Current returns the bar still being built, if any.
+func (agg *BarAggregator) Current() *Bar {
+	return agg.current
+}
+
+// CTA runs a Strategy: it polls the feed, aggregates bars, hands both to the
+// strategy and drives the positioner towards the strategy's target.
+type CTA struct {
+	feed        Feed
+	positioner  Positioner
+	strategy    Strategy
+	aggregator  *BarAggregator
+	pollDelayMs time.Duration
+	logger      *logrus.Logger
+	maxBars     int
+	now         func() time.Time
+
+	mu       sync.Mutex
+	bars     []Bar
+	ticker   *goex.Ticker
+	target   float64
+	position float64
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func NewCTA(
+	feed Feed,
+	positioner Positioner,
+	strategy Strategy,
+	barPeriod time.Duration,
+	pollDelayMs int,
+	logger *logrus.Logger,
+) (*CTA, error) {
+	switch {
+	case feed == nil || positioner == nil || strategy == nil:
+		return nil, fmt.Errorf("%w: nil feed, positioner or strategy", ErrInvalidConfig)
+	case barPeriod <= 0:
+		return nil, fmt.Errorf("%w: bar period %v", ErrInvalidConfig, barPeriod)
+	case pollDelayMs <= 0:
+		return nil, fmt.Errorf("%w: poll delay %dms", ErrInvalidConfig, pollDelayMs)
+	}
+	if logger == nil {
+		logger = logrus.New()
+	}
+	return &CTA{
+		feed:        feed,
+		positioner:  positioner,
+		strategy:    strategy,
+		aggregator:  NewBarAggregator(barPeriod),
+		pollDelayMs: time.Duration(pollDelayMs) * time.Millisecond,
+		logger:      logger,
+		maxBars:     1000,
+		now:         time.Now,
+	}, nil
+}
+
+// Warmup replays the last size klines of period (goex.KLINE_PERIOD_*)
+// through OnBar. Targets set while warming up are only acted upon once the
+// run loop starts.
+func (cta *CTA) Warmup(period, size int) error {
+	klines, err := cta.feed.GetKlineRecords(period, size)
+	if err != nil {
+		return err
+	}
+	for _, k := range klines {
+		var bar = Bar{
+			Pair:  k.Pair,
+			Time:  time.Unix(k.Timestamp, 0),
+			Open:  k.Open,
+			High:  k.High,
+			Low:   k.Low,
+			Close: k.Close,
+			Vol:   k.Vol,
+		}
+		cta.pushBar(bar)
+		cta.strategy.OnBar(cta, &bar)
+	}
+	return nil
+}
+
+// SetTarget sets the position the CTA should hold.
+func (cta *CTA) SetTarget(target float64) {
+	cta.mu.Lock()
+	defer cta.mu.Unlock()
+	cta.target = target
+}
+
+func (cta *CTA) Target() float64 {
+	cta.mu.Lock()
+	defer cta.mu.Unlock()
+	return cta.target
+}
+
+// Position is the position as of the last sync with the positioner.
+func (cta *CTA) Position() float64 {
+	cta.mu.Lock()
+	defer cta.mu.Unlock()
+	return cta.position
+}
+
+// Bars returns a copy of the closed bars, oldest first.
+func (cta *CTA) Bars() []Bar {
+	cta.mu.Lock()
+	defer cta.mu.Unlock()
+	return append([]Bar(nil), cta.bars...)
+}
+
+// Ticker returns the last ticker seen.
+func (cta *CTA) Ticker() *goex.Ticker {
+	cta.mu.Lock()
+	defer cta.mu.Unlock()
+	return cta.ticker
+}
+
+func (cta *CTA) pushBar(bar Bar) {
+	cta.mu.Lock()
+	defer cta.mu.Unlock()
+	cta.bars = append(cta.bars, bar)
+	if len(cta.bars) > cta.maxBars {
+		cta.bars = cta.bars[len(cta.bars)-cta.maxBars:]
+	}
+}
+
+// Start runs the loop in the background until Stop is called.
+func (cta *CTA) Start() {
+	cta.mu.Lock()
+	defer cta.mu.Unlock()
+	if cta.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cta.cancel = cancel
+	cta.done = make(chan struct{})
+	go func(done chan struct{}) {
+		defer close(done)
+		if err := cta.Run(ctx); err != nil && err != context.Canceled {
+			cta.logger.Errorln("CTA stopped:", err)
+		}
+	}(cta.done)
+}
+
+// Stop ends a loop started with Start and waits for it to return.
+func (cta *CTA) Stop() {
+	cta.mu.Lock()
+	var cancel, done = cta.cancel, cta.done
+	cta.cancel, cta.done = nil, nil
+	cta.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Run polls the feed until ctx is done.
+func (cta *CTA) Run(ctx context.Context) error {
+	position, err := cta.positioner.Position()
+	if err != nil {
+		return err
+	}
+	cta.mu.Lock()
+	cta.position = position
+	cta.mu.Unlock()
+	for {
+		if err = cta.step(ctx); err != nil && ctx.Err() == nil {
+			cta.logger.Errorln("CTA step:", err)
+		}
+		if err = sleepCtx(ctx, cta.pollDelayMs); err != nil {
+			return err
+		}
+	}
+}
+
+func (cta *CTA) step(ctx context.Context) error {
+	ticker, err := cta.feed.GetTicker()
+	if err != nil {
+		return err
+	}
+	cta.mu.Lock()
+	cta.ticker = ticker
+	cta.mu.Unlock()
+	cta.strategy.OnTick(cta, ticker)
+	if bar := cta.aggregator.Update(ticker, cta.now()); bar != nil {
+		cta.pushBar(*bar)
+		cta.strategy.OnBar(cta, bar)
+	}
+	return cta.sync(ctx, ticker.Last)
+}
+
+func (cta *CTA) sync(ctx context.Context, price float64) error {
+	var target = cta.Target()
+	if utils.Float64Round(target-cta.Position(), 8) == 0 {
+		return nil
+	}
+	cta.logger.Infof("[ CTA ] position %f -> target %f @ %f", cta.Position(), target, price)
+	var err = cta.positioner.Target(ctx, target, price)
+	position, perr := cta.positioner.Position()
+	if perr != nil {
+		return perr
+	}
+	cta.mu.Lock()
+	cta.position = position
+	cta.mu.Unlock()
+	return err
 }
@@ -1,7 +1,153 @@
 package trade
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"github.com/nntaoli-project/GoEx"
+	"math"
+	"testing"
+	"time"
+)
+
+type targetStrategy struct {
+	ticks  int
+	bars   int
+	target float64
+}
+
+func (s *targetStrategy) OnTick(cta *CTA, ticker *goex.Ticker) {
+	if s.ticks == 0 {
+		cta.SetTarget(s.target)
+	}
+	s.ticks++
+}
+
+func (s *targetStrategy) OnBar(cta *CTA, bar *Bar) {
+	s.bars++
+}
+
+func TestBarAggregator(t *testing.T) {
+	var agg = NewBarAggregator(time.Minute)
+	var t0 = time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC)
+	if bar := agg.Update(&goex.Ticker{Last: 100, Vol: 10}, t0); bar != nil {
+		t.Fatalf("unexpected bar %+v", bar)
+	}
+	agg.Update(&goex.Ticker{Last: 105, Vol: 12}, t0.Add(20*time.Second))
+	agg.Update(&goex.Ticker{Last: 98, Vol: 15}, t0.Add(40*time.Second))
+	var bar = agg.Update(&goex.Ticker{Last: 101, Vol: 16}, t0.Add(61*time.Second))
+	if bar == nil {
+		t.Fatal("bar not closed")
+	}
+	if !bar.Time.Equal(t0) || bar.Open != 100 || bar.High != 105 || bar.Low != 98 || bar.Close != 98 || bar.Vol != 5 {
+		t.Fatalf("unexpected bar %+v", bar)
+	}
+	if cur := agg.Current(); cur.Open != 101 || cur.Vol != 1 {
+		t.Fatalf("unexpected open bar %+v", cur)
+	}
+}
+
+func TestNewCTA_Invalid(t *testing.T) {
+	ex, mgr := newMockSpot(OPMODE_TAKE)
+	var feed, positioner, strategy = NewSpotFeed(ex.Spot(), spotPair), NewSpotPositioner(mgr), &targetStrategy{}
+	if _, err := NewCTA(nil, positioner, strategy, time.Minute, 1, nil); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("nil feed: want ErrInvalidConfig, got %v", err)
+	}
+	if _, err := NewCTA(feed, positioner, nil, time.Minute, 1, nil); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("nil strategy: want ErrInvalidConfig, got %v", err)
+	}
+	if _, err := NewCTA(feed, positioner, strategy, 0, 1, nil); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("zero bar period: want ErrInvalidConfig, got %v", err)
+	}
+	if _, err := NewCTA(feed, positioner, strategy, time.Minute, 0, nil); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("zero poll delay: want ErrInvalidConfig, got %v", err)
+	}
+}
 
 func TestNewCTA(t *testing.T) {
-	t.Log("hello")
+	ex, mgr := newMockSpot(OPMODE_TAKE)
+	ex.Market(spotPair).AddKlines(
+		goex.Kline{Timestamp: 1, Open: 100, High: 102, Low: 99, Close: 101},
+		goex.Kline{Timestamp: 2, Open: 101, High: 103, Low: 100, Close: 102},
+	)
+	var strategy = &targetStrategy{target: 1.5}
+	cta, err := NewCTA(NewSpotFeed(ex.Spot(), spotPair), NewSpotPositioner(mgr), strategy, time.Minute, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cta.Warmup(goex.KLINE_PERIOD_1MIN, 10); err != nil {
+		t.Fatal(err)
+	}
+	if strategy.bars != 2 || len(cta.Bars()) != 2 {
+		t.Fatalf("want 2 warmup bars, got %d", strategy.bars)
+	}
+	cta.Start()
+	var deadline = time.Now().Add(time.Second)
+	for cta.Position() != 1.5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cta.SetTarget(0.5)
+	for cta.Position() != 0.5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cta.Stop()
+	if cta.Position() != 0.5 {
+		t.Fatalf("want position 0.5, got %f", cta.Position())
+	}
+	if btc, _ := ex.Balance(goex.BTC); btc != 10.5 {
+		t.Fatalf("want 10.5 BTC, got %f", btc)
+	}
+	if strategy.ticks == 0 {
+		t.Fatal("OnTick never called")
+	}
+}
+
+func TestSpotPositionerRejectsShort(t *testing.T) {
+	_, mgr := newMockSpot(OPMODE_TAKE)
+	var p = NewSpotPositioner(mgr)
+	if err := p.Target(context.Background(), -1, 100); !errors.Is(err, ErrShortUnsupported) {
+		t.Fatalf("want ErrShortUnsupported, got %v", err)
+	}
+}
+
+func TestFuturePositioner(t *testing.T) {
+	_, mgr := newMockFuture()
+	var p = NewFuturePositioner(mgr)
+	if err := p.Target(context.Background(), 3, 100); err != nil {
+		t.Fatal(err)
+	}
+	if pos, _ := p.Position(); pos != 3 {
+		t.Fatalf("want 3, got %f", pos)
+	}
+	if err := p.Target(context.Background(), -2, 100); err != nil {
+		t.Fatal(err)
+	}
+	if pos, _ := p.Position(); pos != -2 {
+		t.Fatalf("want -2, got %f", pos)
+	}
+}
+
+// partialCloser closes at most one contract per request.
+type partialCloser struct {
+	FutureTradeManagerAPI
+}
+
+func (c partialCloser) CloseLongCtx(ctx context.Context, price, opAmount float64) (*ExecutionReport, error) {
+	return c.FutureTradeManagerAPI.CloseLongCtx(ctx, price, math.Min(opAmount, 1))
+}
+
+func TestFuturePositioner_PartialClose(t *testing.T) {
+	_, mgr := newMockFuture()
+	var p = NewFuturePositioner(partialCloser{mgr})
+	if err := p.Target(context.Background(), 3, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Target(context.Background(), -2, 100); err == nil {
+		t.Fatal("want an error for the long left open")
+	}
+	if short, _ := mgr.GetPosition(goex.OPEN_SELL); short != nil && short.Amount != 0 {
+		t.Fatalf("short opened next to a long %+v", short)
+	}
+	if pos, _ := p.Position(); pos != 2 {
+		t.Fatalf("want 2 long left, got %f", pos)
+	}
 }
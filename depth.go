@@ -0,0 +1,209 @@
+package trade
+
+import (
+	"github.com/nntaoli-project/GoEx"
+	"math"
+	"sort"
+)
+
+const defaultDepthSize = 20 //默认深度档数
+
+// PriceMode says where OPMODE_MAKE, OPMODE_MAKE_WAIT, OPMODE_ICEBERG and
+// OPMODE_POST_ONLY orders are placed. OPMODE_TAKE, OPMODE_IOC and OPMODE_FOK
+// orders ignore it.
+type PriceMode int
+
+const (
+	PRICEMODE_TICKER  = iota //按ticker买一/卖一加减slidePrice
+	PRICEMODE_JOIN           //挂在同侧最优价排队
+	PRICEMODE_IMPROVE        //比同侧最优价优一个tick
+	PRICEMODE_INSIDE         //挂在买卖价差中间
+)
+
+func (mode PriceMode) String() string {
+	switch mode {
+	case PRICEMODE_TICKER:
+		return "PRICEMODE_TICKER"
+	case PRICEMODE_JOIN:
+		return "PRICEMODE_JOIN"
+	case PRICEMODE_IMPROVE:
+		return "PRICEMODE_IMPROVE"
+	case PRICEMODE_INSIDE:
+		return "PRICEMODE_INSIDE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// DepthQuote is what taking an amount from the book would cost.
+type DepthQuote struct {
+	Amount     float64 //请求数量
+	Fillable   float64 //深度和滑点预算内可成交的数量
+	AvgPrice   float64 //预计成交均价, 无可成交时为0
+	WorstPrice float64 //用到的最后一档价格, 可作为吃单限价
+	BestPrice  float64 //对手方最优价
+}
+
+// Slippage is how much worse than the best price AvgPrice is, as a fraction
+// of the best price.
+func (q *DepthQuote) Slippage() float64 {
+	if q.BestPrice == 0 || q.AvgPrice == 0 {
+		return 0
+	}
+	return math.Abs(q.AvgPrice-q.BestPrice) / q.BestPrice
+}
+
+// levels returns the side of depth a buy (asks) or sell (bids) would take,
+// best first. Exchanges do not agree on the order of AskList.
+func levels(depth *goex.Depth, isBuy bool) goex.DepthRecords {
+	var side = depth.BidList
+	if isBuy {
+		side = depth.AskList
+	}
+	side = append(goex.DepthRecords(nil), side...)
+	sort.Slice(side, func(i, j int) bool {
+		if isBuy {
+			return side[i].Price < side[j].Price
+		}
+		return side[i].Price > side[j].Price
+	})
+	return side
+}
+
+// QuoteDepth walks the book to fill amount. With a positive maxSlippage it
+// stops where the average price would move more than that fraction away from
+// the best price.
+func QuoteDepth(depth *goex.Depth, isBuy bool, amount, maxSlippage float64) *DepthQuote {
+	var q = &DepthQuote{Amount: amount}
+	var book = levels(depth, isBuy)
+	if len(book) == 0 {
+		return q
+	}
+	q.BestPrice = book[0].Price
+	var limit = 0.0
+	if maxSlippage > 0 {
+		limit = q.BestPrice * (1 + maxSlippage)
+		if !isBuy {
+			limit = q.BestPrice * (1 - maxSlippage)
+		}
+	}
+	var cost = 0.0
+	for _, level := range book {
+		var take = math.Min(level.Amount, amount-q.Fillable)
+		if take <= 0 {
+			break
+		}
+		var over = limit > 0 && (isBuy && level.Price > limit || !isBuy && level.Price < limit)
+		if over {
+			// 该档只吃到均价正好等于限价为止
+			take = math.Min(take, (limit*q.Fillable-cost)/(level.Price-limit))
+			if take <= 0 {
+				break
+			}
+		}
+		cost += take * level.Price
+		q.Fillable += take
+		q.WorstPrice = level.Price
+		if over {
+			break
+		}
+	}
+	if q.Fillable > 0 {
+		q.AvgPrice = cost / q.Fillable
+	}
+	return q
+}
+
+// within drops the levels a buy (sell) would take above (below) limit.
+func within(depth *goex.Depth, isBuy bool, limit float64) *goex.Depth {
+	var capped = &goex.Depth{ContractType: depth.ContractType, Pair: depth.Pair, UTime: depth.UTime}
+	for _, level := range levels(depth, isBuy) {
+		if isBuy && level.Price > limit || !isBuy && level.Price < limit {
+			break
+		}
+		if isBuy {
+			capped.AskList = append(capped.AskList, level)
+		} else {
+			capped.BidList = append(capped.BidList, level)
+		}
+	}
+	return capped
+}
+
+// topOfBook is the best bid and ask of depth, falling back to ticker for an
+// empty side.
+func topOfBook(depth *goex.Depth, ticker *goex.Ticker) (bid, ask float64) {
+	bid, ask = ticker.Buy, ticker.Sell
+	if depth == nil {
+		return
+	}
+	if book := levels(depth, false); len(book) > 0 {
+		bid = book[0].Price
+	}
+	if book := levels(depth, true); len(book) > 0 {
+		ask = book[0].Price
+	}
+	return
+}
+
+// queuePrice is where a resting order goes under mode, never crossing the
+// spread.
+func queuePrice(mode PriceMode, isBuy bool, bid, ask float64, inst *Instrument) float64 {
+	var tick = inst.TickSize
+	var price = bid
+	if !isBuy {
+		price = ask
+	}
+	switch mode {
+	case PRICEMODE_IMPROVE:
+		if isBuy {
+			price = bid + tick
+		} else {
+			price = ask - tick
+		}
+	case PRICEMODE_INSIDE:
+		if isBuy {
+			price = math.Floor((bid+ask)/2/tick+1e-9) * tick
+		} else {
+			price = math.Ceil((bid+ask)/2/tick-1e-9) * tick
+		}
+	}
+	if isBuy {
+		price = math.Max(bid, math.Min(price, ask-tick))
+	} else {
+		price = math.Min(ask, math.Max(price, bid+tick))
+	}
+	return inst.RoundPrice(price)
+}
+
+// Quote asks the exchange's depth what buying (goex.BUY) or selling
+// (goex.SELL) amount would cost, see QuoteDepth.
+func (spot *SpotTradeManager) Quote(side goex.TradeSide, amount, maxSlippage float64) (*DepthQuote, error) {
+	depth, err := spot.exchange.GetDepth(spot.depthSize(), spot.pair)
+	if err != nil {
+		return nil, err
+	}
+	return QuoteDepth(depth, side == goex.BUY || side == goex.BUY_MARKET, amount, maxSlippage), nil
+}
+
+func (spot *SpotTradeManager) depthSize() int {
+	if spot.depthLevels > 0 {
+		return spot.depthLevels
+	}
+	return defaultDepthSize
+}
+
+// usesDepth tells whether trade must read the order book.
+func (spot *SpotTradeManager) usesDepth() bool {
+	return spot.priceMode != PRICEMODE_TICKER || spot.maxSlippage > 0
+}
+
+// Quote is SpotTradeManager.Quote for the contract: goex.OPEN_BUY and
+// goex.CLOSE_SELL take asks, goex.OPEN_SELL and goex.CLOSE_BUY take bids.
+func (future *FutureTradeManager) Quote(openType int, amount, maxSlippage float64) (*DepthQuote, error) {
+	depth, err := future.exchange.GetFutureDepth(future.pair, future.contractType, defaultDepthSize)
+	if err != nil {
+		return nil, err
+	}
+	return QuoteDepth(depth, openType == goex.OPEN_BUY || openType == goex.CLOSE_SELL, amount, maxSlippage), nil
+}
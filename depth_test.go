@@ -0,0 +1,122 @@
+package trade
+
+import (
+	"context"
+	"github.com/goex-top/goex_trade/mockex"
+	"github.com/nntaoli-project/GoEx"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestQuoteDepth(t *testing.T) {
+	var depth = &goex.Depth{
+		AskList: goex.DepthRecords{{Price: 103, Amount: 2}, {Price: 101, Amount: 1}, {Price: 100, Amount: 1}},
+		BidList: goex.DepthRecords{{Price: 98, Amount: 1}, {Price: 99, Amount: 1}},
+	}
+	var q = QuoteDepth(depth, true, 3, 0)
+	if q.Fillable != 3 || math.Abs(q.AvgPrice-304.0/3) > 1e-9 || q.WorstPrice != 103 || q.BestPrice != 100 {
+		t.Fatalf("unexpected quote %+v", q)
+	}
+	// 1% over the best ask allows half of the 103 level: (201+51.5)/2.5 = 101.
+	q = QuoteDepth(depth, true, 3, 0.01)
+	if math.Abs(q.Fillable-2.5) > 1e-9 || math.Abs(q.AvgPrice-101) > 1e-9 || math.Abs(q.Slippage()-0.01) > 1e-9 {
+		t.Fatalf("unexpected capped quote %+v", q)
+	}
+	q = QuoteDepth(depth, false, 5, 0)
+	if q.Fillable != 2 || q.AvgPrice != 98.5 || q.BestPrice != 99 {
+		t.Fatalf("unexpected sell quote %+v", q)
+	}
+}
+
+func TestFutureTradeManager_Quote(t *testing.T) {
+	ex, mgr := newMockFuture()
+	ex.FutureMarket(futurePair, goex.QUARTER_CONTRACT).SetDepth(
+		goex.DepthRecords{{Price: 99, Amount: 2}, {Price: 98, Amount: 10}},
+		goex.DepthRecords{{Price: 101, Amount: 2}},
+	)
+	q, err := mgr.Quote(goex.CLOSE_BUY, 4, 0)
+	if err != nil || q.Fillable != 4 || q.AvgPrice != 98.5 || q.WorstPrice != 98 {
+		t.Fatalf("unexpected quote %+v, %v", q, err)
+	}
+}
+
+func TestQueuePrice(t *testing.T) {
+	var inst = &Instrument{TickSize: 0.5, LotSize: 0.01}
+	for _, tc := range []struct {
+		mode     PriceMode
+		isBuy    bool
+		bid, ask float64
+		want     float64
+	}{
+		{PRICEMODE_JOIN, true, 99, 101, 99},
+		{PRICEMODE_JOIN, false, 99, 101, 101},
+		{PRICEMODE_IMPROVE, true, 99, 101, 99.5},
+		{PRICEMODE_IMPROVE, false, 99, 101, 100.5},
+		{PRICEMODE_IMPROVE, true, 100, 100.5, 100},
+		{PRICEMODE_INSIDE, true, 99, 101, 100},
+		{PRICEMODE_INSIDE, true, 99, 100.5, 99.5},
+		{PRICEMODE_INSIDE, false, 99, 100.5, 100},
+	} {
+		if got := queuePrice(tc.mode, tc.isBuy, tc.bid, tc.ask, inst); got != tc.want {
+			t.Fatalf("%v buy=%v %v/%v: want %v, got %v", tc.mode, tc.isBuy, tc.bid, tc.ask, tc.want, got)
+		}
+	}
+}
+
+func TestSpotTradeManager_DepthTake(t *testing.T) {
+	var ex = mockex.New("mock")
+	ex.SetBalance(goex.USDT, 10000)
+	ex.Market(spotPair).SetDepth(
+		goex.DepthRecords{{Price: 99, Amount: 5}},
+		goex.DepthRecords{{Price: 101, Amount: 0.5}, {Price: 102, Amount: 0.5}, {Price: 110, Amount: 5}},
+	)
+	mgr, err := NewSpotTradeManagerWithConfig(ex.Spot(), spotPair, DefaultSpotConfig(),
+		WithDepthPricing(PRICEMODE_TICKER, 0.01),
+		WithRetryDelay(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := mgr.Buy(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Filled != 1 || rep.VWAP != 101.5 || rep.Children[0].Price != 102 {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	// The 110 level is 9% away from where the request started: only the
+	// first level is taken, then the manager waits for the book to refill.
+	ex.Market(spotPair).SetDepth(
+		goex.DepthRecords{{Price: 99, Amount: 5}},
+		goex.DepthRecords{{Price: 101, Amount: 0.5}, {Price: 110, Amount: 5}},
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	rep, err = mgr.BuyCtx(ctx, 1)
+	if err != context.DeadlineExceeded || rep.Filled != 0.5 || rep.VWAP != 101 {
+		t.Fatalf("want only the 101 level taken, got %+v, %v", rep, err)
+	}
+}
+
+func TestSpotTradeManager_DepthImprove(t *testing.T) {
+	var ex = mockex.New("mock")
+	ex.SetBalance(goex.USDT, 10000)
+	ex.Market(spotPair).SetTicker(99, 101)
+	var cfg = DefaultSpotConfig()
+	cfg.OpMode = OPMODE_MAKE
+	cfg.MaxSpace = 5
+	mgr, err := NewSpotTradeManagerWithConfig(ex.Spot(), spotPair, cfg,
+		WithDepthPricing(PRICEMODE_IMPROVE, 0),
+		WithRetryDelay(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	rep, _ := mgr.BuyCtx(ctx, 1)
+	if len(rep.Children) != 1 || rep.Children[0].Price != 99.01 || !rep.Children[0].Maker {
+		t.Fatalf("want one maker order one tick above the bid, got %+v", rep.Children)
+	}
+}
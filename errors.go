@@ -0,0 +1,42 @@
+package trade
+
+import "errors"
+
+var (
+	// ErrBelowMinStocks is returned when the requested amount is smaller than
+	// the minimum tradable amount of the manager.
+	ErrBelowMinStocks = errors.New("amount below minStocks")
+	// ErrUnknownSide is returned for a trade side or position direction the
+	// manager cannot handle.
+	ErrUnknownSide = errors.New("unknown trade side")
+	// ErrAmbiguousPosition is returned when both long and short positions are
+	// held and the requested direction does not say which one to close.
+	ErrAmbiguousPosition = errors.New("ambiguous position direction")
+	// ErrInsufficientBalance is returned when the account cannot fund the
+	// rest of the requested amount. The result may still hold a partial fill.
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	// ErrNoInitialAccount is returned by FutureTradeManager.Profit when the
+	// account could not be read while the manager was built.
+	ErrNoInitialAccount = errors.New("initial account unknown")
+	// ErrShortUnsupported is returned when a spot position is asked to go
+	// below zero.
+	ErrShortUnsupported = errors.New("short positions unsupported")
+	// ErrInvalidConfig is returned by the config constructors for values
+	// that make no sense, such as a negative slide price.
+	ErrInvalidConfig = errors.New("invalid config")
+	// ErrUnknownInstrument is returned by an InstrumentSource that has no
+	// filters for the requested pair.
+	ErrUnknownInstrument = errors.New("unknown instrument")
+	// ErrConditionalNotFound is returned by ConditionalManager for an order
+	// ID it does not know, or that is no longer active when it must be.
+	ErrConditionalNotFound = errors.New("conditional order not found")
+	// ErrRiskRejected is matched by the RiskError a RiskGate turns a request
+	// down with.
+	ErrRiskRejected = errors.New("rejected by risk gate")
+	// ErrNoPrice is returned by Portfolio for a currency or pair none of its
+	// feeds can price.
+	ErrNoPrice = errors.New("no price")
+	// ErrLegImbalance is returned by ArbExecutor when its legs filled
+	// unequally and the policy could not even them out.
+	ErrLegImbalance = errors.New("arbitrage legs imbalanced")
+)
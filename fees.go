@@ -0,0 +1,113 @@
+package trade
+
+import (
+	"github.com/nntaoli-project/GoEx"
+	"strings"
+)
+
+// FeeAsset says which currency a spot fee is charged in.
+type FeeAsset int
+
+const (
+	FEE_RECEIVED = iota //收到的币种: 买入收基础币, 卖出收计价币
+	FEE_QUOTE           //计价币
+	FEE_BASE            //基础币
+)
+
+// FeeSchedule is the commission of one exchange (or pair). Rates are
+// fractions of the notional; a negative rate is a rebate. Futures fees are
+// always charged in the quote currency on filled contracts × contract value
+// × price, as for linear contracts.
+type FeeSchedule struct {
+	Maker float64  //挂单费率, 负数为返佣
+	Taker float64  //吃单费率
+	Asset FeeAsset //现货手续费币种
+}
+
+// Rate is the maker or taker rate.
+func (sched FeeSchedule) Rate(maker bool) float64 {
+	if maker {
+		return sched.Maker
+	}
+	return sched.Taker
+}
+
+// Currency is the currency a spot fee on the given side is charged in.
+func (sched FeeSchedule) Currency(pair goex.CurrencyPair, isBuy bool) goex.Currency {
+	switch {
+	case sched.Asset == FEE_QUOTE:
+		return pair.CurrencyB
+	case sched.Asset == FEE_BASE:
+		return pair.CurrencyA
+	case isBuy:
+		return pair.CurrencyA
+	default:
+		return pair.CurrencyB
+	}
+}
+
+// FeeModel looks up the fee schedule of a pair on an exchange, as named by
+// GetExchangeName.
+type FeeModel interface {
+	Schedule(exchange string, pair goex.CurrencyPair) FeeSchedule
+}
+
+// FeeTable is a FeeModel with a default schedule that can be overridden per
+// exchange and per pair. Exchange names are matched case-insensitively.
+type FeeTable struct {
+	def       FeeSchedule
+	exchanges map[string]FeeSchedule
+	pairs     map[string]FeeSchedule
+}
+
+func NewFeeTable(def FeeSchedule) *FeeTable {
+	return &FeeTable{
+		def:       def,
+		exchanges: make(map[string]FeeSchedule),
+		pairs:     make(map[string]FeeSchedule),
+	}
+}
+
+// SetExchange overrides the default for every pair of exchange.
+func (table *FeeTable) SetExchange(exchange string, sched FeeSchedule) *FeeTable {
+	table.exchanges[strings.ToLower(exchange)] = sched
+	return table
+}
+
+// SetPair overrides the exchange schedule for one pair.
+func (table *FeeTable) SetPair(exchange string, pair goex.CurrencyPair, sched FeeSchedule) *FeeTable {
+	table.pairs[strings.ToLower(exchange)+"|"+pair.ToSymbol("_")] = sched
+	return table
+}
+
+func (table *FeeTable) Schedule(exchange string, pair goex.CurrencyPair) FeeSchedule {
+	exchange = strings.ToLower(exchange)
+	if sched, ok := table.pairs[exchange+"|"+pair.ToSymbol("_")]; ok {
+		return sched
+	}
+	if sched, ok := table.exchanges[exchange]; ok {
+		return sched
+	}
+	return table.def
+}
+
+// chargeSpot replaces the exchange-reported fee of every child with the one
+// sched implies, in the currency it names.
+func chargeSpot(rep *ExecutionReport, sched FeeSchedule) {
+	rep.FeeCurrency = sched.Currency(rep.Pair, rep.IsBuy())
+	for _, child := range rep.Children {
+		var notional = child.Filled
+		if rep.FeeCurrency == rep.Pair.CurrencyB {
+			notional *= fillPrice(child)
+		}
+		child.Fee = notional * sched.Rate(child.Maker)
+	}
+}
+
+// chargeFuture is chargeSpot for contracts worth contractValue each.
+func chargeFuture(rep *ExecutionReport, sched FeeSchedule, contractValue float64) {
+	rep.FeeCurrency = rep.Pair.CurrencyB
+	for _, child := range rep.Children {
+		child.Fee = child.Filled * contractValue * fillPrice(child) * sched.Rate(child.Maker)
+	}
+}
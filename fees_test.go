@@ -0,0 +1,96 @@
+package trade
+
+import (
+	"github.com/nntaoli-project/GoEx"
+	"testing"
+)
+
+func TestFeeTable(t *testing.T) {
+	var table = NewFeeTable(FeeSchedule{Maker: 0.001, Taker: 0.002}).
+		SetExchange("Binance.com", FeeSchedule{Maker: 0.0002, Taker: 0.0004}).
+		SetPair("binance.com", goex.ETH_USDT, FeeSchedule{Maker: -0.0001, Taker: 0.0003, Asset: FEE_QUOTE})
+	if sched := table.Schedule("okex.com", goex.ETH_USDT); sched.Taker != 0.002 {
+		t.Fatalf("want default schedule, got %+v", sched)
+	}
+	if sched := table.Schedule("binance.com", goex.BTC_USDT); sched.Taker != 0.0004 {
+		t.Fatalf("want exchange schedule, got %+v", sched)
+	}
+	var sched = table.Schedule("BINANCE.COM", goex.ETH_USDT)
+	if sched.Rate(true) != -0.0001 || sched.Currency(goex.ETH_USDT, true) != goex.USDT {
+		t.Fatalf("want pair schedule, got %+v", sched)
+	}
+	if c := (FeeSchedule{}).Currency(goex.ETH_USDT, true); c != goex.ETH {
+		t.Fatalf("want fee in received ETH, got %v", c)
+	}
+}
+
+func TestExecutionReport_Rebate(t *testing.T) {
+	var rep = &ExecutionReport{Pair: spotPair, Side: goex.SELL, Children: []*ChildOrder{
+		{Price: 100, Filled: 2, Maker: true},
+		{Price: 99, AvgPrice: 98, Filled: 1},
+	}}
+	chargeSpot(rep, FeeSchedule{Maker: -0.001, Taker: 0.002, Asset: FEE_QUOTE})
+	rep.finish(298, 3, 1)
+	// -0.2 rebate on the maker child, 0.196 on the taker one.
+	if rep.FeeCurrency != goex.USDT || rep.Fees != -0.004 {
+		t.Fatalf("unexpected fees %v %v", rep.Fees, rep.FeeCurrency)
+	}
+	if rep.VWAP != 99.33333333 || rep.NetVWAP != 99.33466667 {
+		t.Fatalf("unexpected prices %v / %v", rep.VWAP, rep.NetVWAP)
+	}
+}
+
+func TestSpotTradeManager_NetVWAP(t *testing.T) {
+	ex, mgr := newMockSpot(OPMODE_TAKE)
+	ex.SetFee(0, 0.001)
+	mgr.fees = NewFeeTable(FeeSchedule{Taker: 0.001})
+	rep, err := mgr.Buy(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.VWAP != 101 || rep.FeeCurrency != goex.BTC || rep.Fees != 0.001 || rep.NetVWAP != 101.1011011 {
+		t.Fatalf("unexpected buy report %+v", rep)
+	}
+
+	mgr.fees = NewFeeTable(FeeSchedule{Taker: 0.001, Asset: FEE_QUOTE})
+	rep, err = mgr.Sell(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.VWAP != 99 || rep.FeeCurrency != goex.USDT || rep.Fees != 0.099 || rep.NetVWAP != 98.901 {
+		t.Fatalf("unexpected sell report %+v", rep)
+	}
+}
+
+func TestFutureTradeManager_ProfitNetOfFees(t *testing.T) {
+	ex, mgr := newMockFuture()
+	ex.SetFee(0.001, 0.002)
+	mgr.fees = NewFeeTable(FeeSchedule{Maker: 0.001, Taker: 0.002})
+	pos, err := mgr.OpenLong(100, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The order is priced through the ask, so it pays the taker fee.
+	if rep := pos.Report; rep.Children[0].Maker || rep.Fees != 1.005 || rep.NetVWAP != 100.701 {
+		t.Fatalf("unexpected open report %+v", rep)
+	}
+	// 22.5 unrealised, less the fees to open and to close at 105.
+	if profit, _ := mgr.Profit(105, 5); profit != 20.445 {
+		t.Fatalf("want 20.445 marked profit, got %v", profit)
+	}
+	ex.FutureMarket(futurePair, goex.QUARTER_CONTRACT).SetTicker(109.5, 110.5)
+	rep, err := mgr.CloseLong(110, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Fees != 1.095 || rep.NetVWAP != 109.281 {
+		t.Fatalf("unexpected close report %+v", rep)
+	}
+	if profit, _ := mgr.Profit(0, 0); profit != 42.9 {
+		t.Fatalf("want 42.9 net profit, got %v", profit)
+	}
+	// The exchange took the same fees from the margin.
+	if margin := ex.Margin(goex.USD); margin != 1042.9 {
+		t.Fatalf("want margin 1042.9, got %v", margin)
+	}
+}
@@ -0,0 +1,100 @@
+package trade
+
+import (
+	"context"
+	"github.com/beaquant/utils"
+	"github.com/nntaoli-project/GoEx"
+)
+
+func orderClosed(order *goex.Order) bool {
+	return statusClosed(order.Status)
+}
+
+// total sums the quote money and base amount filled by the tracked orders.
+func (spot *SpotTradeManager) total(inst *Instrument, fills *orderFills) (diffMoney, dealAmount float64) {
+	diffMoney, dealAmount = fills.sum()
+	return utils.Float64Round(diffMoney, 8), utils.Float64Round(dealAmount, spot.fillDot(inst)*2)
+}
+
+// refresh fetches the current state of every tracked order still open.
+func (spot *SpotTradeManager) refresh(ctx context.Context, fills *orderFills) error {
+	for _, id := range fills.open() {
+		order, err := spot.lookup(ctx, id)
+		if err != nil {
+			return err
+		}
+		fills.update(order)
+	}
+	return nil
+}
+
+// lookup fetches one of the manager's orders. Some exchanges stop answering
+// GetOneOrder for cancelled orders, so the latest page of the order history
+// is searched before trying again.
+func (spot *SpotTradeManager) lookup(ctx context.Context, id string) (*goex.Order, error) {
+	for {
+		if order := spot.find(id); order != nil {
+			return order, nil
+		}
+		if err := sleepCtx(ctx, spot.retryDelayMs); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// find is one try of lookup, nil when neither GetOneOrder nor the history
+// has the order.
+func (spot *SpotTradeManager) find(id string) *goex.Order {
+	if order, err := spot.exchange.GetOneOrder(id, spot.pair); err == nil {
+		return order
+	}
+	if orders, err := spot.exchange.GetOrderHistorys(spot.pair, 1, 50); err == nil {
+		for i := range orders {
+			if orders[i].OrderID2 == id {
+				return &orders[i]
+			}
+		}
+	}
+	return nil
+}
+
+// search is find for Recover: a nil order when the exchange says it does
+// not know id, an error when it could not tell.
+func (spot *SpotTradeManager) search(id string) (*goex.Order, error) {
+	order, err := spot.exchange.GetOneOrder(id, spot.pair)
+	if err == nil {
+		return order, nil
+	}
+	orders, herr := spot.exchange.GetOrderHistorys(spot.pair, 1, 50)
+	if herr != nil {
+		return nil, herr
+	}
+	for i := range orders {
+		if orders[i].OrderID2 == id {
+			return &orders[i], nil
+		}
+	}
+	if orderNotFound(err) {
+		return nil, nil
+	}
+	return nil, err
+}
+
+// cancel pulls one of the manager's orders and waits until the exchange
+// reports it closed, leaving every other order on the pair alone. The final
+// state of the order is returned.
+func (spot *SpotTradeManager) cancel(ctx context.Context, id string) (*goex.Order, error) {
+	for {
+		spot.exchange.CancelOrder(id, spot.pair)
+		order, err := spot.lookup(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if orderClosed(order) {
+			return order, nil
+		}
+		if err = sleepCtx(ctx, spot.retryDelayMs); err != nil {
+			return order, err
+		}
+	}
+}
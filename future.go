@@ -1,9 +1,12 @@
 package trade
 
 import (
+	"context"
+	"fmt"
 	"github.com/beaquant/utils"
 	"github.com/nntaoli-project/GoEx"
 	"github.com/sirupsen/logrus"
+	"math"
 	"time"
 )
 
@@ -12,7 +15,7 @@ type FutureTradeManager struct {
 	pair                            goex.CurrencyPair  //货币对
 	contractType                    string             //合约类型
 	initAccount                     *Account           //初始账户
-	opMode                          OpMode             //下单方式:吃单|挂单
+	opMode                          OpMode             //下单方式:吃单|挂单|冰山
 	slidePrice                      float64            //下单滑动价
 	slideGrowthRate                 float64            //下单滑动价增长率
 	openPositionSlideGrowthRateMax  float64            //下单滑动价最大增长率
@@ -22,15 +25,24 @@ type FutureTradeManager struct {
 	priceDot                        int                //价格小数精度
 	amountDot                       int                //数量小数精度
 	marginLevel                     int                //杆杠大小
+	instruments                     InstrumentSource   //交易规则
+	fees                            FeeModel           //手续费模型
+	contractValue                   float64            //合约面值, 0为未查询
+	realised                        float64            //本管理器平仓的已实现盈亏(不含手续费)
+	feesPaid                        float64            //本管理器累计手续费
+	iceberg                         Iceberg            //冰山单参数(OPMODE_ICEBERG)
+	journal                         Journal            //订单日志
+	recovered                       *RecoveryReport    //最近一次Recover的结果
 	//maxSpace     float64           //挂单失效距离
 	//maxAmount    float64           //开仓最大单次下单量
 	//minStocks    float64           //最小交易数量
 }
 
 type SummaryPosition struct {
-	Amount   float64   //持仓量, OKCoin表示合约的份数(整数且大于1)
-	Price    float64   //持仓均价
-	Position *Position //
+	Amount   float64          //持仓量, OKCoin表示合约的份数(整数且大于1)
+	Price    float64          //持仓均价
+	Position *Position        //
+	Report   *ExecutionReport //本次开仓的执行报告
 }
 
 type Position struct {
@@ -43,6 +55,11 @@ type Position struct {
 	ContractType string  //商品期货为合约代码
 }
 
+// NewFutureTradeManager builds a manager from positional arguments without
+// validating them. If the initial account cannot be read the error is only
+// logged, and Profit without a FeeModel returns ErrNoInitialAccount.
+//
+// Deprecated: use NewFutureTradeManagerWithConfig.
 func NewFutureTradeManager(
 	exchange goex.FutureRestAPI,
 	pair goex.CurrencyPair,
@@ -60,42 +77,40 @@ func NewFutureTradeManager(
 	priceDot int,
 	amountDot int,
 ) *FutureTradeManager {
-	if logger == nil {
-		logger = logrus.New()
-	}
-	utils.SetDelay(retryDelayMs)
-	mgr := &FutureTradeManager{
-		exchange:                        exchange,
-		pair:                            pair,
-		contractType:                    contractType,
-		initAccount:                     nil,
-		opMode:                          opMode,
-		slidePrice:                      slidePrice,
-		slideGrowthRate:                 slideGrowthRate,
-		openPositionSlideGrowthRateMax:  openPositionSlideGrowthRateMax,
-		coverPositionSlideGrowthRateMax: coverPositionSlideGrowthRateMax,
-		retryDelayMs:                    time.Duration(retryDelayMs) * time.Millisecond,
-		logger:                          logger,
-		priceDot:                        priceDot,
-		amountDot:                       amountDot,
-		//maxAmount:    maxAmount,
-		//maxSpace:     maxSpace,
-		//minStocks:    minStocks,
-	}
-	mgr.initAccount = mgr.GetAccount()
+	mgr, err := newFutureTradeManager(exchange, pair, FutureConfig{
+		ContractType:                    contractType,
+		OpMode:                          opMode,
+		SlidePrice:                      slidePrice,
+		SlideGrowthRate:                 slideGrowthRate,
+		OpenPositionSlideGrowthRateMax:  openPositionSlideGrowthRateMax,
+		CoverPositionSlideGrowthRateMax: coverPositionSlideGrowthRateMax,
+		RetryDelay:                      time.Duration(retryDelayMs) * time.Millisecond,
+		Logger:                          logger,
+		PriceDot:                        priceDot,
+		AmountDot:                       amountDot,
+	})
+	if err != nil {
+		mgr.logger.Errorln("get initial account:", err)
+	}
 	return mgr
 }
 
-func (future *FutureTradeManager) getPosition(direction int) *Position {
-
+// getPosition reads the position on one side of the contract, nil when
+// there is none. Once ctx is done the exchange is asked once more, without
+// retrying, see reFinal.
+func (future *FutureTradeManager) getPosition(ctx context.Context, direction int) (*Position, error) {
 	var allCost = 0.0
 	var allAmount = 0.0
 	var allProfit = 0.0
 	var allFrozen = 0.0
 	var posMargin = 0
-	var positions = utils.RE(future.exchange.GetFuturePosition, future.pair, future.contractType).([]goex.FuturePosition)
+	res, err := reFinal(ctx, future.retryDelayMs, future.exchange.GetFuturePosition, future.pair, future.contractType)
+	if err != nil {
+		return nil, err
+	}
+	var positions = res.([]goex.FuturePosition)
 	if len(positions) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	for i := 0; i < len(positions); i++ {
@@ -107,7 +122,7 @@ func (future *FutureTradeManager) getPosition(direction int) *Position {
 				allProfit += positions[i].BuyProfitReal
 				allFrozen += positions[i].BuyAmount - positions[i].BuyAvailable
 			} else if direction == goex.OPEN_SELL {
-				allCost += positions[i].BuyPriceAvg * positions[i].SellAmount
+				allCost += positions[i].SellPriceAvg * positions[i].SellAmount
 				allAmount += positions[i].SellAmount
 				allProfit += positions[i].SellProfitReal
 				allFrozen += positions[i].SellAmount - positions[i].SellAvailable
@@ -115,7 +130,7 @@ func (future *FutureTradeManager) getPosition(direction int) *Position {
 		}
 	}
 	if allAmount == 0 {
-		return nil
+		return nil, nil
 	}
 	return &Position{
 		MarginLevel:  posMargin,
@@ -125,16 +140,51 @@ func (future *FutureTradeManager) getPosition(direction int) *Position {
 		Profit:       allProfit,
 		Type:         direction,
 		ContractType: future.contractType,
+	}, nil
+}
+
+// instrument returns the filters orders are rounded to, see
+// SpotTradeManager.instrument. Without a source the minimum is one contract.
+func (future *FutureTradeManager) instrument() *Instrument {
+	if future.instruments != nil {
+		inst, err := future.instruments.Instrument(future.pair, future.contractType)
+		if err != nil {
+			future.logger.Warningf("instrument %s %s: %v", future.pair.ToSymbol("_"), future.contractType, err)
+		}
+		if inst != nil {
+			return inst
+		}
 	}
+	return dotInstrument(future.pair, future.contractType, future.priceDot, future.amountDot, 1)
 }
 
+// open stops placing orders once ctx is done or the journal fails, returning
+// what was opened so far together with the error. Every exchange call is
+// bounded by ctx; the orders of the last step are still cancelled and read
+// back once on the way out, see settle.
 // direction : goex.OPEN_BUY, goex.OPEN_SELL
-func (future *FutureTradeManager) open(direction int, price, opAmount float64) *SummaryPosition {
-	var initPosition = future.getPosition(direction)
+func (future *FutureTradeManager) open(ctx context.Context, direction int, price, opAmount float64) (*SummaryPosition, error) {
+	if direction != goex.OPEN_BUY && direction != goex.OPEN_SELL {
+		return nil, fmt.Errorf("%w: open direction %d", ErrUnknownSide, direction)
+	}
+	var inst = future.instrument()
+	rep, ticker, err := future.startReport(ctx, direction, opAmount)
+	if err != nil {
+		return nil, err
+	}
+	initPosition, err := future.getPosition(ctx, direction)
+	if err != nil {
+		return nil, err
+	}
+	fills, err := future.newFills(ctx, rep)
+	if err != nil {
+		return nil, err
+	}
 	var isFirst = true
 	var initAmount = 0.0
 	var positionNow = initPosition
 	var step = 0.0
+	var stopErr error
 	if initPosition != nil {
 		initAmount = initPosition.Amount
 	}
@@ -143,52 +193,66 @@ func (future *FutureTradeManager) open(direction int, price, opAmount float64) *
 		if isFirst {
 			isFirst = false
 		} else {
-			positionNow = future.getPosition(direction)
+			if positionNow, stopErr = future.getPosition(ctx, direction); stopErr != nil {
+				break
+			}
 			if positionNow != nil {
 				needOpen = opAmount - (positionNow.Amount - initAmount)
 			}
 		}
-		if needOpen < 1 {
+		if needOpen < inst.MinAmount(0) || inst.FloorAmount(needOpen) <= 0 {
 			break
 		}
 		if step > future.openPositionSlideGrowthRateMax {
 			break
 		}
-		var amount = needOpen
-		//var orderId string
-		if direction == goex.OPEN_BUY {
-			future.exchange.PlaceFutureOrder(
-				future.pair,
-				future.contractType,
-				utils.Float64RoundString(price+future.slidePrice*(1+step), future.priceDot),
-				utils.Float64RoundString(amount, future.amountDot),
-				goex.OPEN_BUY,
-				0,
-				future.marginLevel,
-			)
-		} else if direction == goex.OPEN_SELL {
-			future.exchange.PlaceFutureOrder(
-				future.pair,
-				future.contractType,
-				utils.Float64RoundString(price-future.slidePrice*(1+step), future.priceDot),
-				utils.Float64RoundString(amount, future.amountDot),
-				goex.OPEN_SELL,
-				0,
-				future.marginLevel,
-			)
+		if stopErr = ctx.Err(); stopErr != nil {
+			break
 		}
-		for {
-			var orders = utils.RE(future.exchange.GetUnfinishFutureOrders, future.pair, future.contractType).([]goex.FutureOrder)
-			if len(orders) == 0 {
-				break
+		var amount = inst.FloorAmount(needOpen)
+		if future.opMode == OPMODE_ICEBERG {
+			amount = math.Min(amount, future.iceberg.visible(inst, inst.MinAmount(0)))
+		}
+		var orderPrice = price + future.slidePrice*(1+step)
+		if direction == goex.OPEN_SELL {
+			orderPrice = price - future.slidePrice*(1+step)
+		}
+		if stopErr = fills.journal.placing(inst.RoundPrice(orderPrice), amount); stopErr != nil {
+			break
+		}
+		orderId, err := future.exchange.PlaceFutureOrder(
+			future.pair,
+			future.contractType,
+			inst.FormatPrice(orderPrice),
+			inst.FormatAmount(amount),
+			direction,
+			0,
+			future.marginLevel,
+		)
+		if err == nil {
+			fills.add(orderId, inst.RoundPrice(orderPrice), amount, passive(rep.IsBuy(), orderPrice, ticker))
+			if future.opMode == OPMODE_ICEBERG {
+				stopErr = sleepCtx(ctx, future.retryDelayMs) //让可见部分挂一会
 			}
-			time.Sleep(future.retryDelayMs)
-			for j := 0; j < len(orders); j++ {
-				future.exchange.FutureCancelOrder(future.pair, future.contractType, orders[j].OrderID2)
-				if j < (len(orders) - 1) {
-					time.Sleep(future.retryDelayMs)
-				}
+		} else {
+			fills.journal.placeFailed(err)
+		}
+		if err := future.settle(ctx, fills, "slide step expired"); err != nil && stopErr == nil {
+			stopErr = err
+		}
+		if stopErr == nil && err == nil && future.opMode == OPMODE_ICEBERG && fills.byID[orderId].Filled >= amount {
+			stopErr = sleepCtx(ctx, future.iceberg.refreshDelay()) //整片成交, 不加滑价, 稍后补单
+			if stopErr == nil {
+				continue
+			}
+		}
+		if stopErr != nil {
+			if now, err := future.getPosition(ctx, direction); err == nil {
+				positionNow = now
+			} else {
+				future.logger.Warningf("position after stopping: %v", err)
 			}
+			break
 		}
 		step += future.slideGrowthRate
 	}
@@ -196,38 +260,76 @@ func (future *FutureTradeManager) open(direction int, price, opAmount float64) *
 		Price:    0,
 		Amount:   0,
 		Position: positionNow,
+		Report:   future.finishReport(rep, fills),
+	}
+	if stopErr == nil {
+		stopErr = fills.journal.failed()
 	}
 	if positionNow == nil {
-		return pos
+		return pos, stopErr
 	}
 	if initPosition == nil {
 		pos.Price = positionNow.Price
 		pos.Amount = positionNow.Amount
 	} else {
 		pos.Amount = positionNow.Amount - initPosition.Amount
-		pos.Price = utils.Float64Round(((positionNow.Price*positionNow.Amount)-(initPosition.Price*initPosition.Amount))/pos.Amount, future.priceDot)
+		if pos.Amount != 0 {
+			pos.Price = utils.Float64Round(((positionNow.Price*positionNow.Amount)-(initPosition.Price*initPosition.Amount))/pos.Amount, future.priceDot)
+		}
 	}
-	return pos
+	return pos, stopErr
 }
 
-//
+// cover stops placing orders once ctx is done or the journal fails, like
+// open.
 // direction : goex.CLOSE_BUY, goex.CLOSE_SELL
-func (future *FutureTradeManager) cover(direction int, opAmount, price float64) float64 {
+func (future *FutureTradeManager) cover(ctx context.Context, direction int, opAmount, price float64) (*ExecutionReport, error) {
+	if direction != goex.CLOSE_BUY && direction != goex.CLOSE_SELL {
+		return nil, fmt.Errorf("%w: cover direction %d", ErrUnknownSide, direction)
+	}
+	var inst = future.instrument()
+	rep, ticker, err := future.startReport(ctx, direction, opAmount)
+	if err != nil {
+		return nil, err
+	}
+	var entry *Position //平仓前的持仓, 用于计算已实现盈亏
+	if direction == goex.CLOSE_BUY {
+		entry, err = future.getPosition(ctx, goex.OPEN_BUY)
+	} else {
+		entry, err = future.getPosition(ctx, goex.OPEN_SELL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fills, err := future.newFills(ctx, rep)
+	if err != nil {
+		return nil, err
+	}
 	var initP = make([]goex.FuturePosition, 0)
 	var positions = make([]goex.FuturePosition, 0)
 	var isFirst = true
-	var orderId string
-	//var err error
 	var step = 0.0
-	var index = 0
+	var stopErr error
 	for {
 		var n = 0
-		positions = utils.RE(future.exchange.GetFuturePosition, future.pair, future.contractType).([]goex.FuturePosition)
+		var sliced = future.opMode == OPMODE_ICEBERG //本轮冰山单每片都已成交
+		var placed = make([]string, 0)
+		if stopErr = ctx.Err(); stopErr != nil {
+			break
+		}
+		res, err := reCtx(ctx, future.retryDelayMs, future.exchange.GetFuturePosition, future.pair, future.contractType)
+		if err != nil {
+			stopErr = err
+			break
+		}
+		positions = res.([]goex.FuturePosition)
 		if isFirst == true {
-			if len(positions) > 1 || (direction != goex.CLOSE_BUY && direction != goex.CLOSE_SELL) {
-				future.logger.Fatalln("有多，空双向持仓，并且参数direction未明确方向！或 direction 参数异常：", direction)
+			if len(positions) > 1 {
+				future.logger.Errorln("有多，空双向持仓，并且参数direction未明确方向！", direction)
+				fills.journal.done(nil, ErrAmbiguousPosition.Error())
+				return nil, ErrAmbiguousPosition
 			}
-			copy(initP, positions)
+			initP = append(initP, positions...)
 			isFirst = false
 		}
 		for i := 0; i < len(positions); i++ {
@@ -237,110 +339,358 @@ func (future *FutureTradeManager) cover(direction int, opAmount, price float64)
 				continue
 			}
 			var amount = 0.0
+			var orderPrice = 0.0
 			if direction == goex.CLOSE_BUY {
 				amount = opAmount - (initP[i].BuyAmount - positions[i].BuyAmount)
-			} else if direction == goex.CLOSE_BUY {
+				orderPrice = price - future.slidePrice*(1+step)
+			} else if direction == goex.CLOSE_SELL {
 				amount = opAmount - (initP[i].SellAmount - positions[i].SellAmount)
+				orderPrice = price + future.slidePrice*(1+step)
 			}
-
-			if amount == 0 {
+			amount = inst.FloorAmount(amount)
+			if amount <= 0 || amount < inst.MinQty {
 				continue
 			}
-			if direction == goex.CLOSE_BUY {
-				orderId, _ = future.exchange.PlaceFutureOrder(
-					future.pair,
-					future.contractType,
-					utils.Float64RoundString(price-future.slidePrice*(1+step), future.priceDot),
-					utils.Float64RoundString(amount, future.amountDot),
-					goex.CLOSE_BUY,
-					0,
-					future.marginLevel,
-				)
-				n++
-			} else if direction == goex.CLOSE_SELL {
-				orderId, _ = future.exchange.PlaceFutureOrder(
-					future.pair,
-					future.contractType,
-					utils.Float64RoundString(price+future.slidePrice*(1+step), future.priceDot),
-					utils.Float64RoundString(amount, future.amountDot),
-					goex.CLOSE_SELL,
-					0,
-					future.marginLevel,
-				)
-				n++
+			if future.opMode == OPMODE_ICEBERG {
+				amount = math.Min(amount, future.iceberg.visible(inst, inst.MinAmount(0)))
+			}
+			if stopErr = fills.journal.placing(inst.RoundPrice(orderPrice), amount); stopErr != nil {
+				break
 			}
-			index = i
+			orderId, err := future.exchange.PlaceFutureOrder(
+				future.pair,
+				future.contractType,
+				inst.FormatPrice(orderPrice),
+				inst.FormatAmount(amount),
+				direction,
+				0,
+				future.marginLevel,
+			)
+			if err == nil {
+				fills.add(orderId, inst.RoundPrice(orderPrice), amount, passive(rep.IsBuy(), orderPrice, ticker))
+				placed = append(placed, orderId)
+			} else {
+				fills.journal.placeFailed(err)
+				sliced = false
+			}
+			n++
 		}
 		if n == 0 {
 			break
 		}
-		time.Sleep(future.retryDelayMs)
-
-		future.exchange.FutureCancelOrder(future.pair, future.contractType, orderId)
+		if stopErr == nil {
+			stopErr = sleepCtx(ctx, future.retryDelayMs)
+		}
+		if err := future.settle(ctx, fills, "slide step expired"); err != nil && stopErr == nil {
+			stopErr = err
+		}
+		if stopErr != nil {
+			break
+		}
+		for _, id := range placed {
+			if child := fills.byID[id]; child.Filled < child.Amount {
+				sliced = false
+			}
+		}
+		if sliced {
+			if stopErr = sleepCtx(ctx, future.iceberg.refreshDelay()); stopErr != nil {
+				break
+			}
+			continue
+		}
 		step += future.slideGrowthRate
 		if step > future.coverPositionSlideGrowthRateMax {
 			break
 		}
 	}
+	rep = future.finishReport(rep, fills)
+	if stopErr == nil {
+		stopErr = fills.journal.failed()
+	}
+	if entry != nil && rep.Filled > 0 {
+		var pnl = (rep.VWAP - entry.Price) * rep.Filled * future.getContractValue()
+		if direction == goex.CLOSE_SELL {
+			pnl = -pnl
+		}
+		future.realised += pnl
+	}
+	return rep, stopErr
+}
 
-	var nowP = utils.RE(future.exchange.GetFuturePosition, future.pair, future.contractType).([]goex.FuturePosition)
-	if len(nowP)-1 < index ||
-		(nowP[index].BuyAmount != initP[index].BuyAmount && direction == goex.CLOSE_BUY) ||
-		(nowP[index].SellAmount != initP[index].SellAmount && direction == goex.CLOSE_SELL) {
-		if len(initP) == 0 {
-			return 0
-		} else {
-			if direction == goex.CLOSE_BUY {
-				return initP[index].BuyAmount
-			} else if direction == goex.CLOSE_SELL {
-				return initP[index].SellAmount
+// startReport opens the report of one open or cover call, taking the mid of
+// the contract's ticker, which is also returned, as arrival price.
+func (future *FutureTradeManager) startReport(ctx context.Context, openType int, opAmount float64) (*ExecutionReport, *goex.Ticker, error) {
+	var rep = &ExecutionReport{
+		Pair:         future.pair,
+		ContractType: future.contractType,
+		Side:         goex.SELL,
+		OpenType:     openType,
+		Requested:    opAmount,
+		StartedAt:    time.Now(),
+	}
+	if openType == goex.OPEN_BUY || openType == goex.CLOSE_SELL {
+		rep.Side = goex.BUY
+	}
+	res, err := reCtx(ctx, future.retryDelayMs, future.exchange.GetFutureTicker, future.pair, future.contractType)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ticker = res.(*goex.Ticker)
+	rep.ArrivalPrice = (ticker.Buy + ticker.Sell) / 2
+	return rep, ticker, nil
+}
+
+// passive reports whether a limit order at price rests on the book of ticker
+// instead of crossing it, i.e. whether it pays the maker fee.
+func passive(isBuy bool, price float64, ticker *goex.Ticker) bool {
+	if isBuy {
+		return price < ticker.Sell
+	}
+	return price > ticker.Buy
+}
+
+func (future *FutureTradeManager) finishReport(rep *ExecutionReport, fills *orderFills) *ExecutionReport {
+	rep.Children = fills.children
+	var contractValue = 1.0
+	if future.fees != nil {
+		contractValue = future.getContractValue()
+		chargeFuture(rep, future.fees.Schedule(future.exchange.GetExchangeName(), future.pair), contractValue)
+	}
+	var diffMoney, dealAmount = fills.sum()
+	rep.finish(diffMoney, utils.Float64Round(dealAmount, 8), contractValue)
+	future.feesPaid += rep.Fees
+	fills.journal.done(rep, "")
+	return rep
+}
+
+// getContractValue asks the exchange once for the value of one contract,
+// assuming 1 if it cannot tell.
+func (future *FutureTradeManager) getContractValue() float64 {
+	if future.contractValue == 0 {
+		cv, err := future.exchange.GetContractValue(future.pair)
+		if err != nil || cv <= 0 {
+			future.logger.Warningf("contract value %s: %v, assuming 1", future.pair.ToSymbol("_"), err)
+			cv = 1
+		}
+		future.contractValue = cv
+	}
+	return future.contractValue
+}
+
+// settle cancels the child orders that are still open, and only those, and
+// reads them back, noting reason on those that closed unfilled or partly
+// filled. The first order that could not be closed fails it.
+func (future *FutureTradeManager) settle(ctx context.Context, fills *orderFills, reason string) error {
+	var firstErr error
+	for _, id := range fills.open() {
+		order, err := future.cancel(ctx, id)
+		if order != nil {
+			fills.updateFuture(order)
+			if order.Status == goex.ORDER_CANCEL {
+				fills.cancelled(id, reason)
 			}
 		}
-	} else {
-		if direction == goex.CLOSE_BUY {
-			return initP[index].BuyAmount - nowP[index].BuyAmount
-		} else if direction == goex.CLOSE_SELL {
-			return initP[index].SellAmount - nowP[index].SellAmount
+		if err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
-	return 0
+	return firstErr
 }
 
-func (future *FutureTradeManager) GetAccount() *Account {
-	var account = new(Account)
+// cancel withdraws order id and reads it back until the exchange reports it
+// closed, cancelling again every retryDelayMs. A failed cancel is only
+// logged, as the order may have filled meanwhile, which the read tells.
+// Once ctx is done one more cancel and read are made, see reFinal, and an
+// order still open then is returned with the error.
+func (future *FutureTradeManager) cancel(ctx context.Context, id string) (*goex.FutureOrder, error) {
 	for {
-		acc := utils.RE(future.exchange.GetFutureUserinfo).(*goex.FutureAccount)
-		for _, v := range acc.FutureSubAccounts {
-			if v.Currency == future.pair.CurrencyB {
-				account.Balance = v.KeepDeposit
-				account.FrozenBalance = v.KeepDeposit - v.AccountRights
-			} else if v.Currency == future.pair.CurrencyA {
-				account.Balance = v.KeepDeposit
-				account.FrozenBalance = v.KeepDeposit - v.AccountRights
+		if _, err := future.exchange.FutureCancelOrder(future.pair, future.contractType, id); err != nil {
+			future.logger.Warningf("cancel order %s failed: %v", id, err)
+		}
+		res, err := reFinal(ctx, future.retryDelayMs, future.exchange.GetFutureOrder, id, future.pair, future.contractType)
+		if err != nil {
+			return nil, fmt.Errorf("cancel order %s: %w", id, err)
+		}
+		var order = res.(*goex.FutureOrder)
+		if statusClosed(order.Status) {
+			return order, nil
+		}
+		if err = ctx.Err(); err == nil {
+			err = sleepCtx(ctx, future.retryDelayMs)
+		}
+		if err != nil {
+			return order, fmt.Errorf("cancel order %s: %w", id, err)
+		}
+	}
+}
+
+// search looks id up for Recover: a nil order when the exchange says it
+// does not know id, an error when it could not tell.
+func (future *FutureTradeManager) search(id string) (*goex.FutureOrder, error) {
+	order, err := future.exchange.GetFutureOrder(id, future.pair, future.contractType)
+	if orderNotFound(err) {
+		return nil, nil
+	}
+	return order, err
+}
+
+func (future *FutureTradeManager) GetAccount() (*Account, error) {
+	return future.GetAccountCtx(context.Background())
+}
+
+// GetAccountCtx is GetAccount bounded by ctx. The margin is read from the
+// quote currency's account, or from the base currency's when the exchange
+// keeps none in the quote currency, as for coin-margined contracts.
+func (future *FutureTradeManager) GetAccountCtx(ctx context.Context) (*Account, error) {
+	res, err := reCtx(ctx, future.retryDelayMs, future.exchange.GetFutureUserinfo)
+	if err != nil {
+		return nil, err
+	}
+	var account = &Account{Pair: future.pair}
+	var margin *goex.FutureSubAccount
+	for _, v := range res.(*goex.FutureAccount).FutureSubAccounts {
+		if v.Currency == future.pair.CurrencyB {
+			margin = &v
+			break
+		}
+		if v.Currency == future.pair.CurrencyA {
+			margin = &v
+		}
+	}
+	if margin != nil {
+		account.Balance = margin.KeepDeposit
+		account.FrozenBalance = margin.KeepDeposit - margin.AccountRights
+	}
+	return account, nil
+}
+
+// CancelAll cancels every unfinished order of the contract.
+func (future *FutureTradeManager) CancelAll() error {
+	return future.CancelAllCtx(context.Background())
+}
+
+// CancelAllCtx is CancelAll bounded by ctx. A cancel the exchange refuses is
+// logged and tried again on the next pass.
+func (future *FutureTradeManager) CancelAllCtx(ctx context.Context) error {
+	for {
+		res, err := reCtx(ctx, future.retryDelayMs, future.exchange.GetUnfinishFutureOrders, future.pair, future.contractType)
+		if err != nil {
+			return err
+		}
+		var orders = res.([]goex.FutureOrder)
+		if len(orders) == 0 {
+			return nil
+		}
+		if err = sleepCtx(ctx, future.retryDelayMs); err != nil {
+			return err
+		}
+		for j := 0; j < len(orders); j++ {
+			if _, err = future.exchange.FutureCancelOrder(future.pair, future.contractType, orders[j].OrderID2); err != nil {
+				future.logger.Warningf("cancel order %s failed: %v", orders[j].OrderID2, err)
+			}
+			if j < (len(orders) - 1) {
+				if err = sleepCtx(ctx, future.retryDelayMs); err != nil {
+					return err
+				}
 			}
 		}
 	}
-	return account
 }
 
-func (future *FutureTradeManager) OpenLong(price, opAmount float64) *SummaryPosition {
-	return future.open(goex.OPEN_BUY, opAmount, price)
+// GetPosition reports the position held on one side of the contract, or nil
+// when there is none.
+// direction : goex.OPEN_BUY, goex.OPEN_SELL
+func (future *FutureTradeManager) GetPosition(direction int) (*Position, error) {
+	return future.GetPositionCtx(context.Background(), direction)
+}
+
+// GetPositionCtx is GetPosition bounded by ctx.
+func (future *FutureTradeManager) GetPositionCtx(ctx context.Context, direction int) (*Position, error) {
+	if direction != goex.OPEN_BUY && direction != goex.OPEN_SELL {
+		return nil, fmt.Errorf("%w: position direction %d", ErrUnknownSide, direction)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return future.getPosition(ctx, direction)
+}
+
+func (future *FutureTradeManager) OpenLong(price, opAmount float64) (*SummaryPosition, error) {
+	return future.open(context.Background(), goex.OPEN_BUY, price, opAmount)
 }
 
-func (future *FutureTradeManager) OpenShort(price, opAmount float64) *SummaryPosition {
-	return future.open(goex.OPEN_SELL, opAmount, price)
+// OpenLongCtx is OpenLong that stops placing orders once ctx is done. The
+// orders already placed are cancelled and what was opened is returned with
+// ctx.Err().
+func (future *FutureTradeManager) OpenLongCtx(ctx context.Context, price, opAmount float64) (*SummaryPosition, error) {
+	return future.open(ctx, goex.OPEN_BUY, price, opAmount)
 }
 
-func (future *FutureTradeManager) CloseLong(price, opAmount float64) float64 {
-	return future.cover(goex.CLOSE_BUY, opAmount, price)
+func (future *FutureTradeManager) OpenShort(price, opAmount float64) (*SummaryPosition, error) {
+	return future.open(context.Background(), goex.OPEN_SELL, price, opAmount)
 }
 
-func (future *FutureTradeManager) CloseShort(price, opAmount float64) float64 {
-	return future.cover(goex.CLOSE_SELL, opAmount, price)
+func (future *FutureTradeManager) OpenShortCtx(ctx context.Context, price, opAmount float64) (*SummaryPosition, error) {
+	return future.open(ctx, goex.OPEN_SELL, price, opAmount)
 }
 
-func (future *FutureTradeManager) Profit(price, opAmount float64) float64 {
-	var accountNow = future.GetAccount()
+func (future *FutureTradeManager) CloseLong(price, opAmount float64) (*ExecutionReport, error) {
+	return future.cover(context.Background(), goex.CLOSE_BUY, opAmount, price)
+}
+
+// CloseLongCtx is CloseLong that stops placing orders once ctx is done, see
+// OpenLongCtx.
+func (future *FutureTradeManager) CloseLongCtx(ctx context.Context, price, opAmount float64) (*ExecutionReport, error) {
+	return future.cover(ctx, goex.CLOSE_BUY, opAmount, price)
+}
+
+func (future *FutureTradeManager) CloseShort(price, opAmount float64) (*ExecutionReport, error) {
+	return future.cover(context.Background(), goex.CLOSE_SELL, opAmount, price)
+}
+
+func (future *FutureTradeManager) CloseShortCtx(ctx context.Context, price, opAmount float64) (*ExecutionReport, error) {
+	return future.cover(ctx, goex.CLOSE_SELL, opAmount, price)
+}
+
+// Profit is the change of the margin balance since the manager was built.
+//
+// With a FeeModel it is instead worked out from the manager's own fills: the
+// PnL realised by CloseLong/CloseShort less every fee paid, plus, when price
+// and opAmount are positive, what closing up to opAmount contracts of each
+// open side at price would bring after the taker fee.
+func (future *FutureTradeManager) Profit(price, opAmount float64) (float64, error) {
+	if future.fees != nil {
+		return future.netProfit(price, opAmount), nil
+	}
+	if future.initAccount == nil {
+		return 0, ErrNoInitialAccount
+	}
+	accountNow, err := future.GetAccount()
+	if err != nil {
+		return 0, err
+	}
 	future.logger.Infoln("NOW:", accountNow, "--account:", future.initAccount)
-	return utils.Float64Round(accountNow.Balance - future.initAccount.Balance)
+	return utils.Float64Round(accountNow.Balance - future.initAccount.Balance), nil
+}
+
+func (future *FutureTradeManager) netProfit(price, opAmount float64) float64 {
+	var profit = future.realised - future.feesPaid
+	if price <= 0 || opAmount <= 0 {
+		return utils.Float64Round(profit, 8)
+	}
+	var cv = future.getContractValue()
+	var taker = future.fees.Schedule(future.exchange.GetExchangeName(), future.pair).Taker
+	for _, direction := range []int{goex.OPEN_BUY, goex.OPEN_SELL} {
+		pos, err := future.getPosition(context.Background(), direction)
+		if err != nil || pos == nil || pos.Amount <= 0 {
+			continue
+		}
+		var amount = math.Min(pos.Amount, opAmount)
+		var pnl = (price - pos.Price) * amount * cv
+		if direction == goex.OPEN_SELL {
+			pnl = -pnl
+		}
+		profit += pnl - amount*cv*price*taker
+	}
+	return utils.Float64Round(profit, 8)
 }
@@ -1,58 +1,156 @@
 package trade
 
 import (
+	"context"
+	"errors"
+	"github.com/goex-top/goex_trade/mockex"
 	"github.com/nntaoli-project/GoEx"
-	"github.com/nntaoli-project/GoEx/builder"
-	"net"
-	"net/http"
-	"net/url"
 	"testing"
 	"time"
 )
 
-var httpProxyClient = &http.Client{
-	Transport: &http.Transport{
-		Proxy: func(req *http.Request) (*url.URL, error) {
-			return &url.URL{
-				Scheme: "socks5",
-				Host:   "127.0.0.1:1080"}, nil
-		},
-		Dial: (&net.Dialer{
-			Timeout: 10 * time.Second,
-		}).Dial,
-	},
-	Timeout: 10 * time.Second,
-}
-
-var futureExchange = builder.NewCustomAPIBuilder(httpProxyClient).APIKey("xxxx").APISecretkey("xxxx").FutureBuild(goex.BITMEX)
-var futureMgr = NewFutureTradeManager(
-	futureExchange,
-	goex.NewCurrencyPair2("XBT_USD"),
-	"",
-	OPMODE_MAKE,
-	1.0,
-	0.01,
-	0.05,
-	0.05,
-	500,
-	nil,
-	2,
-	1,
-)
+var futurePair = goex.BTC_USD
+
+func newMockFuture() (*mockex.Exchange, *FutureTradeManager) {
+	var ex = mockex.New("mock")
+	ex.SetMargin(goex.USD, 1000)
+	ex.FutureMarket(futurePair, goex.QUARTER_CONTRACT).SetTicker(99.5, 100.5)
+	var mgr = NewFutureTradeManager(
+		ex.Future(),
+		futurePair,
+		goex.QUARTER_CONTRACT,
+		OPMODE_MAKE,
+		1.0,
+		0.01,
+		0.05,
+		0.05,
+		1,
+		nil,
+		2,
+		0,
+	)
+	return ex, mgr
+}
 
 func TestNewFutureTradeManager(t *testing.T) {
-	t.Log(futureExchange.GetExchangeName())
+	_, mgr := newMockFuture()
+	if mgr.initAccount == nil || mgr.initAccount.Balance != 1000 {
+		t.Fatalf("unexpected initial account %+v", mgr.initAccount)
+	}
 }
-func TestNewFutureTradeManager2(t *testing.T) {
-	t.Log(futureExchange.GetFuturePosition(futureMgr.pair, ""))
-	t.Log(futureMgr.getPosition(goex.SELL))
+
+func TestNewFutureTradeManager_AccountError(t *testing.T) {
+	var ex = mockex.New("mock")
+	ex.SetMargin(goex.USD, 1000)
+	var boom = errors.New("boom")
+	ex.Fail("GetFutureUserinfo", 1, boom)
+	var mgr = NewFutureTradeManager(ex.Future(), futurePair, goex.QUARTER_CONTRACT, OPMODE_TAKE, 1, 0.01, 0.05, 0.05, 1, nil, 2, 0)
+	if mgr.initAccount == nil || mgr.initAccount.Balance != 1000 {
+		t.Fatalf("transient error left initial account %+v", mgr.initAccount)
+	}
+
+	ex.Fail("GetFutureUserinfo", 1<<20, boom)
+	var cfg = DefaultFutureConfig()
+	cfg.RetryDelay = time.Millisecond
+	if _, err := NewFutureTradeManagerWithConfig(ex.Future(), futurePair, cfg); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want the account read to give up, got %v", err)
+	}
+	mgr = NewFutureTradeManager(ex.Future(), futurePair, goex.QUARTER_CONTRACT, OPMODE_TAKE, 1, 0.01, 0.05, 0.05, 1, nil, 2, 0)
+	if _, err := mgr.Profit(0, 0); err != ErrNoInitialAccount {
+		t.Fatalf("want ErrNoInitialAccount, got %v", err)
+	}
 }
 
-func TestFutureTradeManager_GetAccount(t *testing.T) {
-	t.Log(futureMgr.GetAccount())
+func TestFutureTradeManager_GetAccountCoinMargined(t *testing.T) {
+	var ex = mockex.New("mock")
+	ex.SetMargin(goex.BTC, 2)
+	var mgr = NewFutureTradeManager(ex.Future(), futurePair, goex.QUARTER_CONTRACT, OPMODE_TAKE, 1, 0.01, 0.05, 0.05, 1, nil, 2, 0)
+	ex.SetMargin(goex.USD, 1000)
+	for i := 0; i < 20; i++ {
+		if acc, err := mgr.GetAccount(); err != nil || acc.Balance != 1000 {
+			t.Fatalf("want the quote currency's margin, got %+v, %v", acc, err)
+		}
+	}
+	if mgr.initAccount == nil || mgr.initAccount.Balance != 2 {
+		t.Fatalf("want the base currency's margin, got %+v", mgr.initAccount)
+	}
+}
 
+func TestFutureTradeManager_OpenCloseLong(t *testing.T) {
+	ex, mgr := newMockFuture()
+	pos, err := mgr.OpenLong(100, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos.Amount != 5 || pos.Price != 100.5 {
+		t.Fatalf("unexpected position %+v", pos)
+	}
+	if rep := pos.Report; rep.Filled != 5 || rep.VWAP != 100.5 || rep.ArrivalPrice != 100 || rep.Slippage != 0.5 || len(rep.Children) != 1 {
+		t.Fatalf("unexpected open report %+v", rep)
+	}
+	ex.FutureMarket(futurePair, goex.QUARTER_CONTRACT).SetTicker(109.5, 110.5)
+	rep, err := mgr.CloseLong(110, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Filled != 5 || rep.IsBuy() || rep.VWAP != 109.5 || rep.Slippage != 0.5 {
+		t.Fatalf("unexpected close report %+v", rep)
+	}
+	profit, err := mgr.Profit(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profit != 45 {
+		t.Fatalf("want profit 45, got %f", profit)
+	}
 }
 
-func TestFutureTradeManager_Profit(t *testing.T) {
-	t.Log(futureMgr.Profit(10, 10))
+func TestFutureTradeManager_OpenShort(t *testing.T) {
+	_, mgr := newMockFuture()
+	pos, err := mgr.OpenShort(100, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos.Amount != 3 || pos.Price != 99.5 {
+		t.Fatalf("unexpected position %+v", pos)
+	}
+	if p, _ := mgr.GetPosition(goex.OPEN_SELL); p == nil || p.Price != 99.5 {
+		t.Fatalf("unexpected short position %+v", p)
+	}
+}
+
+func TestFutureTradeManager_GetAccount(t *testing.T) {
+	_, mgr := newMockFuture()
+	acc, err := mgr.GetAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.Balance != 1000 {
+		t.Fatalf("unexpected account %+v", acc)
+	}
+}
+
+func TestFutureTradeManager_CtxOutage(t *testing.T) {
+	ex, mgr := newMockFuture()
+	foreign, err := ex.Future().PlaceFutureOrder(futurePair, goex.QUARTER_CONTRACT, "90", "1", goex.OPEN_BUY, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mgr.OpenLong(101, 2); err != nil {
+		t.Fatal(err)
+	}
+	if open := ex.OpenOrders(); len(open) != 1 || open[0] != foreign {
+		t.Fatalf("want only the foreign order left open, got %v", open)
+	}
+
+	ex.Fail("GetFuturePosition", 1000, errors.New("maintenance"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var started = time.Now()
+	if _, err = mgr.CloseLongCtx(ctx, 100, 2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want the deadline, got %v", err)
+	}
+	if took := time.Since(started); took > time.Second {
+		t.Fatalf("close outlived its deadline by %v", took)
+	}
 }
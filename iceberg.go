@@ -0,0 +1,47 @@
+package trade
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Iceberg configures OPMODE_ICEBERG: only a slice of about Visible rests on
+// the book, and the next one is placed a little after it has filled.
+type Iceberg struct {
+	Visible       float64       //可见数量
+	Variance      float64       //可见数量随机浮动比例, [0, 1)
+	RefreshDelay  time.Duration //补单前等待
+	RefreshJitter time.Duration //补单等待的随机增加量上限
+}
+
+func (ice *Iceberg) Validate() error {
+	switch {
+	case ice.Visible < 0:
+		return fmt.Errorf("%w: negative iceberg visible %v", ErrInvalidConfig, ice.Visible)
+	case ice.Variance < 0 || ice.Variance >= 1:
+		return fmt.Errorf("%w: iceberg variance %v outside [0, 1)", ErrInvalidConfig, ice.Variance)
+	case ice.RefreshDelay < 0 || ice.RefreshJitter < 0:
+		return fmt.Errorf("%w: negative iceberg refresh delay", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// visible draws the size of the next slice, rounded down to the lot size but
+// never below min.
+func (ice *Iceberg) visible(inst *Instrument, min float64) float64 {
+	var v = ice.Visible
+	if ice.Variance > 0 {
+		v *= 1 + ice.Variance*(2*rand.Float64()-1)
+	}
+	return math.Max(inst.FloorAmount(v), min)
+}
+
+// refreshDelay draws how long to wait before replenishing.
+func (ice *Iceberg) refreshDelay() time.Duration {
+	if ice.RefreshJitter <= 0 {
+		return ice.RefreshDelay
+	}
+	return ice.RefreshDelay + time.Duration(rand.Int63n(int64(ice.RefreshJitter)+1))
+}
@@ -0,0 +1,79 @@
+package trade
+
+import (
+	"errors"
+	"github.com/goex-top/goex_trade/mockex"
+	"github.com/nntaoli-project/GoEx"
+	"testing"
+	"time"
+)
+
+func TestIceberg_Visible(t *testing.T) {
+	var ice = Iceberg{Visible: 0.3, Variance: 0.5, RefreshDelay: time.Millisecond, RefreshJitter: time.Millisecond}
+	var inst = &Instrument{TickSize: 0.01, LotSize: 0.01}
+	for i := 0; i < 100; i++ {
+		if v := ice.visible(inst, 0.01); v < 0.15 || v > 0.45 {
+			t.Fatalf("slice %v outside 0.3±50%%", v)
+		}
+		if d := ice.refreshDelay(); d < time.Millisecond || d > 2*time.Millisecond {
+			t.Fatalf("delay %v outside [1ms, 2ms]", d)
+		}
+	}
+	if v := ice.visible(inst, 0.5); v != 0.5 {
+		t.Fatalf("want the minimum 0.5, got %v", v)
+	}
+}
+
+func TestSpotTradeManager_Iceberg(t *testing.T) {
+	var ex = mockex.New("mock")
+	ex.SetBalance(goex.USDT, 10000)
+	ex.Market(spotPair).SetTicker(99, 101)
+	mgr, err := NewSpotTradeManagerWithConfig(ex.Spot(), spotPair, DefaultSpotConfig(),
+		WithIceberg(Iceberg{Visible: 0.3}),
+		WithSlidePrice(2),
+		WithRetryDelay(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := mgr.Buy(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Filled != 1 || len(rep.Children) != 4 {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	for _, child := range rep.Children {
+		if child.Amount > 0.3 || child.Price != 101 {
+			t.Fatalf("slice too large %+v", child)
+		}
+	}
+	if _, err = NewSpotTradeManagerWithConfig(ex.Spot(), spotPair, DefaultSpotConfig(), WithOpMode(OPMODE_ICEBERG)); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("want ErrInvalidConfig without a visible amount, got %v", err)
+	}
+}
+
+func TestFutureTradeManager_Iceberg(t *testing.T) {
+	_, mgr := newMockFuture()
+	mgr.opMode = OPMODE_ICEBERG
+	mgr.iceberg = Iceberg{Visible: 2}
+	pos, err := mgr.OpenLong(100, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos.Amount != 5 || len(pos.Report.Children) != 3 {
+		t.Fatalf("unexpected open %+v %+v", pos, pos.Report)
+	}
+	rep, err := mgr.CloseLong(100, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Filled != 5 || len(rep.Children) != 3 {
+		t.Fatalf("unexpected close %+v", rep)
+	}
+	for _, child := range append(pos.Report.Children, rep.Children...) {
+		if child.Amount > 2 {
+			t.Fatalf("slice too large %+v", child)
+		}
+	}
+}
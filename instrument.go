@@ -0,0 +1,244 @@
+package trade
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/beaquant/utils"
+	"github.com/nntaoli-project/GoEx"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Instrument holds the trading filters of a pair or futures contract.
+type Instrument struct {
+	Pair         goex.CurrencyPair //货币对
+	ContractType string            //合约类型, 现货为空
+	TickSize     float64           //最小价格变动
+	LotSize      float64           //最小数量变动
+	MinNotional  float64           //最小下单金额(仅现货)
+	MinQty       float64           //最小下单数量
+}
+
+func (inst *Instrument) Validate() error {
+	switch {
+	case inst.TickSize <= 0:
+		return fmt.Errorf("%w: %s tickSize %v must be positive", ErrInvalidConfig, inst.Pair.ToSymbol("_"), inst.TickSize)
+	case inst.LotSize <= 0:
+		return fmt.Errorf("%w: %s lotSize %v must be positive", ErrInvalidConfig, inst.Pair.ToSymbol("_"), inst.LotSize)
+	case inst.MinNotional < 0 || inst.MinQty < 0:
+		return fmt.Errorf("%w: %s negative minimum", ErrInvalidConfig, inst.Pair.ToSymbol("_"))
+	}
+	return nil
+}
+
+// PriceDot is the number of decimals needed to print a tick multiple.
+func (inst *Instrument) PriceDot() int {
+	return stepDot(inst.TickSize)
+}
+
+// AmountDot is the number of decimals needed to print a lot multiple.
+func (inst *Instrument) AmountDot() int {
+	return stepDot(inst.LotSize)
+}
+
+// RoundPrice rounds price to the nearest tick.
+func (inst *Instrument) RoundPrice(price float64) float64 {
+	return utils.Float64Round(math.Round(price/inst.TickSize)*inst.TickSize, inst.PriceDot())
+}
+
+// FloorAmount rounds amount down to a lot multiple, so an order never asks
+// for more than the caller has.
+func (inst *Instrument) FloorAmount(amount float64) float64 {
+	return utils.Float64Round(math.Floor(amount/inst.LotSize+1e-9)*inst.LotSize, inst.AmountDot())
+}
+
+func (inst *Instrument) FormatPrice(price float64) string {
+	return strconv.FormatFloat(inst.RoundPrice(price), 'f', inst.PriceDot(), 64)
+}
+
+func (inst *Instrument) FormatAmount(amount float64) string {
+	return strconv.FormatFloat(inst.FloorAmount(amount), 'f', inst.AmountDot(), 64)
+}
+
+// MinAmount is the smallest lot multiple that satisfies both MinQty and,
+// when price is positive, MinNotional. It is never below one lot.
+func (inst *Instrument) MinAmount(price float64) float64 {
+	var min = math.Max(inst.MinQty, inst.LotSize)
+	if inst.MinNotional > 0 && price > 0 {
+		var lots = math.Ceil(inst.MinNotional/price/inst.LotSize - 1e-9)
+		min = math.Max(min, utils.Float64Round(lots*inst.LotSize, inst.AmountDot()))
+	}
+	return min
+}
+
+// stepDot counts the decimals of step, e.g. 0.05 -> 2, 10 -> 0.
+func stepDot(step float64) int {
+	var s = strconv.FormatFloat(step, 'f', -1, 64)
+	var i = strings.IndexByte(s, '.')
+	if i < 0 {
+		return 0
+	}
+	if len(s)-i-1 > maxDot {
+		return maxDot
+	}
+	return len(s) - i - 1
+}
+
+// dotInstrument is the instrument implied by the decimal precisions the
+// managers were configured with, used when no InstrumentSource is set.
+func dotInstrument(pair goex.CurrencyPair, contractType string, priceDot, amountDot int, minQty float64) *Instrument {
+	return &Instrument{
+		Pair:         pair,
+		ContractType: contractType,
+		TickSize:     math.Pow10(-priceDot),
+		LotSize:      math.Pow10(-amountDot),
+		MinQty:       minQty,
+	}
+}
+
+// InstrumentSource looks up the filters of a pair. contractType is empty for
+// spot pairs.
+type InstrumentSource interface {
+	Instrument(pair goex.CurrencyPair, contractType string) (*Instrument, error)
+}
+
+// InstrumentFunc adapts a function, typically one querying an exchange's
+// symbol info endpoint, to InstrumentSource.
+type InstrumentFunc func(pair goex.CurrencyPair, contractType string) (*Instrument, error)
+
+func (fn InstrumentFunc) Instrument(pair goex.CurrencyPair, contractType string) (*Instrument, error) {
+	return fn(pair, contractType)
+}
+
+// StaticInstruments is a fixed InstrumentSource keyed by pair and contract
+// type.
+type StaticInstruments map[string]*Instrument
+
+func NewStaticInstruments(instruments ...*Instrument) StaticInstruments {
+	var static = make(StaticInstruments, len(instruments))
+	for _, inst := range instruments {
+		static[instrumentKey(inst.Pair, inst.ContractType)] = inst
+	}
+	return static
+}
+
+func (static StaticInstruments) Instrument(pair goex.CurrencyPair, contractType string) (*Instrument, error) {
+	if inst, ok := static[instrumentKey(pair, contractType)]; ok {
+		return inst, nil
+	}
+	return nil, fmt.Errorf("%w: %s %s", ErrUnknownInstrument, pair.ToSymbol("_"), contractType)
+}
+
+func instrumentKey(pair goex.CurrencyPair, contractType string) string {
+	return pair.ToSymbol("_") + "|" + contractType
+}
+
+type instrumentRecord struct {
+	Pair         string  `json:"pair"`
+	ContractType string  `json:"contract_type"`
+	TickSize     float64 `json:"tick_size"`
+	LotSize      float64 `json:"lot_size"`
+	MinNotional  float64 `json:"min_notional"`
+	MinQty       float64 `json:"min_qty"`
+}
+
+// LoadInstruments reads a JSON array of instruments such as
+//
+//	[{"pair": "BTC_USDT", "tick_size": 0.01, "lot_size": 0.00001, "min_notional": 5}]
+func LoadInstruments(r io.Reader) (StaticInstruments, error) {
+	var records []instrumentRecord
+	var dec = json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&records); err != nil {
+		return nil, err
+	}
+	var instruments = make([]*Instrument, 0, len(records))
+	for _, rec := range records {
+		var inst = &Instrument{
+			Pair:         goex.NewCurrencyPair2(rec.Pair),
+			ContractType: rec.ContractType,
+			TickSize:     rec.TickSize,
+			LotSize:      rec.LotSize,
+			MinNotional:  rec.MinNotional,
+			MinQty:       rec.MinQty,
+		}
+		if err := inst.Validate(); err != nil {
+			return nil, err
+		}
+		instruments = append(instruments, inst)
+	}
+	return NewStaticInstruments(instruments...), nil
+}
+
+func LoadInstrumentsFile(path string) (StaticInstruments, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadInstruments(f)
+}
+
+// InstrumentCache remembers what source returned for ttl, or forever when
+// ttl is not positive. It is safe for concurrent use.
+type InstrumentCache struct {
+	source  InstrumentSource
+	ttl     time.Duration
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[string]cachedInstrument
+}
+
+type cachedInstrument struct {
+	inst    *Instrument
+	fetched time.Time
+}
+
+func NewInstrumentCache(source InstrumentSource, ttl time.Duration) *InstrumentCache {
+	return &InstrumentCache{
+		source:  source,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]cachedInstrument),
+	}
+}
+
+// Instrument returns the cached entry while it is fresh and asks the source
+// otherwise. If the source fails, the stale entry (if any) is returned along
+// with the error so callers can keep trading on the last known filters.
+func (cache *InstrumentCache) Instrument(pair goex.CurrencyPair, contractType string) (*Instrument, error) {
+	var key = instrumentKey(pair, contractType)
+	cache.mu.Lock()
+	var entry, ok = cache.entries[key]
+	cache.mu.Unlock()
+	if ok && !entry.fetched.IsZero() && (cache.ttl <= 0 || cache.now().Sub(entry.fetched) < cache.ttl) {
+		return entry.inst, nil
+	}
+	inst, err := cache.source.Instrument(pair, contractType)
+	if err == nil {
+		err = inst.Validate()
+	}
+	if err != nil {
+		return entry.inst, err
+	}
+	cache.mu.Lock()
+	cache.entries[key] = cachedInstrument{inst: inst, fetched: cache.now()}
+	cache.mu.Unlock()
+	return inst, nil
+}
+
+// Invalidate forces the next lookup of the pair to hit the source, e.g.
+// after the exchange rejected an order built from the cached filters.
+func (cache *InstrumentCache) Invalidate(pair goex.CurrencyPair, contractType string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if entry, ok := cache.entries[instrumentKey(pair, contractType)]; ok {
+		entry.fetched = time.Time{}
+		cache.entries[instrumentKey(pair, contractType)] = entry
+	}
+}
@@ -0,0 +1,120 @@
+package trade
+
+import (
+	"errors"
+	"github.com/goex-top/goex_trade/mockex"
+	"github.com/nntaoli-project/GoEx"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstrumentRounding(t *testing.T) {
+	var inst = &Instrument{Pair: spotPair, TickSize: 0.05, LotSize: 0.001, MinQty: 0.002, MinNotional: 10}
+	if p := inst.RoundPrice(101.26); p != 101.25 {
+		t.Fatalf("want 101.25, got %v", p)
+	}
+	if s := inst.FormatPrice(101.28); s != "101.30" {
+		t.Fatalf("want 101.30, got %s", s)
+	}
+	if a := inst.FloorAmount(0.12399); a != 0.123 {
+		t.Fatalf("want 0.123, got %v", a)
+	}
+	if s := inst.FormatAmount(0.3); s != "0.300" {
+		t.Fatalf("want 0.300, got %s", s)
+	}
+	if m := inst.MinAmount(0); m != 0.002 {
+		t.Fatalf("want MinQty without price, got %v", m)
+	}
+	if m := inst.MinAmount(3000); m != 0.004 {
+		t.Fatalf("want 0.004 to reach 10 notional, got %v", m)
+	}
+	var coarse = &Instrument{TickSize: 10, LotSize: 1}
+	if s := coarse.FormatPrice(1234); s != "1230" || coarse.PriceDot() != 0 {
+		t.Fatalf("unexpected coarse price %s", s)
+	}
+}
+
+func TestLoadInstruments(t *testing.T) {
+	static, err := LoadInstruments(strings.NewReader(`[
+		{"pair": "BTC_USDT", "tick_size": 0.01, "lot_size": 0.00001, "min_notional": 5},
+		{"pair": "BTC_USD", "contract_type": "quarter", "tick_size": 0.5, "lot_size": 1, "min_qty": 1}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, err := static.Instrument(goex.BTC_USD, goex.QUARTER_CONTRACT)
+	if err != nil || inst.TickSize != 0.5 {
+		t.Fatalf("unexpected instrument %+v, %v", inst, err)
+	}
+	if _, err = static.Instrument(goex.ETH_USDT, ""); !errors.Is(err, ErrUnknownInstrument) {
+		t.Fatalf("want ErrUnknownInstrument, got %v", err)
+	}
+	if _, err = LoadInstruments(strings.NewReader(`[{"pair": "BTC_USDT", "tick_size": 0}]`)); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("want ErrInvalidConfig, got %v", err)
+	}
+}
+
+func TestInstrumentCache(t *testing.T) {
+	var calls = 0
+	var fail error
+	var tick = 0.1
+	var cache = NewInstrumentCache(InstrumentFunc(func(pair goex.CurrencyPair, contractType string) (*Instrument, error) {
+		calls++
+		if fail != nil {
+			return nil, fail
+		}
+		return &Instrument{Pair: pair, TickSize: tick, LotSize: 0.01}, nil
+	}), time.Minute)
+	var now = time.Unix(1600000000, 0)
+	cache.now = func() time.Time { return now }
+
+	cache.Instrument(spotPair, "")
+	cache.Instrument(spotPair, "")
+	if calls != 1 {
+		t.Fatalf("want 1 fetch, got %d", calls)
+	}
+	now = now.Add(2 * time.Minute)
+	tick = 0.5
+	if inst, _ := cache.Instrument(spotPair, ""); calls != 2 || inst.TickSize != 0.5 {
+		t.Fatalf("expired entry not refreshed: %d calls, %+v", calls, inst)
+	}
+
+	fail = errors.New("down")
+	cache.Invalidate(spotPair, "")
+	inst, err := cache.Instrument(spotPair, "")
+	if err != fail || inst == nil || inst.TickSize != 0.5 {
+		t.Fatalf("want stale entry with error, got %+v, %v", inst, err)
+	}
+}
+
+func TestSpotTradeManager_Instruments(t *testing.T) {
+	var ex = mockex.New("mock")
+	ex.SetBalance(goex.USDT, 10000)
+	ex.Market(spotPair).SetTicker(99, 101)
+	ex.Market(spotPair).SetRules(mockex.Rules{TickSize: 0.5, LotSize: 0.01, MinNotional: 5})
+	var source = InstrumentFunc(func(pair goex.CurrencyPair, contractType string) (*Instrument, error) {
+		var r = ex.Market(pair).Rules()
+		return &Instrument{Pair: pair, TickSize: r.TickSize, LotSize: r.LotSize, MinNotional: r.MinNotional}, nil
+	})
+	// A slide of 0.3 is off tick and the amount has too many decimals for
+	// the lot size: both only go through because of the instrument.
+	mgr, err := NewSpotTradeManagerWithConfig(ex.Spot(), spotPair, DefaultSpotConfig(),
+		WithSlidePrice(0.3),
+		WithRetryDelay(time.Millisecond),
+		WithInstruments(NewInstrumentCache(source, 0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := mgr.Buy(0.5678)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Filled != 0.56 || rep.Children[0].Price != 101.5 {
+		t.Fatalf("unexpected fill %+v", rep)
+	}
+	if _, err = mgr.Buy(0.001); !errors.Is(err, ErrBelowMinStocks) {
+		t.Fatalf("want ErrBelowMinStocks, got %v", err)
+	}
+}
@@ -0,0 +1,726 @@
+package trade
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nntaoli-project/GoEx"
+	"github.com/sirupsen/logrus"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// JournalEvent is what a JournalEntry records.
+type JournalEvent int
+
+const (
+	JOURNAL_INTENT  JournalEvent = iota //开始一个请求
+	JOURNAL_PLACING                     //即将下单, 尚无订单ID
+	JOURNAL_PLACED                      //下单成功
+	JOURNAL_FILL                        //成交量增加
+	JOURNAL_CANCEL                      //决定撤单
+	JOURNAL_CLOSED                      //订单结束(成交|撤销|拒绝)
+	JOURNAL_DONE                        //请求结束
+)
+
+func (event JournalEvent) String() string {
+	switch event {
+	case JOURNAL_INTENT:
+		return "JOURNAL_INTENT"
+	case JOURNAL_PLACING:
+		return "JOURNAL_PLACING"
+	case JOURNAL_PLACED:
+		return "JOURNAL_PLACED"
+	case JOURNAL_FILL:
+		return "JOURNAL_FILL"
+	case JOURNAL_CANCEL:
+		return "JOURNAL_CANCEL"
+	case JOURNAL_CLOSED:
+		return "JOURNAL_CLOSED"
+	case JOURNAL_DONE:
+		return "JOURNAL_DONE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+func (event JournalEvent) MarshalText() ([]byte, error) {
+	return []byte(event.String()), nil
+}
+
+func (event *JournalEvent) UnmarshalText(text []byte) error {
+	for e := JOURNAL_INTENT; e <= JOURNAL_DONE; e++ {
+		if e.String() == string(text) {
+			*event = e
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown journal event %q", text)
+}
+
+// JournalEntry is one line of the order journal. Request ties the entries of
+// one Buy, Sell, OpenLong ... call together.
+type JournalEntry struct {
+	Time         time.Time        `json:"time"`
+	Event        JournalEvent     `json:"event"`
+	Request      string           `json:"request"`
+	Exchange     string           `json:"exchange"`
+	Pair         string           `json:"pair"`                    //如BTC_USDT
+	ContractType string           `json:"contract_type,omitempty"` //合约类型, 现货为空
+	Side         goex.TradeSide   `json:"side"`
+	OpenType     int              `json:"open_type,omitempty"` //期货: goex.OPEN_BUY|OPEN_SELL|CLOSE_BUY|CLOSE_SELL
+	OrderID      string           `json:"order_id,omitempty"`  //JOURNAL_PLACING及下单失败的JOURNAL_CLOSED为空
+	Price        float64          `json:"price,omitempty"`     //委托价, 请求结束时为成交均价
+	Amount       float64          `json:"amount,omitempty"`    //委托量, 请求开始时为请求数量
+	Filled       float64          `json:"filled,omitempty"`    //成交量, 请求结束时为总成交量
+	AvgPrice     float64          `json:"avg_price,omitempty"` //成交均价
+	Status       goex.TradeStatus `json:"status"`
+	Reason       string           `json:"reason,omitempty"`
+}
+
+// Journal is an append-only record of what the managers did, read back on
+// construction to find orders a crashed process left behind.
+type Journal interface {
+	Append(entry JournalEntry) error
+	Entries() ([]JournalEntry, error)
+}
+
+type journalFile struct {
+	path string
+	mu   sync.Mutex
+}
+
+// JournalCompacter is implemented by journals that can drop the entries of
+// finished requests, so that reading the journal back does not slow down as
+// it grows. Recover compacts such a journal once it has closed out what a
+// crash left behind.
+type JournalCompacter interface {
+	Compact() error
+}
+
+// NewJournalFile keeps the journal in path, one JSON entry per line. Every
+// append is synced to disk before it returns; a line cut short by a crash at
+// the end of the file is ignored when reading back. Several managers may
+// share one file as long as they share the Journal returned here, which is
+// also a JournalCompacter.
+func NewJournalFile(path string) Journal {
+	return &journalFile{path: path}
+}
+
+func (f *journalFile) Append(entry JournalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(data, '\n')); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (f *journalFile) Entries() ([]JournalEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.entries()
+}
+
+func (f *journalFile) entries() ([]JournalEntry, error) {
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []JournalEntry
+	var broken error //坏行之后还有内容才算错误
+	var scanner = bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var text = bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		if broken != nil {
+			return nil, broken
+		}
+		var entry JournalEntry
+		if err = json.Unmarshal(text, &entry); err != nil {
+			broken = fmt.Errorf("%s:%d: %w", f.path, line, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Compact rewrites the file without the requests that are done and whose
+// orders are all closed. The rewrite replaces the file by a rename, so a
+// crash leaves either the old or the new one.
+func (f *journalFile) Compact() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entries, err := f.entries()
+	if err != nil {
+		return err
+	}
+	var finished = finishedRequests(entries)
+	if len(finished) == 0 {
+		return nil
+	}
+	var tmp = f.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	var w = bufio.NewWriter(file)
+	for _, entry := range entries {
+		if finished[entry.Request] {
+			continue
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		w.Write(append(data, '\n'))
+	}
+	if err = w.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, f.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// finishedRequests are the requests in entries that have a JOURNAL_DONE and
+// no order left without a JOURNAL_CLOSED.
+func finishedRequests(entries []JournalEntry) map[string]bool {
+	type orderKey struct{ request, id string }
+	var finished = make(map[string]bool)
+	var placed = make(map[orderKey]bool) //订单 -> 是否已结束
+	for _, entry := range entries {
+		switch {
+		case entry.Request == "":
+		case entry.Event == JOURNAL_DONE:
+			finished[entry.Request] = true
+		case entry.Event == JOURNAL_PLACED:
+			var key = orderKey{entry.Request, entry.OrderID}
+			placed[key] = placed[key]
+		case entry.Event == JOURNAL_CLOSED && entry.OrderID != "":
+			placed[orderKey{entry.Request, entry.OrderID}] = true
+		}
+	}
+	for key, closed := range placed {
+		if !closed {
+			delete(finished, key.request)
+		}
+	}
+	return finished
+}
+
+var journalSeq uint64
+
+func newRequestID() string {
+	return fmt.Sprintf("%x-%x", time.Now().UnixNano(), atomic.AddUint64(&journalSeq, 1))
+}
+
+// fillJournal writes the entries of one request. The first write that fails
+// is kept: placing returns it, so the request places no further order, and
+// the manager returns it once the request is wound down. A nil fillJournal
+// writes nothing.
+type fillJournal struct {
+	journal Journal
+	logger  *logrus.Logger
+	base    JournalEntry //请求相关的公共字段
+	err     error        //第一次写入失败
+}
+
+func (fj *fillJournal) write(entry JournalEntry) error {
+	entry.Time = time.Now()
+	var err = fj.journal.Append(entry)
+	if err != nil {
+		fj.logger.Errorf("[ JOURNAL ] %s %s %s: %v", entry.Event, entry.Request, entry.OrderID, err)
+		if fj.err == nil {
+			fj.err = fmt.Errorf("journal %s: %w", entry.Event, err)
+		}
+	}
+	return err
+}
+
+func (fj *fillJournal) intent(amount float64) error {
+	if fj == nil {
+		return nil
+	}
+	var entry = fj.base
+	entry.Event = JOURNAL_INTENT
+	entry.Amount = amount
+	fj.write(entry)
+	return fj.err
+}
+
+// placing is written before every order goes to the exchange, so Recover
+// can tell an order the process crashed before journaling from one placed
+// by someone else. It fails when this or any earlier write failed.
+func (fj *fillJournal) placing(price, amount float64) error {
+	if fj == nil {
+		return nil
+	}
+	if fj.err != nil {
+		return fj.err
+	}
+	var entry = fj.base
+	entry.Event = JOURNAL_PLACING
+	entry.Price = price
+	entry.Amount = amount
+	fj.write(entry)
+	return fj.err
+}
+
+// placeFailed closes the last placing when the exchange turned the order
+// down.
+func (fj *fillJournal) placeFailed(cause error) {
+	if fj == nil {
+		return
+	}
+	var entry = fj.base
+	entry.Event = JOURNAL_CLOSED
+	entry.Status = goex.ORDER_REJECT
+	entry.Reason = cause.Error()
+	fj.write(entry)
+}
+
+// failed is the first write that failed, nil for a nil fillJournal.
+func (fj *fillJournal) failed() error {
+	if fj == nil {
+		return nil
+	}
+	return fj.err
+}
+
+func (fj *fillJournal) record(event JournalEvent, child *ChildOrder) error {
+	if fj == nil {
+		return nil
+	}
+	var entry = fj.base
+	entry.Event = event
+	entry.OrderID = child.OrderID
+	entry.Price = child.Price
+	entry.Amount = child.Amount
+	entry.Filled = child.Filled
+	entry.AvgPrice = child.AvgPrice
+	entry.Status = child.Status
+	entry.Reason = child.CancelReason
+	return fj.write(entry)
+}
+
+// done closes the request, with its totals when rep is not nil.
+func (fj *fillJournal) done(rep *ExecutionReport, reason string) error {
+	if fj == nil {
+		return nil
+	}
+	var entry = fj.base
+	entry.Event = JOURNAL_DONE
+	entry.Reason = reason
+	if rep != nil {
+		entry.Amount = rep.Requested
+		entry.Filled = rep.Filled
+		entry.Price = rep.VWAP
+	}
+	return fj.write(entry)
+}
+
+// newFills starts tracking a spot request run under ctx, journaling it when
+// the manager has a journal. A request that cannot be journaled must not
+// trade.
+func (spot *SpotTradeManager) newFills(ctx context.Context, tradeType goex.TradeSide, tradeAmount float64) (*orderFills, error) {
+	var fills = newOrderFills().followed(ctx)
+	if spot.journal != nil {
+		fills.journal = &fillJournal{journal: spot.journal, logger: spot.logger, base: spot.journalScope()}
+		fills.journal.base.Request = newRequestID()
+		fills.journal.base.Side = tradeType
+		return fills, fills.journal.intent(tradeAmount)
+	}
+	return fills, nil
+}
+
+// newFills starts tracking the futures request rep reports on, see
+// SpotTradeManager.newFills.
+func (future *FutureTradeManager) newFills(ctx context.Context, rep *ExecutionReport) (*orderFills, error) {
+	var fills = newOrderFills().followed(ctx)
+	if future.journal != nil {
+		fills.journal = &fillJournal{journal: future.journal, logger: future.logger, base: future.journalScope()}
+		fills.journal.base.Request = newRequestID()
+		fills.journal.base.Side = rep.Side
+		fills.journal.base.OpenType = rep.OpenType
+		return fills, fills.journal.intent(rep.Requested)
+	}
+	return fills, nil
+}
+
+func (spot *SpotTradeManager) journalScope() JournalEntry {
+	return JournalEntry{Exchange: spot.exchange.GetExchangeName(), Pair: spot.pair.ToSymbol("_")}
+}
+
+func (future *FutureTradeManager) journalScope() JournalEntry {
+	return JournalEntry{Exchange: future.exchange.GetExchangeName(), Pair: future.pair.ToSymbol("_"), ContractType: future.contractType}
+}
+
+// RecoveryReport is what Recover found in the journal.
+type RecoveryReport struct {
+	Orders      []*ChildOrder  `json:"orders"`      //崩溃时未结束的订单(含已下单但未记下订单ID的), 恢复后的最终状态
+	Interrupted []JournalEntry `json:"interrupted"` //未结束的请求, Filled为其订单的总成交量
+}
+
+// journalState is the journal replayed for one manager.
+type journalState struct {
+	open    []*JournalEntry          //已下单未结束的订单, 按下单顺序
+	intents []*JournalEntry          //已开始未结束的请求
+	pending []*JournalEntry          //未结束的请求中记了JOURNAL_PLACING却没有下文的下单
+	filled  map[string]float64       //订单ID -> 成交量
+	request map[string]string        //订单ID -> 请求
+	byID    map[string]*JournalEntry //订单ID -> 最后状态
+}
+
+func replayJournal(entries []JournalEntry, scope JournalEntry) *journalState {
+	var state = &journalState{
+		filled:  make(map[string]float64),
+		request: make(map[string]string),
+		byID:    make(map[string]*JournalEntry),
+	}
+	var intents = make(map[string]*JournalEntry)
+	var pending = make(map[string]*JournalEntry)
+	var closed = make(map[string]bool)
+	var order []string
+	var requests []string
+	for i := range entries {
+		var entry = entries[i]
+		if entry.Exchange != scope.Exchange || entry.Pair != scope.Pair || entry.ContractType != scope.ContractType {
+			continue
+		}
+		switch entry.Event {
+		case JOURNAL_INTENT:
+			intents[entry.Request] = &entry
+			requests = append(requests, entry.Request)
+		case JOURNAL_DONE:
+			delete(intents, entry.Request)
+		case JOURNAL_PLACING:
+			pending[entry.Request] = &entry
+		case JOURNAL_PLACED:
+			delete(pending, entry.Request)
+			if _, ok := state.byID[entry.OrderID]; !ok {
+				order = append(order, entry.OrderID)
+			}
+			state.byID[entry.OrderID] = &entry
+			state.request[entry.OrderID] = entry.Request
+			state.filled[entry.OrderID] = entry.Filled
+		case JOURNAL_FILL, JOURNAL_CLOSED:
+			if entry.OrderID == "" { //下单被拒
+				delete(pending, entry.Request)
+				continue
+			}
+			if placed, ok := state.byID[entry.OrderID]; ok {
+				placed.Filled = entry.Filled
+				placed.AvgPrice = entry.AvgPrice
+				placed.Status = entry.Status
+			}
+			state.filled[entry.OrderID] = entry.Filled
+			if entry.Event == JOURNAL_CLOSED {
+				closed[entry.OrderID] = true
+			}
+		}
+	}
+	for _, id := range order {
+		if !closed[id] {
+			state.open = append(state.open, state.byID[id])
+		}
+	}
+	for _, req := range requests {
+		if intent, ok := intents[req]; ok {
+			state.intents = append(state.intents, intent)
+			if placing, ok := pending[req]; ok {
+				state.pending = append(state.pending, placing)
+			}
+			delete(intents, req)
+		}
+	}
+	return state
+}
+
+// openOrder is an order the exchange lists as unfinished.
+type openOrder struct {
+	id       string
+	side     goex.TradeSide
+	openType int //期货开平类型, 现货为0
+	price    float64
+	amount   float64
+}
+
+// adopts tells whether o may be the order placing was journaled for.
+func (o *openOrder) adopts(placing *JournalEntry) bool {
+	return o.side == placing.Side && o.openType == placing.OpenType && math.Abs(o.amount-placing.Amount) <= 1e-8*math.Max(1, placing.Amount)
+}
+
+// recoverJournal closes out what a crashed process left in journal for the
+// manager described by scope. An interrupted request whose last placement
+// never got its order ID journaled adopts an open order of the same side
+// and amount that no entry knows about. Journaled or adopted orders the
+// exchange still lists as open are then cancelled through cancel, the others
+// are looked up through find, and the final states are journaled; an order
+// find reports missing keeps its journaled fill. Other orders are left
+// alone. A journal that is a JournalCompacter is compacted afterwards.
+func recoverJournal(journal Journal, logger *logrus.Logger, scope JournalEntry,
+	unfinished func() ([]openOrder, error),
+	cancel func(child *ChildOrder) error,
+	find func(child *ChildOrder) (bool, error),
+) (*RecoveryReport, error) {
+	entries, err := journal.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var state = replayJournal(entries, scope)
+	var rep = &RecoveryReport{}
+	if len(state.open) > 0 || len(state.pending) > 0 {
+		orders, err := unfinished()
+		if err != nil {
+			return nil, err
+		}
+		var open = make(map[string]bool)
+		for _, o := range orders {
+			open[o.id] = true
+		}
+		for _, placing := range state.pending {
+			var adopted *JournalEntry
+			for i := range orders {
+				var o = &orders[i]
+				if _, known := state.byID[o.id]; known || !o.adopts(placing) {
+					continue
+				}
+				var entry = *placing
+				entry.Event = JOURNAL_PLACED
+				entry.OrderID = o.id
+				entry.Price = o.price
+				entry.Reason = "recovered: adopted"
+				var fj = &fillJournal{journal: journal, logger: logger}
+				if err = fj.write(entry); err != nil {
+					return rep, fj.err
+				}
+				adopted = &entry
+				break
+			}
+			if adopted == nil {
+				logger.Warningf("[ JOURNAL ] %s was placing %s %v @ %v at the crash and no such order is open; it may have been rejected or filled",
+					placing.Request, placing.Side.String(), placing.Amount, placing.Price)
+				continue
+			}
+			state.byID[adopted.OrderID] = adopted
+			state.request[adopted.OrderID] = adopted.Request
+			state.open = append(state.open, adopted)
+		}
+		for _, placed := range state.open {
+			var fj = &fillJournal{journal: journal, logger: logger, base: *placed}
+			var child = &ChildOrder{
+				OrderID:  placed.OrderID,
+				Price:    placed.Price,
+				Amount:   placed.Amount,
+				Filled:   placed.Filled,
+				AvgPrice: placed.AvgPrice,
+				Status:   placed.Status,
+				PlacedAt: placed.Time,
+			}
+			if open[child.OrderID] {
+				child.CancelReason = "recovered: orphaned"
+				fj.record(JOURNAL_CANCEL, child)
+				if err = cancel(child); err != nil {
+					return rep, err
+				}
+			} else if found, err := find(child); err != nil {
+				return rep, err
+			} else if !found {
+				child.CancelReason = "recovered: not found"
+				logger.Warningf("[ JOURNAL ] order %s of %s not found, keeping the journaled fill %v", child.OrderID, placed.Request, child.Filled)
+			}
+			if child.ClosedAt.IsZero() {
+				child.ClosedAt = time.Now()
+			}
+			fj.record(JOURNAL_CLOSED, child)
+			if fj.err != nil {
+				return rep, fj.err
+			}
+			state.filled[child.OrderID] = child.Filled
+			rep.Orders = append(rep.Orders, child)
+		}
+	}
+	for _, intent := range state.intents {
+		var entry = *intent
+		entry.Filled = 0
+		for id, req := range state.request {
+			if req == entry.Request {
+				entry.Filled += state.filled[id]
+			}
+		}
+		var fj = &fillJournal{journal: journal, logger: logger, base: entry}
+		if err = fj.done(nil, "recovered: interrupted"); err != nil {
+			return rep, fj.err
+		}
+		rep.Interrupted = append(rep.Interrupted, entry)
+	}
+	if len(rep.Orders) > 0 || len(rep.Interrupted) > 0 {
+		logger.Warningf("[ JOURNAL ] %s %s %s: recovered %d orders of %d interrupted requests", scope.Exchange, scope.Pair,
+			scope.ContractType, len(rep.Orders), len(rep.Interrupted))
+	}
+	if compacter, ok := journal.(JournalCompacter); ok {
+		if err = compacter.Compact(); err != nil {
+			logger.Warningf("[ JOURNAL ] compact: %v", err)
+		}
+	}
+	return rep, nil
+}
+
+// OrderNotFound is implemented by the errors an exchange returns for an
+// order ID it does not know. Recover gives up looking for a journaled order
+// only on such an error; any other error is retried until ctx is done.
+type OrderNotFound interface {
+	error
+	OrderNotFound() bool
+}
+
+func orderNotFound(err error) bool {
+	var notFound OrderNotFound
+	return errors.As(err, &notFound) && notFound.OrderNotFound()
+}
+
+// recoverTimeout bounds the Recover the WithConfig constructors run, so an
+// exchange that never confirms a cancel fails the constructor instead of
+// hanging it.
+const recoverTimeout = time.Minute
+
+// Recover reconciles the journal with the exchange, see
+// NewSpotTradeManagerWithConfig, which calls it. Without a journal there is
+// nothing to do.
+func (spot *SpotTradeManager) Recover(ctx context.Context) (*RecoveryReport, error) {
+	if spot.journal == nil {
+		return &RecoveryReport{}, nil
+	}
+	var unfinished = func() ([]openOrder, error) {
+		res, err := reCtx(ctx, spot.retryDelayMs, spot.exchange.GetUnfinishOrders, spot.pair)
+		if err != nil {
+			return nil, err
+		}
+		var open []openOrder
+		for _, order := range res.([]goex.Order) {
+			open = append(open, openOrder{id: order.OrderID2, side: order.Side, price: order.Price, amount: order.Amount})
+		}
+		return open, nil
+	}
+	var cancel = func(child *ChildOrder) error {
+		order, err := spot.cancel(ctx, child.OrderID)
+		if err != nil {
+			return fmt.Errorf("cancel orphan %s: %w", child.OrderID, err)
+		}
+		child.observe(order.DealAmount, order.AvgPrice, order.Fee, order.Status)
+		return nil
+	}
+	var find = func(child *ChildOrder) (bool, error) {
+		res, err := reCtx(ctx, spot.retryDelayMs, spot.search, child.OrderID)
+		if err != nil {
+			return false, fmt.Errorf("look up %s: %w", child.OrderID, err)
+		}
+		var order = res.(*goex.Order)
+		if order == nil {
+			return false, nil
+		}
+		child.observe(order.DealAmount, order.AvgPrice, order.Fee, order.Status)
+		return true, nil
+	}
+	rep, err := recoverJournal(spot.journal, spot.logger, spot.journalScope(), unfinished, cancel, find)
+	if rep != nil {
+		spot.recovered = rep
+	}
+	return rep, err
+}
+
+// Recovered is what the last Recover found.
+func (spot *SpotTradeManager) Recovered() *RecoveryReport {
+	return spot.recovered
+}
+
+// Recover reconciles the journal with the exchange, see
+// NewFutureTradeManagerWithConfig, which calls it. Without a journal there
+// is nothing to do. An orphan the exchange will not close fails Recover once
+// ctx is done.
+func (future *FutureTradeManager) Recover(ctx context.Context) (*RecoveryReport, error) {
+	if future.journal == nil {
+		return &RecoveryReport{}, nil
+	}
+	var unfinished = func() ([]openOrder, error) {
+		res, err := reCtx(ctx, future.retryDelayMs, future.exchange.GetUnfinishFutureOrders, future.pair, future.contractType)
+		if err != nil {
+			return nil, err
+		}
+		var open []openOrder
+		for _, order := range res.([]goex.FutureOrder) {
+			var side = goex.TradeSide(goex.SELL)
+			if order.OType == goex.OPEN_BUY || order.OType == goex.CLOSE_SELL {
+				side = goex.BUY
+			}
+			open = append(open, openOrder{id: order.OrderID2, side: side, openType: order.OType, price: order.Price, amount: order.Amount})
+		}
+		return open, nil
+	}
+	var cancel = func(child *ChildOrder) error {
+		order, err := future.cancel(ctx, child.OrderID)
+		if order != nil {
+			child.observe(order.DealAmount, order.AvgPrice, order.Fee, order.Status)
+		}
+		if err != nil {
+			return fmt.Errorf("orphan: %w", err)
+		}
+		return nil
+	}
+	var find = func(child *ChildOrder) (bool, error) {
+		res, err := reCtx(ctx, future.retryDelayMs, future.search, child.OrderID)
+		if err != nil {
+			return false, fmt.Errorf("look up %s: %w", child.OrderID, err)
+		}
+		var order = res.(*goex.FutureOrder)
+		if order == nil {
+			return false, nil
+		}
+		child.observe(order.DealAmount, order.AvgPrice, order.Fee, order.Status)
+		return true, nil
+	}
+	rep, err := recoverJournal(future.journal, future.logger, future.journalScope(), unfinished, cancel, find)
+	if rep != nil {
+		future.recovered = rep
+	}
+	return rep, err
+}
+
+// Recovered is what the last Recover found.
+func (future *FutureTradeManager) Recovered() *RecoveryReport {
+	return future.recovered
+}
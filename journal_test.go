@@ -0,0 +1,356 @@
+package trade
+
+import (
+	"context"
+	"errors"
+	"github.com/goex-top/goex_trade/mockex"
+	"github.com/nntaoli-project/GoEx"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newJournal(t *testing.T) (Journal, string, func()) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var path = filepath.Join(dir, "orders.jsonl")
+	return NewJournalFile(path), path, func() { os.RemoveAll(dir) }
+}
+
+func newJournalSpot(t *testing.T, ex *mockex.Exchange, journal Journal) *SpotTradeManager {
+	var cfg = DefaultSpotConfig()
+	cfg.SlidePrice = 0.5
+	cfg.MaxAmount = 2
+	cfg.MinStocks = 0.01
+	cfg.RetryDelay = time.Millisecond
+	mgr, err := NewSpotTradeManagerWithConfig(ex.Spot(), spotPair, cfg, WithJournal(journal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mgr
+}
+
+func TestJournalFile(t *testing.T) {
+	journal, path, cleanup := newJournal(t)
+	defer cleanup()
+	if entries, err := journal.Entries(); err != nil || len(entries) != 0 {
+		t.Fatalf("missing file: %v, %v", entries, err)
+	}
+	journal.Append(JournalEntry{Event: JOURNAL_INTENT, Request: "r1", Amount: 1})
+	journal.Append(JournalEntry{Event: JOURNAL_PLACED, Request: "r1", OrderID: "7", Status: goex.ORDER_UNFINISH})
+
+	// A crash halfway through a line loses only that line.
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.WriteString(`{"time":"2019-06-01T10:00:00Z","event":"JOURNAL_FI`)
+	file.Close()
+	entries, err := journal.Entries()
+	if err != nil || len(entries) != 2 || entries[1].Event != JOURNAL_PLACED || entries[1].OrderID != "7" {
+		t.Fatalf("unexpected entries %+v, %v", entries, err)
+	}
+
+	file, _ = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.WriteString("\n")
+	file.Close()
+	journal.Append(JournalEntry{Event: JOURNAL_DONE, Request: "r1"})
+	if _, err = journal.Entries(); err == nil {
+		t.Fatal("want an error for a broken line inside the journal")
+	}
+}
+
+func TestJournalFile_Compact(t *testing.T) {
+	journal, _, cleanup := newJournal(t)
+	defer cleanup()
+	for _, entry := range []JournalEntry{
+		{Event: JOURNAL_INTENT, Request: "done"},
+		{Event: JOURNAL_PLACED, Request: "done", OrderID: "1"},
+		{Event: JOURNAL_CLOSED, Request: "done", OrderID: "1"},
+		{Event: JOURNAL_DONE, Request: "done"},
+		{Event: JOURNAL_INTENT, Request: "running"},
+		{Event: JOURNAL_PLACED, Request: "running", OrderID: "2"},
+		{Event: JOURNAL_INTENT, Request: "orphan"},
+		{Event: JOURNAL_PLACED, Request: "orphan", OrderID: "3"},
+		{Event: JOURNAL_DONE, Request: "orphan"},
+	} {
+		journal.Append(entry)
+	}
+	if err := journal.(JournalCompacter).Compact(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := journal.Entries()
+	if err != nil || len(entries) != 5 || entries[0].Request != "running" || entries[4].Event != JOURNAL_DONE {
+		t.Fatalf("unexpected entries %+v, %v", entries, err)
+	}
+	journal.Append(JournalEntry{Event: JOURNAL_CLOSED, Request: "orphan", OrderID: "3"})
+	journal.(JournalCompacter).Compact()
+	if entries, err = journal.Entries(); err != nil || len(entries) != 2 {
+		t.Fatalf("unexpected entries %+v, %v", entries, err)
+	}
+}
+
+func TestSpotTradeManager_Journal(t *testing.T) {
+	journal, _, cleanup := newJournal(t)
+	defer cleanup()
+	ex, _ := newMockSpot(OPMODE_TAKE)
+	var mgr = newJournalSpot(t, ex, journal)
+	if _, err := mgr.Buy(3); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := journal.Entries()
+	var count = make(map[JournalEvent]int)
+	for _, entry := range entries {
+		if entry.Request != entries[0].Request || entry.Pair != "BTC_USDT" || entry.Side != goex.BUY {
+			t.Fatalf("entry of another request %+v", entry)
+		}
+		count[entry.Event]++
+	}
+	var first, last = entries[0], entries[len(entries)-1]
+	if first.Event != JOURNAL_INTENT || first.Amount != 3 || last.Event != JOURNAL_DONE || last.Filled != 3 {
+		t.Fatalf("request not opened and closed %+v %+v", first, last)
+	}
+	if count[JOURNAL_PLACED] != 2 || count[JOURNAL_CLOSED] != 2 || count[JOURNAL_FILL] != 2 {
+		t.Fatalf("unexpected events %v", count)
+	}
+	if rep := newJournalSpot(t, ex, journal).Recovered(); len(rep.Orders) != 0 || len(rep.Interrupted) != 0 {
+		t.Fatalf("clean journal recovered %+v", rep)
+	}
+}
+
+func TestSpotTradeManager_Recover(t *testing.T) {
+	journal, _, cleanup := newJournal(t)
+	defer cleanup()
+	ex, _ := newMockSpot(OPMODE_TAKE)
+	resting, _ := ex.Spot().LimitBuy("1", "90", spotPair)
+	filled, _ := ex.Spot().LimitBuy("0.5", "101", spotPair)
+	other, _ := ex.Spot().LimitSell("1", "120", spotPair)
+	var scope = JournalEntry{Request: "r1", Exchange: "mock", Pair: "BTC_USDT", Side: goex.BUY}
+	for _, entry := range []JournalEntry{
+		{Event: JOURNAL_INTENT, Amount: 1.5},
+		{Event: JOURNAL_PLACED, OrderID: resting.OrderID2, Price: 90, Amount: 1},
+		{Event: JOURNAL_PLACED, OrderID: filled.OrderID2, Price: 101, Amount: 0.5},
+	} {
+		entry.Request, entry.Exchange, entry.Pair, entry.Side = scope.Request, scope.Exchange, scope.Pair, scope.Side
+		journal.Append(entry)
+	}
+
+	var rep = newJournalSpot(t, ex, journal).Recovered()
+	if open := ex.OpenOrders(); len(open) != 1 || open[0] != other.OrderID2 {
+		t.Fatalf("want only the unjournaled order open, got %v", open)
+	}
+	if len(rep.Orders) != 2 || rep.Orders[0].Status != goex.ORDER_CANCEL || rep.Orders[0].CancelReason == "" ||
+		rep.Orders[1].Status != goex.ORDER_FINISH || rep.Orders[1].Filled != 0.5 {
+		t.Fatalf("unexpected orders %+v %+v", rep.Orders[0], rep.Orders[1])
+	}
+	if len(rep.Interrupted) != 1 || rep.Interrupted[0].Request != "r1" || rep.Interrupted[0].Filled != 0.5 {
+		t.Fatalf("unexpected requests %+v", rep.Interrupted)
+	}
+	if rep = newJournalSpot(t, ex, journal).Recovered(); len(rep.Orders) != 0 || len(rep.Interrupted) != 0 {
+		t.Fatalf("recovered twice %+v", rep)
+	}
+}
+
+func TestSpotTradeManager_RecoverPlacing(t *testing.T) {
+	journal, _, cleanup := newJournal(t)
+	defer cleanup()
+	ex, _ := newMockSpot(OPMODE_TAKE)
+	// The process crashed after sending the order but before journaling its ID.
+	orphan, _ := ex.Spot().LimitBuy("1", "90", spotPair)
+	other, _ := ex.Spot().LimitBuy("2", "90", spotPair)
+	var scope = JournalEntry{Request: "r1", Exchange: "mock", Pair: "BTC_USDT", Side: goex.BUY}
+	for _, entry := range []JournalEntry{
+		{Event: JOURNAL_INTENT, Amount: 1},
+		{Event: JOURNAL_PLACING, Price: 90, Amount: 1},
+	} {
+		entry.Request, entry.Exchange, entry.Pair, entry.Side = scope.Request, scope.Exchange, scope.Pair, scope.Side
+		journal.Append(entry)
+	}
+
+	var rep = newJournalSpot(t, ex, journal).Recovered()
+	if open := ex.OpenOrders(); len(open) != 1 || open[0] != other.OrderID2 {
+		t.Fatalf("want only the order of another amount open, got %v", open)
+	}
+	if len(rep.Orders) != 1 || rep.Orders[0].OrderID != orphan.OrderID2 || rep.Orders[0].Status != goex.ORDER_CANCEL {
+		t.Fatalf("orphan not adopted %+v", rep.Orders)
+	}
+	if len(rep.Interrupted) != 1 || rep.Interrupted[0].Request != "r1" {
+		t.Fatalf("unexpected requests %+v", rep.Interrupted)
+	}
+	if rep = newJournalSpot(t, ex, journal).Recovered(); len(rep.Orders) != 0 || len(rep.Interrupted) != 0 {
+		t.Fatalf("recovered twice %+v", rep)
+	}
+}
+
+// failingJournal fails every append of one event.
+type failingJournal struct {
+	event JournalEvent
+	err   error
+}
+
+func (j *failingJournal) Append(entry JournalEntry) error {
+	if entry.Event == j.event {
+		return j.err
+	}
+	return nil
+}
+
+func (j *failingJournal) Entries() ([]JournalEntry, error) {
+	return nil, nil
+}
+
+func TestSpotTradeManager_JournalFails(t *testing.T) {
+	var diskFull = errors.New("disk full")
+	ex, _ := newMockSpot(OPMODE_TAKE)
+	var mgr = newJournalSpot(t, ex, &failingJournal{event: JOURNAL_PLACING, err: diskFull})
+	rep, err := mgr.Buy(1)
+	if !errors.Is(err, diskFull) {
+		t.Fatalf("want the journal error, got %v", err)
+	}
+	if rep != nil && rep.Filled != 0 || len(ex.OpenOrders()) != 0 {
+		t.Fatalf("placed an order it could not journal %+v", rep)
+	}
+
+	mgr = newJournalSpot(t, ex, &failingJournal{event: JOURNAL_INTENT, err: diskFull})
+	if _, err = mgr.Buy(1); !errors.Is(err, diskFull) {
+		t.Fatalf("want the journal error, got %v", err)
+	}
+}
+
+func TestFutureTradeManager_Recover(t *testing.T) {
+	journal, _, cleanup := newJournal(t)
+	defer cleanup()
+	ex, _ := newMockFuture()
+	id, err := ex.Future().PlaceFutureOrder(futurePair, goex.QUARTER_CONTRACT, "90", "2", goex.OPEN_BUY, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Append(JournalEntry{Event: JOURNAL_INTENT, Request: "r1", Exchange: "mock", Pair: "BTC_USD", ContractType: goex.QUARTER_CONTRACT, OpenType: goex.OPEN_BUY, Amount: 2})
+	journal.Append(JournalEntry{Event: JOURNAL_PLACED, Request: "r1", Exchange: "mock", Pair: "BTC_USD", ContractType: goex.QUARTER_CONTRACT, OpenType: goex.OPEN_BUY, OrderID: id, Price: 90, Amount: 2})
+
+	var cfg = DefaultFutureConfig()
+	cfg.RetryDelay = time.Millisecond
+	mgr, err := NewFutureTradeManagerWithConfig(ex.Future(), futurePair, cfg, WithJournal(journal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if open := ex.OpenOrders(); len(open) != 0 {
+		t.Fatalf("orphan left open %v", open)
+	}
+	if rep := mgr.Recovered(); len(rep.Orders) != 1 || rep.Orders[0].Status != goex.ORDER_CANCEL || len(rep.Interrupted) != 1 {
+		t.Fatalf("unexpected recovery %+v", rep)
+	}
+}
+
+func TestFutureTradeManager_RecoverLookup(t *testing.T) {
+	journal, _, cleanup := newJournal(t)
+	defer cleanup()
+	ex, _ := newMockFuture()
+	id, err := ex.Future().PlaceFutureOrder(futurePair, goex.QUARTER_CONTRACT, "101", "2", goex.OPEN_BUY, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var scope = JournalEntry{Request: "r1", Exchange: "mock", Pair: "BTC_USD", ContractType: goex.QUARTER_CONTRACT, OpenType: goex.OPEN_BUY}
+	for _, entry := range []JournalEntry{
+		{Event: JOURNAL_INTENT, Amount: 3},
+		{Event: JOURNAL_PLACED, OrderID: id, Price: 101, Amount: 2},
+		{Event: JOURNAL_PLACED, OrderID: "lost", Price: 101, Amount: 1, Filled: 0.5},
+	} {
+		entry.Request, entry.Exchange, entry.Pair, entry.ContractType, entry.OpenType = scope.Request, scope.Exchange, scope.Pair, scope.ContractType, scope.OpenType
+		journal.Append(entry)
+	}
+
+	var cfg = DefaultFutureConfig()
+	cfg.RetryDelay = time.Millisecond
+	mgr, err := NewFutureTradeManagerWithConfig(ex.Future(), futurePair, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr.journal = journal
+	ex.Fail("GetFutureOrder", 3, errors.New("timeout"))
+	rep, err := mgr.Recover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Orders) != 2 || rep.Orders[0].Filled != 2 || rep.Orders[1].Filled != 0.5 || rep.Orders[1].CancelReason != "recovered: not found" {
+		t.Fatalf("unexpected recovery %+v", rep)
+	}
+	if entries, _ := journal.Entries(); len(entries) != 0 {
+		t.Fatalf("finished requests not compacted %+v", entries)
+	}
+
+	// An exchange that cannot tell fails Recover instead of losing the fill.
+	journal.Append(JournalEntry{Event: JOURNAL_INTENT, Request: "r2", Exchange: "mock", Pair: "BTC_USD", ContractType: goex.QUARTER_CONTRACT, Amount: 2})
+	journal.Append(JournalEntry{Event: JOURNAL_PLACED, Request: "r2", Exchange: "mock", Pair: "BTC_USD", ContractType: goex.QUARTER_CONTRACT, OrderID: id, Amount: 2})
+	ex.Fail("GetFutureOrder", 1000, errors.New("timeout"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = mgr.Recover(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want the deadline, got %v", err)
+	}
+	if entries, _ := journal.Entries(); len(entries) != 2 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+}
+
+func TestFutureTradeManager_RecoverBounded(t *testing.T) {
+	journal, _, cleanup := newJournal(t)
+	defer cleanup()
+	ex, _ := newMockFuture()
+	id, err := ex.Future().PlaceFutureOrder(futurePair, goex.QUARTER_CONTRACT, "90", "2", goex.OPEN_BUY, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Append(JournalEntry{Event: JOURNAL_INTENT, Request: "r1", Exchange: "mock", Pair: "BTC_USD", ContractType: goex.QUARTER_CONTRACT, OpenType: goex.OPEN_BUY, Amount: 2})
+	journal.Append(JournalEntry{Event: JOURNAL_PLACED, Request: "r1", Exchange: "mock", Pair: "BTC_USD", ContractType: goex.QUARTER_CONTRACT, OpenType: goex.OPEN_BUY, OrderID: id, Price: 90, Amount: 2})
+
+	var cfg = DefaultFutureConfig()
+	cfg.RetryDelay = time.Millisecond
+	mgr, err := NewFutureTradeManagerWithConfig(ex.Future(), futurePair, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr.journal = journal
+	ex.Fail("FutureCancelOrder", 1000, errors.New("maintenance"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = mgr.Recover(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want the deadline, got %v", err)
+	}
+	if open := ex.OpenOrders(); len(open) != 1 {
+		t.Fatalf("orphan gone %v", open)
+	}
+}
+
+func TestSpotTradeManager_JournalPostOnly(t *testing.T) {
+	journal, _, cleanup := newJournal(t)
+	defer cleanup()
+	var ex = mockex.New("mock")
+	ex.SetBalance(goex.USDT, 10000)
+	ex.Market(spotPair).SetTicker(99, 101)
+	var spot = &rejectingSpot{Spot: ex.Spot(), n: 2}
+	mgr, err := NewSpotTradeManagerWithConfig(spot, spotPair, DefaultSpotConfig(),
+		WithOpMode(OPMODE_POST_ONLY),
+		WithRetryDelay(time.Millisecond),
+		WithJournal(journal),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	mgr.BuyCtx(ctx, 1)
+	entries, _ := journal.Entries()
+	var placing, rejected = 0, 0
+	for _, entry := range entries {
+		if entry.Event == JOURNAL_PLACING {
+			placing++
+		} else if entry.Event == JOURNAL_CLOSED && entry.OrderID == "" {
+			rejected++
+		}
+	}
+	if placing != len(spot.prices) || rejected != 2 {
+		t.Fatalf("want every attempt journaled, got %d placing, %d rejected for %v", placing, rejected, spot.prices)
+	}
+}
@@ -0,0 +1,267 @@
+package trade
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/beaquant/utils"
+	"github.com/nntaoli-project/GoEx"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FlattenResult is what Flatten did to one registered manager.
+type FlattenResult struct {
+	Name        string  `json:"name"`
+	ClosedLong  float64 `json:"closed_long,omitempty"`  //平掉的多仓
+	ClosedShort float64 `json:"closed_short,omitempty"` //平掉的空仓
+	Error       string  `json:"error,omitempty"`
+}
+
+// drainTimeout bounds how long Flatten waits for cancelled requests to
+// return before it flattens anyway.
+const drainTimeout = 10 * time.Second
+
+type killFuture struct {
+	mgr  FutureTradeManagerAPI
+	feed Feed
+}
+
+// KillSwitch is the incident button over a set of managers: Flatten turns
+// the RiskGate's kill switch on, cancels every pending order of every
+// registered spot and futures manager and closes every futures position,
+// and the gate keeps turning new requests down until Rearm.
+//
+// New orders are only blocked for managers wrapped with NewRiskSpot or
+// NewRiskFuture over Gate(); the managers registered here are the unwrapped
+// ones, so flattening is never itself blocked. Requests already running
+// through the gate, including the slices of a TWAP, VWAP or arbitrage over
+// wrapped managers, are cancelled and waited for before anything is
+// flattened, so none of them places orders afterwards.
+type KillSwitch struct {
+	gate   *RiskGate
+	logger *logrus.Logger
+
+	mu      sync.Mutex
+	spots   map[string]SpotTradeManagerAPI
+	futures map[string]killFuture
+	flatten sync.Mutex //同一时间只做一次平仓
+}
+
+// NewKillSwitch blocks orders through gate, or through a gate without limits
+// when gate is nil.
+func NewKillSwitch(gate *RiskGate, logger *logrus.Logger) *KillSwitch {
+	if logger == nil {
+		logger = logrus.New()
+	}
+	if gate == nil {
+		gate, _ = NewRiskGate(RiskLimits{}, logger)
+	}
+	return &KillSwitch{
+		gate:    gate,
+		logger:  logger,
+		spots:   make(map[string]SpotTradeManagerAPI),
+		futures: make(map[string]killFuture),
+	}
+}
+
+// Gate is the RiskGate new orders must go through to be blocked.
+func (ks *KillSwitch) Gate() *RiskGate {
+	return ks.gate
+}
+
+// RegisterSpot adds a spot manager whose pending orders Flatten cancels.
+// Registering a name again replaces the manager.
+func (ks *KillSwitch) RegisterSpot(name string, mgr SpotTradeManagerAPI) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.spots[name] = mgr
+}
+
+// RegisterFuture adds a futures manager whose orders Flatten cancels and
+// whose positions it closes, priced off the ticker of feed.
+func (ks *KillSwitch) RegisterFuture(name string, mgr FutureTradeManagerAPI, feed Feed) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.futures[name] = killFuture{mgr: mgr, feed: feed}
+}
+
+// Unregister drops the spot or futures manager registered as name.
+func (ks *KillSwitch) Unregister(name string) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	delete(ks.spots, name)
+	delete(ks.futures, name)
+}
+
+// Armed tells whether orders are allowed, that is the switch has not been
+// pulled since the last Rearm.
+func (ks *KillSwitch) Armed() bool {
+	killed, _ := ks.gate.Killed()
+	return !killed
+}
+
+// Rearm lets orders through again.
+func (ks *KillSwitch) Rearm() {
+	ks.logger.Warningln("[ KILL ] re-armed")
+	ks.gate.Resume()
+}
+
+// Flatten blocks new orders, stops those in flight, then cancels and closes
+// everything registered. It carries on past failures and returns one result
+// per manager, sorted by name, with the first error.
+func (ks *KillSwitch) Flatten(ctx context.Context, reason string) ([]FlattenResult, error) {
+	ks.gate.Kill(reason)
+	var drainCtx, cancel = context.WithTimeout(ctx, drainTimeout)
+	if err := ks.gate.Drain(drainCtx); err != nil {
+		ks.logger.Errorf("[ KILL ] requests still in flight: %v", err)
+	}
+	cancel()
+	ks.flatten.Lock()
+	defer ks.flatten.Unlock()
+	ks.mu.Lock()
+	var spots = make(map[string]SpotTradeManagerAPI, len(ks.spots))
+	for name, mgr := range ks.spots {
+		spots[name] = mgr
+	}
+	var futures = make(map[string]killFuture, len(ks.futures))
+	for name, f := range ks.futures {
+		futures[name] = f
+	}
+	ks.mu.Unlock()
+
+	var results []FlattenResult
+	var firstErr error
+	var fail = func(res *FlattenResult, err error) {
+		res.Error = err.Error()
+		if firstErr == nil {
+			firstErr = fmt.Errorf("flatten %s: %w", res.Name, err)
+		}
+		ks.logger.Errorf("[ KILL ] %s: %v", res.Name, err)
+	}
+	for name, mgr := range spots {
+		var res = FlattenResult{Name: name}
+		if err := mgr.CancelAllPendingOrdersCtx(ctx); err != nil {
+			fail(&res, err)
+		}
+		results = append(results, res)
+	}
+	for name, f := range futures {
+		var res = FlattenResult{Name: name}
+		if err := ks.closeFuture(ctx, f, &res); err != nil {
+			fail(&res, err)
+		}
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	ks.logger.Warningf("[ KILL ] flattened %d managers: %s", len(results), reason)
+	return results, firstErr
+}
+
+func (ks *KillSwitch) closeFuture(ctx context.Context, f killFuture, res *FlattenResult) error {
+	if err := f.mgr.CancelAllCtx(ctx); err != nil {
+		return err
+	}
+	ticker, err := f.feed.GetTicker()
+	if err != nil {
+		return err
+	}
+	for _, direction := range []int{goex.OPEN_BUY, goex.OPEN_SELL} {
+		pos, err := f.mgr.GetPositionCtx(ctx, direction)
+		if err != nil {
+			return err
+		}
+		if pos == nil || pos.Amount <= 0 {
+			continue
+		}
+		var rep *ExecutionReport
+		var filled = 0.0
+		if direction == goex.OPEN_BUY {
+			rep, err = f.mgr.CloseLongCtx(ctx, ticker.Buy, pos.Amount)
+		} else {
+			rep, err = f.mgr.CloseShortCtx(ctx, ticker.Sell, pos.Amount)
+		}
+		if rep != nil {
+			filled = rep.Filled
+		}
+		if direction == goex.OPEN_BUY {
+			res.ClosedLong = filled
+		} else {
+			res.ClosedShort = filled
+		}
+		if err != nil {
+			return err
+		}
+		if filled < pos.Amount {
+			return fmt.Errorf("closed %s of %s", utils.Float64RoundString(filled, 8), utils.Float64RoundString(pos.Amount, 8))
+		}
+	}
+	return nil
+}
+
+// WatchSignals flattens when one of sigs arrives, until ctx is done. Pick
+// signals the process does not otherwise need, such as syscall.SIGUSR1.
+func (ks *KillSwitch) WatchSignals(ctx context.Context, sigs ...os.Signal) {
+	var ch = make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-ch:
+			ks.Flatten(ctx, "signal "+sig.String())
+		}
+	}
+}
+
+type killStatus struct {
+	Armed   bool            `json:"armed"`
+	Reason  string          `json:"reason,omitempty"`
+	Results []FlattenResult `json:"results,omitempty"`
+}
+
+// Handler serves the switch over HTTP: GET reports whether it is armed, POST
+// flattens (with the "reason" form value) and DELETE re-arms. With a
+// non-empty token every request must carry it as "Authorization: Bearer
+// <token>".
+func (ks *KillSwitch) Handler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var status killStatus
+		var code = http.StatusOK
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var reason = r.FormValue("reason")
+			if reason == "" {
+				reason = "http " + r.RemoteAddr
+			}
+			results, err := ks.Flatten(context.Background(), reason) //客户端断开也要平完
+			status.Results = results
+			if err != nil {
+				code = http.StatusInternalServerError
+			}
+		case http.MethodDelete:
+			ks.Rearm()
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var killed bool
+		killed, status.Reason = ks.gate.Killed()
+		status.Armed = !killed
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(status)
+	})
+}
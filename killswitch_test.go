@@ -0,0 +1,159 @@
+package trade
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/nntaoli-project/GoEx"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKillSwitch_HTTP(t *testing.T) {
+	sex, smgr := newMockSpot(OPMODE_TAKE)
+	fex, fmgr := newMockFuture()
+	if _, err := sex.Spot().LimitBuy("1", "90", spotPair); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fmgr.OpenLong(100, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fex.Future().PlaceFutureOrder(futurePair, goex.QUARTER_CONTRACT, "50", "1", goex.OPEN_BUY, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	var ks = NewKillSwitch(nil, nil)
+	ks.RegisterSpot("spot", smgr)
+	ks.RegisterFuture("future", fmgr, NewFutureFeed(fex.Future(), futurePair, goex.QUARTER_CONTRACT))
+	var spot = NewRiskSpot(smgr, spotPair, NewSpotFeed(sex.Spot(), spotPair), ks.Gate())
+	var srv = httptest.NewServer(ks.Handler("secret"))
+	defer srv.Close()
+	var call = func(method, token string) (int, killStatus) {
+		req, _ := http.NewRequest(method, srv.URL, strings.NewReader("reason=test"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var status killStatus
+		json.NewDecoder(resp.Body).Decode(&status)
+		return resp.StatusCode, status
+	}
+
+	if code, _ := call(http.MethodPost, "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("want 401, got %d", code)
+	}
+	if !ks.Armed() {
+		t.Fatal("switch pulled without the token")
+	}
+	code, status := call(http.MethodPost, "secret")
+	if code != http.StatusOK || status.Armed || status.Reason != "test" || len(status.Results) != 2 {
+		t.Fatalf("unexpected flatten response %d %+v", code, status)
+	}
+	if status.Results[0].Name != "future" || status.Results[0].ClosedLong != 2 {
+		t.Fatalf("unexpected future result %+v", status.Results[0])
+	}
+	if open := sex.OpenOrders(); len(open) != 0 {
+		t.Fatalf("spot orders left %v", open)
+	}
+	if open := fex.OpenOrders(); len(open) != 0 {
+		t.Fatalf("futures orders left %v", open)
+	}
+	if pos, _ := fmgr.GetPosition(goex.OPEN_BUY); pos != nil && pos.Amount != 0 {
+		t.Fatalf("long left open %+v", pos)
+	}
+	_, err := spot.Buy(0.1)
+	wantRule(t, err, RISK_KILL_SWITCH)
+
+	if code, status = call(http.MethodDelete, "secret"); code != http.StatusOK || !status.Armed {
+		t.Fatalf("unexpected rearm response %d %+v", code, status)
+	}
+	if _, err = spot.Buy(0.1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKillSwitch_StopsRequestInFlight(t *testing.T) {
+	ex, mgr := newMockSpot(OPMODE_MAKE) //买一加滑价挂单, 不会成交
+	var ks = NewKillSwitch(nil, nil)
+	ks.RegisterSpot("spot", mgr)
+	var spot = NewRiskSpot(mgr, spotPair, NewSpotFeed(ex.Spot(), spotPair), ks.Gate())
+	var done = make(chan error, 1)
+	go func() {
+		_, err := spot.BuyCtx(context.Background(), 1)
+		done <- err
+	}()
+	for len(ex.OpenOrders()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := ks.Flatten(context.Background(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("want the request cancelled, got %v", err)
+		}
+	default:
+		t.Fatal("request still running after Flatten")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if open := ex.OpenOrders(); len(open) != 0 {
+		t.Fatalf("orders placed after Flatten %v", open)
+	}
+}
+
+func TestKillSwitch_WatchSignals(t *testing.T) {
+	// Catching the signal here as well keeps it from ending the test binary
+	// should it arrive before WatchSignals listens.
+	var caught = make(chan os.Signal, 1)
+	signal.Notify(caught, os.Interrupt)
+	defer signal.Stop(caught)
+	self, _ := os.FindProcess(os.Getpid())
+	if err := self.Signal(os.Interrupt); err != nil {
+		t.Skipf("cannot signal the test process: %v", err)
+	}
+
+	var ks = NewKillSwitch(nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ks.WatchSignals(ctx, os.Interrupt)
+	var deadline = time.Now().Add(time.Second)
+	for ks.Armed() && time.Now().Before(deadline) {
+		self.Signal(os.Interrupt)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if ks.Armed() {
+		t.Fatal("signal did not pull the switch")
+	}
+	if _, reason := ks.Gate().Killed(); reason != "signal "+os.Interrupt.String() {
+		t.Fatalf("unexpected reason %q", reason)
+	}
+}
+
+func TestKillSwitch_FlattenOutage(t *testing.T) {
+	fex, fmgr := newMockFuture()
+	if _, err := fmgr.OpenLong(101, 2); err != nil {
+		t.Fatal(err)
+	}
+	var ks = NewKillSwitch(nil, nil)
+	ks.RegisterFuture("future", fmgr, NewFutureFeed(fex.Future(), futurePair, goex.QUARTER_CONTRACT))
+	fex.Fail("GetUnfinishFutureOrders", 1000, errors.New("maintenance"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var started = time.Now()
+	if _, err := ks.Flatten(ctx, "outage"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want the deadline, got %v", err)
+	}
+	if took := time.Since(started); took > time.Second {
+		t.Fatalf("flatten outlived its deadline by %v", took)
+	}
+}
@@ -0,0 +1,686 @@
+// Package mockex is a deterministic, in-memory exchange that implements
+// goex.API and goex.FutureRestAPI so the trade managers can be exercised
+// without network access.
+//
+// Every market is scripted by hand: tests set the ticker and order book,
+// fund the account and decide which calls fail. Orders match against the
+// scripted book (or the ticker when no book is set) as soon as they are
+// placed; whatever does not cross rests until the market is moved, Fill is
+// called or the order is cancelled.
+package mockex
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nntaoli-project/GoEx"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRejected             = errors.New("mockex: order rejected")
+	ErrInsufficientBalance  = errors.New("mockex: insufficient balance")
+	ErrInsufficientPosition = errors.New("mockex: insufficient position")
+	ErrOrderClosed          = errors.New("mockex: order already closed")
+	ErrFilter               = errors.New("mockex: order breaks market rules")
+)
+
+// ErrWouldCross is the error of a post-only order that would take. It
+// satisfies trade.PostOnlyRejection.
+var ErrWouldCross error = postOnlyError("mockex: post-only order would take")
+
+type postOnlyError string
+
+func (e postOnlyError) Error() string { return string(e) }
+
+func (e postOnlyError) PostOnlyRejected() bool { return true }
+
+// ErrOrderNotFound is the error for an order ID the exchange does not know.
+// It satisfies trade.OrderNotFound.
+var ErrOrderNotFound error = notFoundError("mockex: order not found")
+
+type notFoundError string
+
+func (e notFoundError) Error() string { return string(e) }
+
+func (e notFoundError) OrderNotFound() bool { return true }
+
+// Exchange holds the state shared by the spot and futures views returned by
+// Spot and Future.
+type Exchange struct {
+	mu            sync.Mutex
+	name          string
+	latency       time.Duration
+	fillRatio     float64
+	contractValue float64
+	makerFee      float64
+	takerFee      float64
+	slippage      float64
+	rejects       int
+	failures      map[string][]error
+	balances      map[goex.Currency]*goex.SubAccount
+	margins       map[goex.Currency]float64
+	markets       map[string]*Market
+	positions     map[string]*position
+	orders        []*order
+	index         map[string]*order
+	fills         []Fill
+	seq           int
+	tid           int64
+	now           func() time.Time
+}
+
+// New returns an empty exchange reporting name from GetExchangeName.
+func New(name string) *Exchange {
+	return &Exchange{
+		name:          name,
+		fillRatio:     1,
+		contractValue: 1,
+		failures:      make(map[string][]error),
+		balances:      make(map[goex.Currency]*goex.SubAccount),
+		margins:       make(map[goex.Currency]float64),
+		markets:       make(map[string]*Market),
+		positions:     make(map[string]*position),
+		index:         make(map[string]*order),
+		now:           time.Now,
+	}
+}
+
+// Spot returns the goex.API view of the exchange.
+func (e *Exchange) Spot() *Spot {
+	return &Spot{e}
+}
+
+// Future returns the goex.FutureRestAPI view of the exchange.
+func (e *Exchange) Future() *Future {
+	return &Future{e}
+}
+
+func (e *Exchange) GetExchangeName() string {
+	return e.name
+}
+
+// SetLatency delays every API call by d.
+func (e *Exchange) SetLatency(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.latency = d
+}
+
+// SetFillRatio caps every matching pass to ratio of an order's open amount,
+// so that crossing orders are only partially filled. 1 disables the cap.
+func (e *Exchange) SetFillRatio(ratio float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.fillRatio = ratio
+}
+
+// SetFee sets the maker and taker fee rates. Spot fees are taken from the
+// currency received, futures fees from the margin balance.
+func (e *Exchange) SetFee(maker, taker float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.makerFee = maker
+	e.takerFee = taker
+}
+
+// SetSlippage worsens every taker fill by ratio of its price, without going
+// past the limit price of the order.
+func (e *Exchange) SetSlippage(ratio float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.slippage = ratio
+}
+
+// SetContractValue sets the face value of one futures contract used when
+// realising PnL. It defaults to 1.
+func (e *Exchange) SetContractValue(value float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.contractValue = value
+}
+
+// SetClock replaces the source of order and trade timestamps.
+func (e *Exchange) SetClock(now func() time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.now = now
+}
+
+// Reject makes the next n order placements, spot or futures, fail with
+// ErrRejected.
+func (e *Exchange) Reject(n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rejects += n
+}
+
+// Fail makes the next n calls of the named API method (e.g. "GetTicker")
+// return err.
+func (e *Exchange) Fail(method string, n int, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i := 0; i < n; i++ {
+		e.failures[method] = append(e.failures[method], err)
+	}
+}
+
+// SetBalance sets the available spot balance of currency and clears any
+// frozen amount.
+func (e *Exchange) SetBalance(currency goex.Currency, amount float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.balances[currency] = &goex.SubAccount{Currency: currency, Amount: amount}
+}
+
+// Balance reports the available and frozen spot balance of currency.
+func (e *Exchange) Balance(currency goex.Currency) (amount, frozen float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var sub = e.balance(currency)
+	return sub.Amount, sub.ForzenAmount
+}
+
+// SetMargin sets the futures margin balance held in currency. Realised PnL
+// of contracts quoted in currency is booked against it.
+func (e *Exchange) SetMargin(currency goex.Currency, amount float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.margins[currency] = amount
+}
+
+// Margin reports the futures margin balance held in currency.
+func (e *Exchange) Margin(currency goex.Currency) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.margins[currency]
+}
+
+// Market returns the spot market of pair, creating it if needed.
+func (e *Exchange) Market(pair goex.CurrencyPair) *Market {
+	return e.FutureMarket(pair, "")
+}
+
+// FutureMarket returns the futures market of pair and contractType,
+// creating it if needed.
+func (e *Exchange) FutureMarket(pair goex.CurrencyPair, contractType string) *Market {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.market(pair, contractType)
+}
+
+// Fill fills up to amount of the open order id at price, as if a
+// counterparty had crossed it.
+func (e *Exchange) Fill(id string, amount, price float64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var o, ok = e.index[id]
+	if !ok {
+		return ErrOrderNotFound
+	}
+	if !o.open() {
+		return ErrOrderClosed
+	}
+	if amount > o.amount-o.filled {
+		amount = o.amount - o.filled
+	}
+	e.fill(o, amount, price, true)
+	return nil
+}
+
+// Fills returns every fill so far, oldest first.
+func (e *Exchange) Fills() []Fill {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Fill(nil), e.fills...)
+}
+
+// OpenOrders returns the ids of all orders still resting, in placement order.
+func (e *Exchange) OpenOrders() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var ids []string
+	for _, o := range e.orders {
+		if o.open() {
+			ids = append(ids, o.id)
+		}
+	}
+	return ids
+}
+
+// call applies the configured latency and pops a scripted failure for method.
+func (e *Exchange) call(method string) error {
+	e.mu.Lock()
+	var latency = e.latency
+	e.mu.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if errs := e.failures[method]; len(errs) > 0 {
+		e.failures[method] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+func (e *Exchange) reject() bool {
+	if e.rejects > 0 {
+		e.rejects--
+		return true
+	}
+	return false
+}
+
+func (e *Exchange) balance(currency goex.Currency) *goex.SubAccount {
+	var sub, ok = e.balances[currency]
+	if !ok {
+		sub = &goex.SubAccount{Currency: currency}
+		e.balances[currency] = sub
+	}
+	return sub
+}
+
+func (e *Exchange) market(pair goex.CurrencyPair, contractType string) *Market {
+	var key = marketKey(pair, contractType)
+	var m, ok = e.markets[key]
+	if !ok {
+		m = &Market{ex: e, pair: pair, contractType: contractType}
+		e.markets[key] = m
+	}
+	return m
+}
+
+func marketKey(pair goex.CurrencyPair, contractType string) string {
+	return pair.ToSymbol("_") + "|" + contractType
+}
+
+func (e *Exchange) nextID() (int, string) {
+	e.seq++
+	return e.seq, strconv.Itoa(e.seq)
+}
+
+// place registers o, matches it against its market and leaves the rest
+// resting. The caller must hold e.mu and have reserved funds for o.
+func (e *Exchange) place(o *order) {
+	o.seq, o.id = e.nextID()
+	o.created = e.now()
+	o.status = goex.ORDER_UNFINISH
+	e.orders = append(e.orders, o)
+	e.index[o.id] = o
+	e.match(o, false)
+	if o.market && o.open() {
+		// market orders never rest
+		e.cancel(o)
+	}
+}
+
+// match crosses o against its market. Resting orders (maker) fill at their
+// own price, incoming orders take the book price.
+func (e *Exchange) match(o *order, maker bool) {
+	var want = o.amount - o.filled
+	if e.fillRatio > 0 && e.fillRatio < 1 {
+		want *= e.fillRatio
+	}
+	if want <= 0 {
+		return
+	}
+	var fills = o.book.take(o.isBuy, o.price, o.market, want)
+	for _, f := range fills {
+		var price = f.Price
+		if maker {
+			price = o.price
+		} else if e.slippage != 0 {
+			price = e.slip(o, price)
+		}
+		var amount = f.Amount
+		if o.isBuy && o.market && o.future == 0 {
+			// market buys are not pre-funded, stop when money runs out
+			var quote = e.balance(o.book.pair.CurrencyB)
+			if amount*price > quote.Amount {
+				amount = quote.Amount / price
+			}
+		}
+		if amount <= 0 {
+			break
+		}
+		e.fill(o, amount, price, maker)
+	}
+}
+
+func (e *Exchange) slip(o *order, price float64) float64 {
+	if o.isBuy {
+		price *= 1 + e.slippage
+		if !o.market && price > o.price {
+			price = o.price
+		}
+	} else {
+		price *= 1 - e.slippage
+		if !o.market && price < o.price {
+			price = o.price
+		}
+	}
+	return price
+}
+
+// rematch gives every resting order of m a chance to fill after m moved.
+func (e *Exchange) rematch(m *Market) {
+	for _, o := range e.orders {
+		if o.book == m && o.open() {
+			e.match(o, true)
+		}
+	}
+}
+
+func (e *Exchange) fill(o *order, amount, price float64, maker bool) {
+	if amount <= 0 {
+		return
+	}
+	var rate = e.takerFee
+	if maker {
+		rate = e.makerFee
+	}
+	var fee float64
+	o.filled += amount
+	o.cost += amount * price
+	if o.amount-o.filled <= epsilon {
+		o.status = goex.ORDER_FINISH
+	} else {
+		o.status = goex.ORDER_PART_FINISH
+	}
+	if o.future != 0 {
+		fee = e.fillFuture(o, amount, price, rate)
+	} else {
+		fee = e.fillSpot(o, amount, price, rate)
+	}
+	o.fee += fee
+	e.fills = append(e.fills, Fill{
+		OrderID:      o.id,
+		Pair:         o.book.pair,
+		ContractType: o.book.contractType,
+		Side:         o.side,
+		OpenType:     o.future,
+		Buy:          o.isBuy,
+		Maker:        maker,
+		Price:        price,
+		Amount:       amount,
+		Fee:          fee,
+		Time:         e.now(),
+	})
+	e.tid++
+	var side = goex.TradeSide(goex.SELL)
+	if o.isBuy {
+		side = goex.BUY
+	}
+	o.book.trades = append(o.book.trades, goex.Trade{
+		Tid:    e.tid,
+		Type:   side,
+		Amount: amount,
+		Price:  price,
+		Date:   e.now().UnixNano() / int64(time.Millisecond),
+		Pair:   o.book.pair,
+	})
+}
+
+func (e *Exchange) cancel(o *order) {
+	var rest = o.amount - o.filled
+	if o.future != 0 {
+		e.releaseFuture(o, rest)
+	} else {
+		e.releaseSpot(o, rest)
+	}
+	o.status = goex.ORDER_CANCEL
+}
+
+const epsilon = 1e-9
+
+// Fill is one execution against an order placed on the mock.
+type Fill struct {
+	OrderID      string
+	Pair         goex.CurrencyPair
+	ContractType string         // "" for spot
+	Side         goex.TradeSide // spot orders only
+	OpenType     int            // futures orders only: goex.OPEN_BUY ... goex.CLOSE_SELL
+	Buy          bool
+	Maker        bool
+	Price        float64
+	Amount       float64
+	Fee          float64 // in the currency received for spot, in margin for futures
+	Time         time.Time
+}
+
+// Market is one scripted spot or futures market.
+type Market struct {
+	ex           *Exchange
+	pair         goex.CurrencyPair
+	contractType string
+	ticker       goex.Ticker
+	bids         goex.DepthRecords
+	asks         goex.DepthRecords
+	trades       []goex.Trade
+	klines       []goex.Kline
+	rules        Rules
+}
+
+// Rules are the trading filters of a market. Zero fields are not enforced.
+type Rules struct {
+	TickSize    float64 // prices must be multiples of it
+	LotSize     float64 // amounts must be multiples of it
+	MinQty      float64
+	MinNotional float64 // price * amount, limit orders only
+}
+
+// SetTicker sets the best bid and ask (and last as their midpoint) and lets
+// resting orders that now cross fill. Any scripted book is dropped, so the
+// ticker acts as an unlimited top of book until SetDepth is called again.
+func (m *Market) SetTicker(buy, sell float64) {
+	m.ex.mu.Lock()
+	defer m.ex.mu.Unlock()
+	m.bids, m.asks = nil, nil
+	m.ticker.Pair = m.pair
+	m.ticker.Buy = buy
+	m.ticker.Sell = sell
+	m.ticker.Last = (buy + sell) / 2
+	m.ticker.Date = uint64(m.ex.now().Unix())
+	m.ex.rematch(m)
+}
+
+// SetLast sets the last traded price reported by the ticker.
+func (m *Market) SetLast(last float64) {
+	m.ex.mu.Lock()
+	defer m.ex.mu.Unlock()
+	m.ticker.Last = last
+}
+
+// SetDepth replaces the order book. Bids and asks may be given in any order.
+// The ticker follows the new top of book and resting orders are rematched.
+func (m *Market) SetDepth(bids, asks goex.DepthRecords) {
+	m.ex.mu.Lock()
+	defer m.ex.mu.Unlock()
+	m.bids = append(goex.DepthRecords(nil), bids...)
+	m.asks = append(goex.DepthRecords(nil), asks...)
+	sort.Slice(m.bids, func(i, j int) bool { return m.bids[i].Price > m.bids[j].Price })
+	sort.Slice(m.asks, func(i, j int) bool { return m.asks[i].Price < m.asks[j].Price })
+	m.ticker.Pair = m.pair
+	if len(m.bids) > 0 {
+		m.ticker.Buy = m.bids[0].Price
+	}
+	if len(m.asks) > 0 {
+		m.ticker.Sell = m.asks[0].Price
+	}
+	m.ticker.Last = (m.ticker.Buy + m.ticker.Sell) / 2
+	m.ticker.Date = uint64(m.ex.now().Unix())
+	m.ex.rematch(m)
+}
+
+// SetRules makes the market reject orders that break rules with ErrFilter.
+func (m *Market) SetRules(rules Rules) {
+	m.ex.mu.Lock()
+	defer m.ex.mu.Unlock()
+	m.rules = rules
+}
+
+// Rules returns the filters set by SetRules.
+func (m *Market) Rules() Rules {
+	m.ex.mu.Lock()
+	defer m.ex.mu.Unlock()
+	return m.rules
+}
+
+// admit checks an incoming order against the market rules.
+func (m *Market) admit(price, amount float64, market bool) error {
+	var r = m.rules
+	switch {
+	case !market && !multipleOf(price, r.TickSize):
+		return fmt.Errorf("%w: price %v not a multiple of tick %v", ErrFilter, price, r.TickSize)
+	case !multipleOf(amount, r.LotSize):
+		return fmt.Errorf("%w: amount %v not a multiple of lot %v", ErrFilter, amount, r.LotSize)
+	case amount < r.MinQty-epsilon:
+		return fmt.Errorf("%w: amount %v below %v", ErrFilter, amount, r.MinQty)
+	case !market && price*amount < r.MinNotional-epsilon:
+		return fmt.Errorf("%w: notional %v below %v", ErrFilter, price*amount, r.MinNotional)
+	}
+	return nil
+}
+
+func multipleOf(x, step float64) bool {
+	if step <= 0 {
+		return true
+	}
+	var n = x / step
+	return math.Abs(n-math.Round(n)) < 1e-6
+}
+
+// AddTrades appends public trades returned by GetTrades.
+func (m *Market) AddTrades(trades ...goex.Trade) {
+	m.ex.mu.Lock()
+	defer m.ex.mu.Unlock()
+	for _, t := range trades {
+		if t.Tid == 0 {
+			m.ex.tid++
+			t.Tid = m.ex.tid
+		} else if t.Tid > m.ex.tid {
+			m.ex.tid = t.Tid
+		}
+		t.Pair = m.pair
+		m.trades = append(m.trades, t)
+	}
+}
+
+// AddKlines appends bars returned by GetKlineRecords.
+func (m *Market) AddKlines(klines ...goex.Kline) {
+	m.ex.mu.Lock()
+	defer m.ex.mu.Unlock()
+	for _, k := range klines {
+		k.Pair = m.pair
+		m.klines = append(m.klines, k)
+	}
+}
+
+type fillRecord = goex.DepthRecord
+
+// liquidity is how much an order on the given side could take at limit or
+// better. Without a scripted book a crossing ticker is unlimited.
+func (m *Market) liquidity(isBuy bool, limit float64) float64 {
+	var levels, best = m.asks, m.ticker.Sell
+	var crosses = func(price float64) bool { return price <= limit+epsilon }
+	if !isBuy {
+		levels, best = m.bids, m.ticker.Buy
+		crosses = func(price float64) bool { return price >= limit-epsilon }
+	}
+	if len(levels) == 0 {
+		if best > 0 && crosses(best) {
+			return math.Inf(1)
+		}
+		return 0
+	}
+	var total = 0.0
+	for _, level := range levels {
+		if !crosses(level.Price) {
+			break
+		}
+		total += level.Amount
+	}
+	return total
+}
+
+// take removes up to want from the side of the book an order on the given
+// side would cross, honouring limit unless market is set. Without a scripted
+// book the ticker is treated as an unlimited top level.
+func (m *Market) take(isBuy bool, limit float64, market bool, want float64) []fillRecord {
+	var levels = &m.asks
+	var best = m.ticker.Sell
+	var crosses = func(price float64) bool { return market || price <= limit+epsilon }
+	if !isBuy {
+		levels = &m.bids
+		best = m.ticker.Buy
+		crosses = func(price float64) bool { return market || price >= limit-epsilon }
+	}
+	if len(*levels) == 0 {
+		if best > 0 && crosses(best) {
+			return []fillRecord{{Price: best, Amount: want}}
+		}
+		return nil
+	}
+	var fills []fillRecord
+	for want > epsilon && len(*levels) > 0 {
+		var level = &(*levels)[0]
+		if !crosses(level.Price) {
+			break
+		}
+		var amount = level.Amount
+		if amount > want {
+			amount = want
+		}
+		fills = append(fills, fillRecord{Price: level.Price, Amount: amount})
+		want -= amount
+		level.Amount -= amount
+		if level.Amount <= epsilon {
+			*levels = (*levels)[1:]
+		}
+	}
+	if len(m.bids) > 0 {
+		m.ticker.Buy = m.bids[0].Price
+	}
+	if len(m.asks) > 0 {
+		m.ticker.Sell = m.asks[0].Price
+	}
+	return fills
+}
+
+type order struct {
+	id        string
+	seq       int
+	book      *Market
+	isBuy     bool
+	market    bool
+	side      goex.TradeSide
+	future    int // goex.OPEN_BUY ... goex.CLOSE_SELL, 0 for spot
+	leverRate int
+	price     float64
+	amount    float64
+	filled    float64
+	cost      float64
+	fee       float64
+	status    goex.TradeStatus
+	created   time.Time
+}
+
+func (o *order) open() bool {
+	return o.status == goex.ORDER_UNFINISH || o.status == goex.ORDER_PART_FINISH
+}
+
+func (o *order) avgPrice() float64 {
+	if o.filled == 0 {
+		return 0
+	}
+	return o.cost / o.filled
+}
+
+func (o *order) timestamp() int64 {
+	return o.created.UnixNano() / int64(time.Millisecond)
+}
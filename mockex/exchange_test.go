@@ -0,0 +1,179 @@
+package mockex
+
+import (
+	"errors"
+	"github.com/nntaoli-project/GoEx"
+	"testing"
+	"time"
+)
+
+var pair = goex.BTC_USDT
+
+func TestSpotLimitOrderWalksBook(t *testing.T) {
+	var ex = New("mock")
+	ex.SetBalance(goex.USDT, 1000)
+	ex.Market(pair).SetDepth(
+		goex.DepthRecords{{Price: 99, Amount: 1}},
+		goex.DepthRecords{{Price: 101, Amount: 1}, {Price: 100, Amount: 1}, {Price: 105, Amount: 5}},
+	)
+	var spot = ex.Spot()
+	order, err := spot.LimitBuy("3", "102", pair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.DealAmount != 2 || order.AvgPrice != 100.5 || order.Status != goex.ORDER_PART_FINISH {
+		t.Fatalf("unexpected order %+v", order)
+	}
+	if usdt, frozen := ex.Balance(goex.USDT); usdt != 1000-201-102 || frozen != 102 {
+		t.Fatalf("unexpected USDT balance %f frozen %f", usdt, frozen)
+	}
+	ticker, _ := spot.GetTicker(pair)
+	if ticker.Sell != 105 {
+		t.Fatalf("book not consumed, ask %f", ticker.Sell)
+	}
+
+	ex.Market(pair).SetTicker(99, 101)
+	order, _ = spot.GetOneOrder(order.OrderID2, pair)
+	if order.Status != goex.ORDER_FINISH || order.DealAmount != 3 {
+		t.Fatalf("resting order not filled %+v", order)
+	}
+	if btc, _ := ex.Balance(goex.BTC); btc != 3 {
+		t.Fatalf("want 3 BTC, got %f", btc)
+	}
+}
+
+func TestSpotCancelReleasesFunds(t *testing.T) {
+	var ex = New("mock")
+	ex.SetBalance(goex.BTC, 2)
+	ex.Market(pair).SetTicker(99, 101)
+	var spot = ex.Spot()
+	order, err := spot.LimitSell("1.5", "110", pair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orders, _ := spot.GetUnfinishOrders(pair); len(orders) != 1 {
+		t.Fatalf("want 1 open order, got %d", len(orders))
+	}
+	if ok, err := spot.CancelOrder(order.OrderID2, pair); !ok || err != nil {
+		t.Fatalf("cancel failed: %v", err)
+	}
+	if btc, frozen := ex.Balance(goex.BTC); btc != 2 || frozen != 0 {
+		t.Fatalf("unexpected BTC balance %f frozen %f", btc, frozen)
+	}
+	if _, err := spot.LimitSell("3", "110", pair); err != ErrInsufficientBalance {
+		t.Fatalf("want ErrInsufficientBalance, got %v", err)
+	}
+}
+
+func TestScriptedFailures(t *testing.T) {
+	var ex = New("mock")
+	ex.SetBalance(goex.USDT, 1000)
+	ex.Market(pair).SetTicker(99, 101)
+	var spot = ex.Spot()
+	var boom = errors.New("boom")
+	ex.Fail("GetTicker", 1, boom)
+	if _, err := spot.GetTicker(pair); err != boom {
+		t.Fatalf("want boom, got %v", err)
+	}
+	if _, err := spot.GetTicker(pair); err != nil {
+		t.Fatal(err)
+	}
+	ex.Reject(1)
+	if _, err := spot.LimitBuy("1", "101", pair); err != ErrRejected {
+		t.Fatalf("want ErrRejected, got %v", err)
+	}
+	ex.SetFillRatio(0.25)
+	order, err := spot.LimitBuy("1", "101", pair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.DealAmount != 0.25 {
+		t.Fatalf("want 0.25 filled, got %f", order.DealAmount)
+	}
+}
+
+func TestSpotTimeInForce(t *testing.T) {
+	var ex = New("mock")
+	ex.SetBalance(goex.USDT, 1000)
+	ex.Market(pair).SetDepth(nil, goex.DepthRecords{{Price: 101, Amount: 0.5}, {Price: 102, Amount: 5}})
+	var spot = ex.Spot()
+	if _, err := spot.LimitOrder(goex.BUY, "1", "101", pair, "POST_ONLY"); !errors.Is(err, ErrWouldCross) {
+		t.Fatalf("want ErrWouldCross, got %v", err)
+	}
+	order, err := spot.LimitOrder(goex.BUY, "1", "101", pair, "FOK")
+	if err != nil || order.Status != goex.ORDER_CANCEL || order.DealAmount != 0 {
+		t.Fatalf("want an unfilled cancelled order, got %+v, %v", order, err)
+	}
+	order, err = spot.LimitOrder(goex.BUY, "1", "101", pair, "IOC")
+	if err != nil || order.Status != goex.ORDER_CANCEL || order.DealAmount != 0.5 {
+		t.Fatalf("want half filled and the rest cancelled, got %+v, %v", order, err)
+	}
+	if usdt, frozen := ex.Balance(goex.USDT); usdt != 1000-50.5 || frozen != 0 {
+		t.Fatalf("unexpected USDT balance %f frozen %f", usdt, frozen)
+	}
+}
+
+func TestMarketRules(t *testing.T) {
+	var ex = New("mock")
+	ex.SetBalance(goex.USDT, 1000)
+	ex.Market(pair).SetTicker(99, 101)
+	ex.Market(pair).SetRules(Rules{TickSize: 0.5, LotSize: 0.01, MinNotional: 10})
+	var spot = ex.Spot()
+	for _, c := range [][2]string{{"1", "100.2"}, {"0.015", "100"}, {"0.05", "100"}} {
+		if _, err := spot.LimitBuy(c[0], c[1], pair); !errors.Is(err, ErrFilter) {
+			t.Fatalf("%s @ %s: want ErrFilter, got %v", c[0], c[1], err)
+		}
+	}
+	if _, err := spot.LimitBuy("0.25", "100.5", pair); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	var ex = New("mock")
+	ex.SetLatency(20 * time.Millisecond)
+	var start = time.Now()
+	ex.Spot().GetAccount()
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatal("latency not applied")
+	}
+}
+
+func TestFuturePositionLifecycle(t *testing.T) {
+	var ex = New("mock")
+	ex.SetMargin(goex.USDT, 100)
+	ex.SetContractValue(10)
+	var market = ex.FutureMarket(pair, goex.QUARTER_CONTRACT)
+	market.SetTicker(99, 101)
+	var future = ex.Future()
+
+	if _, err := future.PlaceFutureOrder(pair, goex.QUARTER_CONTRACT, "0", "2", goex.OPEN_SELL, 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := future.PlaceFutureOrder(pair, goex.QUARTER_CONTRACT, "99", "3", goex.CLOSE_SELL, 0, 10); err != ErrInsufficientPosition {
+		t.Fatalf("want ErrInsufficientPosition, got %v", err)
+	}
+	id, err := future.PlaceFutureOrder(pair, goex.QUARTER_CONTRACT, "95", "2", goex.CLOSE_SELL, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	positions, _ := future.GetFuturePosition(pair, goex.QUARTER_CONTRACT)
+	if len(positions) != 1 || positions[0].SellAmount != 2 || positions[0].SellAvailable != 0 || positions[0].SellPriceAvg != 99 {
+		t.Fatalf("unexpected positions %+v", positions)
+	}
+	if orders, _ := future.GetUnfinishFutureOrders(pair, goex.QUARTER_CONTRACT); len(orders) != 1 {
+		t.Fatalf("want 1 open order, got %d", len(orders))
+	}
+
+	market.SetTicker(94, 95)
+	order, _ := future.GetFutureOrder(id, pair, goex.QUARTER_CONTRACT)
+	if order.Status != goex.ORDER_FINISH {
+		t.Fatalf("close order not filled %+v", order)
+	}
+	if positions, _ = future.GetFuturePosition(pair, goex.QUARTER_CONTRACT); len(positions) != 0 {
+		t.Fatalf("position not closed %+v", positions)
+	}
+	if margin := ex.Margin(goex.USDT); margin != 180 {
+		t.Fatalf("want margin 180, got %f", margin)
+	}
+}
@@ -0,0 +1,401 @@
+package mockex
+
+import (
+	"github.com/nntaoli-project/GoEx"
+	"sort"
+	"strconv"
+)
+
+// Future is the goex.FutureRestAPI view of an Exchange. Contracts are
+// linear: PnL is (exit - entry) * amount * contract value, booked in the
+// quote currency of the pair.
+type Future struct {
+	*Exchange
+}
+
+var _ goex.FutureRestAPI = (*Future)(nil)
+
+type position struct {
+	pair         goex.CurrencyPair
+	contractType string
+	leverRate    int
+	long         leg
+	short        leg
+}
+
+type leg struct {
+	amount   float64
+	cost     float64
+	frozen   float64
+	realised float64
+}
+
+func (l *leg) avg() float64 {
+	if l.amount <= epsilon {
+		return 0
+	}
+	return l.cost / l.amount
+}
+
+func (f *Future) GetFutureTicker(currencyPair goex.CurrencyPair, contractType string) (*goex.Ticker, error) {
+	if err := f.call("GetFutureTicker"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ticker = f.market(currencyPair, contractType).ticker
+	return &ticker, nil
+}
+
+func (f *Future) GetFutureDepth(currencyPair goex.CurrencyPair, contractType string, size int) (*goex.Depth, error) {
+	if err := f.call("GetFutureDepth"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.market(currencyPair, contractType).depth(size), nil
+}
+
+// GetFutureIndex reports the last price of the first futures market of
+// currencyPair.
+func (f *Future) GetFutureIndex(currencyPair goex.CurrencyPair) (float64, error) {
+	if err := f.call("GetFutureIndex"); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, m := range f.markets {
+		if m.pair == currencyPair && m.contractType != "" {
+			return m.ticker.Last, nil
+		}
+	}
+	return 0, nil
+}
+
+func (f *Future) GetFutureUserinfo() (*goex.FutureAccount, error) {
+	if err := f.call("GetFutureUserinfo"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var acc = &goex.FutureAccount{
+		FutureSubAccounts: make(map[goex.Currency]goex.FutureSubAccount, len(f.margins)),
+	}
+	for currency := range f.margins {
+		acc.FutureSubAccounts[currency] = f.futureAccount(currency)
+	}
+	return acc, nil
+}
+
+// Rights reports the futures account rights held in currency, the margin
+// balance plus unrealised PnL, without the latency and scripted failures of
+// GetFutureUserinfo.
+func (e *Exchange) Rights(currency goex.Currency) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.futureAccount(currency).AccountRights
+}
+
+func (e *Exchange) futureAccount(currency goex.Currency) goex.FutureSubAccount {
+	var margin = e.margins[currency]
+	var realised, unrealised = 0.0, 0.0
+	for _, p := range e.positions {
+		if p.pair.CurrencyB != currency {
+			continue
+		}
+		var last = e.market(p.pair, p.contractType).ticker.Last
+		realised += p.long.realised + p.short.realised
+		if last > 0 {
+			unrealised += (last*p.long.amount - p.long.cost) * e.contractValue
+			unrealised += (p.short.cost - last*p.short.amount) * e.contractValue
+		}
+	}
+	return goex.FutureSubAccount{
+		Currency:      currency,
+		AccountRights: margin + unrealised,
+		KeepDeposit:   margin,
+		ProfitReal:    realised,
+		ProfitUnreal:  unrealised,
+	}
+}
+
+// PlaceFutureOrder opens or closes contracts. matchPrice 1 places a market
+// order and ignores price. Closing more than the open, unreserved position
+// fails with ErrInsufficientPosition.
+func (f *Future) PlaceFutureOrder(currencyPair goex.CurrencyPair, contractType, price, amount string, openType, matchPrice, leverRate int) (string, error) {
+	if err := f.call("PlaceFutureOrder"); err != nil {
+		return "", err
+	}
+	qty, err := strconv.ParseFloat(amount, 64)
+	if err != nil {
+		return "", err
+	}
+	var px = 0.0
+	if matchPrice != 1 {
+		if px, err = strconv.ParseFloat(price, 64); err != nil {
+			return "", err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reject() {
+		return "", ErrRejected
+	}
+	var book = f.market(currencyPair, contractType)
+	if err = book.admit(px, qty, matchPrice == 1); err != nil {
+		return "", err
+	}
+	var o = &order{
+		book:      book,
+		isBuy:     openType == goex.OPEN_BUY || openType == goex.CLOSE_SELL,
+		market:    matchPrice == 1,
+		future:    openType,
+		leverRate: leverRate,
+		price:     px,
+		amount:    qty,
+	}
+	switch openType {
+	case goex.OPEN_BUY, goex.OPEN_SELL:
+	case goex.CLOSE_BUY, goex.CLOSE_SELL:
+		var l = f.leg(o)
+		if l.amount-l.frozen < qty-epsilon {
+			return "", ErrInsufficientPosition
+		}
+		l.frozen += qty
+	default:
+		return "", ErrRejected
+	}
+	f.place(o)
+	return o.id, nil
+}
+
+func (f *Future) FutureCancelOrder(currencyPair goex.CurrencyPair, contractType, orderId string) (bool, error) {
+	if err := f.call("FutureCancelOrder"); err != nil {
+		return false, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var o, ok = f.index[orderId]
+	if !ok || o.future == 0 {
+		return false, ErrOrderNotFound
+	}
+	if !o.open() {
+		return false, ErrOrderClosed
+	}
+	f.cancel(o)
+	return true, nil
+}
+
+// GetFuturePosition reports one record per contract of currencyPair that
+// still holds a long or short position. An empty contractType matches every
+// contract.
+func (f *Future) GetFuturePosition(currencyPair goex.CurrencyPair, contractType string) ([]goex.FuturePosition, error) {
+	if err := f.call("GetFuturePosition"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var positions = make([]goex.FuturePosition, 0)
+	for _, key := range sortedKeys(f.positions) {
+		var p = f.positions[key]
+		if p.pair != currencyPair || (contractType != "" && p.contractType != contractType) {
+			continue
+		}
+		if p.long.amount <= epsilon && p.short.amount <= epsilon {
+			continue
+		}
+		positions = append(positions, goex.FuturePosition{
+			BuyAmount:      p.long.amount,
+			BuyAvailable:   p.long.amount - p.long.frozen,
+			BuyPriceAvg:    p.long.avg(),
+			BuyPriceCost:   p.long.avg(),
+			BuyProfitReal:  p.long.realised,
+			LeverRate:      p.leverRate,
+			SellAmount:     p.short.amount,
+			SellAvailable:  p.short.amount - p.short.frozen,
+			SellPriceAvg:   p.short.avg(),
+			SellPriceCost:  p.short.avg(),
+			SellProfitReal: p.short.realised,
+			Symbol:         p.pair,
+			ContractType:   p.contractType,
+		})
+	}
+	return positions, nil
+}
+
+func (f *Future) GetFutureOrders(orderIds []string, currencyPair goex.CurrencyPair, contractType string) ([]goex.FutureOrder, error) {
+	if err := f.call("GetFutureOrders"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var orders = make([]goex.FutureOrder, 0, len(orderIds))
+	for _, id := range orderIds {
+		if o, ok := f.index[id]; ok && o.future != 0 {
+			orders = append(orders, futureOrder(o))
+		}
+	}
+	return orders, nil
+}
+
+func (f *Future) GetFutureOrder(orderId string, currencyPair goex.CurrencyPair, contractType string) (*goex.FutureOrder, error) {
+	if err := f.call("GetFutureOrder"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var o, ok = f.index[orderId]
+	if !ok || o.future == 0 {
+		return nil, ErrOrderNotFound
+	}
+	var snapshot = futureOrder(o)
+	return &snapshot, nil
+}
+
+func (f *Future) GetUnfinishFutureOrders(currencyPair goex.CurrencyPair, contractType string) ([]goex.FutureOrder, error) {
+	if err := f.call("GetUnfinishFutureOrders"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var orders = make([]goex.FutureOrder, 0)
+	for _, o := range f.orders {
+		if o.future != 0 && o.open() && o.book.pair == currencyPair && o.book.contractType == contractType {
+			orders = append(orders, futureOrder(o))
+		}
+	}
+	return orders, nil
+}
+
+// GetFee reports the taker fee rate.
+func (f *Future) GetFee() (float64, error) {
+	if err := f.call("GetFee"); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.takerFee, nil
+}
+
+func (f *Future) GetContractValue(currencyPair goex.CurrencyPair) (float64, error) {
+	if err := f.call("GetContractValue"); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.contractValue, nil
+}
+
+// GetDeliveryTime reports weekly delivery on Friday 16:00:00.
+func (f *Future) GetDeliveryTime() (int, int, int, int) {
+	return 4, 16, 0, 0
+}
+
+// GetKlineRecords returns up to size of the bars added with AddKlines to the
+// contractType market whose timestamp is at least since. period is ignored.
+func (f *Future) GetKlineRecords(contract_type string, currency goex.CurrencyPair, period, size, since int) ([]goex.FutureKline, error) {
+	if err := f.call("GetKlineRecords"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var klines = f.market(currency, contract_type).klineRecords(size, int64(since))
+	var records = make([]goex.FutureKline, len(klines))
+	for i := range klines {
+		records[i] = goex.FutureKline{Kline: &klines[i]}
+	}
+	return records, nil
+}
+
+// GetTrades returns the public trades of the contract with a Tid above since.
+func (f *Future) GetTrades(contract_type string, currencyPair goex.CurrencyPair, since int64) ([]goex.Trade, error) {
+	if err := f.call("GetTrades"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.market(currencyPair, contract_type).tradesSince(since), nil
+}
+
+func (e *Exchange) position(o *order) *position {
+	var key = marketKey(o.book.pair, o.book.contractType)
+	var p, ok = e.positions[key]
+	if !ok {
+		p = &position{pair: o.book.pair, contractType: o.book.contractType}
+		e.positions[key] = p
+	}
+	return p
+}
+
+// leg is the side of the position o opens or closes.
+func (e *Exchange) leg(o *order) *leg {
+	var p = e.position(o)
+	if o.future == goex.OPEN_BUY || o.future == goex.CLOSE_BUY {
+		return &p.long
+	}
+	return &p.short
+}
+
+// fillFuture settles a fill and returns the fee taken from the margin.
+func (e *Exchange) fillFuture(o *order, amount, price, rate float64) float64 {
+	var fee = amount * price * e.contractValue * rate
+	e.margins[o.book.pair.CurrencyB] -= fee
+	var p = e.position(o)
+	if o.leverRate > 0 {
+		p.leverRate = o.leverRate
+	}
+	var l = e.leg(o)
+	switch o.future {
+	case goex.OPEN_BUY, goex.OPEN_SELL:
+		l.amount += amount
+		l.cost += amount * price
+	case goex.CLOSE_BUY, goex.CLOSE_SELL:
+		var avg = l.avg()
+		var pnl = (price - avg) * amount * e.contractValue
+		if o.future == goex.CLOSE_SELL {
+			pnl = -pnl
+		}
+		l.amount -= amount
+		l.cost -= avg * amount
+		l.frozen -= amount
+		l.realised += pnl
+		if l.amount <= epsilon {
+			l.amount, l.cost, l.frozen = 0, 0, 0
+		}
+		e.margins[o.book.pair.CurrencyB] += pnl
+	}
+	return fee
+}
+
+func (e *Exchange) releaseFuture(o *order, rest float64) {
+	if o.future == goex.CLOSE_BUY || o.future == goex.CLOSE_SELL {
+		e.leg(o).frozen -= rest
+	}
+}
+
+func futureOrder(o *order) goex.FutureOrder {
+	return goex.FutureOrder{
+		OrderID2:     o.id,
+		Price:        o.price,
+		Amount:       o.amount,
+		AvgPrice:     o.avgPrice(),
+		DealAmount:   o.filled,
+		OrderID:      int64(o.seq),
+		OrderTime:    o.timestamp(),
+		Status:       o.status,
+		Currency:     o.book.pair,
+		OType:        o.future,
+		LeverRate:    o.leverRate,
+		Fee:          o.fee,
+		ContractName: o.book.contractType,
+	}
+}
+
+func sortedKeys(positions map[string]*position) []string {
+	var keys = make([]string, 0, len(positions))
+	for key := range positions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
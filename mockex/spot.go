@@ -0,0 +1,351 @@
+package mockex
+
+import (
+	"fmt"
+	"github.com/nntaoli-project/GoEx"
+	"strconv"
+)
+
+// Spot is the goex.API view of an Exchange.
+type Spot struct {
+	*Exchange
+}
+
+var _ goex.API = (*Spot)(nil)
+
+func (s *Spot) LimitBuy(amount, price string, currency goex.CurrencyPair) (*goex.Order, error) {
+	return s.placeSpot("LimitBuy", goex.BUY, amount, price, currency, "")
+}
+
+func (s *Spot) LimitSell(amount, price string, currency goex.CurrencyPair) (*goex.Order, error) {
+	return s.placeSpot("LimitSell", goex.SELL, amount, price, currency, "")
+}
+
+// LimitOrder places a goex.BUY or goex.SELL limit order with a time in
+// force, as trade.TimeInForceAPI expects: "POST_ONLY" orders that would take
+// fail with ErrWouldCross, "IOC" orders are cancelled after matching and
+// "FOK" orders are cancelled unfilled unless the book covers all of amount.
+// Anything else is an ordinary limit order.
+func (s *Spot) LimitOrder(side goex.TradeSide, amount, price string, currency goex.CurrencyPair, timeInForce string) (*goex.Order, error) {
+	if side != goex.BUY && side != goex.SELL {
+		return nil, fmt.Errorf("mockex: LimitOrder side %s", side.String())
+	}
+	return s.placeSpot("LimitOrder", side, amount, price, currency, timeInForce)
+}
+
+// MarketBuy buys amount of the base currency at whatever the book offers. The
+// price argument is ignored.
+func (s *Spot) MarketBuy(amount, price string, currency goex.CurrencyPair) (*goex.Order, error) {
+	return s.placeSpot("MarketBuy", goex.BUY_MARKET, amount, price, currency, "")
+}
+
+// MarketSell sells amount of the base currency at whatever the book bids.
+// The price argument is ignored.
+func (s *Spot) MarketSell(amount, price string, currency goex.CurrencyPair) (*goex.Order, error) {
+	return s.placeSpot("MarketSell", goex.SELL_MARKET, amount, price, currency, "")
+}
+
+func (s *Spot) placeSpot(method string, side goex.TradeSide, amount, price string, currency goex.CurrencyPair, timeInForce string) (*goex.Order, error) {
+	if err := s.call(method); err != nil {
+		return nil, err
+	}
+	var market = side == goex.BUY_MARKET || side == goex.SELL_MARKET
+	qty, err := strconv.ParseFloat(amount, 64)
+	if err != nil {
+		return nil, err
+	}
+	var px = 0.0
+	if !market {
+		if px, err = strconv.ParseFloat(price, 64); err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reject() {
+		return nil, ErrRejected
+	}
+	var book = s.market(currency, "")
+	if err = book.admit(px, qty, market); err != nil {
+		return nil, err
+	}
+	var o = &order{
+		book:   book,
+		isBuy:  side == goex.BUY || side == goex.BUY_MARKET,
+		market: market,
+		side:   side,
+		price:  px,
+		amount: qty,
+	}
+	if timeInForce == "POST_ONLY" && book.liquidity(o.isBuy, px) > 0 {
+		return nil, ErrWouldCross
+	}
+	if err = s.reserveSpot(o); err != nil {
+		return nil, err
+	}
+	if timeInForce == "FOK" && book.liquidity(o.isBuy, px) < qty-epsilon {
+		// register it so it can be looked up, but never let it match
+		o.seq, o.id = s.nextID()
+		o.created = s.now()
+		s.orders = append(s.orders, o)
+		s.index[o.id] = o
+		s.cancel(o)
+	} else {
+		s.place(o)
+	}
+	if (timeInForce == "IOC" || timeInForce == "FOK") && o.open() {
+		s.cancel(o)
+	}
+	var snapshot = spotOrder(o)
+	return &snapshot, nil
+}
+
+func (s *Spot) CancelOrder(orderId string, currency goex.CurrencyPair) (bool, error) {
+	if err := s.call("CancelOrder"); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var o, ok = s.index[orderId]
+	if !ok || o.future != 0 {
+		return false, ErrOrderNotFound
+	}
+	if !o.open() {
+		return false, ErrOrderClosed
+	}
+	s.cancel(o)
+	return true, nil
+}
+
+func (s *Spot) GetOneOrder(orderId string, currency goex.CurrencyPair) (*goex.Order, error) {
+	if err := s.call("GetOneOrder"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var o, ok = s.index[orderId]
+	if !ok || o.future != 0 {
+		return nil, ErrOrderNotFound
+	}
+	var snapshot = spotOrder(o)
+	return &snapshot, nil
+}
+
+func (s *Spot) GetUnfinishOrders(currency goex.CurrencyPair) ([]goex.Order, error) {
+	if err := s.call("GetUnfinishOrders"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var orders = make([]goex.Order, 0)
+	for _, o := range s.orders {
+		if o.future == 0 && o.open() && o.book.pair == currency {
+			orders = append(orders, spotOrder(o))
+		}
+	}
+	return orders, nil
+}
+
+// GetOrderHistorys pages through every order placed on currency, newest
+// first. currentPage starts at 1.
+func (s *Spot) GetOrderHistorys(currency goex.CurrencyPair, currentPage, pageSize int) ([]goex.Order, error) {
+	if err := s.call("GetOrderHistorys"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var all []goex.Order
+	for i := len(s.orders) - 1; i >= 0; i-- {
+		if o := s.orders[i]; o.future == 0 && o.book.pair == currency {
+			all = append(all, spotOrder(o))
+		}
+	}
+	if currentPage < 1 {
+		currentPage = 1
+	}
+	var from = (currentPage - 1) * pageSize
+	if pageSize <= 0 || from >= len(all) {
+		return []goex.Order{}, nil
+	}
+	var to = from + pageSize
+	if to > len(all) {
+		to = len(all)
+	}
+	return all[from:to], nil
+}
+
+func (s *Spot) GetAccount() (*goex.Account, error) {
+	if err := s.call("GetAccount"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var acc = &goex.Account{
+		Exchange:    s.name,
+		SubAccounts: make(map[goex.Currency]goex.SubAccount, len(s.balances)),
+	}
+	for currency, sub := range s.balances {
+		acc.SubAccounts[currency] = *sub
+	}
+	return acc, nil
+}
+
+func (s *Spot) GetTicker(currency goex.CurrencyPair) (*goex.Ticker, error) {
+	if err := s.call("GetTicker"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ticker = s.market(currency, "").ticker
+	return &ticker, nil
+}
+
+func (s *Spot) GetDepth(size int, currency goex.CurrencyPair) (*goex.Depth, error) {
+	if err := s.call("GetDepth"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.market(currency, "").depth(size), nil
+}
+
+// GetKlineRecords returns up to size of the bars added with AddKlines whose
+// timestamp is at least since, oldest first. period is ignored.
+func (s *Spot) GetKlineRecords(currency goex.CurrencyPair, period, size, since int) ([]goex.Kline, error) {
+	if err := s.call("GetKlineRecords"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.market(currency, "").klineRecords(size, int64(since)), nil
+}
+
+// GetTrades returns the public trades of currency with a Tid above since,
+// including the fills of orders placed on the mock.
+func (s *Spot) GetTrades(currencyPair goex.CurrencyPair, since int64) ([]goex.Trade, error) {
+	if err := s.call("GetTrades"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.market(currencyPair, "").tradesSince(since), nil
+}
+
+// reserveSpot freezes the funds a limit order needs and rejects orders the
+// account cannot cover.
+func (e *Exchange) reserveSpot(o *order) error {
+	if o.market {
+		if !o.isBuy && e.balance(o.book.pair.CurrencyA).Amount < o.amount-epsilon {
+			return ErrInsufficientBalance
+		}
+		return nil
+	}
+	var sub = e.balance(o.book.pair.CurrencyA)
+	var need = o.amount
+	if o.isBuy {
+		sub = e.balance(o.book.pair.CurrencyB)
+		need = o.amount * o.price
+	}
+	if sub.Amount < need-epsilon {
+		return ErrInsufficientBalance
+	}
+	sub.Amount -= need
+	sub.ForzenAmount += need
+	return nil
+}
+
+// fillSpot settles a fill and returns the fee charged on the currency
+// received.
+func (e *Exchange) fillSpot(o *order, amount, price, rate float64) float64 {
+	var base = e.balance(o.book.pair.CurrencyA)
+	var quote = e.balance(o.book.pair.CurrencyB)
+	var fee = amount * rate
+	if !o.isBuy {
+		fee = amount * price * rate
+	}
+	switch {
+	case o.isBuy && o.market:
+		quote.Amount -= amount * price
+		base.Amount += amount - fee
+	case o.isBuy:
+		quote.ForzenAmount -= amount * o.price
+		quote.Amount += amount * (o.price - price)
+		base.Amount += amount - fee
+	case o.market:
+		base.Amount -= amount
+		quote.Amount += amount*price - fee
+	default:
+		base.ForzenAmount -= amount
+		quote.Amount += amount*price - fee
+	}
+	return fee
+}
+
+func (e *Exchange) releaseSpot(o *order, rest float64) {
+	if o.market || rest <= 0 {
+		return
+	}
+	var sub = e.balance(o.book.pair.CurrencyA)
+	if o.isBuy {
+		sub = e.balance(o.book.pair.CurrencyB)
+		rest *= o.price
+	}
+	sub.ForzenAmount -= rest
+	sub.Amount += rest
+}
+
+func spotOrder(o *order) goex.Order {
+	return goex.Order{
+		Price:      o.price,
+		Amount:     o.amount,
+		AvgPrice:   o.avgPrice(),
+		DealAmount: o.filled,
+		Fee:        o.fee,
+		OrderID2:   o.id,
+		OrderID:    o.seq,
+		OrderTime:  int(o.timestamp()),
+		Status:     o.status,
+		Currency:   o.book.pair,
+		Side:       o.side,
+	}
+}
+
+func (m *Market) depth(size int) *goex.Depth {
+	var bids, asks = m.bids, m.asks
+	if size > 0 && len(bids) > size {
+		bids = bids[:size]
+	}
+	if size > 0 && len(asks) > size {
+		asks = asks[:size]
+	}
+	return &goex.Depth{
+		ContractType: m.contractType,
+		Pair:         m.pair,
+		UTime:        m.ex.now(),
+		BidList:      append(goex.DepthRecords(nil), bids...),
+		AskList:      append(goex.DepthRecords(nil), asks...),
+	}
+}
+
+func (m *Market) klineRecords(size int, since int64) []goex.Kline {
+	var klines = make([]goex.Kline, 0, len(m.klines))
+	for _, k := range m.klines {
+		if k.Timestamp >= since {
+			klines = append(klines, k)
+		}
+	}
+	if size > 0 && len(klines) > size {
+		klines = klines[len(klines)-size:]
+	}
+	return klines
+}
+
+func (m *Market) tradesSince(since int64) []goex.Trade {
+	var trades = make([]goex.Trade, 0)
+	for _, t := range m.trades {
+		if t.Tid > since {
+			trades = append(trades, t)
+		}
+	}
+	return trades
+}
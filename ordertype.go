@@ -0,0 +1,142 @@
+package trade
+
+import (
+	"context"
+	"errors"
+	"github.com/nntaoli-project/GoEx"
+	"math"
+)
+
+// Time in force values passed to TimeInForceAPI.
+const (
+	TIF_GTC       = "GTC"       //一直有效
+	TIF_POST_ONLY = "POST_ONLY" //只做maker, 会立即成交时交易所拒单
+	TIF_IOC       = "IOC"       //立即成交, 剩余撤销
+	TIF_FOK       = "FOK"       //全部立即成交, 否则整单撤销
+)
+
+const postOnlyRetries = 5 //post-only被拒后最多退让的tick数
+
+// TimeInForceAPI is implemented by exchange wrappers that can pass an order
+// type with a limit order, such as the PostOnly, IOC and FOK parameters some
+// goex exchanges accept. Spot managers use it for OPMODE_POST_ONLY, OPMODE_IOC
+// and OPMODE_FOK when the exchange has it, and emulate those modes with plain
+// limit orders otherwise. A post-only order rejected because it would take
+// must come back as an error satisfying PostOnlyRejection.
+type TimeInForceAPI interface {
+	LimitOrder(side goex.TradeSide, amount, price string, currency goex.CurrencyPair, timeInForce string) (*goex.Order, error)
+}
+
+// taking tells whether opMode prices orders against the other side of the
+// book.
+func taking(opMode OpMode) bool {
+	return opMode == OPMODE_TAKE || opMode == OPMODE_IOC || opMode == OPMODE_FOK
+}
+
+// immediate tells whether opMode orders must not rest on the book.
+func immediate(opMode OpMode) bool {
+	return opMode == OPMODE_IOC || opMode == OPMODE_FOK
+}
+
+func timeInForce(opMode OpMode) string {
+	switch opMode {
+	case OPMODE_POST_ONLY:
+		return TIF_POST_ONLY
+	case OPMODE_IOC:
+		return TIF_IOC
+	case OPMODE_FOK:
+		return TIF_FOK
+	default:
+		return TIF_GTC
+	}
+}
+
+// native returns the exchange's TimeInForceAPI when opMode needs one and
+// the exchange has it.
+func (spot *SpotTradeManager) native(opMode OpMode) (TimeInForceAPI, bool) {
+	if timeInForce(opMode) == TIF_GTC {
+		return nil, false
+	}
+	api, ok := spot.exchange.(TimeInForceAPI)
+	return api, ok
+}
+
+// passivePrice moves a post-only price back to one tick inside the spread
+// when it would take.
+func passivePrice(isBuy bool, price, bid, ask float64, inst *Instrument) float64 {
+	if isBuy && ask > 0 && price >= ask {
+		return inst.RoundPrice(ask - inst.TickSize)
+	}
+	if !isBuy && bid > 0 && price <= bid {
+		return inst.RoundPrice(bid + inst.TickSize)
+	}
+	return price
+}
+
+// PostOnlyRejection is implemented by the errors a TimeInForceAPI returns
+// for a post-only order the exchange turned down because it would have
+// taken, such as mockex.ErrWouldCross.
+type PostOnlyRejection interface {
+	error
+	PostOnlyRejected() bool
+}
+
+func postOnlyRejected(err error) bool {
+	var rejection PostOnlyRejection
+	return errors.As(err, &rejection) && rejection.PostOnlyRejected()
+}
+
+// place puts one child order on the book the way opMode says and returns it
+// with the price it went in at. Every attempt is journaled before it is
+// sent. A post-only order the exchange rejects as one that would take, see
+// PostOnlyRejection, is tried again one tick further back after
+// retryDelayMs, up to postOnlyRetries times; any other error may hide an
+// order that landed, so it is returned at once.
+func (spot *SpotTradeManager) place(ctx context.Context, journal *fillJournal, opMode OpMode, tradeType goex.TradeSide, tradeFunc func(amount, price string, currency goex.CurrencyPair) (*goex.Order, error), inst *Instrument, amount, price float64) (*goex.Order, float64, error) {
+	var limit = tradeType == goex.BUY || tradeType == goex.SELL
+	var api, ok = spot.native(opMode)
+	for retry := 0; ; retry++ {
+		if err := journal.placing(price, amount); err != nil {
+			return nil, price, err
+		}
+		var order *goex.Order
+		var err error
+		if limit && ok {
+			order, err = api.LimitOrder(tradeType, inst.FormatAmount(amount), inst.FormatPrice(price), spot.pair, timeInForce(opMode))
+		} else {
+			order, err = tradeFunc(inst.FormatAmount(amount), inst.FormatPrice(price), spot.pair)
+		}
+		if err != nil {
+			journal.placeFailed(err)
+		}
+		if err == nil || opMode != OPMODE_POST_ONLY || !limit || retry >= postOnlyRetries || !postOnlyRejected(err) {
+			return order, price, err
+		}
+		var back = inst.RoundPrice(price - inst.TickSize)
+		if tradeType == goex.SELL {
+			back = inst.RoundPrice(price + inst.TickSize)
+		}
+		spot.logger.Warningf("[ %-4s ] post-only %s rejected: %v, retrying @ %s", tradeType.String(), inst.FormatPrice(price), err, inst.FormatPrice(back))
+		if serr := sleepCtx(ctx, spot.retryDelayMs); serr != nil {
+			return nil, price, err
+		}
+		price = back
+	}
+}
+
+// fillable tells whether depth can fill all of amount at price or better.
+// OPMODE_FOK orders are only placed when it does; another taker can still
+// get there first, so an emulated FOK order may end up partially filled.
+func fillable(depth *goex.Depth, isBuy bool, amount, price float64) bool {
+	var q = QuoteDepth(within(depth, isBuy, price), isBuy, amount, 0)
+	return q.Fillable >= amount-math.Max(amount*1e-9, 1e-12)
+}
+
+// expire closes an OPMODE_IOC or OPMODE_FOK order right after it was
+// placed, cancelling whatever an emulated one left resting.
+func (spot *SpotTradeManager) expire(ctx context.Context, order *goex.Order) (*goex.Order, error) {
+	if orderClosed(order) {
+		return order, nil
+	}
+	return spot.cancel(ctx, order.OrderID2)
+}
@@ -0,0 +1,186 @@
+package trade
+
+import (
+	"context"
+	"errors"
+	"github.com/goex-top/goex_trade/mockex"
+	"github.com/nntaoli-project/GoEx"
+	"testing"
+	"time"
+)
+
+// rejectingSpot turns down the first n post-only orders, as an exchange does
+// when the book moved under them, or with err when it is set.
+type rejectingSpot struct {
+	*mockex.Spot
+	n      int
+	err    error
+	prices []string
+}
+
+func (s *rejectingSpot) LimitOrder(side goex.TradeSide, amount, price string, currency goex.CurrencyPair, timeInForce string) (*goex.Order, error) {
+	s.prices = append(s.prices, price)
+	if timeInForce == TIF_POST_ONLY && s.n > 0 {
+		s.n--
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, mockex.ErrWouldCross
+	}
+	return s.Spot.LimitOrder(side, amount, price, currency, timeInForce)
+}
+
+func TestPassivePrice(t *testing.T) {
+	var inst = &Instrument{TickSize: 0.01, LotSize: 0.01}
+	for _, tc := range []struct {
+		isBuy bool
+		price float64
+		want  float64
+	}{
+		{true, 99.5, 99.5},
+		{true, 101, 100.99},
+		{true, 104, 100.99},
+		{false, 100.5, 100.5},
+		{false, 99, 99.01},
+	} {
+		if got := passivePrice(tc.isBuy, tc.price, 99, 101, inst); got != tc.want {
+			t.Errorf("passivePrice(%v, %v) = %v, want %v", tc.isBuy, tc.price, got, tc.want)
+		}
+	}
+}
+
+func TestSpotTradeManager_PostOnly(t *testing.T) {
+	var ex = mockex.New("mock")
+	ex.SetBalance(goex.USDT, 10000)
+	ex.Market(spotPair).SetTicker(99, 101)
+	var spot = &rejectingSpot{Spot: ex.Spot(), n: 2}
+	var cfg = DefaultSpotConfig()
+	cfg.MaxSpace = 5
+	mgr, err := NewSpotTradeManagerWithConfig(spot, spotPair, cfg,
+		WithOpMode(OPMODE_POST_ONLY),
+		WithSlidePrice(5),
+		WithRetryDelay(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	rep, _ := mgr.BuyCtx(ctx, 1)
+	// 104 would take the 101 ask: it goes in one tick inside, and one more
+	// tick back after each rejection.
+	if len(spot.prices) != 3 || spot.prices[0] != "100.99" || spot.prices[2] != "100.97" {
+		t.Fatalf("unexpected placement prices %v", spot.prices)
+	}
+	if len(rep.Children) != 1 || rep.Children[0].Price != 100.97 || !rep.Children[0].Maker || rep.Filled != 0 {
+		t.Fatalf("want one resting maker order, got %+v", rep.Children)
+	}
+}
+
+func TestSpotTradeManager_PostOnlyTimeout(t *testing.T) {
+	var ex = mockex.New("mock")
+	ex.SetBalance(goex.USDT, 10000)
+	ex.Market(spotPair).SetTicker(99, 101)
+	var spot = &rejectingSpot{Spot: ex.Spot(), n: 1, err: errors.New("gateway timeout")}
+	var cfg = DefaultSpotConfig()
+	cfg.MaxSpace = 5
+	mgr, err := NewSpotTradeManagerWithConfig(spot, spotPair, cfg,
+		WithOpMode(OPMODE_POST_ONLY),
+		WithRetryDelay(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order *goex.Order
+	order, _, err = mgr.place(context.Background(), nil, OPMODE_POST_ONLY, goex.BUY, spot.LimitBuy, mgr.instrument(), 1, 100)
+	// The order may have landed: it is not sent again one tick back.
+	if err == nil || order != nil || len(spot.prices) != 1 {
+		t.Fatalf("want the timeout after a single attempt, got %v, %v", spot.prices, err)
+	}
+}
+
+func TestSpotTradeManager_IOC(t *testing.T) {
+	for _, native := range []bool{true, false} {
+		var ex = mockex.New("mock")
+		ex.SetBalance(goex.USDT, 10000)
+		ex.Market(spotPair).SetDepth(
+			goex.DepthRecords{{Price: 99, Amount: 5}},
+			goex.DepthRecords{{Price: 101, Amount: 0.5}, {Price: 102, Amount: 5}},
+		)
+		var api goex.API = ex.Spot()
+		if !native {
+			api = struct{ goex.API }{ex.Spot()}
+		}
+		mgr, err := NewSpotTradeManagerWithConfig(api, spotPair, DefaultSpotConfig(),
+			WithOpMode(OPMODE_IOC),
+			WithRetryDelay(time.Millisecond),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep, err := mgr.Buy(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Filled != 1 || rep.VWAP != 101.5 || len(rep.Children) != 2 {
+			t.Fatalf("native %v: unexpected report %+v", native, rep)
+		}
+		var first = rep.Children[0]
+		if first.Filled != 0.5 || first.Status != goex.ORDER_CANCEL || first.ClosedAt.IsZero() {
+			t.Fatalf("native %v: want the first order cancelled after its fill, got %+v", native, first)
+		}
+		if !native && first.CancelReason != "OPMODE_IOC: unfilled remainder" {
+			t.Fatalf("unexpected cancel reason %q", first.CancelReason)
+		}
+		if open := ex.OpenOrders(); len(open) != 0 {
+			t.Fatalf("native %v: orders left resting %v", native, open)
+		}
+	}
+}
+
+func TestSpotTradeManager_FOK(t *testing.T) {
+	for _, native := range []bool{true, false} {
+		var ex = mockex.New("mock")
+		ex.SetBalance(goex.USDT, 10000)
+		ex.Market(spotPair).SetDepth(
+			goex.DepthRecords{{Price: 99, Amount: 5}},
+			goex.DepthRecords{{Price: 101, Amount: 0.5}, {Price: 102, Amount: 5}},
+		)
+		var api goex.API = ex.Spot()
+		if !native {
+			api = struct{ goex.API }{ex.Spot()}
+		}
+		mgr, err := NewSpotTradeManagerWithConfig(api, spotPair, DefaultSpotConfig(),
+			WithOpMode(OPMODE_FOK),
+			WithRetryDelay(time.Millisecond),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Only 0.5 is offered at 101: nothing is placed.
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		rep, err := mgr.BuyCtx(ctx, 1)
+		cancel()
+		if err != context.DeadlineExceeded || rep.Filled != 0 || len(rep.Children) != 0 {
+			t.Fatalf("native %v: want no order, got %+v, %v", native, rep, err)
+		}
+		mgr.slidePrice = 1
+		rep, err = mgr.Buy(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Filled != 1 || rep.VWAP != 101.5 || len(rep.Children) != 1 {
+			t.Fatalf("native %v: unexpected report %+v", native, rep)
+		}
+	}
+}
+
+func TestFutureConfig_SpotOnlyOpModes(t *testing.T) {
+	for _, opMode := range []OpMode{OPMODE_POST_ONLY, OPMODE_IOC, OPMODE_FOK} {
+		var cfg = DefaultFutureConfig()
+		cfg.OpMode = opMode
+		if err := cfg.Validate(); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: want ErrInvalidConfig, got %v", opMode, err)
+		}
+	}
+}
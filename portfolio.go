@@ -0,0 +1,522 @@
+package trade
+
+import (
+	"context"
+	"fmt"
+	"github.com/beaquant/utils"
+	"github.com/nntaoli-project/GoEx"
+	"github.com/sirupsen/logrus"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Contract is a futures contract whose positions a Portfolio counts.
+type Contract struct {
+	Pair         goex.CurrencyPair
+	ContractType string
+	ContractSpec //面值及正向/反向
+}
+
+// Exposure is the net holding of one asset across every account.
+type Exposure struct {
+	Currency goex.Currency `json:"currency"`
+	Amount   float64       `json:"amount"` //现货余额+期货净持仓折合数量, 负数为净空
+	Value    float64       `json:"value"`  //按计价币估值
+}
+
+// StrategyPnL is the PnL of the requests made under one tag, in the
+// portfolio's quote currency.
+type StrategyPnL struct {
+	Tag        string  `json:"tag"`
+	Realised   float64 `json:"realised"`   //已实现盈亏(扣除手续费)
+	Unrealised float64 `json:"unrealised"` //按最新价计算的浮动盈亏
+	Fees       float64 `json:"fees"`       //手续费合计, 基础币手续费按成交均价折算
+}
+
+// tagBook is the average-cost position of one tag on one instrument. A
+// futures position has one book per side. Spot books are linear contracts
+// worth one coin each. Realised PnL and fees are kept in the margin
+// currency of spec.
+type tagBook struct {
+	pair     goex.CurrencyPair
+	spec     ContractSpec
+	position float64 //正数为多, 负数为空
+	avg      float64
+	realised float64
+	fees     float64
+}
+
+// fill books qty (negative for sells) at price, realising PnL on the part
+// that reduces the position.
+func (book *tagBook) fill(qty, price float64) {
+	if qty == 0 {
+		return
+	}
+	if book.position != 0 && (book.position > 0) != (qty > 0) {
+		var closed = math.Min(math.Abs(qty), math.Abs(book.position))
+		var sign = 1.0
+		if book.position < 0 {
+			sign = -1
+		}
+		book.realised += book.spec.PnL(book.avg, price, closed) * sign
+		book.position -= closed * sign
+		qty += closed * sign
+		if math.Abs(book.position) < 1e-12 {
+			book.position, book.avg = 0, 0
+		}
+	}
+	if qty != 0 {
+		book.avg = book.spec.average(math.Abs(book.position), book.avg, math.Abs(qty), price)
+		book.position += qty
+	}
+}
+
+// charge takes the fees of rep off the book. A fee in the other currency of
+// the pair is converted at the VWAP of rep.
+func (book *tagBook) charge(rep *ExecutionReport) {
+	var fee = rep.Fees
+	switch rep.FeeCurrency {
+	case book.spec.MarginCurrency(book.pair):
+	case book.pair.CurrencyA:
+		fee *= rep.VWAP
+	case book.pair.CurrencyB:
+		if rep.VWAP <= 0 {
+			return
+		}
+		fee /= rep.VWAP
+	default:
+		return
+	}
+	book.realised -= fee
+	book.fees += fee
+}
+
+type portfolioFuture struct {
+	exchange  goex.FutureRestAPI
+	contracts []Contract
+}
+
+// Portfolio adds up accounts on any number of exchanges and the requests of
+// any number of managers, valuing everything in one quote currency from the
+// tickers of the feeds given to AddPrice.
+//
+// Balances, equity and exposure come from the accounts added with
+// AddSpotAccount and AddFutureAccount, so each account is counted once
+// however many managers trade it. PnL comes from the managers wrapped with
+// Spot and Future, booked at average cost per tag.
+type Portfolio struct {
+	quote  goex.Currency
+	logger *logrus.Logger
+
+	mu      sync.Mutex
+	feeds   map[string]Feed
+	spots   map[string]goex.API
+	futures map[string]portfolioFuture
+	books   map[string]map[string]*tagBook //标签 -> 品种 -> 账本
+}
+
+func NewPortfolio(quote goex.Currency, logger *logrus.Logger) *Portfolio {
+	if logger == nil {
+		logger = logrus.New()
+	}
+	return &Portfolio{
+		quote:   quote,
+		logger:  logger,
+		feeds:   make(map[string]Feed),
+		spots:   make(map[string]goex.API),
+		futures: make(map[string]portfolioFuture),
+		books:   make(map[string]map[string]*tagBook),
+	}
+}
+
+// AddPrice prices pair.CurrencyA in pair.CurrencyB, and the other way
+// round, from the last price of feed. It also marks the positions held on
+// pair. Currencies are only valued through a pair that has the quote
+// currency on one side.
+func (p *Portfolio) AddPrice(pair goex.CurrencyPair, feed Feed) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.feeds[pair.ToSymbol("_")] = feed
+}
+
+// AddSpotAccount counts every balance of exchange.
+func (p *Portfolio) AddSpotAccount(name string, exchange goex.API) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.spots[name] = exchange
+}
+
+// AddFutureAccount counts the margin balances of exchange and its positions
+// on contracts.
+func (p *Portfolio) AddFutureAccount(name string, exchange goex.FutureRestAPI, contracts ...Contract) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.futures[name] = portfolioFuture{exchange: exchange, contracts: contracts}
+}
+
+func (p *Portfolio) book(tag, key string, pair goex.CurrencyPair, spec ContractSpec) *tagBook {
+	var books, ok = p.books[tag]
+	if !ok {
+		books = make(map[string]*tagBook)
+		p.books[tag] = books
+	}
+	book, ok := books[key]
+	if !ok {
+		book = &tagBook{pair: pair, spec: spec}
+		books[key] = book
+	}
+	return book
+}
+
+type portfolioSpot struct {
+	SpotTradeManagerAPI
+	p   *Portfolio
+	tag string
+}
+
+// Spot books the Buy and Sell reports of mgr under tag.
+func (p *Portfolio) Spot(tag string, mgr SpotTradeManagerAPI) SpotTradeManagerAPI {
+	return &portfolioSpot{SpotTradeManagerAPI: mgr, p: p, tag: tag}
+}
+
+func (s *portfolioSpot) booked(rep *ExecutionReport, err error) (*ExecutionReport, error) {
+	if rep == nil || rep.Filled <= 0 {
+		return rep, err
+	}
+	s.p.mu.Lock()
+	defer s.p.mu.Unlock()
+	var book = s.p.book(s.tag, rep.Pair.ToSymbol("_"), rep.Pair, ContractSpec{})
+	var qty = rep.Filled
+	if !rep.IsBuy() {
+		qty = -qty
+	}
+	book.fill(qty, rep.VWAP)
+	book.charge(rep)
+	return rep, err
+}
+
+func (s *portfolioSpot) Buy(amount float64) (*ExecutionReport, error) {
+	return s.booked(s.SpotTradeManagerAPI.Buy(amount))
+}
+
+func (s *portfolioSpot) BuyCtx(ctx context.Context, amount float64) (*ExecutionReport, error) {
+	return s.booked(s.SpotTradeManagerAPI.BuyCtx(ctx, amount))
+}
+
+func (s *portfolioSpot) Sell(amount float64) (*ExecutionReport, error) {
+	return s.booked(s.SpotTradeManagerAPI.Sell(amount))
+}
+
+func (s *portfolioSpot) SellCtx(ctx context.Context, amount float64) (*ExecutionReport, error) {
+	return s.booked(s.SpotTradeManagerAPI.SellCtx(ctx, amount))
+}
+
+type portfolioFutureMgr struct {
+	FutureTradeManagerAPI
+	p    *Portfolio
+	tag  string
+	spec ContractSpec
+}
+
+// Future books the open and close reports of mgr under tag, on contracts as
+// spec describes.
+func (p *Portfolio) Future(tag string, mgr FutureTradeManagerAPI, spec ContractSpec) FutureTradeManagerAPI {
+	return &portfolioFutureMgr{FutureTradeManagerAPI: mgr, p: p, tag: tag, spec: spec}
+}
+
+func (f *portfolioFutureMgr) book(rep *ExecutionReport) {
+	if rep == nil || rep.Filled <= 0 {
+		return
+	}
+	f.p.mu.Lock()
+	defer f.p.mu.Unlock()
+	var leg, qty = "LONG", rep.Filled
+	switch rep.OpenType {
+	case goex.OPEN_SELL:
+		leg, qty = "SHORT", -qty
+	case goex.CLOSE_BUY:
+		qty = -qty
+	case goex.CLOSE_SELL:
+		leg = "SHORT"
+	}
+	var book = f.p.book(f.tag, positionKey(rep.Pair, rep.ContractType)+":"+leg, rep.Pair, f.spec)
+	book.fill(qty, rep.VWAP)
+	book.charge(rep)
+}
+
+func (f *portfolioFutureMgr) OpenLong(price, opAmount float64) (*SummaryPosition, error) {
+	return f.OpenLongCtx(context.Background(), price, opAmount)
+}
+
+func (f *portfolioFutureMgr) OpenLongCtx(ctx context.Context, price, opAmount float64) (*SummaryPosition, error) {
+	pos, err := f.FutureTradeManagerAPI.OpenLongCtx(ctx, price, opAmount)
+	if pos != nil {
+		f.book(pos.Report)
+	}
+	return pos, err
+}
+
+func (f *portfolioFutureMgr) OpenShort(price, opAmount float64) (*SummaryPosition, error) {
+	return f.OpenShortCtx(context.Background(), price, opAmount)
+}
+
+func (f *portfolioFutureMgr) OpenShortCtx(ctx context.Context, price, opAmount float64) (*SummaryPosition, error) {
+	pos, err := f.FutureTradeManagerAPI.OpenShortCtx(ctx, price, opAmount)
+	if pos != nil {
+		f.book(pos.Report)
+	}
+	return pos, err
+}
+
+func (f *portfolioFutureMgr) CloseLong(price, opAmount float64) (*ExecutionReport, error) {
+	return f.CloseLongCtx(context.Background(), price, opAmount)
+}
+
+func (f *portfolioFutureMgr) CloseLongCtx(ctx context.Context, price, opAmount float64) (*ExecutionReport, error) {
+	rep, err := f.FutureTradeManagerAPI.CloseLongCtx(ctx, price, opAmount)
+	f.book(rep)
+	return rep, err
+}
+
+func (f *portfolioFutureMgr) CloseShort(price, opAmount float64) (*ExecutionReport, error) {
+	return f.CloseShortCtx(context.Background(), price, opAmount)
+}
+
+func (f *portfolioFutureMgr) CloseShortCtx(ctx context.Context, price, opAmount float64) (*ExecutionReport, error) {
+	rep, err := f.FutureTradeManagerAPI.CloseShortCtx(ctx, price, opAmount)
+	f.book(rep)
+	return rep, err
+}
+
+// pricer reads each feed at most once per Portfolio call.
+type pricer struct {
+	quote goex.Currency
+	feeds map[string]Feed
+	last  map[string]float64
+}
+
+func (p *Portfolio) pricer() *pricer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var feeds = make(map[string]Feed, len(p.feeds))
+	for key, feed := range p.feeds {
+		feeds[key] = feed
+	}
+	return &pricer{quote: p.quote, feeds: feeds, last: make(map[string]float64)}
+}
+
+// mark is the last price of pair.
+func (pr *pricer) mark(pair goex.CurrencyPair) (float64, error) {
+	var key = pair.ToSymbol("_")
+	if price, ok := pr.last[key]; ok {
+		return price, nil
+	}
+	var feed, ok = pr.feeds[key]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrNoPrice, key)
+	}
+	ticker, err := feed.GetTicker()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	var price = tickerPrice(ticker)
+	if price <= 0 {
+		return 0, fmt.Errorf("%w: %s", ErrNoPrice, key)
+	}
+	pr.last[key] = price
+	return price, nil
+}
+
+// value is amount of currency in the quote currency.
+func (pr *pricer) value(currency goex.Currency, amount float64) (float64, error) {
+	if currency == pr.quote || amount == 0 {
+		return amount, nil
+	}
+	if _, ok := pr.feeds[goex.NewCurrencyPair(currency, pr.quote).ToSymbol("_")]; ok {
+		price, err := pr.mark(goex.NewCurrencyPair(currency, pr.quote))
+		return amount * price, err
+	}
+	if _, ok := pr.feeds[goex.NewCurrencyPair(pr.quote, currency).ToSymbol("_")]; ok {
+		price, err := pr.mark(goex.NewCurrencyPair(pr.quote, currency))
+		return amount / price, err
+	}
+	return 0, fmt.Errorf("%w: %s in %s", ErrNoPrice, currency.Symbol, pr.quote.Symbol)
+}
+
+// Balances adds up, per currency, the spot balances (free and frozen) and
+// the futures margin (with unrealised PnL) of every account.
+func (p *Portfolio) Balances() (map[goex.Currency]float64, error) {
+	p.mu.Lock()
+	var spots = make(map[string]goex.API, len(p.spots))
+	for name, api := range p.spots {
+		spots[name] = api
+	}
+	var futures = make(map[string]portfolioFuture, len(p.futures))
+	for name, f := range p.futures {
+		futures[name] = f
+	}
+	p.mu.Unlock()
+
+	var balances = make(map[goex.Currency]float64)
+	for name, api := range spots {
+		acc, err := api.GetAccount()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for currency, sub := range acc.SubAccounts {
+			balances[currency] += sub.Amount + sub.ForzenAmount
+		}
+	}
+	for name, f := range futures {
+		acc, err := f.exchange.GetFutureUserinfo()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for currency, sub := range acc.FutureSubAccounts {
+			balances[currency] += sub.AccountRights
+		}
+	}
+	for currency, amount := range balances {
+		if amount == 0 {
+			delete(balances, currency)
+		} else {
+			balances[currency] = utils.Float64Round(amount, 8)
+		}
+	}
+	return balances, nil
+}
+
+// Equity is the value of Balances in the quote currency. Futures positions
+// add only their unrealised PnL, which the margin already carries.
+func (p *Portfolio) Equity() (float64, error) {
+	balances, err := p.Balances()
+	if err != nil {
+		return 0, err
+	}
+	var pr = p.pricer()
+	var equity = 0.0
+	for currency, amount := range balances {
+		value, err := pr.value(currency, amount)
+		if err != nil {
+			return 0, err
+		}
+		equity += value
+	}
+	return utils.Float64Round(equity, 8), nil
+}
+
+// Exposure is the net holding of every asset other than the quote
+// currency: balances plus, for futures, the base currency long - short
+// contracts stand for, see ContractSpec.Base. Inverse contracts are
+// converted at the last price of their pair. Assets that cannot be priced
+// are listed without a value and reported in the error.
+func (p *Portfolio) Exposure() ([]Exposure, error) {
+	balances, err := p.Balances()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	var futures = make([]portfolioFuture, 0, len(p.futures))
+	for _, f := range p.futures {
+		futures = append(futures, f)
+	}
+	p.mu.Unlock()
+	var amounts = make(map[goex.Currency]float64, len(balances))
+	for currency, amount := range balances {
+		amounts[currency] = amount
+	}
+	var pr = p.pricer()
+	var firstErr error
+	for _, f := range futures {
+		for _, c := range f.contracts {
+			positions, err := f.exchange.GetFuturePosition(c.Pair, c.ContractType)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", c.Pair.ToSymbol("_"), c.ContractType, err)
+			}
+			var net = 0.0
+			for _, pos := range positions {
+				if pos.ContractType == c.ContractType {
+					net += pos.BuyAmount - pos.SellAmount
+				}
+			}
+			if net == 0 {
+				continue
+			}
+			var price = 0.0
+			if c.Inverse {
+				if price, err = pr.mark(c.Pair); err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					continue
+				}
+			}
+			amounts[c.Pair.CurrencyA] += c.Base(net, price)
+		}
+	}
+
+	var exposures []Exposure
+	for currency, amount := range amounts {
+		if currency == p.quote || amount == 0 {
+			continue
+		}
+		var exp = Exposure{Currency: currency, Amount: utils.Float64Round(amount, 8)}
+		value, err := pr.value(currency, amount)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		exp.Value = utils.Float64Round(value, 8)
+		exposures = append(exposures, exp)
+	}
+	sort.Slice(exposures, func(i, j int) bool { return exposures[i].Currency.Symbol < exposures[j].Currency.Symbol })
+	return exposures, firstErr
+}
+
+// PnL is the realised and unrealised PnL of every tag, sorted by tag.
+// Positions are marked at the last price of their pair, and amounts in
+// another currency, such as the base currency inverse contracts settle in,
+// are converted into the portfolio's.
+func (p *Portfolio) PnL() ([]StrategyPnL, error) {
+	p.mu.Lock()
+	var books = make(map[string][]tagBook, len(p.books))
+	for tag, byKey := range p.books {
+		for _, book := range byKey {
+			books[tag] = append(books[tag], *book)
+		}
+	}
+	p.mu.Unlock()
+
+	var pr = p.pricer()
+	var pnls []StrategyPnL
+	for tag, list := range books {
+		var pnl = StrategyPnL{Tag: tag}
+		for _, book := range list {
+			var unrealised = 0.0
+			if book.position != 0 {
+				mark, err := pr.mark(book.pair)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", tag, err)
+				}
+				unrealised = book.spec.PnL(book.avg, mark, book.position)
+			}
+			var amounts = []*float64{&book.realised, &unrealised, &book.fees}
+			for _, amount := range amounts {
+				value, err := pr.value(book.spec.MarginCurrency(book.pair), *amount)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", tag, err)
+				}
+				*amount = value
+			}
+			pnl.Realised += book.realised
+			pnl.Unrealised += unrealised
+			pnl.Fees += book.fees
+		}
+		pnl.Realised = utils.Float64Round(pnl.Realised, 8)
+		pnl.Unrealised = utils.Float64Round(pnl.Unrealised, 8)
+		pnl.Fees = utils.Float64Round(pnl.Fees, 8)
+		pnls = append(pnls, pnl)
+	}
+	sort.Slice(pnls, func(i, j int) bool { return pnls[i].Tag < pnls[j].Tag })
+	return pnls, nil
+}
@@ -0,0 +1,110 @@
+package trade
+
+import (
+	"errors"
+	"github.com/goex-top/goex_trade/mockex"
+	"github.com/nntaoli-project/GoEx"
+	"math"
+	"testing"
+)
+
+func TestPortfolio_Spot(t *testing.T) {
+	exA, mgr := newMockSpot(OPMODE_TAKE)
+	var exB = mockex.New("b")
+	exB.SetBalance(goex.USDT, 500)
+	exB.SetBalance(goex.ETH, 2)
+	exB.Market(goex.ETH_USDT).SetTicker(9, 11)
+
+	var p = NewPortfolio(goex.USDT, nil)
+	p.AddSpotAccount("a", exA.Spot())
+	p.AddSpotAccount("b", exB.Spot())
+	p.AddPrice(spotPair, NewSpotFeed(exA.Spot(), spotPair))
+	if _, err := p.Equity(); !errors.Is(err, ErrNoPrice) {
+		t.Fatalf("want ErrNoPrice for ETH, got %v", err)
+	}
+	p.AddPrice(goex.ETH_USDT, NewSpotFeed(exB.Spot(), goex.ETH_USDT))
+	balances, err := p.Balances()
+	if err != nil || balances[goex.USDT] != 10500 || balances[goex.BTC] != 10 || balances[goex.ETH] != 2 {
+		t.Fatalf("unexpected balances %v, %v", balances, err)
+	}
+	if equity, _ := p.Equity(); equity != 11520 {
+		t.Fatalf("want equity 11520, got %v", equity)
+	}
+
+	var spot = p.Spot("trend", mgr)
+	if _, err = spot.Buy(2); err != nil {
+		t.Fatal(err)
+	}
+	exA.Market(spotPair).SetTicker(109, 111)
+	if _, err = spot.Sell(1); err != nil {
+		t.Fatal(err)
+	}
+	pnl, err := p.PnL()
+	if err != nil || len(pnl) != 1 || pnl[0].Tag != "trend" || pnl[0].Realised != 8 || pnl[0].Unrealised != 9 {
+		t.Fatalf("unexpected pnl %+v, %v", pnl, err)
+	}
+	exposure, err := p.Exposure()
+	if err != nil || len(exposure) != 2 || exposure[0].Currency != goex.BTC || exposure[0].Amount != 11 ||
+		exposure[0].Value != 1210 || exposure[1].Currency != goex.ETH || exposure[1].Value != 20 {
+		t.Fatalf("unexpected exposure %+v, %v", exposure, err)
+	}
+}
+
+func TestPortfolio_Future(t *testing.T) {
+	ex, mgr := newMockFuture()
+	var p = NewPortfolio(goex.USD, nil)
+	p.AddFutureAccount("f", ex.Future(), Contract{Pair: futurePair, ContractType: goex.QUARTER_CONTRACT})
+	p.AddPrice(futurePair, NewFutureFeed(ex.Future(), futurePair, goex.QUARTER_CONTRACT))
+
+	pos, err := p.Future("hedge", mgr, ContractSpec{Value: 1}).OpenShort(100, 2)
+	if err != nil || pos.Report.Filled != 2 {
+		t.Fatalf("unexpected entry %+v, %v", pos, err)
+	}
+	ex.FutureMarket(futurePair, goex.QUARTER_CONTRACT).SetTicker(94.5, 95.5)
+	var unrealised = (pos.Report.VWAP - 95) * 2
+	pnl, err := p.PnL()
+	if err != nil || len(pnl) != 1 || pnl[0].Realised != 0 || pnl[0].Unrealised != unrealised {
+		t.Fatalf("want %v unrealised, got %+v, %v", unrealised, pnl, err)
+	}
+	exposure, err := p.Exposure()
+	if err != nil || len(exposure) != 1 || exposure[0].Currency != goex.BTC || exposure[0].Amount != -2 || exposure[0].Value != -190 {
+		t.Fatalf("unexpected exposure %+v, %v", exposure, err)
+	}
+	if equity, _ := p.Equity(); equity != 1000+unrealised {
+		t.Fatalf("want equity %v, got %v", 1000+unrealised, equity)
+	}
+
+	// The same position read as inverse contracts worth 100 USD each.
+	var inverse = NewPortfolio(goex.USD, nil)
+	inverse.AddFutureAccount("f", ex.Future(), Contract{Pair: futurePair, ContractType: goex.QUARTER_CONTRACT, ContractSpec: ContractSpec{Value: 100, Inverse: true}})
+	inverse.AddPrice(futurePair, NewFutureFeed(ex.Future(), futurePair, goex.QUARTER_CONTRACT))
+	exposure, err = inverse.Exposure()
+	if err != nil || len(exposure) != 1 || exposure[0].Currency != goex.BTC || math.Abs(exposure[0].Amount+200.0/95) > 1e-8 ||
+		math.Abs(exposure[0].Value+200) > 1e-6 {
+		t.Fatalf("unexpected exposure %+v, %v", exposure, err)
+	}
+}
+
+func TestTagBook(t *testing.T) {
+	var spot = &tagBook{pair: spotPair}
+	spot.fill(2, 100)
+	spot.charge(&ExecutionReport{Pair: spotPair, Fees: 0.002, FeeCurrency: goex.BTC, VWAP: 100})
+	spot.fill(-2, 110)
+	spot.charge(&ExecutionReport{Pair: spotPair, Fees: 0.22, FeeCurrency: goex.USDT, VWAP: 110})
+	if math.Abs(spot.realised-19.58) > 1e-9 || math.Abs(spot.fees-0.42) > 1e-9 {
+		t.Fatalf("unexpected spot book %+v", spot)
+	}
+
+	var inverse = &tagBook{pair: futurePair, spec: ContractSpec{Value: 100, Inverse: true}}
+	inverse.fill(10, 10000)
+	inverse.fill(10, 5000)
+	if math.Abs(inverse.avg-20000.0/3) > 1e-6 {
+		t.Fatalf("want the harmonic mean entry, got %v", inverse.avg)
+	}
+	inverse.fill(-20, 8000)
+	inverse.charge(&ExecutionReport{Pair: futurePair, Fees: 2, FeeCurrency: goex.USD, VWAP: 8000})
+	// 2000 USD worth 0.3 BTC when opened, 0.25 BTC when closed, less 2 USD in fees
+	if math.Abs(inverse.realised-0.04975) > 1e-9 || inverse.position != 0 {
+		t.Fatalf("unexpected inverse book %+v", inverse)
+	}
+}
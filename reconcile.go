@@ -0,0 +1,635 @@
+package trade
+
+import (
+	"context"
+	"fmt"
+	"github.com/beaquant/utils"
+	"github.com/nntaoli-project/GoEx"
+	"github.com/sirupsen/logrus"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Severity grades a Discrepancy.
+type Severity int
+
+const (
+	SEVERITY_INFO     = iota //超过Dust但未到Warn
+	SEVERITY_WARNING         //偏差超过Warn
+	SEVERITY_CRITICAL        //偏差超过Halt, 停止交易
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SEVERITY_INFO:
+		return "SEVERITY_INFO"
+	case SEVERITY_WARNING:
+		return "SEVERITY_WARNING"
+	case SEVERITY_CRITICAL:
+		return "SEVERITY_CRITICAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+type ledgerLeg struct {
+	amount float64
+	price  float64 //持仓均价
+}
+
+type ledgerPosition struct {
+	pair         goex.CurrencyPair
+	contractType string
+	long, short  ledgerLeg
+}
+
+func (pos *ledgerPosition) leg(direction int) *ledgerLeg {
+	if direction == goex.OPEN_SELL || direction == goex.CLOSE_SELL {
+		return &pos.short
+	}
+	return &pos.long
+}
+
+// ContractSpec says how a futures contract is margined and settled. goex
+// futures venues mostly list inverse (coin-margined) contracts, such as
+// BTC_USD contracts worth 100 USD each and margined in BTC; mockex and USDT
+// swaps list linear ones.
+type ContractSpec struct {
+	Value   float64 //合约面值, 0为1: 正向合约为每张的基础币数量, 反向合约为每张的计价币金额
+	Inverse bool    //反向(币本位)合约: 保证金和盈亏为基础币
+}
+
+func (spec ContractSpec) value() float64 {
+	if spec.Value <= 0 {
+		return 1
+	}
+	return spec.Value
+}
+
+// MarginCurrency is the currency contracts on pair are margined in and
+// settle their PnL in: the base currency for inverse contracts, the quote
+// currency for linear ones.
+func (spec ContractSpec) MarginCurrency(pair goex.CurrencyPair) goex.Currency {
+	if spec.Inverse {
+		return pair.CurrencyA
+	}
+	return pair.CurrencyB
+}
+
+// PnL is what amount contracts bought at entry and sold at exit earn, in the
+// margin currency. A short earns the negative.
+func (spec ContractSpec) PnL(entry, exit, amount float64) float64 {
+	if !spec.Inverse {
+		return (exit - entry) * amount * spec.value()
+	}
+	if entry <= 0 || exit <= 0 {
+		return 0
+	}
+	return amount * spec.value() * (1/entry - 1/exit)
+}
+
+// Base is the amount of the base currency amount contracts stand for at
+// price.
+func (spec ContractSpec) Base(amount, price float64) float64 {
+	if !spec.Inverse {
+		return amount * spec.value()
+	}
+	if price <= 0 {
+		return 0
+	}
+	return amount * spec.value() / price
+}
+
+// average is the entry price of amount contracts at price added to held
+// contracts at avg: weighted by contracts for linear contracts and by their
+// value in the base currency for inverse ones, as the exchanges do.
+func (spec ContractSpec) average(held, avg, amount, price float64) float64 {
+	if held+amount <= 0 {
+		return 0
+	}
+	if !spec.Inverse || avg <= 0 || price <= 0 {
+		return (avg*held + price*amount) / (held + amount)
+	}
+	return (held + amount) / (held/avg + amount/price)
+}
+
+// Ledger is what a strategy believes one exchange account holds, kept up to
+// date from the reports of its requests. Only the balances, margins and
+// positions seeded with SetBalance, SetMargin and SetPosition are tracked;
+// fills in anything else are ignored.
+type Ledger struct {
+	mu        sync.Mutex
+	balances  map[goex.Currency]float64  //现货余额(含冻结)
+	margins   map[goex.Currency]float64  //期货保证金余额(不含浮动盈亏)
+	positions map[string]*ledgerPosition //交易对+合约类型
+}
+
+func NewLedger() *Ledger {
+	return &Ledger{
+		balances:  make(map[goex.Currency]float64),
+		margins:   make(map[goex.Currency]float64),
+		positions: make(map[string]*ledgerPosition),
+	}
+}
+
+func positionKey(pair goex.CurrencyPair, contractType string) string {
+	return pair.ToSymbol("_") + ":" + contractType
+}
+
+// SetBalance seeds or corrects the spot holding of currency, free and frozen
+// together.
+func (l *Ledger) SetBalance(currency goex.Currency, amount float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.balances[currency] = amount
+}
+
+func (l *Ledger) Balance(currency goex.Currency) (float64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	amount, ok := l.balances[currency]
+	return amount, ok
+}
+
+// SetMargin seeds or corrects the futures margin balance in currency,
+// without unrealised PnL.
+func (l *Ledger) SetMargin(currency goex.Currency, amount float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.margins[currency] = amount
+}
+
+func (l *Ledger) Margin(currency goex.Currency) (float64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	amount, ok := l.margins[currency]
+	return amount, ok
+}
+
+// SetPosition seeds or corrects one side of a contract.
+// direction : goex.OPEN_BUY, goex.OPEN_SELL
+func (l *Ledger) SetPosition(pair goex.CurrencyPair, contractType string, direction int, amount, price float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var key = positionKey(pair, contractType)
+	var pos, ok = l.positions[key]
+	if !ok {
+		pos = &ledgerPosition{pair: pair, contractType: contractType}
+		l.positions[key] = pos
+	}
+	*pos.leg(direction) = ledgerLeg{amount: amount, price: price}
+}
+
+// Position is one side of a contract and whether it is tracked.
+func (l *Ledger) Position(pair goex.CurrencyPair, contractType string, direction int) (amount float64, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pos, ok := l.positions[positionKey(pair, contractType)]
+	if !ok {
+		return 0, false
+	}
+	return pos.leg(direction).amount, true
+}
+
+// ApplySpot books a spot report: the base currency moves by Filled and the
+// quote currency by Filled × VWAP the other way. Fees are booked when the
+// report says which currency they were charged in.
+func (l *Ledger) ApplySpot(rep *ExecutionReport) {
+	if rep == nil || rep.Filled <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var base, quote = rep.Filled, -rep.Filled * rep.VWAP
+	if !rep.IsBuy() {
+		base, quote = -base, -quote
+	}
+	l.add(l.balances, rep.Pair.CurrencyA, base)
+	l.add(l.balances, rep.Pair.CurrencyB, quote)
+	if rep.FeeCurrency.Symbol != "" {
+		l.add(l.balances, rep.FeeCurrency, -rep.Fees)
+	}
+}
+
+// ApplyFuture books a futures report on contracts as spec describes: opens
+// grow the position at VWAP, closes shrink it and add the realised PnL to
+// the margin of spec's margin currency. Fees are taken from the margin of
+// the currency the report says they were charged in.
+func (l *Ledger) ApplyFuture(rep *ExecutionReport, spec ContractSpec) {
+	if rep == nil || rep.Filled <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rep.FeeCurrency.Symbol != "" {
+		l.add(l.margins, rep.FeeCurrency, -rep.Fees)
+	}
+	pos, ok := l.positions[positionKey(rep.Pair, rep.ContractType)]
+	if !ok {
+		return
+	}
+	var leg = pos.leg(rep.OpenType)
+	switch rep.OpenType {
+	case goex.OPEN_BUY, goex.OPEN_SELL:
+		leg.price = spec.average(leg.amount, leg.price, rep.Filled, rep.VWAP)
+		leg.amount += rep.Filled
+	case goex.CLOSE_BUY, goex.CLOSE_SELL:
+		var pnl = spec.PnL(leg.price, rep.VWAP, rep.Filled)
+		if rep.OpenType == goex.CLOSE_SELL {
+			pnl = -pnl
+		}
+		l.add(l.margins, spec.MarginCurrency(rep.Pair), pnl)
+		leg.amount = math.Max(leg.amount-rep.Filled, 0)
+		if leg.amount == 0 {
+			leg.price = 0
+		}
+	}
+}
+
+func (l *Ledger) add(book map[goex.Currency]float64, currency goex.Currency, amount float64) {
+	if v, ok := book[currency]; ok {
+		book[currency] = v + amount
+	}
+}
+
+type ledgerSpot struct {
+	SpotTradeManagerAPI
+	ledger *Ledger
+}
+
+// NewLedgerSpot books every report of mgr's Buy and Sell requests in ledger.
+func NewLedgerSpot(mgr SpotTradeManagerAPI, ledger *Ledger) SpotTradeManagerAPI {
+	return &ledgerSpot{SpotTradeManagerAPI: mgr, ledger: ledger}
+}
+
+func (s *ledgerSpot) Buy(amount float64) (*ExecutionReport, error) {
+	return s.BuyCtx(context.Background(), amount)
+}
+
+func (s *ledgerSpot) BuyCtx(ctx context.Context, amount float64) (*ExecutionReport, error) {
+	rep, err := s.SpotTradeManagerAPI.BuyCtx(ctx, amount)
+	s.ledger.ApplySpot(rep)
+	return rep, err
+}
+
+func (s *ledgerSpot) Sell(amount float64) (*ExecutionReport, error) {
+	return s.SellCtx(context.Background(), amount)
+}
+
+func (s *ledgerSpot) SellCtx(ctx context.Context, amount float64) (*ExecutionReport, error) {
+	rep, err := s.SpotTradeManagerAPI.SellCtx(ctx, amount)
+	s.ledger.ApplySpot(rep)
+	return rep, err
+}
+
+type ledgerFuture struct {
+	FutureTradeManagerAPI
+	ledger *Ledger
+	spec   ContractSpec
+}
+
+// NewLedgerFuture books every report of mgr's opens and closes in ledger,
+// for contracts as spec describes, see Ledger.ApplyFuture.
+func NewLedgerFuture(mgr FutureTradeManagerAPI, ledger *Ledger, spec ContractSpec) FutureTradeManagerAPI {
+	return &ledgerFuture{FutureTradeManagerAPI: mgr, ledger: ledger, spec: spec}
+}
+
+func (f *ledgerFuture) opened(pos *SummaryPosition, err error) (*SummaryPosition, error) {
+	if pos != nil {
+		f.ledger.ApplyFuture(pos.Report, f.spec)
+	}
+	return pos, err
+}
+
+func (f *ledgerFuture) closed(rep *ExecutionReport, err error) (*ExecutionReport, error) {
+	f.ledger.ApplyFuture(rep, f.spec)
+	return rep, err
+}
+
+func (f *ledgerFuture) OpenLong(price, opAmount float64) (*SummaryPosition, error) {
+	return f.OpenLongCtx(context.Background(), price, opAmount)
+}
+
+func (f *ledgerFuture) OpenLongCtx(ctx context.Context, price, opAmount float64) (*SummaryPosition, error) {
+	return f.opened(f.FutureTradeManagerAPI.OpenLongCtx(ctx, price, opAmount))
+}
+
+func (f *ledgerFuture) OpenShort(price, opAmount float64) (*SummaryPosition, error) {
+	return f.OpenShortCtx(context.Background(), price, opAmount)
+}
+
+func (f *ledgerFuture) OpenShortCtx(ctx context.Context, price, opAmount float64) (*SummaryPosition, error) {
+	return f.opened(f.FutureTradeManagerAPI.OpenShortCtx(ctx, price, opAmount))
+}
+
+func (f *ledgerFuture) CloseLong(price, opAmount float64) (*ExecutionReport, error) {
+	return f.CloseLongCtx(context.Background(), price, opAmount)
+}
+
+func (f *ledgerFuture) CloseLongCtx(ctx context.Context, price, opAmount float64) (*ExecutionReport, error) {
+	return f.closed(f.FutureTradeManagerAPI.CloseLongCtx(ctx, price, opAmount))
+}
+
+func (f *ledgerFuture) CloseShort(price, opAmount float64) (*ExecutionReport, error) {
+	return f.CloseShortCtx(context.Background(), price, opAmount)
+}
+
+func (f *ledgerFuture) CloseShortCtx(ctx context.Context, price, opAmount float64) (*ExecutionReport, error) {
+	return f.closed(f.FutureTradeManagerAPI.CloseShortCtx(ctx, price, opAmount))
+}
+
+// Discrepancy is one figure on which a Ledger and its exchange disagree.
+type Discrepancy struct {
+	Account  string   `json:"account"`
+	Kind     string   `json:"kind"`  //balance|margin|position
+	Asset    string   `json:"asset"` //币种, 或 交易对:合约类型:LONG|SHORT
+	Ledger   float64  `json:"ledger"`
+	Exchange float64  `json:"exchange"`
+	Diff     float64  `json:"diff"`  //Exchange - Ledger
+	Drift    float64  `json:"drift"` //|Diff| / max(|Ledger|, |Exchange|)
+	Severity Severity `json:"severity"`
+}
+
+func (d Discrepancy) String() string {
+	return fmt.Sprintf("%s %s %s %s: ledger %s, exchange %s", d.Severity, d.Account, d.Kind, d.Asset,
+		utils.Float64RoundString(d.Ledger, 8), utils.Float64RoundString(d.Exchange, 8))
+}
+
+// ReconcileConfig says how a Reconciler grades and acts on what it finds.
+type ReconcileConfig struct {
+	Dust        float64       //绝对差不超过此值视为一致
+	Warn        float64       //相对偏差达到此比例为WARNING, 0为超过Dust即WARNING
+	Halt        float64       //相对偏差达到此比例为CRITICAL, 0为从不
+	Interval    time.Duration //Run的检查间隔
+	AutoCorrect bool          //以交易所数据修正账本
+	Gate        *RiskGate     //出现CRITICAL时Kill, 为空不停止交易
+}
+
+func (cfg *ReconcileConfig) Validate() error {
+	switch {
+	case cfg.Dust < 0 || cfg.Warn < 0 || cfg.Halt < 0:
+		return fmt.Errorf("%w: negative reconcile threshold", ErrInvalidConfig)
+	case cfg.Halt > 0 && cfg.Halt < cfg.Warn:
+		return fmt.Errorf("%w: halt %v below warn %v", ErrInvalidConfig, cfg.Halt, cfg.Warn)
+	case cfg.Interval < time.Millisecond:
+		return fmt.Errorf("%w: interval %v below 1ms", ErrInvalidConfig, cfg.Interval)
+	}
+	return nil
+}
+
+func (cfg *ReconcileConfig) grade(ledger, exchange float64) (Discrepancy, bool) {
+	var d = Discrepancy{Ledger: ledger, Exchange: exchange, Diff: utils.Float64Round(exchange-ledger, 8)}
+	if math.Abs(d.Diff) <= cfg.Dust || d.Diff == 0 {
+		return d, false
+	}
+	d.Drift = math.Abs(d.Diff) / math.Max(math.Abs(ledger), math.Abs(exchange))
+	switch {
+	case cfg.Halt > 0 && d.Drift >= cfg.Halt:
+		d.Severity = SEVERITY_CRITICAL
+	case d.Drift >= cfg.Warn:
+		d.Severity = SEVERITY_WARNING
+	default:
+		d.Severity = SEVERITY_INFO
+	}
+	return d, true
+}
+
+type reconcileAccount struct {
+	ledger *Ledger
+	spot   goex.API
+	future goex.FutureRestAPI
+}
+
+// Reconciler compares Ledgers with what their exchanges report: spot
+// balances with GetAccount, futures margins with GetFutureUserinfo and
+// positions with GetFuturePosition. Only what a ledger tracks is compared.
+//
+// With AutoCorrect the ledger is set to the exchange's figure after each
+// discrepancy is reported; a request still running at that moment may then
+// be booked twice, so correct between requests. A CRITICAL discrepancy
+// kills the configured RiskGate until someone resumes it.
+type Reconciler struct {
+	cfg    ReconcileConfig
+	logger *logrus.Logger
+
+	mu       sync.Mutex
+	accounts map[string]reconcileAccount
+	last     []Discrepancy
+}
+
+func NewReconciler(cfg ReconcileConfig, logger *logrus.Logger) (*Reconciler, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = logrus.New()
+	}
+	return &Reconciler{cfg: cfg, logger: logger, accounts: make(map[string]reconcileAccount)}, nil
+}
+
+// AddSpot compares the balances ledger tracks with exchange's account.
+// Names are shared with AddFuture and must be unique.
+func (rc *Reconciler) AddSpot(name string, exchange goex.API, ledger *Ledger) error {
+	return rc.add(name, reconcileAccount{ledger: ledger, spot: exchange})
+}
+
+// AddFuture compares the margins and positions ledger tracks with
+// exchange's futures account.
+func (rc *Reconciler) AddFuture(name string, exchange goex.FutureRestAPI, ledger *Ledger) error {
+	return rc.add(name, reconcileAccount{ledger: ledger, future: exchange})
+}
+
+func (rc *Reconciler) add(name string, account reconcileAccount) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if _, ok := rc.accounts[name]; ok {
+		return fmt.Errorf("%w: account %s added twice", ErrInvalidConfig, name)
+	}
+	rc.accounts[name] = account
+	return nil
+}
+
+// Last is what the latest Check found.
+func (rc *Reconciler) Last() []Discrepancy {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.last
+}
+
+// Check compares every account once, sorted by name, carrying on past
+// accounts that cannot be read and returning the first such error.
+func (rc *Reconciler) Check(ctx context.Context) ([]Discrepancy, error) {
+	rc.mu.Lock()
+	var names = make([]string, 0, len(rc.accounts))
+	for name := range rc.accounts {
+		names = append(names, name)
+	}
+	var accounts = make(map[string]reconcileAccount, len(rc.accounts))
+	for name, account := range rc.accounts {
+		accounts[name] = account
+	}
+	rc.mu.Unlock()
+	sort.Strings(names)
+
+	var found []Discrepancy
+	var firstErr error
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return found, err
+		}
+		var account = accounts[name]
+		var ds []Discrepancy
+		var err error
+		if account.spot != nil {
+			ds, err = rc.checkSpot(account)
+		} else {
+			ds, err = rc.checkFuture(account)
+		}
+		if err != nil {
+			rc.logger.Errorf("[ RECONCILE ] %s: %v", name, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("reconcile %s: %w", name, err)
+			}
+		}
+		for i := range ds {
+			ds[i].Account = name
+		}
+		found = append(found, ds...)
+	}
+
+	var critical []string
+	for _, d := range found {
+		switch d.Severity {
+		case SEVERITY_CRITICAL:
+			rc.logger.Errorf("[ RECONCILE ] %s", d)
+			critical = append(critical, d.Account+" "+d.Asset)
+		case SEVERITY_WARNING:
+			rc.logger.Warningf("[ RECONCILE ] %s", d)
+		default:
+			rc.logger.Infof("[ RECONCILE ] %s", d)
+		}
+	}
+	if len(critical) > 0 && rc.cfg.Gate != nil {
+		rc.cfg.Gate.Kill(fmt.Sprintf("reconcile: %d critical discrepancies, first %s", len(critical), critical[0]))
+	}
+	rc.mu.Lock()
+	rc.last = found
+	rc.mu.Unlock()
+	return found, firstErr
+}
+
+func (rc *Reconciler) checkSpot(account reconcileAccount) ([]Discrepancy, error) {
+	acc, err := account.spot.GetAccount()
+	if err != nil {
+		return nil, err
+	}
+	var ledger = account.ledger
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	var found []Discrepancy
+	for currency, amount := range ledger.balances {
+		var sub = acc.SubAccounts[currency]
+		if d, ok := rc.cfg.grade(amount, sub.Amount+sub.ForzenAmount); ok {
+			d.Kind, d.Asset = "balance", currency.Symbol
+			found = append(found, d)
+			if rc.cfg.AutoCorrect {
+				ledger.balances[currency] = d.Exchange
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Asset < found[j].Asset })
+	return found, nil
+}
+
+func (rc *Reconciler) checkFuture(account reconcileAccount) ([]Discrepancy, error) {
+	var ledger = account.ledger
+	ledger.mu.Lock()
+	var positions = make([]*ledgerPosition, 0, len(ledger.positions))
+	for _, pos := range ledger.positions {
+		positions = append(positions, pos)
+	}
+	var hasMargin = len(ledger.margins) > 0
+	ledger.mu.Unlock()
+
+	var acc *goex.FutureAccount
+	if hasMargin {
+		var err error
+		if acc, err = account.future.GetFutureUserinfo(); err != nil {
+			return nil, err
+		}
+	}
+	var held = make(map[*ledgerPosition][]goex.FuturePosition, len(positions))
+	for _, pos := range positions {
+		exPositions, err := account.future.GetFuturePosition(pos.pair, pos.contractType)
+		if err != nil {
+			return nil, err
+		}
+		held[pos] = exPositions
+	}
+
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	var found []Discrepancy
+	if acc != nil {
+		for currency, amount := range ledger.margins {
+			if d, ok := rc.cfg.grade(amount, acc.FutureSubAccounts[currency].KeepDeposit); ok {
+				d.Kind, d.Asset = "margin", currency.Symbol
+				found = append(found, d)
+				if rc.cfg.AutoCorrect {
+					ledger.margins[currency] = d.Exchange
+				}
+			}
+		}
+	}
+	for pos, exPositions := range held {
+		var long, short ledgerLeg
+		var longCost, shortCost = 0.0, 0.0
+		for _, p := range exPositions {
+			if p.ContractType != pos.contractType {
+				continue
+			}
+			long.amount += p.BuyAmount
+			longCost += p.BuyAmount * p.BuyPriceAvg
+			short.amount += p.SellAmount
+			shortCost += p.SellAmount * p.SellPriceAvg
+		}
+		if long.amount > 0 {
+			long.price = longCost / long.amount
+		}
+		if short.amount > 0 {
+			short.price = shortCost / short.amount
+		}
+		for _, side := range []struct {
+			name   string
+			leg    *ledgerLeg
+			actual ledgerLeg
+		}{{"LONG", &pos.long, long}, {"SHORT", &pos.short, short}} {
+			if d, ok := rc.cfg.grade(side.leg.amount, side.actual.amount); ok {
+				d.Kind, d.Asset = "position", positionKey(pos.pair, pos.contractType)+":"+side.name
+				found = append(found, d)
+				if rc.cfg.AutoCorrect {
+					*side.leg = side.actual
+				}
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Kind != found[j].Kind {
+			return found[i].Kind < found[j].Kind
+		}
+		return found[i].Asset < found[j].Asset
+	})
+	return found, nil
+}
+
+// Run checks every Interval until ctx is done.
+func (rc *Reconciler) Run(ctx context.Context) error {
+	for {
+		rc.Check(ctx) //出错的账户已记录日志
+		if err := sleepCtx(ctx, rc.cfg.Interval); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package trade
+
+import (
+	"context"
+	"errors"
+	"github.com/nntaoli-project/GoEx"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestReconciler_Spot(t *testing.T) {
+	ex, mgr := newMockSpot(OPMODE_TAKE)
+	var ledger = NewLedger()
+	ledger.SetBalance(goex.USDT, 10000)
+	ledger.SetBalance(goex.BTC, 10)
+	gate, _ := NewRiskGate(RiskLimits{}, nil)
+	rc, err := NewReconciler(ReconcileConfig{Dust: 1e-8, Warn: 0.01, Halt: 0.05, Interval: time.Millisecond, AutoCorrect: true, Gate: gate}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rc.AddSpot("mock", ex.Spot(), ledger); err != nil {
+		t.Fatal(err)
+	}
+	if err = rc.AddFuture("mock", ex.Future(), ledger); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("want a duplicate name rejected, got %v", err)
+	}
+
+	if _, err = NewLedgerSpot(mgr, ledger).Buy(2); err != nil {
+		t.Fatal(err)
+	}
+	if btc, _ := ledger.Balance(goex.BTC); btc != 12 {
+		t.Fatalf("buy not booked, %v BTC", btc)
+	}
+	if found, err := rc.Check(context.Background()); err != nil || len(found) != 0 {
+		t.Fatalf("want no drift, got %v, %v", found, err)
+	}
+
+	ex.SetBalance(goex.BTC, 11)
+	ex.SetBalance(goex.USDT, 9797)
+	found, _ := rc.Check(context.Background())
+	if len(found) != 2 || found[0].Asset != "BTC" || found[0].Severity != SEVERITY_CRITICAL || found[0].Diff != -1 ||
+		found[1].Asset != "USDT" || found[1].Severity != SEVERITY_INFO {
+		t.Fatalf("unexpected discrepancies %v", found)
+	}
+	if killed, _ := gate.Killed(); !killed {
+		t.Fatal("critical drift did not halt trading")
+	}
+	if btc, _ := ledger.Balance(goex.BTC); btc != 11 {
+		t.Fatalf("ledger not corrected, %v BTC", btc)
+	}
+	if found, _ = rc.Check(context.Background()); len(found) != 0 {
+		t.Fatalf("drift after correction %v", found)
+	}
+}
+
+func TestReconciler_Future(t *testing.T) {
+	ex, mgr := newMockFuture()
+	var ledger = NewLedger()
+	ledger.SetMargin(goex.USD, 1000)
+	ledger.SetPosition(futurePair, goex.QUARTER_CONTRACT, goex.OPEN_BUY, 0, 0)
+	rc, _ := NewReconciler(ReconcileConfig{Dust: 1e-8, Warn: 0.01, Interval: time.Millisecond}, nil)
+	rc.AddFuture("mock", ex.Future(), ledger)
+
+	var future = NewLedgerFuture(mgr, ledger, ContractSpec{Value: 1})
+	if _, err := future.OpenLong(100, 2); err != nil {
+		t.Fatal(err)
+	}
+	ex.FutureMarket(futurePair, goex.QUARTER_CONTRACT).SetTicker(104.5, 105.5)
+	if _, err := future.CloseLong(104.5, 1); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := rc.Check(context.Background()); err != nil || len(found) != 0 {
+		t.Fatalf("want no drift, got %v, %v", found, err)
+	}
+
+	if _, err := ex.Future().PlaceFutureOrder(futurePair, goex.QUARTER_CONTRACT, "106", "1", goex.OPEN_BUY, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	found, _ := rc.Check(context.Background())
+	if len(found) != 1 || found[0].Kind != "position" || found[0].Asset != "BTC_USD:quarter:LONG" ||
+		found[0].Ledger != 1 || found[0].Exchange != 2 || found[0].Severity != SEVERITY_WARNING {
+		t.Fatalf("unexpected discrepancies %v", found)
+	}
+	if long, _ := ledger.Position(futurePair, goex.QUARTER_CONTRACT, goex.OPEN_BUY); long != 1 {
+		t.Fatalf("ledger corrected without AutoCorrect, long %v", long)
+	}
+}
+
+func TestLedger_ApplyFutureInverse(t *testing.T) {
+	var ledger = NewLedger()
+	ledger.SetMargin(goex.BTC, 1)
+	ledger.SetMargin(goex.USD, 0)
+	ledger.SetPosition(futurePair, goex.QUARTER_CONTRACT, goex.OPEN_SELL, 0, 0)
+	var spec = ContractSpec{Value: 100, Inverse: true}
+	var report = func(openType int, amount, price float64) *ExecutionReport {
+		return &ExecutionReport{Pair: futurePair, ContractType: goex.QUARTER_CONTRACT, OpenType: openType, Filled: amount, VWAP: price}
+	}
+	ledger.ApplyFuture(report(goex.OPEN_SELL, 10, 10000), spec)
+	ledger.ApplyFuture(report(goex.OPEN_SELL, 10, 12500), spec)
+	ledger.ApplyFuture(report(goex.CLOSE_SELL, 20, 8000), spec)
+	// 2000 USD worth 0.1 + 0.08 BTC when shorted, 0.25 BTC when covered
+	if btc, _ := ledger.Margin(goex.BTC); math.Abs(btc-1.07) > 1e-9 {
+		t.Fatalf("unexpected BTC margin %v", btc)
+	}
+	if usd, _ := ledger.Margin(goex.USD); usd != 0 {
+		t.Fatalf("PnL booked in USD %v", usd)
+	}
+}
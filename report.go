@@ -0,0 +1,256 @@
+package trade
+
+import (
+	"context"
+	"github.com/beaquant/utils"
+	"github.com/nntaoli-project/GoEx"
+	"time"
+)
+
+// ChildOrder is one exchange order placed while working a request.
+type ChildOrder struct {
+	OrderID      string           `json:"order_id"`
+	Price        float64          `json:"price"`                   //委托价
+	Amount       float64          `json:"amount"`                  //委托量
+	Filled       float64          `json:"filled"`                  //成交量
+	AvgPrice     float64          `json:"avg_price"`               //成交均价
+	Fee          float64          `json:"fee"`                     //手续费, 负数为返佣
+	Maker        bool             `json:"maker"`                   //按挂单费率计费
+	Status       goex.TradeStatus `json:"status"`                  //最后一次查询到的状态
+	PlacedAt     time.Time        `json:"placed_at"`               //下单时间
+	ClosedAt     time.Time        `json:"closed_at"`               //结束时间, 未结束为零值
+	CancelReason string           `json:"cancel_reason,omitempty"` //管理器撤单的原因
+}
+
+// ExecutionReport describes how one Buy, Sell, OpenLong ... request was
+// worked. Filled and VWAP come from the child orders, except for spot
+// managers in FILLMODE_BALANCE, where they come from the account and so
+// already include fees charged in the traded currencies.
+//
+// With a FeeModel, fees are computed from it and NetVWAP is VWAP adjusted by
+// them. Without one, Fees adds up what the exchange reported, in whatever
+// currency it uses, and NetVWAP equals VWAP.
+type ExecutionReport struct {
+	Pair         goex.CurrencyPair `json:"pair"`
+	ContractType string            `json:"contract_type,omitempty"` //合约类型, 现货为空
+	Side         goex.TradeSide    `json:"side"`                    //goex.BUY|goex.SELL(市价单为BUY_MARKET|SELL_MARKET)
+	OpenType     int               `json:"open_type,omitempty"`     //期货: goex.OPEN_BUY|OPEN_SELL|CLOSE_BUY|CLOSE_SELL
+	Requested    float64           `json:"requested"`               //请求数量
+	Filled       float64           `json:"filled"`                  //成交数量
+	VWAP         float64           `json:"vwap"`                    //成交均价(不含手续费)
+	NetVWAP      float64           `json:"net_vwap"`                //含手续费的成交均价
+	Fees         float64           `json:"fees"`                    //手续费合计, 负数为返佣
+	FeeCurrency  goex.Currency     `json:"fee_currency"`            //手续费币种, 未配置FeeModel时为空
+	ArrivalPrice float64           `json:"arrival_price"`           //开始执行时的中间价
+	Slippage     float64           `json:"slippage"`                //成交均价相对到达价的不利偏移, 正数为吃亏
+	StartedAt    time.Time         `json:"started_at"`
+	FinishedAt   time.Time         `json:"finished_at"`
+	Elapsed      time.Duration     `json:"elapsed"`
+	Children     []*ChildOrder     `json:"children"`
+}
+
+// IsBuy reports whether the request bought, which for futures means opening
+// a long or closing a short.
+func (rep *ExecutionReport) IsBuy() bool {
+	return rep.Side == goex.BUY || rep.Side == goex.BUY_MARKET
+}
+
+// SlippageBps is Slippage in basis points of the arrival price.
+func (rep *ExecutionReport) SlippageBps() float64 {
+	if rep.ArrivalPrice == 0 {
+		return 0
+	}
+	return rep.Slippage / rep.ArrivalPrice * 1e4
+}
+
+// finish fills in the totals from the given quote money and base amount (or
+// contracts worth contractValue each).
+func (rep *ExecutionReport) finish(diffMoney, dealAmount, contractValue float64) {
+	rep.Filled = dealAmount
+	rep.VWAP = 0
+	rep.NetVWAP = 0
+	rep.Slippage = 0
+	if dealAmount > 0 {
+		rep.VWAP = utils.Float64Round(diffMoney/dealAmount, 8)
+		if rep.ArrivalPrice > 0 {
+			rep.Slippage = rep.VWAP - rep.ArrivalPrice
+			if !rep.IsBuy() {
+				rep.Slippage = -rep.Slippage
+			}
+			rep.Slippage = utils.Float64Round(rep.Slippage, 8)
+		}
+	}
+	rep.Fees = 0
+	for _, child := range rep.Children {
+		rep.Fees += child.Fee
+	}
+	rep.Fees = utils.Float64Round(rep.Fees, 8)
+	rep.NetVWAP = rep.VWAP
+	if dealAmount > 0 {
+		var sign = 1.0
+		if !rep.IsBuy() {
+			sign = -1
+		}
+		switch rep.FeeCurrency {
+		case rep.Pair.CurrencyB:
+			rep.NetVWAP = utils.Float64Round((diffMoney+sign*rep.Fees/contractValue)/dealAmount, 8)
+		case rep.Pair.CurrencyA:
+			if net := dealAmount - sign*rep.Fees; net > 0 {
+				rep.NetVWAP = utils.Float64Round(diffMoney/net, 8)
+			}
+		}
+	}
+	rep.FinishedAt = time.Now()
+	rep.Elapsed = rep.FinishedAt.Sub(rep.StartedAt)
+}
+
+// orderFills tracks the child orders of one request, so fills can be summed
+// from the exchange's order records rather than from account balances other
+// programs may also be moving.
+type orderFills struct {
+	children []*ChildOrder
+	byID     map[string]*ChildOrder
+	journal  *fillJournal        //订单日志, 为空时不记录
+	progress func(delta float64) //订单新增成交时回调, 可为空
+}
+
+type progressKey struct{}
+
+// withProgress makes the requests run under ctx call progress with the
+// amount every time one of their orders fills more, so a caller can follow
+// a request by its own orders rather than by account balances other
+// programs may also be moving. progress may be called from any goroutine.
+func withProgress(ctx context.Context, progress func(delta float64)) context.Context {
+	return context.WithValue(ctx, progressKey{}, progress)
+}
+
+// followed attaches the progress callback ctx carries, if any.
+func (fills *orderFills) followed(ctx context.Context) *orderFills {
+	fills.progress, _ = ctx.Value(progressKey{}).(func(delta float64))
+	return fills
+}
+
+func newOrderFills() *orderFills {
+	return &orderFills{byID: make(map[string]*ChildOrder)}
+}
+
+func (fills *orderFills) add(id string, price, amount float64, maker bool) {
+	if _, ok := fills.byID[id]; ok {
+		return
+	}
+	var child = &ChildOrder{OrderID: id, Price: price, Amount: amount, Maker: maker, PlacedAt: time.Now()}
+	fills.children = append(fills.children, child)
+	fills.byID[id] = child
+	fills.journal.record(JOURNAL_PLACED, child)
+}
+
+func (fills *orderFills) observe(id string, filled, avgPrice, fee float64, status goex.TradeStatus) {
+	var child, ok = fills.byID[id]
+	if !ok {
+		return
+	}
+	var prevFilled, wasClosed = child.Filled, statusClosed(child.Status)
+	child.observe(filled, avgPrice, fee, status)
+	if child.Filled > prevFilled {
+		fills.journal.record(JOURNAL_FILL, child)
+		if fills.progress != nil {
+			fills.progress(child.Filled - prevFilled)
+		}
+	}
+	if statusClosed(status) && !wasClosed {
+		fills.journal.record(JOURNAL_CLOSED, child)
+	}
+}
+
+func (child *ChildOrder) observe(filled, avgPrice, fee float64, status goex.TradeStatus) {
+	child.Filled = filled
+	child.AvgPrice = avgPrice
+	child.Fee = fee
+	child.Status = status
+	if statusClosed(status) && child.ClosedAt.IsZero() {
+		child.ClosedAt = time.Now()
+	}
+}
+
+func (fills *orderFills) update(order *goex.Order) {
+	fills.observe(order.OrderID2, order.DealAmount, order.AvgPrice, order.Fee, order.Status)
+}
+
+func (fills *orderFills) updateFuture(order *goex.FutureOrder) {
+	fills.observe(order.OrderID2, order.DealAmount, order.AvgPrice, order.Fee, order.Status)
+}
+
+// cancelled records why the manager pulled an order, keeping the first
+// reason given.
+func (fills *orderFills) cancelled(id, reason string) {
+	if child, ok := fills.byID[id]; ok && child.CancelReason == "" {
+		child.CancelReason = reason
+		fills.journal.record(JOURNAL_CANCEL, child)
+	}
+}
+
+// open lists the orders that may still fill.
+func (fills *orderFills) open() []string {
+	var ids []string
+	for _, child := range fills.children {
+		if !statusClosed(child.Status) {
+			ids = append(ids, child.OrderID)
+		}
+	}
+	return ids
+}
+
+// sum adds up the quote money and base amount filled.
+func (fills *orderFills) sum() (diffMoney, dealAmount float64) {
+	for _, child := range fills.children {
+		diffMoney += child.Filled * fillPrice(child)
+		dealAmount += child.Filled
+	}
+	return
+}
+
+// fillPrice is the average fill price of child, or its limit price for
+// exchanges that do not report one.
+func fillPrice(child *ChildOrder) float64 {
+	if child.AvgPrice == 0 {
+		return child.Price
+	}
+	return child.AvgPrice
+}
+
+func statusClosed(status goex.TradeStatus) bool {
+	switch status {
+	case goex.ORDER_FINISH, goex.ORDER_CANCEL, goex.ORDER_REJECT, goex.ORDER_FAIL:
+		return true
+	}
+	return false
+}
+
+// mergeReports folds the reports of the slices a parent order was cut into
+// into one, as if a single request for requested had placed every child.
+// The arrival price is that of the first slice.
+func mergeReports(side goex.TradeSide, requested float64, started time.Time, contractValue float64, reps []*ExecutionReport) *ExecutionReport {
+	var parent = &ExecutionReport{Side: side, Requested: requested, StartedAt: started}
+	var diffMoney, dealAmount = 0.0, 0.0
+	var first = true
+	for _, rep := range reps {
+		if rep == nil {
+			continue
+		}
+		if first {
+			first = false
+			parent.Pair = rep.Pair
+			parent.ContractType = rep.ContractType
+			parent.OpenType = rep.OpenType
+			parent.ArrivalPrice = rep.ArrivalPrice
+		}
+		if parent.FeeCurrency.Symbol == "" {
+			parent.FeeCurrency = rep.FeeCurrency
+		}
+		parent.Children = append(parent.Children, rep.Children...)
+		diffMoney += rep.VWAP * rep.Filled
+		dealAmount += rep.Filled
+	}
+	parent.finish(diffMoney, utils.Float64Round(dealAmount, 8), contractValue)
+	return parent
+}
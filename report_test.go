@@ -0,0 +1,50 @@
+package trade
+
+import (
+	"context"
+	"github.com/nntaoli-project/GoEx"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecutionReport_Spot(t *testing.T) {
+	ex, mgr := newMockSpot(OPMODE_TAKE)
+	ex.SetFillRatio(0.5)
+	ex.SetFee(0, 0.001)
+	rep, err := mgr.Buy(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.IsBuy() || rep.Requested != 1 || rep.Filled < 0.99 || rep.VWAP != 101 || rep.ArrivalPrice != 100 {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	if rep.Slippage != 1 || rep.SlippageBps() != 100 {
+		t.Fatalf("want 1 (100bps) slippage, got %v (%vbps)", rep.Slippage, rep.SlippageBps())
+	}
+	if len(rep.Children) < 2 || rep.Elapsed <= 0 || rep.Fees <= 0 {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	var first = rep.Children[0]
+	if first.Amount != 1 || first.Filled != 0.5 || first.Status != goex.ORDER_CANCEL ||
+		first.CancelReason != "take: unfilled remainder" || first.ClosedAt.Before(first.PlacedAt) {
+		t.Fatalf("unexpected first child %+v", first)
+	}
+}
+
+func TestExecutionReport_SpotAborted(t *testing.T) {
+	_, mgr := newMockSpot(OPMODE_MAKE)
+	mgr.slidePrice = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	rep, err := mgr.SellCtx(ctx, 1)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("want DeadlineExceeded, got %v", err)
+	}
+	if rep.IsBuy() || rep.Filled != 0 || rep.VWAP != 0 || len(rep.Children) != 1 {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	if reason := rep.Children[0].CancelReason; !strings.HasPrefix(reason, "aborted: ") {
+		t.Fatalf("unexpected cancel reason %q", reason)
+	}
+}
@@ -0,0 +1,61 @@
+package trade
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// reCtx behaves like utils.RE: it calls fn with args until the last return
+// value is a nil error and hands back the first return value. Unlike utils.RE
+// it sleeps delay between attempts and gives up once ctx is done.
+func reCtx(ctx context.Context, delay time.Duration, fn interface{}, args ...interface{}) (interface{}, error) {
+	var f = reflect.ValueOf(fn)
+	var in = make([]reflect.Value, len(args))
+	for i, arg := range args {
+		in[i] = reflect.ValueOf(arg)
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var out = f.Call(in)
+		if last := out[len(out)-1]; last.IsNil() {
+			return out[0].Interface(), nil
+		}
+		if err := sleepCtx(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// reFinal is reCtx, except that once ctx is done fn is still called once,
+// without retrying. It reads back what a request left behind on the way out
+// after ctx stopped it, as spot trade's abort does.
+func reFinal(ctx context.Context, delay time.Duration, fn interface{}, args ...interface{}) (interface{}, error) {
+	if res, err := reCtx(ctx, delay, fn, args...); err == nil {
+		return res, nil
+	}
+	var in = make([]reflect.Value, len(args))
+	for i, arg := range args {
+		in[i] = reflect.ValueOf(arg)
+	}
+	var out = reflect.ValueOf(fn).Call(in)
+	if last := out[len(out)-1]; !last.IsNil() {
+		return nil, fmt.Errorf("%w: %v", ctx.Err(), last.Interface())
+	}
+	return out[0].Interface(), nil
+}
+
+// sleepCtx pauses for d, returning early with ctx.Err() if ctx is done first.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	var timer = time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,50 @@
+package trade
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReCtx(t *testing.T) {
+	var calls = 0
+	var fn = func(n int) (int, error) {
+		calls++
+		if calls < 3 {
+			return 0, errors.New("busy")
+		}
+		return n * 2, nil
+	}
+	res, err := reCtx(context.Background(), time.Millisecond, fn, 21)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.(int) != 42 || calls != 3 {
+		t.Fatalf("got %v after %d calls", res, calls)
+	}
+}
+
+func TestReCtxCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var fn = func() (int, error) {
+		return 0, errors.New("down")
+	}
+	_, err := reCtx(ctx, 5*time.Millisecond, fn)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("want DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestSleepCtx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var start = time.Now()
+	if err := sleepCtx(ctx, time.Hour); err != context.Canceled {
+		t.Fatalf("want Canceled, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("sleepCtx did not return early")
+	}
+}
@@ -0,0 +1,521 @@
+package trade
+
+import (
+	"context"
+	"fmt"
+	"github.com/beaquant/utils"
+	"github.com/nntaoli-project/GoEx"
+	"github.com/sirupsen/logrus"
+	"math"
+	"sync"
+	"time"
+)
+
+// RiskRule names the check a request failed.
+type RiskRule int
+
+const (
+	RISK_KILL_SWITCH = iota //已急停
+	RISK_RATE               //每分钟下单次数超限
+	RISK_COLLAR             //下单价偏离最新价过多
+	RISK_NOTIONAL           //单笔名义价值超限
+	RISK_POSITION           //持仓超限
+	RISK_DAILY_LOSS         //当日亏损超限
+)
+
+func (rule RiskRule) String() string {
+	switch rule {
+	case RISK_KILL_SWITCH:
+		return "RISK_KILL_SWITCH"
+	case RISK_RATE:
+		return "RISK_RATE"
+	case RISK_COLLAR:
+		return "RISK_COLLAR"
+	case RISK_NOTIONAL:
+		return "RISK_NOTIONAL"
+	case RISK_POSITION:
+		return "RISK_POSITION"
+	case RISK_DAILY_LOSS:
+		return "RISK_DAILY_LOSS"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// RiskError is returned by the managers a RiskGate wraps when a request is
+// turned down. It matches ErrRiskRejected with errors.Is.
+type RiskError struct {
+	Rule   RiskRule
+	Reason string
+}
+
+func (e *RiskError) Error() string {
+	return fmt.Sprintf("%v: %s: %s", ErrRiskRejected, e.Rule, e.Reason)
+}
+
+func (e *RiskError) Unwrap() error {
+	return ErrRiskRejected
+}
+
+// RiskLimits are the checks of a RiskGate. Zero fields are not enforced.
+type RiskLimits struct {
+	MaxNotional        float64 //单笔最大名义价值(计价币)
+	MaxPosition        float64 //每个交易对最大持仓(现货为基础币数量, 期货为单边合约张数)
+	MaxDailyLoss       float64 //当日(UTC)最大已实现亏损(计价币)
+	MaxOrdersPerMinute int     //每分钟最多下单次数(子订单数, 请求结束时计入)
+	PriceCollar        float64 //下单参考价偏离最新成交价的最大比例
+}
+
+func (limits *RiskLimits) Validate() error {
+	if limits.MaxNotional < 0 || limits.MaxPosition < 0 || limits.MaxDailyLoss < 0 || limits.MaxOrdersPerMinute < 0 || limits.PriceCollar < 0 {
+		return fmt.Errorf("%w: negative risk limit", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// riskBook is the average cost of what was bought through the gate, used to
+// work out the realised PnL of spot sells.
+type riskBook struct {
+	amount float64
+	avg    float64
+}
+
+// RiskGate checks every request of the managers wrapped with NewRiskSpot and
+// NewRiskFuture before it reaches the exchange. Requests that add to a
+// position are held to every limit; those that reduce one (futures closes)
+// only to the kill switch, the rate and the collar, so a losing position can
+// always be closed. One gate may be shared by managers of different pairs:
+// the rate, the daily loss and the kill switch are then global. The rate
+// counts the child orders of the requests that passed, each request's once
+// it has returned, so a request is never cut short by it.
+//
+// Requests that passed run under a context of the gate: Kill cancels them,
+// so a request in flight stops placing orders as soon as the switch is
+// pulled.
+//
+// Daily loss is the PnL realised through the gate since midnight UTC: futures
+// closes against the position average price, spot sells against the average
+// cost of what the gate saw bought, less fees charged in the quote currency
+// and, for futures, the fees of opens and closes alike.
+type RiskGate struct {
+	limits RiskLimits
+	logger *logrus.Logger
+	now    func() time.Time
+
+	mu       sync.Mutex
+	killed   string
+	orders   []time.Time //最近下的子订单, 按请求结束时间
+	day      string
+	dayPnL   float64
+	books    map[string]*riskBook
+	inflight map[int]context.CancelFunc //已放行且未结束的请求
+	nextID   int
+	drained  chan struct{} //inflight清空时关闭
+}
+
+func NewRiskGate(limits RiskLimits, logger *logrus.Logger) (*RiskGate, error) {
+	if err := limits.Validate(); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = logrus.New()
+	}
+	return &RiskGate{
+		limits:   limits,
+		logger:   logger,
+		now:      time.Now,
+		books:    make(map[string]*riskBook),
+		inflight: make(map[int]context.CancelFunc),
+	}, nil
+}
+
+// Kill turns every further request down until Resume and cancels the
+// requests in flight.
+func (gate *RiskGate) Kill(reason string) {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	if reason == "" {
+		reason = "killed"
+	}
+	gate.killed = reason
+	for _, cancel := range gate.inflight {
+		cancel()
+	}
+	gate.logger.Errorf("[ RISK ] kill switch: %s, %d requests in flight cancelled", reason, len(gate.inflight))
+}
+
+// Drain waits until no request that passed the gate is still running, or
+// until ctx is done.
+func (gate *RiskGate) Drain(ctx context.Context) error {
+	gate.mu.Lock()
+	if len(gate.inflight) == 0 {
+		gate.mu.Unlock()
+		return nil
+	}
+	var drained = gate.drained
+	gate.mu.Unlock()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (gate *RiskGate) Resume() {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	gate.killed = ""
+	gate.logger.Warningln("[ RISK ] kill switch released")
+}
+
+// Killed tells whether the kill switch is on, and why.
+func (gate *RiskGate) Killed() (bool, string) {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	return gate.killed != "", gate.killed
+}
+
+// DailyPnL is the PnL realised today, negative for a loss.
+func (gate *RiskGate) DailyPnL() float64 {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	gate.rollDay()
+	return gate.dayPnL
+}
+
+// RecordPnL adds PnL made outside the wrapped managers to today's total.
+func (gate *RiskGate) RecordPnL(pnl float64) {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	gate.rollDay()
+	gate.dayPnL += pnl
+}
+
+func (gate *RiskGate) rollDay() {
+	var day = gate.now().UTC().Format("2006-01-02")
+	if day != gate.day {
+		gate.day = day
+		gate.dayPnL = 0
+	}
+}
+
+// riskRequest is one request as the gate sees it.
+type riskRequest struct {
+	name          string  //日志用, 如"BTC_USDT BUY"
+	increase      bool    //是否增加持仓
+	amount        float64 //数量
+	price         float64 //参考价
+	last          float64 //最新成交价
+	notional      float64 //名义价值
+	position      float64 //下单前同方向持仓
+	checkNotional bool    //是否检查名义价值
+}
+
+func (gate *RiskGate) reject(req *riskRequest, rule RiskRule, format string, args ...interface{}) error {
+	var err = &RiskError{Rule: rule, Reason: fmt.Sprintf(format, args...)}
+	gate.logger.Warningf("[ RISK ] %s %s rejected: %s", req.name, utils.Float64RoundString(req.amount, 8), err.Reason)
+	return err
+}
+
+// admit checks req and, when it passes, returns the context to run it under
+// and the func to call once it is done.
+func (gate *RiskGate) admit(ctx context.Context, req *riskRequest) (context.Context, func(), error) {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	if err := gate.check(req); err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	var id = gate.nextID
+	gate.nextID++
+	if len(gate.inflight) == 0 {
+		gate.drained = make(chan struct{})
+	}
+	gate.inflight[id] = cancel
+	return ctx, func() {
+		cancel()
+		gate.mu.Lock()
+		defer gate.mu.Unlock()
+		delete(gate.inflight, id)
+		if len(gate.inflight) == 0 {
+			close(gate.drained)
+		}
+	}, nil
+}
+
+// check runs req through the limits. gate.mu must be held.
+func (gate *RiskGate) check(req *riskRequest) error {
+	gate.rollDay()
+	var now = gate.now()
+	var limits = gate.limits
+	if gate.killed != "" {
+		return gate.reject(req, RISK_KILL_SWITCH, "%s", gate.killed)
+	}
+	var recent = gate.orders[:0]
+	for _, at := range gate.orders {
+		if now.Sub(at) < time.Minute {
+			recent = append(recent, at)
+		}
+	}
+	gate.orders = recent
+	if limits.MaxOrdersPerMinute > 0 && len(gate.orders) >= limits.MaxOrdersPerMinute {
+		return gate.reject(req, RISK_RATE, "%d orders in the last minute", len(gate.orders))
+	}
+	if limits.PriceCollar > 0 && req.last > 0 && req.price > 0 && math.Abs(req.price-req.last)/req.last > limits.PriceCollar {
+		return gate.reject(req, RISK_COLLAR, "price %v is more than %v away from last %v", req.price, limits.PriceCollar, req.last)
+	}
+	if limits.MaxNotional > 0 && req.checkNotional && req.notional > limits.MaxNotional {
+		return gate.reject(req, RISK_NOTIONAL, "notional %s above %v", utils.Float64RoundString(req.notional, 8), limits.MaxNotional)
+	}
+	if req.increase && limits.MaxPosition > 0 && req.position+req.amount > limits.MaxPosition {
+		return gate.reject(req, RISK_POSITION, "position would be %s, above %v", utils.Float64RoundString(req.position+req.amount, 8), limits.MaxPosition)
+	}
+	if req.increase && limits.MaxDailyLoss > 0 && -gate.dayPnL >= limits.MaxDailyLoss {
+		return gate.reject(req, RISK_DAILY_LOSS, "lost %s today, limit %v", utils.Float64RoundString(-gate.dayPnL, 8), limits.MaxDailyLoss)
+	}
+	return nil
+}
+
+// placed counts the child orders of rep against the rate.
+func (gate *RiskGate) placed(rep *ExecutionReport) {
+	if rep == nil || len(rep.Children) == 0 {
+		return
+	}
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	var now = gate.now()
+	for range rep.Children {
+		gate.orders = append(gate.orders, now)
+	}
+}
+
+// spotFilled updates the cost book of key with rep and realises the PnL of
+// sells.
+func (gate *RiskGate) spotFilled(key string, rep *ExecutionReport) {
+	if rep == nil || rep.Filled <= 0 {
+		return
+	}
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	gate.rollDay()
+	var book, ok = gate.books[key]
+	if !ok {
+		book = new(riskBook)
+		gate.books[key] = book
+	}
+	if rep.IsBuy() {
+		book.avg = (book.avg*book.amount + rep.VWAP*rep.Filled) / (book.amount + rep.Filled)
+		book.amount += rep.Filled
+	} else if book.amount > 0 {
+		var matched = math.Min(book.amount, rep.Filled)
+		gate.dayPnL += (rep.VWAP - book.avg) * matched
+		book.amount -= matched
+	}
+	if rep.FeeCurrency.Symbol != "" && rep.FeeCurrency == rep.Pair.CurrencyB {
+		gate.dayPnL -= rep.Fees
+	}
+}
+
+type riskSpot struct {
+	SpotTradeManagerAPI
+	pair goex.CurrencyPair
+	feed Feed
+	gate *RiskGate
+}
+
+// NewRiskSpot puts gate in front of the Buy and Sell requests of mgr, which
+// trades pair; feed supplies the ticker the checks price them at. A buy is
+// priced at the ask and a sell at the bid, and both are collared against the
+// last price. The position is the base currency held by the account, frozen
+// included.
+func NewRiskSpot(mgr SpotTradeManagerAPI, pair goex.CurrencyPair, feed Feed, gate *RiskGate) SpotTradeManagerAPI {
+	return &riskSpot{SpotTradeManagerAPI: mgr, pair: pair, feed: feed, gate: gate}
+}
+
+func (r *riskSpot) trade(ctx context.Context, side goex.TradeSide, amount float64) (*ExecutionReport, error) {
+	ticker, err := r.feed.GetTicker()
+	if err != nil {
+		return nil, err
+	}
+	account, err := r.SpotTradeManagerAPI.GetAccountCtx(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	var req = &riskRequest{
+		name:          r.pair.ToSymbol("_") + " " + side.String(),
+		increase:      side == goex.BUY,
+		amount:        amount,
+		price:         ticker.Sell,
+		last:          ticker.Last,
+		position:      account.Stocks + account.FrozenStocks,
+		checkNotional: true,
+	}
+	if side == goex.SELL {
+		req.price = ticker.Buy
+	}
+	req.notional = amount * req.price
+	ctx, done, err := r.gate.admit(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	trade, err := sliceFunc(r.SpotTradeManagerAPI, side)
+	if err != nil {
+		return nil, err
+	}
+	rep, err := trade(ctx, amount)
+	r.gate.placed(rep)
+	r.gate.spotFilled(r.pair.ToSymbol("_"), rep)
+	return rep, err
+}
+
+func (r *riskSpot) Buy(amount float64) (*ExecutionReport, error) {
+	return r.trade(context.Background(), goex.BUY, amount)
+}
+
+func (r *riskSpot) BuyCtx(ctx context.Context, amount float64) (*ExecutionReport, error) {
+	return r.trade(ctx, goex.BUY, amount)
+}
+
+func (r *riskSpot) Sell(amount float64) (*ExecutionReport, error) {
+	return r.trade(context.Background(), goex.SELL, amount)
+}
+
+func (r *riskSpot) SellCtx(ctx context.Context, amount float64) (*ExecutionReport, error) {
+	return r.trade(ctx, goex.SELL, amount)
+}
+
+type riskFuture struct {
+	FutureTradeManagerAPI
+	pair          goex.CurrencyPair
+	contractValue float64
+	feed          Feed
+	gate          *RiskGate
+}
+
+// NewRiskFuture puts gate in front of the OpenLong, OpenShort, CloseLong and
+// CloseShort requests of mgr, which trades pair in contracts worth
+// contractValue (in the quote currency per unit of price, 1 for linear
+// contracts quoted per coin). Requests are collared at their price argument
+// against the last price of feed.
+func NewRiskFuture(mgr FutureTradeManagerAPI, pair goex.CurrencyPair, contractValue float64, feed Feed, gate *RiskGate) FutureTradeManagerAPI {
+	if contractValue <= 0 {
+		contractValue = 1
+	}
+	return &riskFuture{FutureTradeManagerAPI: mgr, pair: pair, contractValue: contractValue, feed: feed, gate: gate}
+}
+
+// request admits one request, see RiskGate.admit, and returns the position
+// held on its side before it.
+func (r *riskFuture) request(ctx context.Context, name string, direction int, increase bool, price, amount float64) (context.Context, func(), *Position, error) {
+	ticker, err := r.feed.GetTicker()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pos, err := r.FutureTradeManagerAPI.GetPositionCtx(ctx, direction)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var req = &riskRequest{
+		name:          r.pair.ToSymbol("_") + " " + name,
+		increase:      increase,
+		amount:        amount,
+		price:         price,
+		last:          ticker.Last,
+		notional:      amount * price * r.contractValue,
+		checkNotional: increase,
+	}
+	if pos != nil {
+		req.position = pos.Amount
+	}
+	ctx, done, err := r.gate.admit(ctx, req)
+	return ctx, done, pos, err
+}
+
+func (r *riskFuture) open(ctx context.Context, direction int, price, opAmount float64) (*SummaryPosition, error) {
+	var name = "OPEN_LONG"
+	if direction == goex.OPEN_SELL {
+		name = "OPEN_SHORT"
+	}
+	ctx, done, _, err := r.request(ctx, name, direction, true, price, opAmount)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	var pos *SummaryPosition
+	if direction == goex.OPEN_SELL {
+		pos, err = r.FutureTradeManagerAPI.OpenShortCtx(ctx, price, opAmount)
+	} else {
+		pos, err = r.FutureTradeManagerAPI.OpenLongCtx(ctx, price, opAmount)
+	}
+	if pos != nil {
+		r.gate.placed(pos.Report)
+	}
+	if pos != nil && pos.Report != nil && pos.Report.FeeCurrency.Symbol != "" {
+		r.gate.RecordPnL(-pos.Report.Fees) //开仓手续费也计入当日亏损
+	}
+	return pos, err
+}
+
+func (r *riskFuture) cover(ctx context.Context, direction int, price, opAmount float64) (*ExecutionReport, error) {
+	var name = "CLOSE_LONG"
+	if direction == goex.OPEN_SELL {
+		name = "CLOSE_SHORT"
+	}
+	ctx, done, pos, err := r.request(ctx, name, direction, false, price, opAmount)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	var rep *ExecutionReport
+	if direction == goex.OPEN_SELL {
+		rep, err = r.FutureTradeManagerAPI.CloseShortCtx(ctx, price, opAmount)
+	} else {
+		rep, err = r.FutureTradeManagerAPI.CloseLongCtx(ctx, price, opAmount)
+	}
+	r.gate.placed(rep)
+	if rep != nil && rep.Filled > 0 && pos != nil {
+		var pnl = (rep.VWAP - pos.Price) * rep.Filled * r.contractValue
+		if direction == goex.OPEN_SELL {
+			pnl = -pnl
+		}
+		if rep.FeeCurrency.Symbol != "" {
+			pnl -= rep.Fees
+		}
+		r.gate.RecordPnL(pnl)
+	}
+	return rep, err
+}
+
+func (r *riskFuture) OpenLong(price, opAmount float64) (*SummaryPosition, error) {
+	return r.open(context.Background(), goex.OPEN_BUY, price, opAmount)
+}
+
+func (r *riskFuture) OpenLongCtx(ctx context.Context, price, opAmount float64) (*SummaryPosition, error) {
+	return r.open(ctx, goex.OPEN_BUY, price, opAmount)
+}
+
+func (r *riskFuture) OpenShort(price, opAmount float64) (*SummaryPosition, error) {
+	return r.open(context.Background(), goex.OPEN_SELL, price, opAmount)
+}
+
+func (r *riskFuture) OpenShortCtx(ctx context.Context, price, opAmount float64) (*SummaryPosition, error) {
+	return r.open(ctx, goex.OPEN_SELL, price, opAmount)
+}
+
+func (r *riskFuture) CloseLong(price, opAmount float64) (*ExecutionReport, error) {
+	return r.cover(context.Background(), goex.OPEN_BUY, price, opAmount)
+}
+
+func (r *riskFuture) CloseLongCtx(ctx context.Context, price, opAmount float64) (*ExecutionReport, error) {
+	return r.cover(ctx, goex.OPEN_BUY, price, opAmount)
+}
+
+func (r *riskFuture) CloseShort(price, opAmount float64) (*ExecutionReport, error) {
+	return r.cover(context.Background(), goex.OPEN_SELL, price, opAmount)
+}
+
+func (r *riskFuture) CloseShortCtx(ctx context.Context, price, opAmount float64) (*ExecutionReport, error) {
+	return r.cover(ctx, goex.OPEN_SELL, price, opAmount)
+}
@@ -0,0 +1,136 @@
+package trade
+
+import (
+	"errors"
+	"github.com/nntaoli-project/GoEx"
+	"testing"
+	"time"
+)
+
+func wantRule(t *testing.T, err error, rule RiskRule) {
+	t.Helper()
+	var risk *RiskError
+	if !errors.As(err, &risk) || risk.Rule != rule || !errors.Is(err, ErrRiskRejected) {
+		t.Fatalf("want %s, got %v", rule, err)
+	}
+}
+
+func TestRiskGate_Spot(t *testing.T) {
+	ex, mgr := newMockSpot(OPMODE_TAKE)
+	gate, err := NewRiskGate(RiskLimits{MaxNotional: 250, MaxPosition: 12, MaxOrdersPerMinute: 3, PriceCollar: 0.05}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clock = time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC)
+	gate.now = func() time.Time { return clock }
+	var spot = NewRiskSpot(mgr, spotPair, NewSpotFeed(ex.Spot(), spotPair), gate)
+
+	_, err = spot.Buy(3)
+	wantRule(t, err, RISK_NOTIONAL)
+	if btc, _ := ex.Balance(goex.BTC); btc != 10 {
+		t.Fatalf("rejected buy reached the exchange, %v BTC", btc)
+	}
+	if _, err = spot.Buy(2); err != nil {
+		t.Fatal(err)
+	}
+	_, err = spot.Buy(1)
+	wantRule(t, err, RISK_POSITION)
+	if _, err = spot.Sell(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = spot.Sell(1); err != nil {
+		t.Fatal(err)
+	}
+	_, err = spot.Sell(1)
+	wantRule(t, err, RISK_RATE)
+	clock = clock.Add(time.Minute)
+	gate.Kill("test")
+	_, err = spot.Sell(1)
+	wantRule(t, err, RISK_KILL_SWITCH)
+	gate.Resume()
+	if _, err = spot.Sell(1); err != nil {
+		t.Fatal(err)
+	}
+	ex.Market(spotPair).SetTicker(80, 120)
+	_, err = spot.Sell(1)
+	wantRule(t, err, RISK_COLLAR)
+}
+
+func TestRiskGate_SpotOrders(t *testing.T) {
+	ex, mgr := newMockSpot(OPMODE_TAKE)
+	gate, _ := NewRiskGate(RiskLimits{MaxPosition: 11, MaxOrdersPerMinute: 2}, nil)
+	var spot = NewRiskSpot(mgr, spotPair, NewSpotFeed(ex.Spot(), spotPair), gate)
+	if _, err := ex.Spot().LimitSell("1", "105", spotPair); err != nil {
+		t.Fatal(err)
+	}
+	_, err := spot.Buy(2)
+	wantRule(t, err, RISK_POSITION) //冻结的1个BTC也算持仓
+	rep, err := spot.Sell(3)
+	if err != nil || len(rep.Children) != 2 {
+		t.Fatalf("want the sell cut into 2 orders, got %+v, %v", rep, err)
+	}
+	_, err = spot.Sell(1)
+	wantRule(t, err, RISK_RATE)
+}
+
+func TestRiskGate_DailyLoss(t *testing.T) {
+	ex, mgr := newMockSpot(OPMODE_TAKE)
+	gate, _ := NewRiskGate(RiskLimits{MaxDailyLoss: 20}, nil)
+	var clock = time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC)
+	gate.now = func() time.Time { return clock }
+	var spot = NewRiskSpot(mgr, spotPair, NewSpotFeed(ex.Spot(), spotPair), gate)
+	if _, err := spot.Buy(2); err != nil {
+		t.Fatal(err)
+	}
+	ex.Market(spotPair).SetTicker(89, 91)
+	if _, err := spot.Sell(2); err != nil {
+		t.Fatal(err)
+	}
+	if pnl := gate.DailyPnL(); pnl != -24 {
+		t.Fatalf("want -24 realised, got %v", pnl)
+	}
+	_, err := spot.Buy(1)
+	wantRule(t, err, RISK_DAILY_LOSS)
+	if _, err = spot.Sell(1); err != nil {
+		t.Fatalf("sells must pass the daily loss limit: %v", err)
+	}
+	clock = clock.Add(24 * time.Hour)
+	if _, err = spot.Buy(1); err != nil {
+		t.Fatalf("limit not reset the next day: %v", err)
+	}
+}
+
+func TestRiskGate_Future(t *testing.T) {
+	ex, mgr := newMockFuture()
+	gate, _ := NewRiskGate(RiskLimits{MaxPosition: 3, MaxDailyLoss: 50, PriceCollar: 0.01}, nil)
+	var future = NewRiskFuture(mgr, futurePair, 1, NewFutureFeed(ex.Future(), futurePair, goex.QUARTER_CONTRACT), gate)
+	_, err := future.OpenLong(110, 1)
+	wantRule(t, err, RISK_COLLAR)
+	if _, err = future.OpenLong(100, 2); err != nil {
+		t.Fatal(err)
+	}
+	_, err = future.OpenLong(100, 2)
+	wantRule(t, err, RISK_POSITION)
+	gate.RecordPnL(-60)
+	_, err = future.OpenShort(100, 1)
+	wantRule(t, err, RISK_DAILY_LOSS)
+	if _, err = future.CloseLong(100, 2); err != nil {
+		t.Fatalf("closes must pass the daily loss limit: %v", err)
+	}
+	if pos, _ := mgr.GetPosition(goex.OPEN_BUY); pos != nil && pos.Amount != 0 {
+		t.Fatalf("long not closed %+v", pos)
+	}
+}
+
+func TestRiskGate_FutureOpenFees(t *testing.T) {
+	ex, mgr := newMockFuture()
+	mgr.fees = NewFeeTable(FeeSchedule{Maker: 0.001, Taker: 0.002})
+	gate, _ := NewRiskGate(RiskLimits{}, nil)
+	var future = NewRiskFuture(mgr, futurePair, 1, NewFutureFeed(ex.Future(), futurePair, goex.QUARTER_CONTRACT), gate)
+	if _, err := future.OpenLong(100, 5); err != nil {
+		t.Fatal(err)
+	}
+	if pnl := gate.DailyPnL(); pnl != -1.005 {
+		t.Fatalf("want the open fee booked as a loss, got %v", pnl)
+	}
+}
@@ -1,6 +1,8 @@
 package trade
 
 import (
+	"context"
+	"fmt"
 	"github.com/beaquant/utils"
 	"github.com/nntaoli-project/GoEx"
 	"github.com/sirupsen/logrus"
@@ -11,7 +13,7 @@ import (
 type SpotTradeManager struct {
 	exchange     goex.API          //交易所
 	pair         goex.CurrencyPair //货币对
-	opMode       OpMode            //下单方式:吃单|挂单|挂单等待
+	opMode       OpMode            //下单方式:吃单|挂单|挂单等待|冰山|只做maker|IOC|FOK
 	maxSpace     float64           //挂单失效距离
 	slidePrice   float64           //下单滑动价
 	maxAmount    float64           //开仓最大单次下单量
@@ -22,6 +24,15 @@ type SpotTradeManager struct {
 	priceDot     int               //价格小数精度
 	amountDot    int               //数量小数精度
 	waitFrozen   bool              //数量小数精度
+	instruments  InstrumentSource  //交易规则
+	fillMode     FillMode          //成交统计方式
+	fees         FeeModel          //手续费模型
+	iceberg      Iceberg           //冰山单参数(OPMODE_ICEBERG)
+	priceMode    PriceMode         //挂单定价方式
+	maxSlippage  float64           //吃单按深度计算的最大滑点比例
+	depthLevels  int               //深度档数
+	journal      Journal           //订单日志
+	recovered    *RecoveryReport   //最近一次Recover的结果
 }
 
 type OpMode int
@@ -30,6 +41,10 @@ const (
 	OPMODE_TAKE = 1 + iota
 	OPMODE_MAKE
 	OPMODE_MAKE_WAIT
+	OPMODE_ICEBERG   //按挂单价只挂出一部分, 成交后再补
+	OPMODE_POST_ONLY //按挂单价只做maker, 被拒后退一个tick重挂
+	OPMODE_IOC       //按吃单价下单, 未立即成交的部分撤销
+	OPMODE_FOK       //按吃单价下单, 不能全部立即成交则不成交
 )
 
 func (op OpMode) String() string {
@@ -40,6 +55,33 @@ func (op OpMode) String() string {
 		return "OPMODE_MAKE"
 	case OPMODE_MAKE_WAIT:
 		return "OPMODE_MAKE_WAIT"
+	case OPMODE_ICEBERG:
+		return "OPMODE_ICEBERG"
+	case OPMODE_POST_ONLY:
+		return "OPMODE_POST_ONLY"
+	case OPMODE_IOC:
+		return "OPMODE_IOC"
+	case OPMODE_FOK:
+		return "OPMODE_FOK"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// FillMode says how a SpotTradeManager works out what its orders filled.
+type FillMode int
+
+const (
+	FILLMODE_ORDER   = iota //按本管理器所下订单的成交记录统计
+	FILLMODE_BALANCE        //按下单前后账户余额差统计, 账户被其他程序共用时不准确
+)
+
+func (mode FillMode) String() string {
+	switch mode {
+	case FILLMODE_ORDER:
+		return "FILLMODE_ORDER"
+	case FILLMODE_BALANCE:
+		return "FILLMODE_BALANCE"
 	default:
 		return "UNKNOWN"
 	}
@@ -53,6 +95,10 @@ type Account struct {
 	FrozenStocks  float64           `json:"frozen_stocks"`
 }
 
+// NewSportManager builds a manager from positional arguments without
+// validating them.
+//
+// Deprecated: use NewSpotTradeManagerWithConfig.
 func NewSportManager(
 	exchange goex.API,
 	pair goex.CurrencyPair,
@@ -68,67 +114,80 @@ func NewSportManager(
 	amountDot int,
 	waitFrozen bool,
 ) *SpotTradeManager {
-	if logger == nil {
-		logger = logrus.New()
-	}
-	utils.SetDelay(retryDelayMs)
-	return &SpotTradeManager{
-		exchange:     exchange,
-		pair:         pair,
-		opMode:       opMode,
-		maxAmount:    maxAmount,
-		maxSpace:     maxSpace,
-		slidePrice:   slidePrice,
-		minStocks:    minStocks,
-		retryDelayMs: time.Duration(retryDelayMs) * time.Millisecond,
-		waitMakeMs:   waitMakeMs,
-		logger:       logger,
-		priceDot:     priceDot,
-		amountDot:    amountDot,
-		waitFrozen:   waitFrozen,
-	}
+	return newSpotTradeManager(exchange, pair, SpotConfig{
+		OpMode:     opMode,
+		MaxSpace:   maxSpace,
+		SlidePrice: slidePrice,
+		MaxAmount:  maxAmount,
+		MinStocks:  minStocks,
+		RetryDelay: time.Duration(retryDelayMs) * time.Millisecond,
+		WaitMake:   time.Duration(waitMakeMs) * time.Millisecond,
+		Logger:     logger,
+		PriceDot:   priceDot,
+		AmountDot:  amountDot,
+		WaitFrozen: waitFrozen,
+	})
+}
+
+func (spot *SpotTradeManager) CancelPendingOrders(orderType goex.TradeSide) error {
+	return spot.CancelPendingOrdersCtx(context.Background(), orderType)
+}
+
+func (spot *SpotTradeManager) CancelPendingOrdersCtx(ctx context.Context, orderType goex.TradeSide) error {
+	return spot.cancelPending(ctx, func(order *goex.Order) bool { return order.Side == orderType })
 }
 
-func (spot *SpotTradeManager) CancelPendingOrders(orderType goex.TradeSide) {
+func (spot *SpotTradeManager) CancelAllPendingOrders() error {
+	return spot.CancelAllPendingOrdersCtx(context.Background())
+}
+
+func (spot *SpotTradeManager) CancelAllPendingOrdersCtx(ctx context.Context) error {
+	return spot.cancelPending(ctx, func(order *goex.Order) bool { return true })
+}
+
+// cancelPending cancels the open orders of the pair that match until none is
+// left, pausing between polls so the cancels can land.
+func (spot *SpotTradeManager) cancelPending(ctx context.Context, match func(order *goex.Order) bool) error {
 	for {
-		orders := utils.RE(spot.exchange.GetUnfinishOrders, spot.pair).([]goex.Order)
-		if len(orders) == 0 {
-			break
+		res, err := reCtx(ctx, spot.retryDelayMs, spot.exchange.GetUnfinishOrders, spot.pair)
+		if err != nil {
+			return err
 		}
-		for j := 0; j < len(orders); j++ {
-			if orders[j].Side != orderType {
-				continue
-			}
-			spot.exchange.CancelOrder(orders[j].OrderID2, spot.pair)
-			if j < len(orders)-1 {
-				time.Sleep(spot.retryDelayMs)
+		var orders []goex.Order
+		for _, order := range res.([]goex.Order) {
+			if match(&order) {
+				orders = append(orders, order)
 			}
 		}
-	}
-}
-
-func (spot *SpotTradeManager) CancelAllPendingOrders() {
-	for {
-		orders := utils.RE(spot.exchange.GetUnfinishOrders, spot.pair).([]goex.Order)
 		if len(orders) == 0 {
-			break
+			return nil
 		}
 		for j := 0; j < len(orders); j++ {
 			spot.exchange.CancelOrder(orders[j].OrderID2, spot.pair)
-			if j < len(orders)-1 {
-				time.Sleep(spot.retryDelayMs)
+			if err = sleepCtx(ctx, spot.retryDelayMs); err != nil {
+				return err
 			}
 		}
 	}
 }
 
-func (spot *SpotTradeManager) StripOrders(orderId string) *goex.Order {
+func (spot *SpotTradeManager) StripOrders(orderId string) (*goex.Order, error) {
+	return spot.StripOrdersCtx(context.Background(), orderId)
+}
+
+func (spot *SpotTradeManager) StripOrdersCtx(ctx context.Context, orderId string) (*goex.Order, error) {
 	var order = new(goex.Order)
 	if orderId == "" {
-		spot.CancelAllPendingOrders()
+		if err := spot.CancelAllPendingOrdersCtx(ctx); err != nil {
+			return order, err
+		}
 	}
 	for {
-		orders := utils.RE(spot.exchange.GetUnfinishOrders, spot.pair).([]goex.Order)
+		res, err := reCtx(ctx, spot.retryDelayMs, spot.exchange.GetUnfinishOrders, spot.pair)
+		if err != nil {
+			return order, err
+		}
+		orders := res.([]goex.Order)
 		if len(orders) == 0 {
 			break
 		}
@@ -140,7 +199,9 @@ func (spot *SpotTradeManager) StripOrders(orderId string) *goex.Order {
 				spot.exchange.CancelOrder(orders[j].OrderID2, spot.pair)
 				dropped++
 				if j < len(orders)-1 {
-					time.Sleep(spot.retryDelayMs)
+					if err = sleepCtx(ctx, spot.retryDelayMs); err != nil {
+						return order, err
+					}
 				}
 			}
 		}
@@ -148,104 +209,294 @@ func (spot *SpotTradeManager) StripOrders(orderId string) *goex.Order {
 			break
 		}
 	}
-	return order
+	return order, nil
 }
 
-func (spot *SpotTradeManager) GetAccount(waitFrozen bool) *Account {
-	var account = new(Account)
+func (spot *SpotTradeManager) GetAccount(waitFrozen bool) (*Account, error) {
+	return spot.GetAccountCtx(context.Background(), waitFrozen)
+}
+
+// GetAccountCtx is GetAccount bounded by ctx. If ctx ends while waiting for
+// frozen funds to settle, the last snapshot is returned along with ctx.Err().
+func (spot *SpotTradeManager) GetAccountCtx(ctx context.Context, waitFrozen bool) (*Account, error) {
 	var alreadyAlert = false
 	for {
-		acc := utils.RE(spot.exchange.GetAccount).(*goex.Account)
-		for _, v := range acc.SubAccounts {
-			if v.Currency == spot.pair.CurrencyB {
-				account.Balance = v.Amount
-				account.FrozenBalance = v.ForzenAmount
-			} else if v.Currency == spot.pair.CurrencyA {
-				account.Stocks = v.Amount
-				account.FrozenStocks = v.ForzenAmount
-			}
+		acc, err := reCtx(ctx, spot.retryDelayMs, spot.exchange.GetAccount)
+		if err != nil {
+			return nil, err
 		}
-
+		var account = spot.account(acc.(*goex.Account))
 		if !waitFrozen || (account.FrozenStocks < spot.minStocks && account.FrozenBalance < 0.01) {
-			break
+			return account, nil
 		}
 		if !alreadyAlert {
 			alreadyAlert = true
 			spot.logger.Infoln("发现账户有冻结的钱或币", account)
 		}
-		time.Sleep(spot.retryDelayMs)
+		if err = sleepCtx(ctx, spot.retryDelayMs); err != nil {
+			return account, err
+		}
+	}
+}
+
+func (spot *SpotTradeManager) account(acc *goex.Account) *Account {
+	var account = new(Account)
+	for _, v := range acc.SubAccounts {
+		if v.Currency == spot.pair.CurrencyB {
+			account.Balance = v.Amount
+			account.FrozenBalance = v.ForzenAmount
+		} else if v.Currency == spot.pair.CurrencyA {
+			account.Stocks = v.Amount
+			account.FrozenStocks = v.ForzenAmount
+		}
 	}
 	account.Pair = spot.pair
 	return account
 }
 
-func (spot *SpotTradeManager) tradeFunc(tradeType goex.TradeSide) (func(amount, price string, currency goex.CurrencyPair) (*goex.Order, error), bool) {
+// instrument returns the filters orders are rounded to: those of the
+// configured InstrumentSource when it answers, otherwise the ones implied by
+// priceDot, amountDot and minStocks.
+func (spot *SpotTradeManager) instrument() *Instrument {
+	if spot.instruments != nil {
+		inst, err := spot.instruments.Instrument(spot.pair, "")
+		if err != nil {
+			spot.logger.Warningf("instrument %s: %v", spot.pair.ToSymbol("_"), err)
+		}
+		if inst != nil {
+			return inst
+		}
+	}
+	return dotInstrument(spot.pair, "", spot.priceDot, spot.amountDot, spot.minStocks)
+}
+
+// minAmount is the smallest order the manager and the exchange both accept
+// at price; price 0 skips the min notional check.
+func (spot *SpotTradeManager) minAmount(inst *Instrument, price float64) float64 {
+	return math.Max(spot.minStocks, inst.MinAmount(price))
+}
+
+// rejected drops a cached instrument after a failed placement, in case the
+// exchange changed its filters.
+func (spot *SpotTradeManager) rejected() {
+	if cache, ok := spot.instruments.(*InstrumentCache); ok {
+		cache.Invalidate(spot.pair, "")
+	}
+}
+
+func (spot *SpotTradeManager) tradeFunc(tradeType goex.TradeSide) (func(amount, price string, currency goex.CurrencyPair) (*goex.Order, error), bool, error) {
 	switch tradeType {
 	case goex.BUY:
-		return spot.exchange.LimitBuy, true
+		return spot.exchange.LimitBuy, true, nil
 	case goex.SELL:
-		return spot.exchange.LimitSell, false
+		return spot.exchange.LimitSell, false, nil
 	case goex.BUY_MARKET:
-		return spot.exchange.MarketBuy, true
+		return spot.exchange.MarketBuy, true, nil
 	case goex.SELL_MARKET:
-		return spot.exchange.MarketSell, false
+		return spot.exchange.MarketSell, false, nil
 	default:
-		spot.logger.Fatalln("UNKNOWN tradeType")
+		return nil, false, fmt.Errorf("%w: %d", ErrUnknownSide, tradeType)
+	}
+}
+
+// withdraw makes a single, uncancellable attempt to pull a resting order. It
+// is used on the way out of trade once ctx is done, when retrying is no
+// longer allowed but the order must not be left on the book.
+func (spot *SpotTradeManager) withdraw(order *goex.Order) {
+	if order == nil || order.OrderID2 == "" {
+		return
+	}
+	if _, err := spot.exchange.CancelOrder(order.OrderID2, spot.pair); err != nil {
+		spot.logger.Errorf("cancel order %s failed: %v", order.OrderID2, err)
+	}
+}
+
+// fillDot is the precision fills are reported in: the configured one, or
+// the lot size's when that is finer.
+func (spot *SpotTradeManager) fillDot(inst *Instrument) int {
+	if inst.AmountDot() > spot.amountDot {
+		return inst.AmountDot()
 	}
-	panic("UNKNOWN tradeType")
+	return spot.amountDot
 }
 
-func (spot *SpotTradeManager) trade(opMode OpMode, tradeType goex.TradeSide, tradeAmount float64) *goex.Order {
-	var initAccount = spot.GetAccount(spot.waitFrozen)
+// settle compares two account snapshots and reports the quote money spent
+// (or received) and the base amount bought (or sold) between them.
+func (spot *SpotTradeManager) settle(inst *Instrument, isBuy bool, initAccount, nowAccount *Account) (diffMoney, dealAmount float64) {
+	var dot = spot.fillDot(inst) * 2 // 如果保留小数过少，会引起在小交易量交易时，计算出的成交价格误差较大。
+	if isBuy {
+		diffMoney = utils.Float64Round(initAccount.Balance-nowAccount.Balance, 8)
+		dealAmount = utils.Float64Round(nowAccount.Stocks-initAccount.Stocks, dot)
+	} else {
+		diffMoney = utils.Float64Round(nowAccount.Balance-initAccount.Balance, 8)
+		dealAmount = utils.Float64Round(initAccount.Stocks-nowAccount.Stocks, dot)
+	}
+	return
+}
+
+func (spot *SpotTradeManager) trade(ctx context.Context, opMode OpMode, tradeType goex.TradeSide, tradeAmount float64) (*ExecutionReport, error) {
+	var tradeFunc, isBuy, err = spot.tradeFunc(tradeType)
+	if err != nil {
+		return nil, err
+	}
+	var started = time.Now()
+	initAccount, err := spot.GetAccountCtx(ctx, spot.waitFrozen)
+	if err != nil {
+		return nil, err
+	}
+	var inst = spot.instrument()
 	var nowAccount = initAccount
+	fills, err := spot.newFills(ctx, tradeType, tradeAmount)
+	if err != nil {
+		return nil, err
+	}
 	var order *goex.Order = nil
 	var prePrice = 0.0
-	var firstPrice = 0.0
+	var arrival = 0.0
+	var anchor = 0.0 //开始时对手方最优价, 吃单滑点预算的基准
 	var dealAmount = 0.0
 	var diffMoney = 0.0
 	var isFirst = true
-	var err error
-	var tradeFunc, isBuy = spot.tradeFunc(tradeType)
+	var shortOf = 0.0
+	var limit = tradeType == goex.BUY || tradeType == goex.SELL
+	var report = func() *ExecutionReport {
+		return spot.report(inst, tradeType, tradeAmount, arrival, started, fills, diffMoney, dealAmount)
+	}
+	// finish reports a trade that ran its course, failing it if the journal
+	// could not keep up.
+	var finish = func(err error) (*ExecutionReport, error) {
+		var rep = report()
+		if err == nil {
+			err = fills.journal.failed()
+		}
+		return rep, err
+	}
+	// abort winds trade down once ctx is done: the resting order (if any) is
+	// withdrawn and the orders (or the account) are read one last time,
+	// without retrying, to work out how much was filled.
+	var abort = func(resting *goex.Order, cause error) (*ExecutionReport, error) {
+		if resting != nil {
+			fills.cancelled(resting.OrderID2, "aborted: "+cause.Error())
+		}
+		spot.withdraw(resting)
+		if spot.fillMode == FILLMODE_BALANCE {
+			if acc, err := spot.exchange.GetAccount(); err == nil {
+				nowAccount = spot.account(acc)
+			}
+			diffMoney, dealAmount = spot.settle(inst, isBuy, initAccount, nowAccount)
+		} else {
+			for _, id := range fills.open() {
+				if ord, err := spot.exchange.GetOneOrder(id, spot.pair); err == nil {
+					fills.update(ord)
+				}
+			}
+			diffMoney, dealAmount = spot.total(inst, fills)
+		}
+		spot.logger.Warningf("[ %-4s ] aborted: %v, dealAmount:%s", tradeType.String(), cause, utils.Float64RoundString(dealAmount, spot.fillDot(inst)))
+		return report(), cause
+	}
+	// replenish waits before an iceberg's next slice is shown.
+	var replenish = func() error {
+		if opMode != OPMODE_ICEBERG {
+			return nil
+		}
+		return sleepCtx(ctx, spot.iceberg.refreshDelay())
+	}
 	for {
-		var ticker = utils.RE(spot.exchange.GetTicker, spot.pair).(*goex.Ticker)
+		res, err := reCtx(ctx, spot.retryDelayMs, spot.exchange.GetTicker, spot.pair)
+		if err != nil {
+			return abort(order, err)
+		}
+		var ticker = res.(*goex.Ticker)
+		if arrival == 0 {
+			arrival = (ticker.Buy + ticker.Sell) / 2
+		}
+		var depth *goex.Depth
+		if spot.usesDepth() {
+			res, err = reCtx(ctx, spot.retryDelayMs, spot.exchange.GetDepth, spot.depthSize(), spot.pair)
+			if err != nil {
+				return abort(order, err)
+			}
+			depth = res.(*goex.Depth)
+		}
 		var tradePrice = 0.0
 		if isBuy {
-			if opMode == OPMODE_TAKE {
-				tradePrice = utils.Float64Round(ticker.Sell+spot.slidePrice, spot.priceDot)
-			} else if opMode == OPMODE_MAKE {
-				tradePrice = utils.Float64Round(ticker.Buy+spot.slidePrice, spot.priceDot)
+			if taking(opMode) {
+				tradePrice = inst.RoundPrice(ticker.Sell + spot.slidePrice)
+			} else if opMode == OPMODE_MAKE || opMode == OPMODE_ICEBERG || opMode == OPMODE_POST_ONLY {
+				tradePrice = inst.RoundPrice(ticker.Buy + spot.slidePrice)
 			} else if opMode == OPMODE_MAKE_WAIT {
-				tradePrice = utils.Float64Round(ticker.Buy, spot.priceDot)
+				tradePrice = inst.RoundPrice(ticker.Buy)
 			}
 		} else {
-			if opMode == OPMODE_TAKE {
-				tradePrice = utils.Float64Round(ticker.Buy-spot.slidePrice, spot.priceDot)
-			} else if opMode == OPMODE_MAKE {
-				tradePrice = utils.Float64Round(ticker.Sell-spot.slidePrice, spot.priceDot)
+			if taking(opMode) {
+				tradePrice = inst.RoundPrice(ticker.Buy - spot.slidePrice)
+			} else if opMode == OPMODE_MAKE || opMode == OPMODE_ICEBERG || opMode == OPMODE_POST_ONLY {
+				tradePrice = inst.RoundPrice(ticker.Sell - spot.slidePrice)
 			} else if opMode == OPMODE_MAKE_WAIT {
-				tradePrice = utils.Float64Round(ticker.Sell, spot.priceDot)
+				tradePrice = inst.RoundPrice(ticker.Sell)
 			}
 		}
+		if !taking(opMode) && spot.priceMode != PRICEMODE_TICKER {
+			var bid, ask = topOfBook(depth, ticker)
+			tradePrice = queuePrice(spot.priceMode, isBuy, bid, ask, inst)
+		}
+		if opMode == OPMODE_POST_ONLY {
+			var bid, ask = topOfBook(depth, ticker)
+			tradePrice = passivePrice(isBuy, tradePrice, bid, ask, inst)
+		}
 		if opMode == OPMODE_MAKE_WAIT { //if make_wait fail, change to make
-			for wait := 0; wait < spot.waitMakeMs/int(spot.retryDelayMs.Nanoseconds()/time.Millisecond.Nanoseconds()); wait++ {
-				order, err = tradeFunc(utils.Float64RoundString(tradeAmount, spot.amountDot), utils.Float64RoundString(tradePrice, spot.priceDot), spot.pair)
-				spot.logger.Infof("[ %-4s ] %s @ %s", tradeType.String(), utils.Float64RoundString(tradeAmount, spot.amountDot), utils.Float64RoundString(tradePrice, spot.priceDot))
+			var step = spot.retryDelayMs
+			if step < time.Millisecond { //旧构造函数不校验, 不足1ms按1ms算
+				step = time.Millisecond
+			}
+			var waits = spot.waitMakeMs / int(step/time.Millisecond)
+			for wait := 0; wait < waits; wait++ {
+				if err = fills.journal.placing(tradePrice, inst.FloorAmount(tradeAmount)); err != nil {
+					return abort(nil, err)
+				}
+				order, err = tradeFunc(inst.FormatAmount(tradeAmount), inst.FormatPrice(tradePrice), spot.pair)
+				spot.logger.Infof("[ %-4s ] %s @ %s", tradeType.String(), inst.FormatAmount(tradeAmount), inst.FormatPrice(tradePrice))
 				if err != nil {
-					time.Sleep(spot.retryDelayMs)
+					order = nil
+					spot.rejected()
+					fills.journal.placeFailed(err)
+					if err = sleepCtx(ctx, spot.retryDelayMs); err != nil {
+						return abort(nil, err)
+					}
 					continue
 				}
-				for ; wait < spot.waitMakeMs/int(spot.retryDelayMs.Nanoseconds()/time.Millisecond.Nanoseconds()); wait++ {
-					order = utils.RE(spot.exchange.GetOneOrder, order.OrderID2, spot.pair).(*goex.Order)
+				fills.add(order.OrderID2, tradePrice, inst.FloorAmount(tradeAmount), limit && passive(isBuy, tradePrice, ticker) && order.DealAmount == 0)
+				for ; wait < waits; wait++ {
+					res, err = reCtx(ctx, spot.retryDelayMs, spot.exchange.GetOneOrder, order.OrderID2, spot.pair)
+					if err != nil {
+						return abort(order, err)
+					}
+					order = res.(*goex.Order)
+					fills.update(order)
 					if order.Status == goex.ORDER_FINISH {
-						return order
-					} else {
-						time.Sleep(spot.retryDelayMs)
-						continue
+						diffMoney, dealAmount = spot.total(inst, fills)
+						return finish(nil)
+					}
+					if err = sleepCtx(ctx, spot.retryDelayMs); err != nil {
+						return abort(order, err)
 					}
 				}
-				if wait >= spot.waitMakeMs/int(spot.retryDelayMs.Nanoseconds()/time.Millisecond.Nanoseconds()) && order.Status != goex.ORDER_FINISH {
-					utils.RE(spot.exchange.CancelOrder, order.OrderID2, spot.pair)
-					return spot.trade(OPMODE_MAKE, tradeType, tradeAmount-order.DealAmount) //递归
+				if wait >= waits && order.Status != goex.ORDER_FINISH {
+					fills.cancelled(order.OrderID2, "waitMake expired")
+					closed, err := spot.cancel(ctx, order.OrderID2)
+					if err != nil {
+						return abort(order, err)
+					}
+					fills.update(closed)
+					diffMoney, dealAmount = spot.total(inst, fills)
+					rest, err := spot.trade(ctx, OPMODE_MAKE, tradeType, tradeAmount-dealAmount) //递归
+					if rest != nil {
+						fills.children = append(fills.children, rest.Children...)
+						diffMoney += rest.VWAP * rest.Filled
+						dealAmount += rest.Filled
+					}
+					return finish(err)
 				}
 			}
 		}
@@ -253,77 +504,229 @@ func (spot *SpotTradeManager) trade(opMode OpMode, tradeType goex.TradeSide, tra
 		if order == nil {
 			if isFirst {
 				isFirst = false
-				firstPrice = tradePrice
 			} else {
-				nowAccount = spot.GetAccount(spot.waitFrozen)
+				acc, err := spot.GetAccountCtx(ctx, spot.waitFrozen)
+				if err != nil {
+					return abort(nil, err)
+				}
+				nowAccount = acc
+			}
+			if spot.fillMode == FILLMODE_BALANCE {
+				diffMoney, dealAmount = spot.settle(inst, isBuy, initAccount, nowAccount)
+			} else {
+				if err = spot.refresh(ctx, fills); err != nil {
+					return abort(nil, err)
+				}
+				diffMoney, dealAmount = spot.total(inst, fills)
 			}
 			var doAmount = 0.0
 			if isBuy {
-				diffMoney = utils.Float64Round(initAccount.Balance-nowAccount.Balance, 8)
-				dealAmount = utils.Float64Round(nowAccount.Stocks-initAccount.Stocks, spot.amountDot*2) // 如果保留小数过少，会引起在小交易量交易时，计算出的成交价格误差较大。
-				doAmount = math.Min(math.Min(spot.maxAmount, tradeAmount-dealAmount), utils.Float64Round((nowAccount.Balance*0.95)/tradePrice, spot.amountDot))
+				doAmount = inst.FloorAmount(math.Min(math.Min(spot.maxAmount, tradeAmount-dealAmount), (nowAccount.Balance*0.95)/tradePrice))
 			} else {
-				diffMoney = utils.Float64Round(nowAccount.Balance-initAccount.Balance, 8)
-				dealAmount = utils.Float64Round(initAccount.Stocks-nowAccount.Stocks, spot.amountDot*2)
-				doAmount = math.Min(math.Min(spot.maxAmount, tradeAmount-dealAmount), nowAccount.Stocks)
+				doAmount = inst.FloorAmount(math.Min(math.Min(spot.maxAmount, tradeAmount-dealAmount), nowAccount.Stocks))
+			}
+			var minAmount = spot.minAmount(inst, tradePrice)
+			if opMode == OPMODE_ICEBERG {
+				doAmount = math.Min(doAmount, spot.iceberg.visible(inst, minAmount))
+			}
+			var thin = false //深度在滑点预算内不够
+			if taking(opMode) && depth != nil && doAmount > 0 {
+				if book := levels(depth, isBuy); anchor == 0 && len(book) > 0 {
+					anchor = book[0].Price
+				}
+				if spot.maxSlippage > 0 && anchor > 0 {
+					var limit = anchor * (1 + spot.maxSlippage)
+					if !isBuy {
+						limit = anchor * (1 - spot.maxSlippage)
+					}
+					depth = within(depth, isBuy, limit)
+				}
+				var q = QuoteDepth(depth, isBuy, doAmount, 0)
+				if q.Fillable < doAmount {
+					doAmount = inst.FloorAmount(q.Fillable)
+					thin = true
+				}
+				if q.WorstPrice > 0 {
+					tradePrice = inst.RoundPrice(q.WorstPrice)
+					if isBuy {
+						doAmount = math.Min(doAmount, inst.FloorAmount((nowAccount.Balance*0.95)/tradePrice))
+					}
+					minAmount = spot.minAmount(inst, tradePrice)
+				}
+				spot.logger.Infof("[ %-4s ] depth: %s expected @ %s, limit %s", tradeType.String(),
+					inst.FormatAmount(q.Fillable), utils.Float64RoundString(q.AvgPrice, 8), inst.FormatPrice(tradePrice))
 			}
 			spot.logger.Infoln(tradeType.String(), "diffMoney:", diffMoney, "dealAmount:", dealAmount, "doAmount:", doAmount, "balance:", utils.Float64RoundString(nowAccount.Balance, 8))
 
-			if doAmount < spot.minStocks {
+			if doAmount < minAmount && thin && tradeAmount-dealAmount >= minAmount {
+				spot.logger.Warningf("[ %-4s ] book too thin within maxSlippage %v, waiting", tradeType.String(), spot.maxSlippage)
+				if err = sleepCtx(ctx, spot.retryDelayMs); err != nil {
+					return abort(nil, err)
+				}
+				continue
+			}
+			if doAmount < minAmount {
+				if tradeAmount-dealAmount >= minAmount {
+					shortOf = tradeAmount - dealAmount
+				}
 				break
 			}
+			if opMode == OPMODE_FOK && limit {
+				if depth == nil {
+					res, err = reCtx(ctx, spot.retryDelayMs, spot.exchange.GetDepth, spot.depthSize(), spot.pair)
+					if err != nil {
+						return abort(nil, err)
+					}
+					depth = res.(*goex.Depth)
+				}
+				if !fillable(depth, isBuy, doAmount, tradePrice) {
+					spot.logger.Warningf("[ %-4s ] fok: book cannot fill %s @ %s, waiting", tradeType.String(), inst.FormatAmount(doAmount), inst.FormatPrice(tradePrice))
+					if err = sleepCtx(ctx, spot.retryDelayMs); err != nil {
+						return abort(nil, err)
+					}
+					continue
+				}
+			}
+			order, tradePrice, err = spot.place(ctx, fills.journal, opMode, tradeType, tradeFunc, inst, doAmount, tradePrice)
+			if jerr := fills.journal.failed(); err != nil && jerr != nil {
+				return abort(nil, jerr)
+			}
 			prePrice = tradePrice
-			order, err = tradeFunc(utils.Float64RoundString(doAmount, spot.amountDot), utils.Float64RoundString(tradePrice, spot.priceDot), spot.pair)
 			spot.logger.Infof("[ %-4s ] %s @ %s, balance:%s", tradeType.String(),
-				utils.Float64RoundString(tradeAmount, spot.amountDot),
-				utils.Float64RoundString(tradePrice, spot.priceDot),
+				inst.FormatAmount(tradeAmount),
+				inst.FormatPrice(tradePrice),
 				utils.Float64RoundString(nowAccount.Balance, 8),
 			)
 
 			if err != nil {
-				spot.CancelPendingOrders(tradeType)
+				order = nil
+				spot.rejected()
+				if spot.fillMode == FILLMODE_BALANCE {
+					if err = spot.CancelPendingOrdersCtx(ctx, tradeType); err != nil {
+						return abort(nil, err)
+					}
+				}
+			} else {
+				fills.add(order.OrderID2, tradePrice, doAmount, limit && passive(isBuy, tradePrice, ticker) && order.DealAmount == 0)
+				fills.update(order)
+				if immediate(opMode) {
+					if !orderClosed(order) {
+						fills.cancelled(order.OrderID2, opMode.String()+": unfilled remainder")
+					}
+					closed, err := spot.expire(ctx, order)
+					if err != nil {
+						return abort(order, err)
+					}
+					fills.update(closed)
+					order = nil
+				}
 			}
 		} else {
 			if opMode == OPMODE_TAKE || (math.Abs(tradePrice-prePrice) > spot.maxSpace) {
+				if opMode == OPMODE_TAKE {
+					fills.cancelled(order.OrderID2, "take: unfilled remainder")
+				} else {
+					fills.cancelled(order.OrderID2, "price moved beyond maxSpace")
+				}
+				if spot.fillMode == FILLMODE_BALANCE {
+					if err = spot.CancelAllPendingOrdersCtx(ctx); err != nil {
+						return abort(order, err)
+					}
+				} else {
+					closed, err := spot.cancel(ctx, order.OrderID2)
+					if err != nil {
+						return abort(order, err)
+					}
+					fills.update(closed)
+				}
 				order = nil
-				spot.CancelAllPendingOrders()
 				if math.Abs(tradePrice-prePrice) > spot.maxSpace {
-					spot.logger.Warningf("step over max space, tradePrice:%s, prePrice:%s, spot.maxSpace:%f", utils.Float64RoundString(tradePrice, spot.priceDot), utils.Float64RoundString(prePrice, spot.priceDot), spot.maxSpace)
+					spot.logger.Warningf("step over max space, tradePrice:%s, prePrice:%s, spot.maxSpace:%f", inst.FormatPrice(tradePrice), inst.FormatPrice(prePrice), spot.maxSpace)
+				}
+			} else if spot.fillMode == FILLMODE_BALANCE {
+				ord, err := spot.StripOrdersCtx(ctx, order.OrderID2)
+				if err != nil {
+					return abort(order, err)
 				}
-			} else {
-				var ord = spot.StripOrders(order.OrderID2)
 				if ord == nil {
 					order = nil
+					if err = replenish(); err != nil {
+						return abort(nil, err)
+					}
+				}
+			} else {
+				ord, err := spot.lookup(ctx, order.OrderID2)
+				if err != nil {
+					return abort(order, err)
+				}
+				fills.update(ord)
+				if orderClosed(ord) {
+					order = nil
+					if err = replenish(); err != nil {
+						return abort(nil, err)
+					}
 				}
 			}
 		}
-		time.Sleep(spot.retryDelayMs)
+		if err = sleepCtx(ctx, spot.retryDelayMs); err != nil {
+			return abort(order, err)
+		}
 	}
-	if dealAmount <= 0 {
-		return nil
+	if shortOf > 0 {
+		return report(), fmt.Errorf("%w: %s %s short of %s", ErrInsufficientBalance, tradeType.String(),
+			utils.Float64RoundString(shortOf, spot.fillDot(inst)), utils.Float64RoundString(tradeAmount, spot.fillDot(inst)))
 	}
-	return &goex.Order{
-		Side:       tradeType,
-		Currency:   spot.pair,
-		Price:      firstPrice,
-		Amount:     tradeAmount,
-		AvgPrice:   utils.Float64Round(diffMoney/dealAmount, spot.priceDot),
-		DealAmount: utils.Float64Round(dealAmount, spot.amountDot),
+	return finish(nil)
+}
+
+// report builds the ExecutionReport of a trade. In FILLMODE_BALANCE the
+// balance differences already carry the fees, so no FeeModel is applied and
+// NetVWAP stays equal to VWAP.
+func (spot *SpotTradeManager) report(inst *Instrument, tradeType goex.TradeSide, tradeAmount, arrival float64, started time.Time, fills *orderFills, diffMoney, dealAmount float64) *ExecutionReport {
+	var rep = &ExecutionReport{
+		Pair:         spot.pair,
+		Side:         tradeType,
+		Requested:    tradeAmount,
+		ArrivalPrice: arrival,
+		StartedAt:    started,
+		Children:     fills.children,
+	}
+	if spot.fees != nil && spot.fillMode == FILLMODE_ORDER {
+		chargeSpot(rep, spot.fees.Schedule(spot.exchange.GetExchangeName(), spot.pair))
 	}
+	rep.finish(diffMoney, dealAmount, 1)
+	rep.Filled = utils.Float64Round(dealAmount, spot.fillDot(inst))
+	fills.journal.done(rep, "")
+	return rep
+}
+
+func (spot *SpotTradeManager) Buy(amount float64) (*ExecutionReport, error) {
+	return spot.BuyCtx(context.Background(), amount)
 }
 
-func (spot *SpotTradeManager) Buy(amount float64) *goex.Order {
-	if amount < spot.minStocks {
-		spot.logger.Errorf("amount < minStocks : %s < %s", utils.Float64RoundString(amount, spot.amountDot), utils.Float64RoundString(spot.minStocks, spot.amountDot))
-		return nil
+// BuyCtx is Buy bounded by ctx. When ctx is cancelled or its deadline passes
+// the resting order is cancelled and whatever was filled so far is returned
+// together with ctx.Err().
+func (spot *SpotTradeManager) BuyCtx(ctx context.Context, amount float64) (*ExecutionReport, error) {
+	if min := spot.minAmount(spot.instrument(), 0); amount < min {
+		return nil, spot.belowMinStocks(amount, min)
 	}
-	return spot.trade(spot.opMode, goex.BUY, amount)
+	return spot.trade(ctx, spot.opMode, goex.BUY, amount)
 }
 
-func (spot *SpotTradeManager) Sell(amount float64) *goex.Order {
-	if amount < spot.minStocks {
-		spot.logger.Errorf("amount < minStocks : %s < %s", utils.Float64RoundString(amount, spot.amountDot), utils.Float64RoundString(spot.minStocks, spot.amountDot))
-		return nil
+func (spot *SpotTradeManager) Sell(amount float64) (*ExecutionReport, error) {
+	return spot.SellCtx(context.Background(), amount)
+}
+
+// SellCtx is Sell bounded by ctx, see BuyCtx.
+func (spot *SpotTradeManager) SellCtx(ctx context.Context, amount float64) (*ExecutionReport, error) {
+	if min := spot.minAmount(spot.instrument(), 0); amount < min {
+		return nil, spot.belowMinStocks(amount, min)
 	}
-	return spot.trade(spot.opMode, goex.SELL, amount)
+	return spot.trade(ctx, spot.opMode, goex.SELL, amount)
+}
+
+func (spot *SpotTradeManager) belowMinStocks(amount, min float64) error {
+	spot.logger.Errorf("amount < minStocks : %v < %v", amount, min)
+	return fmt.Errorf("%w: %v < %v", ErrBelowMinStocks, amount, min)
 }
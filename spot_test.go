@@ -1,7 +1,203 @@
 package trade
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"github.com/goex-top/goex_trade/mockex"
+	"github.com/nntaoli-project/GoEx"
+	"testing"
+	"time"
+)
+
+var spotPair = goex.BTC_USDT
+
+func newMockSpot(opMode OpMode) (*mockex.Exchange, *SpotTradeManager) {
+	var ex = mockex.New("mock")
+	ex.SetBalance(goex.USDT, 10000)
+	ex.SetBalance(goex.BTC, 10)
+	ex.Market(spotPair).SetTicker(99, 101)
+	var mgr = NewSportManager(ex.Spot(), spotPair, opMode, 5, 0.5, 2, 0.01, 1, 10, nil, 2, 4, false)
+	return ex, mgr
+}
 
 func TestNewSportManager(t *testing.T) {
+	_, mgr := newMockSpot(OPMODE_TAKE)
+	if mgr.opMode != OPMODE_TAKE || mgr.retryDelayMs != time.Millisecond {
+		t.Fatalf("unexpected manager %+v", mgr)
+	}
+}
+
+func TestSpotTradeManager_MakeWaitZeroRetryDelay(t *testing.T) {
+	var ex = mockex.New("mock")
+	ex.SetBalance(goex.USDT, 10000)
+	ex.Market(spotPair).SetTicker(99, 101)
+	var mgr = NewSportManager(ex.Spot(), spotPair, OPMODE_MAKE_WAIT, 5, 0.5, 2, 0.01, 0, 1, nil, 2, 4, false)
+	go func() {
+		for {
+			if ids := ex.OpenOrders(); len(ids) > 0 {
+				ex.Fill(ids[0], 1, 99.5)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	if rep, err := mgr.Buy(1); err != nil || rep.Filled != 1 {
+		t.Fatalf("unexpected result %+v, %v", rep, err)
+	}
+}
+
+func TestSpotTradeManager_Buy(t *testing.T) {
+	ex, mgr := newMockSpot(OPMODE_TAKE)
+	rep, err := mgr.Buy(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Filled != 3 || rep.VWAP != 101 {
+		t.Fatalf("unexpected fill %+v", rep)
+	}
+	if btc, _ := ex.Balance(goex.BTC); btc != 13 {
+		t.Fatalf("want 13 BTC, got %f", btc)
+	}
+}
+
+func TestSpotTradeManager_SellPartialFills(t *testing.T) {
+	ex, mgr := newMockSpot(OPMODE_TAKE)
+	ex.SetFillRatio(0.5)
+	rep, err := mgr.Sell(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Filled < 0.99 || rep.VWAP != 99 {
+		t.Fatalf("unexpected fill %+v", rep)
+	}
+	if len(ex.OpenOrders()) != 0 {
+		t.Fatalf("orders left open: %v", ex.OpenOrders())
+	}
+}
+
+func TestSpotTradeManager_BuyRejectedThenFilled(t *testing.T) {
+	ex, mgr := newMockSpot(OPMODE_TAKE)
+	ex.Reject(2)
+	rep, err := mgr.Buy(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Filled != 1 {
+		t.Fatalf("unexpected fill %+v", rep)
+	}
+}
+
+func TestSpotTradeManager_BuyBelowMinStocks(t *testing.T) {
+	_, mgr := newMockSpot(OPMODE_TAKE)
+	if _, err := mgr.Buy(0.001); !errors.Is(err, ErrBelowMinStocks) {
+		t.Fatalf("want ErrBelowMinStocks, got %v", err)
+	}
+}
+
+func TestSpotTradeManager_BuyInsufficientBalance(t *testing.T) {
+	ex, mgr := newMockSpot(OPMODE_TAKE)
+	ex.SetBalance(goex.USDT, 1)
+	rep, err := mgr.Buy(1)
+	if !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("want ErrInsufficientBalance, got %v", err)
+	}
+	if rep.Filled != 0 {
+		t.Fatalf("unexpected fill %+v", rep)
+	}
+}
+
+func TestSpotTradeManager_BuyCtxCancelsRestingOrder(t *testing.T) {
+	ex, mgr := newMockSpot(OPMODE_MAKE)
+	mgr.slidePrice = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	rep, err := mgr.BuyCtx(ctx, 1)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("want DeadlineExceeded, got %v", err)
+	}
+	if rep.Filled != 0 {
+		t.Fatalf("unexpected fill %+v", rep)
+	}
+	if len(ex.OpenOrders()) != 0 {
+		t.Fatalf("orders left open: %v", ex.OpenOrders())
+	}
+}
+
+func TestSpotTradeManager_CancelPendingOrders(t *testing.T) {
+	ex, mgr := newMockSpot(OPMODE_TAKE)
+	sell, err := ex.Spot().LimitSell("1", "105", spotPair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ex.Spot().LimitBuy("1", "95", spotPair); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = mgr.CancelPendingOrdersCtx(ctx, goex.BUY); err != nil {
+		t.Fatal(err)
+	}
+	if open := ex.OpenOrders(); len(open) != 1 || open[0] != sell.OrderID2 {
+		t.Fatalf("want only the sell order left, got %v", open)
+	}
+}
+
+// sharedSpot is an account another program also trades on: every limit
+// buy placed through it is followed by someone else's deposit of 5 BTC.
+type sharedSpot struct {
+	*mockex.Spot
+	ex *mockex.Exchange
+}
+
+func (s sharedSpot) LimitBuy(amount, price string, currency goex.CurrencyPair) (*goex.Order, error) {
+	order, err := s.Spot.LimitBuy(amount, price, currency)
+	btc, _ := s.ex.Balance(goex.BTC)
+	s.ex.SetBalance(goex.BTC, btc+5)
+	return order, err
+}
+
+func TestSpotTradeManager_FillModes(t *testing.T) {
+	for _, c := range []struct {
+		mode FillMode
+		deal float64
+	}{
+		{FILLMODE_ORDER, 3},
+		{FILLMODE_BALANCE, 7}, // 2 bought, then 5 deposited look like a fill
+	} {
+		ex, mgr := newMockSpot(OPMODE_TAKE)
+		mgr.exchange = sharedSpot{Spot: ex.Spot(), ex: ex}
+		mgr.fillMode = c.mode
+		rep, err := mgr.Buy(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Filled != c.deal {
+			t.Fatalf("%v: want %v filled, got %+v", c.mode, c.deal, rep)
+		}
+	}
+}
 
+func TestSpotTradeManager_MakeWaitFallsBackToMake(t *testing.T) {
+	ex, mgr := newMockSpot(OPMODE_MAKE_WAIT)
+	mgr.slidePrice = 2
+	mgr.waitMakeMs = 200
+	go func() {
+		for {
+			if ids := ex.OpenOrders(); len(ids) > 0 {
+				ex.Fill(ids[0], 0.4, 99)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	rep, err := mgr.Buy(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Filled != 1 || rep.VWAP != 100.2 {
+		t.Fatalf("want the waited and follow-up fills merged, got %+v", rep)
+	}
+	if len(ex.OpenOrders()) != 0 {
+		t.Fatalf("orders left open: %v", ex.OpenOrders())
+	}
 }
@@ -0,0 +1,197 @@
+// Package tradetest provides test doubles for the trade manager interfaces.
+package tradetest
+
+import (
+	"context"
+	"github.com/goex-top/goex_trade"
+	"sync"
+)
+
+// Call is one recorded method call.
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// FutureTradeManager is a trade.FutureTradeManagerAPI whose methods call the
+// matching ...Func field, or return zero values when it is nil. Every call
+// is recorded under the method's own name. A ...Ctx method calls its
+// ...CtxFunc field with ctx, or falls back to the field of the method
+// without ctx when that is nil.
+type FutureTradeManager struct {
+	OpenLongFunc    func(price, opAmount float64) (*trade.SummaryPosition, error)
+	OpenShortFunc   func(price, opAmount float64) (*trade.SummaryPosition, error)
+	CloseLongFunc   func(price, opAmount float64) (*trade.ExecutionReport, error)
+	CloseShortFunc  func(price, opAmount float64) (*trade.ExecutionReport, error)
+	GetAccountFunc  func() (*trade.Account, error)
+	GetPositionFunc func(direction int) (*trade.Position, error)
+	ProfitFunc      func(price, opAmount float64) (float64, error)
+	CancelAllFunc   func() error
+
+	OpenLongCtxFunc    func(ctx context.Context, price, opAmount float64) (*trade.SummaryPosition, error)
+	OpenShortCtxFunc   func(ctx context.Context, price, opAmount float64) (*trade.SummaryPosition, error)
+	CloseLongCtxFunc   func(ctx context.Context, price, opAmount float64) (*trade.ExecutionReport, error)
+	CloseShortCtxFunc  func(ctx context.Context, price, opAmount float64) (*trade.ExecutionReport, error)
+	GetAccountCtxFunc  func(ctx context.Context) (*trade.Account, error)
+	GetPositionCtxFunc func(ctx context.Context, direction int) (*trade.Position, error)
+	CancelAllCtxFunc   func(ctx context.Context) error
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+var _ trade.FutureTradeManagerAPI = (*FutureTradeManager)(nil)
+
+func (m *FutureTradeManager) record(method string, args ...interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, Call{Method: method, Args: args})
+}
+
+// Calls returns the calls made so far, oldest first.
+func (m *FutureTradeManager) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+func (m *FutureTradeManager) OpenLong(price, opAmount float64) (*trade.SummaryPosition, error) {
+	m.record("OpenLong", price, opAmount)
+	if m.OpenLongFunc == nil {
+		return nil, nil
+	}
+	return m.OpenLongFunc(price, opAmount)
+}
+
+func (m *FutureTradeManager) OpenLongCtx(ctx context.Context, price, opAmount float64) (*trade.SummaryPosition, error) {
+	m.record("OpenLongCtx", price, opAmount)
+	switch {
+	case m.OpenLongCtxFunc != nil:
+		return m.OpenLongCtxFunc(ctx, price, opAmount)
+	case m.OpenLongFunc != nil:
+		return m.OpenLongFunc(price, opAmount)
+	}
+	return nil, nil
+}
+
+func (m *FutureTradeManager) OpenShort(price, opAmount float64) (*trade.SummaryPosition, error) {
+	m.record("OpenShort", price, opAmount)
+	if m.OpenShortFunc == nil {
+		return nil, nil
+	}
+	return m.OpenShortFunc(price, opAmount)
+}
+
+func (m *FutureTradeManager) OpenShortCtx(ctx context.Context, price, opAmount float64) (*trade.SummaryPosition, error) {
+	m.record("OpenShortCtx", price, opAmount)
+	switch {
+	case m.OpenShortCtxFunc != nil:
+		return m.OpenShortCtxFunc(ctx, price, opAmount)
+	case m.OpenShortFunc != nil:
+		return m.OpenShortFunc(price, opAmount)
+	}
+	return nil, nil
+}
+
+func (m *FutureTradeManager) CloseLong(price, opAmount float64) (*trade.ExecutionReport, error) {
+	m.record("CloseLong", price, opAmount)
+	if m.CloseLongFunc == nil {
+		return nil, nil
+	}
+	return m.CloseLongFunc(price, opAmount)
+}
+
+func (m *FutureTradeManager) CloseLongCtx(ctx context.Context, price, opAmount float64) (*trade.ExecutionReport, error) {
+	m.record("CloseLongCtx", price, opAmount)
+	switch {
+	case m.CloseLongCtxFunc != nil:
+		return m.CloseLongCtxFunc(ctx, price, opAmount)
+	case m.CloseLongFunc != nil:
+		return m.CloseLongFunc(price, opAmount)
+	}
+	return nil, nil
+}
+
+func (m *FutureTradeManager) CloseShort(price, opAmount float64) (*trade.ExecutionReport, error) {
+	m.record("CloseShort", price, opAmount)
+	if m.CloseShortFunc == nil {
+		return nil, nil
+	}
+	return m.CloseShortFunc(price, opAmount)
+}
+
+func (m *FutureTradeManager) CloseShortCtx(ctx context.Context, price, opAmount float64) (*trade.ExecutionReport, error) {
+	m.record("CloseShortCtx", price, opAmount)
+	switch {
+	case m.CloseShortCtxFunc != nil:
+		return m.CloseShortCtxFunc(ctx, price, opAmount)
+	case m.CloseShortFunc != nil:
+		return m.CloseShortFunc(price, opAmount)
+	}
+	return nil, nil
+}
+
+func (m *FutureTradeManager) GetAccount() (*trade.Account, error) {
+	m.record("GetAccount")
+	if m.GetAccountFunc == nil {
+		return nil, nil
+	}
+	return m.GetAccountFunc()
+}
+
+func (m *FutureTradeManager) GetAccountCtx(ctx context.Context) (*trade.Account, error) {
+	m.record("GetAccountCtx")
+	switch {
+	case m.GetAccountCtxFunc != nil:
+		return m.GetAccountCtxFunc(ctx)
+	case m.GetAccountFunc != nil:
+		return m.GetAccountFunc()
+	}
+	return nil, nil
+}
+
+func (m *FutureTradeManager) GetPosition(direction int) (*trade.Position, error) {
+	m.record("GetPosition", direction)
+	if m.GetPositionFunc == nil {
+		return nil, nil
+	}
+	return m.GetPositionFunc(direction)
+}
+
+func (m *FutureTradeManager) GetPositionCtx(ctx context.Context, direction int) (*trade.Position, error) {
+	m.record("GetPositionCtx", direction)
+	switch {
+	case m.GetPositionCtxFunc != nil:
+		return m.GetPositionCtxFunc(ctx, direction)
+	case m.GetPositionFunc != nil:
+		return m.GetPositionFunc(direction)
+	}
+	return nil, nil
+}
+
+func (m *FutureTradeManager) Profit(price, opAmount float64) (float64, error) {
+	m.record("Profit", price, opAmount)
+	if m.ProfitFunc == nil {
+		return 0, nil
+	}
+	return m.ProfitFunc(price, opAmount)
+}
+
+func (m *FutureTradeManager) CancelAll() error {
+	m.record("CancelAll")
+	if m.CancelAllFunc == nil {
+		return nil
+	}
+	return m.CancelAllFunc()
+}
+
+func (m *FutureTradeManager) CancelAllCtx(ctx context.Context) error {
+	m.record("CancelAllCtx")
+	switch {
+	case m.CancelAllCtxFunc != nil:
+		return m.CancelAllCtxFunc(ctx)
+	case m.CancelAllFunc != nil:
+		return m.CancelAllFunc()
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package tradetest
+
+import (
+	"context"
+	"github.com/goex-top/goex_trade"
+	"github.com/nntaoli-project/GoEx"
+	"testing"
+)
+
+type ctxKey struct{}
+
+func TestFutureTradeManager(t *testing.T) {
+	var short = 2.0
+	var ctx = context.WithValue(context.Background(), ctxKey{}, "target")
+	var mgr = &FutureTradeManager{
+		GetPositionFunc: func(direction int) (*trade.Position, error) {
+			if direction == goex.OPEN_SELL && short > 0 {
+				return &trade.Position{Amount: short, Type: goex.OPEN_SELL}, nil
+			}
+			return nil, nil
+		},
+		CloseShortCtxFunc: func(c context.Context, price, opAmount float64) (*trade.ExecutionReport, error) {
+			if c.Value(ctxKey{}) != "target" {
+				t.Error("ctx not passed through")
+			}
+			short -= opAmount
+			return &trade.ExecutionReport{Filled: opAmount}, nil
+		},
+	}
+	// a long target on a short book closes the short before opening
+	if err := trade.NewFuturePositioner(mgr).Target(ctx, 3, 100); err != nil {
+		t.Fatal(err)
+	}
+	var methods []string
+	for _, c := range mgr.Calls() {
+		if c.Method != "GetPositionCtx" {
+			methods = append(methods, c.Method)
+		}
+	}
+	if len(methods) != 2 || methods[0] != "CloseShortCtx" || methods[1] != "OpenLongCtx" {
+		t.Fatalf("unexpected calls %v", methods)
+	}
+	if args := mgr.Calls()[len(mgr.Calls())-1].Args; args[1].(float64) != 3 {
+		t.Fatalf("unexpected OpenLongCtx args %v", args)
+	}
+}
@@ -0,0 +1,154 @@
+package trade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/beaquant/utils"
+	"github.com/nntaoli-project/GoEx"
+	"github.com/sirupsen/logrus"
+	"math"
+	"time"
+)
+
+type TWAPConfig struct {
+	Duration   time.Duration        //执行总时长
+	Slices     int                  //切片数
+	MaxCatchUp float64              //单个切片最多为均分量的几倍(补足之前切片的欠量), 0为不限, 1为不补; 最后一个切片不受限
+	OnProgress func(p TWAPProgress) //每个切片结束后回调, 可为空
+}
+
+// TWAPProgress is handed to TWAPConfig.OnProgress after every slice.
+type TWAPProgress struct {
+	Slice     int              //刚结束的切片, 从1开始
+	Slices    int              //切片数
+	Requested float64          //父单总量
+	Target    float64          //截至本切片应成交量
+	Filled    float64          //累计成交量
+	Report    *ExecutionReport //本切片的执行报告, 切片被跳过时为空
+}
+
+func (cfg *TWAPConfig) Validate() error {
+	switch {
+	case cfg.Duration <= 0:
+		return fmt.Errorf("%w: twap duration %v must be positive", ErrInvalidConfig, cfg.Duration)
+	case cfg.Slices < 1:
+		return fmt.Errorf("%w: twap slices %d must be positive", ErrInvalidConfig, cfg.Slices)
+	case cfg.MaxCatchUp != 0 && cfg.MaxCatchUp < 1:
+		return fmt.Errorf("%w: twap maxCatchUp %v below 1", ErrInvalidConfig, cfg.MaxCatchUp)
+	}
+	return nil
+}
+
+// TWAP works a parent Buy or Sell as equal time slices spread over
+// Duration. Every slice is an ordinary BuyCtx/SellCtx on the manager, so it
+// is priced by the manager's OpMode, and is given until the next slice
+// starts; what it leaves unfilled is added to the following slices. The last
+// slice asks for all that is left, whatever MaxCatchUp says, and runs until
+// it is done or ctx ends.
+type TWAP struct {
+	manager SpotTradeManagerAPI
+	cfg     TWAPConfig
+	logger  *logrus.Logger
+}
+
+func NewTWAP(manager SpotTradeManagerAPI, cfg TWAPConfig, logger *logrus.Logger) (*TWAP, error) {
+	if manager == nil {
+		return nil, fmt.Errorf("%w: nil manager", ErrInvalidConfig)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = logrus.New()
+	}
+	return &TWAP{manager: manager, cfg: cfg, logger: logger}, nil
+}
+
+// Run buys (goex.BUY) or sells (goex.SELL) amount and returns the report of
+// all slices together. When a slice fails for any reason other than its own
+// time running out or being below the minimum, Run stops and returns the
+// report so far with the error.
+func (twap *TWAP) Run(ctx context.Context, side goex.TradeSide, amount float64) (*ExecutionReport, error) {
+	var trade, err = sliceFunc(twap.manager, side)
+	if err != nil {
+		return nil, err
+	}
+	var started = time.Now()
+	var interval = twap.cfg.Duration / time.Duration(twap.cfg.Slices)
+	var even = amount / float64(twap.cfg.Slices)
+	var reps = make([]*ExecutionReport, 0, twap.cfg.Slices)
+	var filled = 0.0
+	var runErr error
+	for i := 0; i < twap.cfg.Slices; i++ {
+		var start = started.Add(interval * time.Duration(i))
+		if err := sleepCtx(ctx, time.Until(start)); err != nil {
+			runErr = err
+			break
+		}
+		var target = amount
+		if i < twap.cfg.Slices-1 {
+			target = even * float64(i+1)
+		}
+		var want = target - filled
+		if twap.cfg.MaxCatchUp > 0 && i < twap.cfg.Slices-1 {
+			want = math.Min(want, even*twap.cfg.MaxCatchUp)
+		}
+		var rep *ExecutionReport
+		var err error
+		if want > 0 {
+			var sliceCtx, cancel = ctx, context.CancelFunc(func() {})
+			if i < twap.cfg.Slices-1 {
+				sliceCtx, cancel = context.WithDeadline(ctx, start.Add(interval))
+			}
+			rep, err = trade(sliceCtx, want)
+			cancel()
+		}
+		if rep != nil {
+			reps = append(reps, rep)
+			filled += rep.Filled
+		}
+		twap.logger.Infof("[TWAP %-4s] slice %d/%d, target:%s, filled:%s", side.String(), i+1, twap.cfg.Slices,
+			utils.Float64RoundString(target, 8), utils.Float64RoundString(filled, 8))
+		if twap.cfg.OnProgress != nil {
+			twap.cfg.OnProgress(TWAPProgress{
+				Slice:     i + 1,
+				Slices:    twap.cfg.Slices,
+				Requested: amount,
+				Target:    target,
+				Filled:    filled,
+				Report:    rep,
+			})
+		}
+		if err != nil && !sliceFatal(ctx, err) {
+			continue
+		}
+		if err != nil {
+			runErr = err
+			break
+		}
+	}
+	return mergeReports(side, amount, started, 1, reps), runErr
+}
+
+// sliceFunc picks the BuyCtx or SellCtx the executors work side with.
+func sliceFunc(manager SpotTradeManagerAPI, side goex.TradeSide) (func(ctx context.Context, amount float64) (*ExecutionReport, error), error) {
+	switch side {
+	case goex.BUY:
+		return manager.BuyCtx, nil
+	case goex.SELL:
+		return manager.SellCtx, nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownSide, side)
+	}
+}
+
+// sliceFatal tells whether err from a child order should stop an executor:
+// a child cut short by its own deadline or too small to place is not, as
+// long as the parent ctx is still live.
+func sliceFatal(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	return !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) && !errors.Is(err, ErrBelowMinStocks)
+}
@@ -0,0 +1,89 @@
+package trade
+
+import (
+	"context"
+	"errors"
+	"github.com/nntaoli-project/GoEx"
+	"math"
+	"testing"
+	"time"
+)
+
+// cappedSpot fills at most fill of every request at 100 and records what it
+// was asked for.
+type cappedSpot struct {
+	SpotTradeManagerAPI
+	fill  float64
+	asked []float64
+}
+
+func (s *cappedSpot) BuyCtx(ctx context.Context, amount float64) (*ExecutionReport, error) {
+	s.asked = append(s.asked, amount)
+	var filled = math.Min(amount, s.fill)
+	var rep = &ExecutionReport{Pair: spotPair, Side: goex.BUY, Requested: amount, ArrivalPrice: 100, Children: []*ChildOrder{
+		{Price: 100, Amount: amount, Filled: filled, Status: goex.ORDER_CANCEL},
+	}}
+	rep.finish(filled*100, filled, 1)
+	return rep, nil
+}
+
+func TestTWAP_Slices(t *testing.T) {
+	_, mgr := newMockSpot(OPMODE_TAKE)
+	var progress []TWAPProgress
+	twap, err := NewTWAP(mgr, TWAPConfig{
+		Duration:   30 * time.Millisecond,
+		Slices:     3,
+		OnProgress: func(p TWAPProgress) { progress = append(progress, p) },
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := twap.Run(context.Background(), goex.BUY, 1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Filled != 1.5 || rep.VWAP != 101 || len(rep.Children) != 3 || rep.Elapsed < 20*time.Millisecond {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+	if len(progress) != 3 || progress[0].Target != 0.5 || progress[1].Filled != 1 || progress[2].Report.Filled != 0.5 {
+		t.Fatalf("unexpected progress %+v", progress)
+	}
+}
+
+func TestTWAP_CatchUp(t *testing.T) {
+	for _, tc := range []struct {
+		maxCatchUp float64
+		asked      []float64
+	}{
+		{0, []float64{0.5, 0.6, 0.7}},
+		{1.1, []float64{0.5, 0.55, 0.7}},
+	} {
+		var spot = &cappedSpot{fill: 0.4}
+		twap, err := NewTWAP(spot, TWAPConfig{Duration: 3 * time.Millisecond, Slices: 3, MaxCatchUp: tc.maxCatchUp}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep, err := twap.Run(context.Background(), goex.BUY, 1.5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Filled != 1.2 || rep.VWAP != 100 || rep.Requested != 1.5 {
+			t.Fatalf("unexpected report %+v", rep)
+		}
+		for i := range tc.asked {
+			if math.Abs(spot.asked[i]-tc.asked[i]) > 1e-9 {
+				t.Fatalf("maxCatchUp %v: want slices %v, got %v", tc.maxCatchUp, tc.asked, spot.asked)
+			}
+		}
+	}
+}
+
+func TestTWAP_Invalid(t *testing.T) {
+	if _, err := NewTWAP(&cappedSpot{}, TWAPConfig{Duration: time.Second, Slices: 0}, nil); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("want ErrInvalidConfig, got %v", err)
+	}
+	twap, _ := NewTWAP(&cappedSpot{}, TWAPConfig{Duration: time.Second, Slices: 1}, nil)
+	if _, err := twap.Run(context.Background(), goex.BUY_MARKET, 1); !errors.Is(err, ErrUnknownSide) {
+		t.Fatalf("want ErrUnknownSide, got %v", err)
+	}
+}
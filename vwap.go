@@ -0,0 +1,369 @@
+package trade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/beaquant/utils"
+	"github.com/nntaoli-project/GoEx"
+	"github.com/sirupsen/logrus"
+	"math"
+	"sync"
+	"time"
+)
+
+// VolumeSource reports the market volume of a pair traded since a moment,
+// in base currency and including the executor's own fills. Implementations
+// may keep state between calls.
+type VolumeSource interface {
+	Volume(since time.Time) (float64, error)
+}
+
+// VolumeFunc adapts a function to VolumeSource.
+type VolumeFunc func(since time.Time) (float64, error)
+
+func (fn VolumeFunc) Volume(since time.Time) (float64, error) {
+	return fn(since)
+}
+
+type tradeVolume struct {
+	exchange goex.API
+	pair     goex.CurrencyPair
+	lastTid  int64
+	total    float64
+}
+
+// TradeVolume counts the public trades returned by GetTrades. It remembers
+// the last trade id seen, so it must not be shared by executors.
+func TradeVolume(exchange goex.API, pair goex.CurrencyPair) VolumeSource {
+	return &tradeVolume{exchange: exchange, pair: pair}
+}
+
+func (tv *tradeVolume) Volume(since time.Time) (float64, error) {
+	trades, err := tv.exchange.GetTrades(tv.pair, tv.lastTid)
+	if err != nil {
+		return tv.total, err
+	}
+	var sinceMs = since.UnixNano() / int64(time.Millisecond)
+	for _, t := range trades {
+		if t.Tid <= tv.lastTid {
+			continue
+		}
+		tv.lastTid = t.Tid
+		if t.Date >= sinceMs {
+			tv.total += t.Amount
+		}
+	}
+	return tv.total, nil
+}
+
+// KlineVolume adds up the volume of the bars of period (goex.KLINE_PERIOD_1MIN
+// ...) that opened at or after since. It suits exchanges without a usable
+// trades endpoint; volume is only seen once bars are published.
+func KlineVolume(exchange goex.API, pair goex.CurrencyPair, period int) VolumeSource {
+	return VolumeFunc(func(since time.Time) (float64, error) {
+		klines, err := exchange.GetKlineRecords(pair, period, 1000, int(since.Unix()))
+		if err != nil {
+			return 0, err
+		}
+		var total = 0.0
+		for _, k := range klines {
+			if k.Timestamp >= since.Unix() {
+				total += k.Vol
+			}
+		}
+		return total, nil
+	})
+}
+
+// ProfileFromKlines turns historical bars into an intraday volume profile for
+// a run of duration starting at the time of day of start: bucket i weighs the
+// volume the bars put between start+i*duration/buckets and the next bucket,
+// on whatever day they were recorded. Bar timestamps are in seconds.
+func ProfileFromKlines(klines []goex.Kline, start time.Time, duration time.Duration, buckets int) []float64 {
+	var profile = make([]float64, buckets)
+	if buckets <= 0 || duration <= 0 {
+		return profile
+	}
+	const day = 24 * time.Hour
+	var offset = time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute + time.Duration(start.Second())*time.Second
+	for _, k := range klines {
+		var t = time.Unix(k.Timestamp, 0).In(start.Location())
+		var tod = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+		var rel = (tod - offset + day) % day
+		if rel >= duration {
+			continue
+		}
+		profile[int(rel*time.Duration(buckets)/duration)] += k.Vol
+	}
+	return profile
+}
+
+type VWAPConfig struct {
+	Volume           VolumeSource         //市场成交量来源
+	Participation    float64              //目标参与率(占含本单在内总成交量的比例), 按成交量分布执行时不用
+	MaxParticipation float64              //参与率上限, 限制单个子单不超过上一间隔成交量的该比例; 0为不限
+	Profile          []float64            //历史日内成交量分布, 非空时按分布在Duration内执行
+	Duration         time.Duration        //按分布执行的总时长; 参与率模式下为最长执行时间, 0为不限
+	Interval         time.Duration        //统计成交量和下子单的间隔
+	OnProgress       func(p VWAPProgress) //每个间隔结束后回调, 可为空
+}
+
+// VWAPProgress is handed to VWAPConfig.OnProgress after every interval.
+type VWAPProgress struct {
+	Requested float64          //父单总量
+	Target    float64          //截至当前应成交量
+	Filled    float64          //累计成交量
+	Market    float64          //开始以来其他人的成交量
+	Report    *ExecutionReport //本间隔子单的执行报告, 未下单时为空
+}
+
+func (cfg *VWAPConfig) Validate() error {
+	switch {
+	case cfg.Interval <= 0:
+		return fmt.Errorf("%w: vwap interval %v must be positive", ErrInvalidConfig, cfg.Interval)
+	case cfg.MaxParticipation < 0 || cfg.MaxParticipation >= 1:
+		return fmt.Errorf("%w: vwap maxParticipation %v outside [0, 1)", ErrInvalidConfig, cfg.MaxParticipation)
+	case cfg.Duration < 0:
+		return fmt.Errorf("%w: negative vwap duration %v", ErrInvalidConfig, cfg.Duration)
+	}
+	if len(cfg.Profile) == 0 {
+		if cfg.Participation <= 0 || cfg.Participation >= 1 {
+			return fmt.Errorf("%w: vwap participation %v outside (0, 1)", ErrInvalidConfig, cfg.Participation)
+		}
+	} else {
+		var sum = 0.0
+		for _, w := range cfg.Profile {
+			if w < 0 {
+				return fmt.Errorf("%w: negative vwap profile weight %v", ErrInvalidConfig, w)
+			}
+			sum += w
+		}
+		if sum == 0 || cfg.Duration == 0 {
+			return fmt.Errorf("%w: vwap profile needs weights and a duration", ErrInvalidConfig)
+		}
+	}
+	if cfg.Volume == nil && (len(cfg.Profile) == 0 || cfg.MaxParticipation > 0) {
+		return fmt.Errorf("%w: vwap needs a volume source", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// VWAP works a parent Buy or Sell along the market's volume. Every Interval
+// it places one child through the manager, sized either to keep its share
+// of the volume traded by others at Participation, or to follow Profile over
+// Duration, and capped by MaxParticipation of the last interval's volume.
+// The child is given until the next interval.
+//
+// Run may be paused: the child in flight is withdrawn, no new ones are
+// placed, and neither the time nor the volume of the pause count towards the
+// schedule.
+type VWAP struct {
+	manager     SpotTradeManagerAPI
+	cfg         VWAPConfig
+	logger      *logrus.Logger
+	mu          sync.Mutex
+	paused      bool
+	pausedAt    time.Time
+	pausedFor   time.Duration //累计暂停时长
+	pauses      int           //累计暂停次数
+	resume      chan struct{}
+	cancelChild context.CancelFunc
+}
+
+func NewVWAP(manager SpotTradeManagerAPI, cfg VWAPConfig, logger *logrus.Logger) (*VWAP, error) {
+	if manager == nil {
+		return nil, fmt.Errorf("%w: nil manager", ErrInvalidConfig)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = logrus.New()
+	}
+	return &VWAP{manager: manager, cfg: cfg, logger: logger}, nil
+}
+
+func (vwap *VWAP) Pause() {
+	vwap.mu.Lock()
+	defer vwap.mu.Unlock()
+	if vwap.paused {
+		return
+	}
+	vwap.paused = true
+	vwap.pausedAt = time.Now()
+	vwap.pauses++
+	vwap.resume = make(chan struct{})
+	if vwap.cancelChild != nil {
+		vwap.cancelChild()
+	}
+}
+
+func (vwap *VWAP) Resume() {
+	vwap.mu.Lock()
+	defer vwap.mu.Unlock()
+	if vwap.paused {
+		vwap.paused = false
+		vwap.pausedFor += time.Since(vwap.pausedAt)
+		close(vwap.resume)
+	}
+}
+
+func (vwap *VWAP) Paused() bool {
+	vwap.mu.Lock()
+	defer vwap.mu.Unlock()
+	return vwap.paused
+}
+
+// waitResumed blocks while the executor is paused.
+func (vwap *VWAP) waitResumed(ctx context.Context) error {
+	vwap.mu.Lock()
+	var paused, resume = vwap.paused, vwap.resume
+	vwap.mu.Unlock()
+	if !paused {
+		return nil
+	}
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pauseStats reports how many pauses there have been and how long the ended
+// ones lasted in total.
+func (vwap *VWAP) pauseStats() (int, time.Duration) {
+	vwap.mu.Lock()
+	defer vwap.mu.Unlock()
+	return vwap.pauses, vwap.pausedFor
+}
+
+// child starts a child order context that Pause can cancel.
+func (vwap *VWAP) child(ctx context.Context) (context.Context, context.CancelFunc) {
+	var childCtx, cancel = context.WithTimeout(ctx, vwap.cfg.Interval)
+	vwap.mu.Lock()
+	defer vwap.mu.Unlock()
+	if vwap.paused {
+		cancel()
+	}
+	vwap.cancelChild = cancel
+	return childCtx, cancel
+}
+
+// profileFraction is the share of the profile's volume expected by x, the
+// elapsed fraction of the run, spreading each bucket evenly over its time.
+func profileFraction(profile []float64, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	var sum, done = 0.0, 0.0
+	var pos = x * float64(len(profile))
+	for i, w := range profile {
+		sum += w
+		if float64(i+1) <= pos {
+			done += w
+		} else if float64(i) < pos {
+			done += w * (pos - float64(i))
+		}
+	}
+	return done / sum
+}
+
+// Run buys (goex.BUY) or sells (goex.SELL) amount and returns the report of
+// all children together. It ends once amount is filled, Duration (not
+// counting pauses) has passed, or ctx is done; a child failing for a reason
+// other than running out of time or being below the minimum stops it with
+// that error.
+func (vwap *VWAP) Run(ctx context.Context, side goex.TradeSide, amount float64) (*ExecutionReport, error) {
+	var trade, err = sliceFunc(vwap.manager, side)
+	if err != nil {
+		return nil, err
+	}
+	if err = vwap.waitResumed(ctx); err != nil {
+		return nil, err
+	}
+	var started = time.Now()
+	var reps = make([]*ExecutionReport, 0)
+	var filled, market, skipped, seen = 0.0, 0.0, 0.0, 0.0
+	var pauses, pausedFor = vwap.pauseStats()
+	var volume = func() float64 {
+		if vwap.cfg.Volume == nil {
+			return seen
+		}
+		v, err := vwap.cfg.Volume.Volume(started)
+		if err != nil {
+			vwap.logger.Warningf("[VWAP %-4s] volume: %v", side.String(), err)
+			return seen
+		}
+		return v
+	}
+	seen = volume()
+	skipped = seen
+	var runErr error
+	for filled < amount {
+		if err = sleepCtx(ctx, vwap.cfg.Interval); err != nil {
+			runErr = err
+			break
+		}
+		if err = vwap.waitResumed(ctx); err != nil {
+			runErr = err
+			break
+		}
+		var n, d = vwap.pauseStats()
+		if n != pauses {
+			pauses = n
+			var v = volume()
+			skipped += v - seen
+			seen = v
+			continue
+		}
+		var elapsed = time.Since(started) - (d - pausedFor)
+		seen = volume()
+		var others = math.Max(seen-skipped-filled, 0)
+		var window = others - market
+		market = others
+
+		var target = 0.0
+		if len(vwap.cfg.Profile) > 0 {
+			target = amount * profileFraction(vwap.cfg.Profile, float64(elapsed)/float64(vwap.cfg.Duration))
+		} else {
+			target = vwap.cfg.Participation / (1 - vwap.cfg.Participation) * others
+		}
+		target = math.Min(target, amount)
+		var want = target - filled
+		if max := vwap.cfg.MaxParticipation; max > 0 {
+			want = math.Min(want, max/(1-max)*window)
+		}
+		var rep *ExecutionReport
+		err = nil
+		if want > 0 {
+			var childCtx, cancel = vwap.child(ctx)
+			rep, err = trade(childCtx, want)
+			cancel()
+		}
+		if rep != nil {
+			reps = append(reps, rep)
+			filled += rep.Filled
+		}
+		vwap.logger.Infof("[VWAP %-4s] market:%s, target:%s, filled:%s", side.String(),
+			utils.Float64RoundString(others, 8), utils.Float64RoundString(target, 8), utils.Float64RoundString(filled, 8))
+		if vwap.cfg.OnProgress != nil {
+			vwap.cfg.OnProgress(VWAPProgress{Requested: amount, Target: target, Filled: filled, Market: others, Report: rep})
+		}
+		if err != nil && sliceFatal(ctx, err) {
+			runErr = err
+			break
+		}
+		if errors.Is(err, ErrBelowMinStocks) && target >= amount {
+			break //余量不足最小下单量
+		}
+		if vwap.cfg.Duration > 0 && elapsed >= vwap.cfg.Duration {
+			break
+		}
+	}
+	return mergeReports(side, amount, started, 1, reps), runErr
+}
@@ -0,0 +1,158 @@
+package trade
+
+import (
+	"context"
+	"errors"
+	"github.com/goex-top/goex_trade/mockex"
+	"github.com/nntaoli-project/GoEx"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProfileFraction(t *testing.T) {
+	var profile = []float64{1, 3, 0, 4}
+	for _, tc := range []struct{ x, want float64 }{
+		{0, 0}, {0.25, 0.125}, {0.375, 0.3125}, {0.75, 0.5}, {0.875, 0.75}, {2, 1},
+	} {
+		if got := profileFraction(profile, tc.x); math.Abs(got-tc.want) > 1e-9 {
+			t.Fatalf("profileFraction(%v) = %v, want %v", tc.x, got, tc.want)
+		}
+	}
+}
+
+func TestProfileFromKlines(t *testing.T) {
+	var start = time.Date(2020, 1, 2, 23, 30, 0, 0, time.UTC)
+	var klines = []goex.Kline{
+		{Timestamp: time.Date(2020, 1, 1, 23, 40, 0, 0, time.UTC).Unix(), Vol: 2},
+		{Timestamp: time.Date(2020, 1, 1, 0, 10, 0, 0, time.UTC).Unix(), Vol: 5}, // 跨过零点
+		{Timestamp: time.Date(2019, 12, 31, 23, 45, 0, 0, time.UTC).Unix(), Vol: 1},
+		{Timestamp: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC).Unix(), Vol: 9}, // 不在时段内
+	}
+	var profile = ProfileFromKlines(klines, start, time.Hour, 2)
+	if profile[0] != 3 || profile[1] != 5 {
+		t.Fatalf("unexpected profile %v", profile)
+	}
+}
+
+func TestTradeVolume(t *testing.T) {
+	var ex = mockex.New("mock")
+	var since = time.Now()
+	var ms = func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+	ex.Market(spotPair).AddTrades(
+		goex.Trade{Amount: 7, Date: ms(since.Add(-time.Minute))},
+		goex.Trade{Amount: 1, Date: ms(since)},
+	)
+	var volume = TradeVolume(ex.Spot(), spotPair)
+	if v, err := volume.Volume(since); err != nil || v != 1 {
+		t.Fatalf("want 1, got %v, %v", v, err)
+	}
+	ex.Market(spotPair).AddTrades(goex.Trade{Amount: 2.5, Date: ms(since.Add(time.Second))})
+	if v, _ := volume.Volume(since); v != 3.5 {
+		t.Fatalf("want 3.5, got %v", v)
+	}
+}
+
+// growingVolume grows by step on every call and counts the fills of spot,
+// like the public trades of an exchange would.
+func growingVolume(spot *cappedSpot, step float64) VolumeSource {
+	var others = 0.0
+	return VolumeFunc(func(since time.Time) (float64, error) {
+		others += step
+		var mine = 0.0
+		for _, a := range spot.asked {
+			mine += math.Min(a, spot.fill)
+		}
+		return others + mine, nil
+	})
+}
+
+func TestVWAP_Participation(t *testing.T) {
+	var spot = &cappedSpot{fill: 10}
+	vwap, err := NewVWAP(spot, VWAPConfig{
+		Volume:        growingVolume(spot, 4),
+		Participation: 0.2,
+		Interval:      time.Millisecond,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := vwap.Run(context.Background(), goex.BUY, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 20% of the total volume is a quarter of what others trade: 1 per 4.
+	if rep.Filled != 2 || len(spot.asked) != 2 || spot.asked[0] != 1 || spot.asked[1] != 1 {
+		t.Fatalf("unexpected run %+v, asked %v", rep, spot.asked)
+	}
+}
+
+func TestVWAP_ParticipationCap(t *testing.T) {
+	var spot = &cappedSpot{fill: 10}
+	vwap, _ := NewVWAP(spot, VWAPConfig{
+		Volume:           growingVolume(spot, 4),
+		Profile:          []float64{1},
+		Duration:         time.Millisecond,
+		MaxParticipation: 0.2,
+		Interval:         time.Millisecond,
+	}, nil)
+	rep, err := vwap.Run(context.Background(), goex.BUY, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The profile wants everything at once, the cap allows 1 per interval.
+	if rep.Filled != 1 || spot.asked[0] != 1 {
+		t.Fatalf("unexpected run %+v, asked %v", rep, spot.asked)
+	}
+}
+
+func TestVWAP_PauseResume(t *testing.T) {
+	var spot = &cappedSpot{fill: 10}
+	var mu sync.Mutex
+	var source = growingVolume(spot, 4)
+	var progress int32
+	vwap, _ := NewVWAP(spot, VWAPConfig{
+		Volume: VolumeFunc(func(since time.Time) (float64, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return source.Volume(since)
+		}),
+		Participation: 0.2,
+		Interval:      time.Millisecond,
+		OnProgress:    func(p VWAPProgress) { atomic.AddInt32(&progress, 1) },
+	}, nil)
+	vwap.Pause()
+	var done = make(chan error)
+	var rep *ExecutionReport
+	go func() {
+		var err error
+		rep, err = vwap.Run(context.Background(), goex.BUY, 2)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&progress); n != 0 || !vwap.Paused() {
+		t.Fatalf("traded %d times while paused", n)
+	}
+	vwap.Resume()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if rep.Filled != 2 || vwap.Paused() {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+}
+
+func TestVWAP_Invalid(t *testing.T) {
+	for _, cfg := range []VWAPConfig{
+		{Participation: 0.1, Interval: time.Second},
+		{Volume: VolumeFunc(nil), Participation: 1, Interval: time.Second},
+		{Profile: []float64{1, -1}, Duration: time.Hour, Interval: time.Second},
+		{Profile: []float64{1}, Interval: time.Second},
+	} {
+		if _, err := NewVWAP(&cappedSpot{}, cfg, nil); !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("%+v: want ErrInvalidConfig, got %v", cfg, err)
+		}
+	}
+}